@@ -2,18 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
 	"metrics/internal/agent"
+	"metrics/internal/config"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func Run(ctx context.Context) error {
-	addrDefault := "localhost:8080"
-	pushDefault := 10_000
-	pollDefault := 2_000
-	keyDefault := ""
-	rateLimitDefault := 1000
-
-	agnt, err := agent.GetConfiguredAgent(addrDefault, pushDefault, pollDefault, keyDefault, rateLimitDefault)
+	agnt, err := agent.GetConfiguredAgent(os.Args[1:], agent.Defaults{
+		Address:         "localhost:8080",
+		PushInterval:    10_000,
+		PollInterval:    2_000,
+		RateLimit:       1000,
+		ShutdownTimeout: 10 * time.Second,
+		PendingFile:     "./agent-pending.json",
+		SpoolDir:        "./agent-spool",
+		SpoolMaxBytes:   64 << 20,
+		SpoolMaxAge:     24 * time.Hour,
+		Pollers:         "runtime,gopsutil",
+		LogLevel:        "info",
+	})
 	if err != nil {
 		return err
 	}
@@ -22,10 +35,13 @@ func Run(ctx context.Context) error {
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	if err := Run(ctx); err != nil {
+		if errors.Is(err, config.ErrPrinted) || errors.Is(err, flag.ErrHelp) {
+			return
+		}
 		log.Printf("Agent error: %v", err)
 	}
 }
@@ -2,19 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
+	"metrics/internal/config"
 	"metrics/internal/server"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func Run(ctx context.Context) error {
-	addrDefault := "localhost:8080"
-	intervalDefault := 300_000
-	fileDefault := "./store"
-	restoreDefault := true
-	databaseDefault := ""
-	key := ""
-
-	srv, err := server.GetConfiguredServer(addrDefault, intervalDefault, fileDefault, restoreDefault, databaseDefault, key)
+	srv, err := server.GetConfiguredServer(os.Args[1:], server.Defaults{
+		Address:           "localhost:8080",
+		StoreInterval:     300_000,
+		FileStoragePath:   "./store",
+		Restore:           true,
+		RetentionInterval: time.Minute,
+		ShutdownTimeout:   10 * time.Second,
+		BatchWindow:       24 * time.Hour,
+		LogLevel:          "info",
+	})
 	if err != nil {
 		return err
 	}
@@ -23,10 +32,13 @@ func Run(ctx context.Context) error {
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	if err := Run(ctx); err != nil {
+		if errors.Is(err, config.ErrPrinted) || errors.Is(err, flag.ErrHelp) {
+			return
+		}
 		log.Printf("Server error: %v", err)
 	}
 }
@@ -35,6 +35,141 @@ const docTemplate = `{
                 }
             }
         },
+        "/api/v1/query_range": {
+            "get": {
+                "description": "Returns time-bucketed samples of a metric: avg/min/max/last for gauges, increase/rate for counters.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Metrics"
+                ],
+                "summary": "Query Metric Range",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Metric Name, optionally with labels, e.g. Alloc{host=\\",
+                        "name": "name",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Metric Type",
+                        "name": "type",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Range start, unix seconds or RFC3339 (default: one hour before to)",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Range end, unix seconds or RFC3339 (default: now)",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Bucket width, duration or seconds (default: range / 60)",
+                        "name": "step",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.RangeQueryResult"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/sources": {
+            "get": {
+                "description": "Lists agents that reported labeled metrics with the number of series per type.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Metrics"
+                ],
+                "summary": "Get Sources",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/handlers.Source"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/write": {
+            "post": {
+                "description": "Accepts snappy-compressed protobuf WriteRequest payloads.",
+                "consumes": [
+                    "application/x-protobuf"
+                ],
+                "tags": [
+                    "Metrics"
+                ],
+                "summary": "Prometheus Remote Write",
+                "responses": {
+                    "204": {
+                        "description": "No Content",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/metrics": {
+            "get": {
+                "description": "Returns all metrics in the Prometheus text exposition format.",
+                "produces": [
+                    "text/plain"
+                ],
+                "tags": [
+                    "Metrics"
+                ],
+                "summary": "Get Prometheus Metrics",
+                "responses": {
+                    "200": {
+                        "description": "Prometheus metrics",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
         "/ping": {
             "get": {
                 "description": "Health check endpoint.",
@@ -196,6 +331,12 @@ const docTemplate = `{
                 ],
                 "summary": "Set Metrics Batch",
                 "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Batch ID",
+                        "name": "X-Batch-ID",
+                        "in": "header"
+                    },
                     {
                         "description": "Metrics Batch",
                         "name": "metrics",
@@ -224,6 +365,12 @@ const docTemplate = `{
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "409": {
+                        "description": "Batch is being applied",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
             }
@@ -337,18 +484,126 @@ const docTemplate = `{
                     }
                 }
             }
+        },
+        "/value/{metricType}/{metricName}": {
+            "delete": {
+                "description": "Deletes a metric and its history by type and name, labeled series are addressed by their series key.",
+                "tags": [
+                    "Metrics"
+                ],
+                "summary": "Delete Metric",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Metric Type",
+                        "name": "metricType",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Metric Name, e.g. Alloc{host=\\",
+                        "name": "metricName",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/values": {
+            "delete": {
+                "description": "Deletes metrics matching a name glob and/or labels, e.g. all series of a decommissioned host.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Metrics"
+                ],
+                "summary": "Delete Metrics Batch",
+                "parameters": [
+                    {
+                        "description": "Metrics Filter",
+                        "name": "filter",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/storage.MetricFilter"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.DeleteMetricsResult"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
         }
     },
     "definitions": {
+        "handlers.DeleteMetricsResult": {
+            "type": "object",
+            "properties": {
+                "deleted": {
+                    "type": "integer"
+                }
+            }
+        },
         "handlers.Metric": {
             "type": "object",
             "properties": {
                 "delta": {
                     "type": "integer"
                 },
+                "histogram": {
+                    "$ref": "#/definitions/storage.Histogram"
+                },
                 "id": {
                     "type": "string"
                 },
+                "labels": {
+                    "$ref": "#/definitions/storage.Labels"
+                },
+                "members": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "set": {
+                    "$ref": "#/definitions/storage.HyperLogLog"
+                },
                 "type": {
                     "type": "string"
                 },
@@ -356,6 +611,111 @@ const docTemplate = `{
                     "type": "number"
                 }
             }
+        },
+        "handlers.RangeQueryResult": {
+            "type": "object",
+            "properties": {
+                "from": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "points": {},
+                "step": {
+                    "type": "number"
+                },
+                "to": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.Source": {
+            "type": "object",
+            "properties": {
+                "counters": {
+                    "type": "integer"
+                },
+                "gauges": {
+                    "type": "integer"
+                },
+                "histograms": {
+                    "type": "integer"
+                },
+                "host": {
+                    "type": "string"
+                },
+                "instance": {
+                    "type": "string"
+                },
+                "sets": {
+                    "type": "integer"
+                }
+            }
+        },
+        "storage.Histogram": {
+            "type": "object",
+            "properties": {
+                "bounds": {
+                    "type": "array",
+                    "items": {
+                        "type": "number"
+                    }
+                },
+                "count": {
+                    "type": "integer"
+                },
+                "counts": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "sum": {
+                    "type": "number"
+                }
+            }
+        },
+        "storage.HyperLogLog": {
+            "type": "object",
+            "properties": {
+                "registers": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "storage.Labels": {
+            "type": "object",
+            "additionalProperties": {
+                "type": "string"
+            }
+        },
+        "storage.MetricFilter": {
+            "type": "object",
+            "properties": {
+                "labels": {
+                    "description": "Labels the series must have, with equal values.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/storage.Labels"
+                        }
+                    ]
+                },
+                "pattern": {
+                    "description": "Pattern is a glob matched against the bare metric name, '*' matches any sequence and '?' any single rune.",
+                    "type": "string"
+                },
+                "type": {
+                    "description": "Type limits the filter to one metric type: gauge, counter, histogram or set.",
+                    "type": "string"
+                }
+            }
         }
     }
 }`
@@ -4,69 +4,210 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/go-resty/resty/v2"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
+	"metrics/internal/config"
 	"metrics/internal/pollers"
-	"metrics/internal/utils"
+	"metrics/internal/spool"
+	"metrics/internal/storage"
+	"metrics/internal/tlsconfig"
 )
 
 // Config holds the configuration parameters for the Agent.
 type Config struct {
-	ServerURL    string
-	Key          string
+	Tags      map[string]string
+	ServerURL string
+	// GRPCAddress is the address of the server gRPC endpoint, when set metrics are pushed over gRPC instead of HTTP.
+	GRPCAddress string
+	Key         string
+	Hostname    string
+	InstanceID  string
+	// PendingFile keeps metrics that could not be pushed on shutdown until the next start, empty drops them.
+	PendingFile string
+	// SpoolDir holds batches that could not be pushed until the server is back, empty disables the spool.
+	SpoolDir string
+	// LogLevel is the minimal level of logged messages, e.g. info.
+	LogLevel string
+	// CryptoKey is the path of the PEM public key of the server encrypting HTTP pushes, empty sends them in clear.
+	CryptoKey string
+	// TLSCA is the path of the PEM CA verifying the server certificate, empty uses the system CAs.
+	// Setting it or a client certificate makes the agent push over HTTPS and gRPC over TLS.
+	TLSCA string
+	// TLSCert and TLSKey are the paths of the PEM client certificate and key presented to servers requiring mTLS.
+	TLSCert string
+	TLSKey  string
+	// Transports names the transports metrics are pushed with, see NewTransport.
+	Transports []string
+	// Pollers names the enabled pollers, empty enables all of them.
+	Pollers      []string
+	SpoolLimits  spool.Limits
 	PollInterval time.Duration
 	PushInterval time.Duration
-	RateLimit    int
+	// ShutdownTimeout bounds waiting for running pushes and the final push when the agent stops,
+	// zero waits without limit.
+	ShutdownTimeout time.Duration
+	RateLimit       int
 }
 
+// Validate checks that the configuration can be used to start the agent.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("poll interval must be positive, got %s", c.PollInterval))
+	}
+	if c.PushInterval <= 0 {
+		errs = append(errs, fmt.Errorf("push interval must be positive, got %s", c.PushInterval))
+	}
+	if c.RateLimit <= 0 {
+		errs = append(errs, fmt.Errorf("rate limit must be positive, got %d", c.RateLimit))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("shutdown timeout must not be negative, got %s", c.ShutdownTimeout))
+	}
+	if c.SpoolLimits.MaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("spool max bytes must not be negative, got %d", c.SpoolLimits.MaxBytes))
+	}
+	if c.SpoolLimits.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("spool max age must not be negative, got %s", c.SpoolLimits.MaxAge))
+	}
+	if err := tlsconfig.CheckPair(c.TLSCert, c.TLSKey); err != nil {
+		errs = append(errs, err)
+	}
+	for _, name := range c.Transports {
+		if err := checkTransport(name, *c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, name := range c.Pollers {
+		if name != PollerRuntime && name != PollerGopsutil {
+			errs = append(errs, fmt.Errorf("unknown poller %q", name))
+		}
+	}
+	if c.LogLevel != "" {
+		if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+			errs = append(errs, fmt.Errorf("bad log level: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TLSEnabled reports whether the agent pushes over TLS.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCA != "" || c.TLSCert != ""
+}
+
+// Poller names accepted in Config.Pollers.
+const (
+	// PollerRuntime collects Go runtime memory statistics.
+	PollerRuntime = "runtime"
+	// PollerGopsutil collects system memory and CPU statistics.
+	PollerGopsutil = "gopsutil"
+)
+
 // Agent represents a metrics collection and reporting agent.
 type Agent struct {
-	client  *resty.Client
-	logger  *zap.Logger
+	transport Transport
+	logger    *zap.Logger
+	// level is the level of the logger, nil when the logger level cannot be changed.
+	level *zap.AtomicLevel
+	// reload loads the configuration again, nil disables reloading.
+	reload  func() (Config, error)
 	pollers []pollers.Poller
+	// available are the pollers Config.Pollers selects from on reload, nil keeps the pollers the agent was created with.
+	available map[string]pollers.Poller
+	// retired are the pollers disabled on reload. They are not polled anymore, but their metrics are still taken,
+	// so the metrics they collected before, or got back from failed pushes, are reported.
+	retired []pollers.Poller
+	// configPath is the config file watched for changes, empty reloads on SIGHUP only.
+	configPath string
+	// pending holds batches restored from the pending file that were not pushed yet.
+	pending []pendingBatch
+	spool   *spool.Spool
 	config  Config
+	// draining is held by drainSpool, so a spooled batch is not pushed by the replay loop and shutdown at once.
+	draining sync.Mutex
 }
 
 // NewAgent creates a new instance of Agent.
+// The transport selected by the config is created when the agent starts.
 func NewAgent(config Config, logger *zap.Logger, pollerList []pollers.Poller) *Agent {
 	return &Agent{
 		config:  config,
-		client:  resty.New(),
 		logger:  logger,
 		pollers: pollerList,
 	}
 }
 
+// NewAgentWithTransport creates a new instance of Agent pushing metrics with the given transport.
+// The agent closes the transport when it stops.
+func NewAgentWithTransport(config Config, logger *zap.Logger, pollerList []pollers.Poller, transport Transport) *Agent {
+	agent := NewAgent(config, logger, pollerList)
+	agent.transport = transport
+	return agent
+}
+
 // Start begins the metrics collection and reporting process.
 func (a *Agent) Start(ctx context.Context) error {
 	pollTicker := time.NewTicker(a.config.PollInterval)
 	reportTicker := time.NewTicker(a.config.PushInterval)
 
-	if err := a.testPing(); err != nil {
-		return fmt.Errorf("cant ping server: %w", err)
+	if a.transport == nil {
+		transport, err := NewTransport(a.config, a.logger)
+		if err != nil {
+			return fmt.Errorf("cant create transport: %w", err)
+		}
+		a.transport = transport
+	}
+	defer func() {
+		if err := a.transport.Close(); err != nil {
+			a.logger.Error("cant close transport", zap.Error(err))
+		}
+	}()
+
+	if pinger, ok := a.transport.(Pinger); ok {
+		if err := pinger.Ping(ctx); err != nil {
+			return fmt.Errorf("cant ping server: %w", err)
+		}
+		a.logger.Info("ping server successfully")
 	}
-	a.logger.Info("ping server successfully")
 
-	jobs := make(chan []pollers.Metric, a.config.RateLimit)
-	done := make(chan struct{}, a.config.RateLimit)
+	if err := a.openSpool(); err != nil {
+		return fmt.Errorf("cant open spool: %w", err)
+	}
+	a.pushPending(ctx)
 
 	var wg sync.WaitGroup
-
-	for range a.config.RateLimit {
+	jobs := a.startWorkers(a.config.RateLimit, &wg)
+	if a.spool != nil {
+		interval := a.config.PushInterval
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			a.pushWorker(jobs, done)
+			a.replaySpool(ctx, interval)
 		}()
 	}
 
+	reloads := make(chan struct{}, 1)
+	if a.reload != nil {
+		go config.Watch(ctx, a.configPath, config.DefaultWatchInterval, func() {
+			select {
+			case reloads <- struct{}{}:
+			default:
+			}
+		})
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -74,10 +215,15 @@ func (a *Agent) Start(ctx context.Context) error {
 			reportTicker.Stop()
 
 			close(jobs)
-			wg.Wait()
-			close(done)
+			return a.shutdown(&wg)
 
-			return nil
+		case <-reloads:
+			next, err := a.reload()
+			if err != nil {
+				a.logger.Error("cant reload config, keep the current one", zap.Error(err))
+				continue
+			}
+			jobs = a.applyConfig(next, pollTicker, reportTicker, jobs, &wg)
 
 		case <-pollTicker.C:
 			for _, poller := range a.pollers {
@@ -89,110 +235,322 @@ func (a *Agent) Start(ctx context.Context) error {
 			}
 
 		case <-reportTicker.C:
-			var metrics []pollers.Metric
-
-			mu := sync.Mutex{}
-			grp := sync.WaitGroup{}
-			grp.Add(len(a.pollers))
+			b := a.collect(ctx)
 
-			for _, poller := range a.pollers {
-				go func(p pollers.Poller) {
-					defer grp.Done()
-					pollerMetrics, err := p.GetMetrics(ctx)
-					if err != nil {
-						a.logger.Error("cant get metrics", zap.Error(err))
-					}
-					mu.Lock()
-					metrics = append(metrics, pollerMetrics...)
-					mu.Unlock()
-				}(poller)
+			if len(b.metrics) == 0 {
+				a.logger.Warn("no metrics to send")
+				continue
 			}
-			grp.Wait()
 
-			if len(metrics) == 0 {
-				a.logger.Warn("no metrics to send")
+			// Batches queue up behind spooled ones, so the server receives them in order.
+			if a.spool != nil && a.spool.Stats().Segments > 0 {
+				a.spoolOrRestore(ctx, b)
 				continue
 			}
 
 			select {
-			case jobs <- metrics:
+			case jobs <- b:
 			default:
 				a.logger.Warn("cant push metrics, workers busy")
+				a.spoolOrRestore(ctx, b)
 			}
+		}
+	}
+}
 
-		case <-done:
-			for _, poller := range a.pollers {
-				if err := poller.ResetMetrics(ctx); err != nil {
-					a.logger.Error("cant reset metrics", zap.Error(err))
-				}
+// startWorkers starts a pool of push workers taking batches from the returned channel.
+// The workers stop when the channel is closed and they pushed the batches left in it.
+func (a *Agent) startWorkers(rateLimit int, wg *sync.WaitGroup) chan batch {
+	jobs := make(chan batch, rateLimit)
+	for range rateLimit {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.pushWorker(jobs)
+		}()
+	}
+	return jobs
+}
+
+// applyConfig applies the settings that can change while the agent runs:
+// the intervals, the rate limit, the key, the enabled pollers and the log level. Other settings need a restart.
+// A new rate limit replaces the worker pool, the old workers stop after pushing the batches already queued for them.
+// It returns the channel of the current worker pool.
+func (a *Agent) applyConfig(
+	next Config,
+	pollTicker *time.Ticker,
+	reportTicker *time.Ticker,
+	jobs chan batch,
+	wg *sync.WaitGroup,
+) chan batch {
+	if next.PollInterval != a.config.PollInterval {
+		pollTicker.Reset(next.PollInterval)
+		a.config.PollInterval = next.PollInterval
+	}
+	if next.PushInterval != a.config.PushInterval {
+		reportTicker.Reset(next.PushInterval)
+		a.config.PushInterval = next.PushInterval
+	}
+	if next.RateLimit != a.config.RateLimit {
+		close(jobs)
+		jobs = a.startWorkers(next.RateLimit, wg)
+		a.config.RateLimit = next.RateLimit
+	}
+	if next.Key != a.config.Key {
+		if setter, ok := a.transport.(KeySetter); ok {
+			setter.SetKey(next.Key)
+		}
+		a.config.Key = next.Key
+	}
+	if a.available != nil {
+		enabled := selectPollers(a.available, next.Pollers)
+		a.retired = retiredPollers(slices.Concat(a.pollers, a.retired), enabled)
+		a.pollers = enabled
+		a.config.Pollers = next.Pollers
+	}
+	if a.level != nil && next.LogLevel != "" {
+		if level, err := zapcore.ParseLevel(next.LogLevel); err == nil {
+			a.level.SetLevel(level)
+		}
+		a.config.LogLevel = next.LogLevel
+	}
+
+	a.logger.Info("config reloaded",
+		zap.Duration("pollInterval", a.config.PollInterval),
+		zap.Duration("pushInterval", a.config.PushInterval),
+		zap.Int("rateLimit", a.config.RateLimit),
+		zap.Int("pollers", len(a.pollers)),
+		zap.String("logLevel", a.config.LogLevel),
+	)
+	return jobs
+}
+
+// selectPollers returns the available pollers with the given names in order, or all of them sorted by name
+// when no names are given. Unknown names are skipped.
+func selectPollers(available map[string]pollers.Poller, names []string) []pollers.Poller {
+	if len(names) == 0 {
+		for name := range available {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	selected := make([]pollers.Poller, 0, len(names))
+	for _, name := range names {
+		if poller, ok := available[name]; ok {
+			selected = append(selected, poller)
+		}
+	}
+	return selected
+}
+
+// retiredPollers returns the pollers that are not enabled.
+func retiredPollers(all, enabled []pollers.Poller) []pollers.Poller {
+	var retired []pollers.Poller
+	for _, poller := range all {
+		if !slices.Contains(enabled, poller) {
+			retired = append(retired, poller)
+		}
+	}
+	return retired
+}
+
+// batch is a set of metrics pushed together.
+// Its metrics are taken from the pollers, so a batch that cannot be delivered must be restored to them.
+// The batch ID is sent with every delivery of the batch, so the server applies retried deliveries once.
+type batch struct {
+	id      string
+	metrics []pollers.Metric
+	taken   []takenMetrics
+}
+
+// takenMetrics are the metrics taken from a poller for a batch, as reported by the poller.
+type takenMetrics struct {
+	poller  pollers.Poller
+	metrics []pollers.Metric
+}
+
+// collect takes the metrics of all pollers, retired ones included, into a batch with the source labels attached.
+func (a *Agent) collect(ctx context.Context) batch {
+	b := batch{id: newBatchID()}
+
+	mu := sync.Mutex{}
+	grp := sync.WaitGroup{}
+	all := slices.Concat(a.pollers, a.retired)
+	grp.Add(len(all))
+
+	for _, poller := range all {
+		go func(p pollers.Poller) {
+			defer grp.Done()
+			pollerMetrics, err := p.TakeMetrics(ctx)
+			if err != nil {
+				a.logger.Error("cant get metrics", zap.Error(err))
+			}
+			if len(pollerMetrics) == 0 {
+				return
 			}
+			mu.Lock()
+			b.metrics = append(b.metrics, pollerMetrics...)
+			b.taken = append(b.taken, takenMetrics{poller: p, metrics: pollerMetrics})
+			mu.Unlock()
+		}(poller)
+	}
+	grp.Wait()
+
+	b.metrics = append(b.metrics, a.spoolStats()...)
+	// The batch holds copies of the taken metrics, so labels are attached to the copies only.
+	a.addSourceLabels(b.metrics)
+	return b
+}
+
+// restore returns the metrics of an undelivered batch to their pollers, to be reported in a later batch.
+func (a *Agent) restore(ctx context.Context, b batch) {
+	for _, taken := range b.taken {
+		if err := taken.poller.RestoreMetrics(ctx, taken.metrics); err != nil {
+			a.logger.Error("cant restore metrics", zap.Error(err))
 		}
 	}
 }
 
-func (a *Agent) testPing() error {
-	resp, err := utils.WithRestyRetry(func() (*resty.Response, error) {
-		return a.client.R().Get(a.config.ServerURL + "/ping")
-	})
+// spoolOrRestore hands a batch that cannot be pushed now to the spool, or back to the pollers without one.
+func (a *Agent) spoolOrRestore(ctx context.Context, b batch) {
+	if a.spool != nil && a.spoolMetrics(b.id, b.metrics) == nil {
+		return
+	}
+	a.restore(ctx, b)
+}
+
+// shutdown waits for running pushes, then pushes the pending batches and the metrics collected since the last push.
+// Batches that cannot be pushed before the shutdown timeout are spooled, or saved to the pending file
+// for the next start without a spool.
+func (a *Agent) shutdown(wg *sync.WaitGroup) error {
+	ctx := context.Background()
+	if a.config.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.config.ShutdownTimeout)
+		defer cancel()
+	}
+
+	waitErr := a.waitWorkers(ctx, wg)
+
+	batches := a.pending
+	if final := a.collect(ctx); len(final.metrics) > 0 {
+		batches = append(batches, pendingBatch{ID: final.id, Metrics: final.metrics})
+	}
+	if len(batches) == 0 {
+		return waitErr
+	}
 
-	if err != nil {
-		return fmt.Errorf("cant ping server: %w", err)
+	unsent := batches
+	if a.spool != nil {
+		a.drainSpool(ctx)
 	}
-	if resp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("bad status code: %d", resp.StatusCode())
+	// The final batches must not overtake spooled ones.
+	if a.spool == nil || a.spool.Stats().Segments == 0 {
+		unsent = a.pushBatches(ctx, batches)
+	}
+	a.pending = nil
+	if len(unsent) == 0 {
+		a.logger.Info("final metrics pushed successfully", zap.Int("batches", len(batches)))
+		return errors.Join(waitErr, a.removePending())
+	}
+
+	if a.spool != nil {
+		for _, b := range unsent {
+			if err := a.spoolMetrics(b.ID, b.Metrics); err != nil {
+				return errors.Join(waitErr, fmt.Errorf("cant spool final metrics: %w", err))
+			}
+		}
+		return errors.Join(waitErr, a.removePending())
+	}
+	if err := a.savePending(unsent); err != nil {
+		return errors.Join(waitErr, fmt.Errorf("cant save pending metrics: %w", err))
+	}
+	return waitErr
+}
+
+// waitWorkers waits for push workers to finish their jobs, giving up when ctx is done.
+func (a *Agent) waitWorkers(ctx context.Context, wg *sync.WaitGroup) error {
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("push workers did not stop in %s", a.config.ShutdownTimeout)
 	}
-	return nil
 }
 
-func (a *Agent) pushWorker(jobs <-chan []pollers.Metric, done chan<- struct{}) {
-	for metrics := range jobs {
-		if err := a.pushMetrics(metrics); err != nil {
+// sourceLabels returns the labels identifying this agent: static tags, hostname and instance ID.
+func (a *Agent) sourceLabels() storage.Labels {
+	labels := make(storage.Labels, len(a.config.Tags)+2)
+	for name, value := range a.config.Tags {
+		labels[name] = value
+	}
+	if a.config.Hostname != "" {
+		labels[storage.LabelHost] = a.config.Hostname
+	}
+	if a.config.InstanceID != "" {
+		labels[storage.LabelInstance] = a.config.InstanceID
+	}
+	return labels
+}
+
+// addSourceLabels attaches the source labels to every metric, overriding labels set by pollers.
+func (a *Agent) addSourceLabels(metrics []pollers.Metric) {
+	source := a.sourceLabels()
+	if len(source) == 0 {
+		return
+	}
+	for i := range metrics {
+		labels := make(storage.Labels, len(metrics[i].Labels)+len(source))
+		for name, value := range metrics[i].Labels {
+			labels[name] = value
+		}
+		for name, value := range source {
+			labels[name] = value
+		}
+		metrics[i].Labels = labels
+	}
+}
+
+func (a *Agent) pushWorker(jobs <-chan batch) {
+	ctx := context.Background()
+	for b := range jobs {
+		if err := a.pushMetrics(ctx, b.id, b.metrics); err != nil {
 			a.logger.Error("cant push metrics", zap.Error(err))
+			a.spoolOrRestore(ctx, b)
 			continue
 		}
 		a.logger.Info("metrics pushed successfully")
-		done <- struct{}{}
 	}
 }
 
-func (a *Agent) pushMetrics(metrics []pollers.Metric) error {
+func (a *Agent) pushMetrics(ctx context.Context, batchID string, metrics []pollers.Metric) error {
+	return a.transport.Push(ctx, batchID, metrics)
+}
+
+// newBatchID returns a random batch ID.
+func newBatchID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// encodeMetrics encodes metrics as a gzipped JSON batch.
+func encodeMetrics(metrics []pollers.Metric) ([]byte, error) {
 	var compressed bytes.Buffer
 	writer := gzip.NewWriter(&compressed)
 	if err := json.NewEncoder(writer).Encode(metrics); err != nil {
-		return fmt.Errorf("cant gzip metrics: %w", err)
+		return nil, fmt.Errorf("cant gzip metrics: %w", err)
 	}
 	if err := writer.Close(); err != nil {
-		return fmt.Errorf("cant close gzip writer: %w", err)
-	}
-
-	hash := utils.GetHash(a.config.Key, compressed.Bytes())
-
-	resp, err := utils.WithRestyRetry(func() (*resty.Response, error) {
-		request := a.client.R().
-			SetHeader("Content-Type", "application/json").
-			SetHeader("Content-Encoding", "gzip").
-			SetHeader("HashSHA256", hash).
-			SetBody(compressed.Bytes())
-
-		a.logger.Debug("Sending metrics",
-			zap.String("url", a.config.ServerURL+"/updates/"),
-			zap.Any("headers", request.Header),
-			zap.ByteString("body", compressed.Bytes()),
-		)
-
-		return request.Post(a.config.ServerURL + "/updates/")
-	})
-
-	if err != nil {
-		a.logger.Error("Failed to send metrics", zap.Error(err))
-		return fmt.Errorf("cant send metrics: %w", err)
-	}
-	if resp.StatusCode() != http.StatusOK {
-		a.logger.Error("Unexpected response from server",
-			zap.Int("status_code", resp.StatusCode()),
-			zap.String("body", resp.String()),
-		)
-		return fmt.Errorf("bad status code: %d", resp.StatusCode())
+		return nil, fmt.Errorf("cant close gzip writer: %w", err)
 	}
-	return nil
+	return compressed.Bytes(), nil
 }
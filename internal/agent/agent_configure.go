@@ -4,100 +4,236 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"metrics/internal/config"
 	"metrics/internal/pollers"
+	"metrics/internal/spool"
 	"metrics/internal/storage"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+// Defaults holds the values of the options set by neither a flag, an environment variable nor the config file.
+type Defaults struct {
+	Address    string
+	Key        string
+	InstanceID string
+	// Tags are static labels as comma-separated name=value pairs.
+	Tags        string
+	PendingFile string
+	SpoolDir    string
+	GRPCAddress string
+	// Transports and Pollers are comma-separated names.
+	Transports      string
+	Pollers         string
+	LogLevel        string
+	CryptoKey       string
+	TLSCA           string
+	TLSCert         string
+	TLSKey          string
+	ShutdownTimeout time.Duration
+	SpoolMaxAge     time.Duration
+	SpoolMaxBytes   int64
+	// PushInterval and PollInterval are in milliseconds.
+	PushInterval int
+	PollInterval int
+	RateLimit    int
+}
+
 // GetConfiguredAgent initializes and configures a new Agent instance.
-// It reads configuration from flags and environment variables, sets up pollers, and returns the configured agent.
-func GetConfiguredAgent(
-	addrDefault string,
-	pushDefault int,
-	pollDefault int,
-	keyDefault string,
-	rateLimitDefault int,
-) (*Agent, error) {
-	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
-
-	addr := fs.String("a", addrDefault, "address")
-	pushInterval := fs.Int("r", pushDefault, "push interval")
-	pollInterval := fs.Int("p", pollDefault, "poll interval")
-	key := fs.String("k", keyDefault, "key")
-	rateLimit := fs.Int("l", rateLimitDefault, "rate limit")
-
-	if err := fs.Parse([]string{}); err != nil {
-		log.Printf("Error parsing flags: %v", err)
-	}
+// It reads configuration from the arguments, environment variables and a config file, falling back to defaults,
+// sets up pollers, and returns the configured agent.
+// It returns config.ErrPrinted when printing the configuration was requested.
+func GetConfiguredAgent(args []string, defaults Defaults) (*Agent, error) {
+	// load is called again on every reload, the arguments and defaults stay the same.
+	load := func() (Config, *config.Loader, error) {
+		fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+
+		addr := fs.String("a", defaults.Address, "address")
+		pushInterval := fs.Int("r", defaults.PushInterval, "push interval")
+		pollInterval := fs.Int("p", defaults.PollInterval, "poll interval")
+		key := fs.String("k", defaults.Key, "key")
+		grpcAddr := fs.String("grpc", defaults.GRPCAddress, "server grpc address, pushes over grpc instead of http when set")
+		transport := fs.String("transport", defaults.Transports, "comma-separated transports: http, grpc, stdout, file:path")
+		rateLimit := fs.Int("l", defaults.RateLimit, "rate limit")
+		hostname := fs.String("hostname", "", "hostname reported in the host label, defaults to the system hostname")
+		instance := fs.String("instance", defaults.InstanceID, "instance ID reported in the instance label")
+		tags := fs.String("tags", defaults.Tags, "static labels attached to all metrics, as comma-separated name=value pairs")
+		shutdownTimeout := fs.Duration("shutdown-timeout", defaults.ShutdownTimeout, "graceful shutdown timeout")
+		pendingFile := fs.String("pending-file", defaults.PendingFile, "file keeping metrics unsent on shutdown")
+		spoolDir := fs.String("spool-dir", defaults.SpoolDir, "directory buffering batches while the server is down")
+		spoolMaxBytes := fs.Int64("spool-max-bytes", defaults.SpoolMaxBytes, "max size of spooled batches")
+		spoolMaxAge := fs.Duration("spool-max-age", defaults.SpoolMaxAge, "max age of spooled batches")
+		pollerNames := fs.String("pollers", defaults.Pollers, "comma-separated pollers: runtime, gopsutil")
+		logLevel := fs.String("log-level", defaults.LogLevel, "log level: debug, info, warn or error")
+		cryptoKey := fs.String("crypto-key", defaults.CryptoKey, "server public key file encrypting http pushes")
+		tlsCA := fs.String("tls-ca", defaults.TLSCA, "ca file verifying the server certificate, pushes over tls when set")
+		tlsCert := fs.String("tls-cert", defaults.TLSCert, "client certificate file for servers requiring mtls")
+		tlsKey := fs.String("tls-key", defaults.TLSKey, "private key file of the client certificate")
+
+		loader := config.NewLoader(fs,
+			config.Option{Flag: "a", Env: "ADDRESS"},
+			config.Option{Flag: "r", Env: "REPORT_INTERVAL"},
+			config.Option{Flag: "p", Env: "POLL_INTERVAL"},
+			config.Option{Flag: "k", Env: "KEY", Secret: true},
+			config.Option{Flag: "grpc", Env: "GRPC_ADDRESS"},
+			config.Option{Flag: "transport", Env: "TRANSPORT"},
+			config.Option{Flag: "l", Env: "RATE_LIMIT"},
+			config.Option{Flag: "hostname", Env: "AGENT_HOSTNAME"},
+			config.Option{Flag: "instance", Env: "INSTANCE_ID"},
+			config.Option{Flag: "tags", Env: "TAGS"},
+			config.Option{Flag: "shutdown-timeout", Env: "SHUTDOWN_TIMEOUT"},
+			config.Option{Flag: "pending-file", Env: "PENDING_FILE"},
+			config.Option{Flag: "spool-dir", Env: "SPOOL_DIR"},
+			config.Option{Flag: "spool-max-bytes", Env: "SPOOL_MAX_BYTES"},
+			config.Option{Flag: "spool-max-age", Env: "SPOOL_MAX_AGE"},
+			config.Option{Flag: "pollers", Env: "POLLERS"},
+			config.Option{Flag: "log-level", Env: "LOG_LEVEL"},
+			config.Option{Flag: "crypto-key", Env: "CRYPTO_KEY"},
+			config.Option{Flag: "tls-ca", Env: "TLS_CA"},
+			config.Option{Flag: "tls-cert", Env: "TLS_CERT"},
+			config.Option{Flag: "tls-key", Env: "TLS_KEY"},
+		)
+		if err := loader.Load(args); err != nil {
+			return Config{}, nil, err
+		}
 
-	if value, ok := os.LookupEnv("ADDRESS"); ok && value != "" {
-		addr = &value
-	}
+		if *hostname == "" {
+			systemHostname, err := os.Hostname()
+			if err != nil {
+				log.Printf("Error getting hostname: %v", err)
+			}
+			hostname = &systemHostname
+		}
 
-	if value, ok := os.LookupEnv("REPORT_INTERVAL"); ok && value != "" {
-		parsed, err := strconv.ParseInt(value, 10, 32)
-		if err == nil && parsed > 0 {
-			valueint := int(parsed)
-			pushInterval = &valueint
+		parsedTags, err := parseTags(*tags)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("cant parse tags: %w", err)
 		}
-	}
 
-	if value, ok := os.LookupEnv("POLL_INTERVAL"); ok && value != "" {
-		parsed, err := strconv.ParseInt(value, 10, 32)
-		if err == nil && parsed > 0 {
-			valueint := int(parsed)
-			pollInterval = &valueint
+		config := Config{
+			ServerURL:       *addr,
+			GRPCAddress:     *grpcAddr,
+			Transports:      splitList(*transport),
+			Key:             *key,
+			PollInterval:    time.Duration(*pollInterval) * time.Millisecond,
+			PushInterval:    time.Duration(*pushInterval) * time.Millisecond,
+			RateLimit:       *rateLimit,
+			Hostname:        *hostname,
+			InstanceID:      *instance,
+			Tags:            parsedTags,
+			ShutdownTimeout: *shutdownTimeout,
+			PendingFile:     *pendingFile,
+			SpoolDir:        *spoolDir,
+			SpoolLimits:     spool.Limits{MaxBytes: *spoolMaxBytes, MaxAge: *spoolMaxAge},
+			Pollers:         splitList(*pollerNames),
+			LogLevel:        *logLevel,
+			CryptoKey:       *cryptoKey,
+			TLSCA:           *tlsCA,
+			TLSCert:         *tlsCert,
+			TLSKey:          *tlsKey,
 		}
+		if !strings.HasPrefix(config.ServerURL, "http://") && !strings.HasPrefix(config.ServerURL, "https://") {
+			scheme := "http://"
+			if config.TLSEnabled() {
+				scheme = "https://"
+			}
+			config.ServerURL = scheme + config.ServerURL
+		}
+		if err := config.Validate(); err != nil {
+			return Config{}, nil, fmt.Errorf("bad config: %w", err)
+		}
+		return config, loader, nil
 	}
 
-	if value, ok := os.LookupEnv("KEY"); ok && value != "" {
-		key = &value
+	config, loader, err := load()
+	if err != nil {
+		return nil, err
 	}
 
-	if value, ok := os.LookupEnv("RATE_LIMIT"); ok && value != "" {
-		parsed, err := strconv.Atoi(value)
-		if err == nil && parsed > 0 {
-			rateLimit = &parsed
-		}
+	if err := loader.PrintIfRequested(os.Stdout); err != nil {
+		return nil, err
 	}
 
-	if !strings.HasPrefix(*addr, "http://") && !strings.HasPrefix(*addr, "https://") {
-		*addr = "http://" + *addr
+	level, err := zap.ParseAtomicLevel(config.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("cant parse log level: %w", err)
 	}
-
-	logger, err := zap.NewProduction()
+	zapConfig := zap.NewProductionConfig()
+	zapConfig.Level = level
+	logger, err := zapConfig.Build()
 	if err != nil {
 		return nil, fmt.Errorf("cant create logger: %w", err)
 	}
 
-	config := Config{
-		ServerURL:    *addr,
-		Key:          *key,
-		PollInterval: time.Duration(*pollInterval) * time.Millisecond,
-		PushInterval: time.Duration(*pushInterval) * time.Millisecond,
-		RateLimit:    *rateLimit,
+	available := map[string]pollers.Poller{
+		PollerRuntime:  pollers.NewDefaultPoller(storage.NewMemStorage()),
+		PollerGopsutil: pollers.NewGopsutilPoller(storage.NewMemStorage()),
+	}
+	agent := NewAgent(config, logger, selectPollers(available, config.Pollers))
+	agent.available = available
+	agent.level = &level
+	agent.configPath = loader.Path()
+	agent.reload = func() (Config, error) {
+		next, _, err := load()
+		return next, err
 	}
-
-	agent := NewAgent(
-		config,
-		logger,
-		[]pollers.Poller{
-			pollers.NewDefaultPoller(storage.NewMemStorage()),
-			pollers.NewGopsutilPoller(storage.NewMemStorage()),
-		},
-	)
 
 	logger.Info("agent started:",
 		zap.String("addr", config.ServerURL),
+		zap.String("grpc", config.GRPCAddress),
+		zap.Strings("transports", config.Transports),
 		zap.Duration("pushInterval", config.PushInterval),
 		zap.Duration("pollInterval", config.PollInterval),
 		zap.Int("rateLimit", config.RateLimit),
+		zap.String("hostname", config.Hostname),
+		zap.String("instance", config.InstanceID),
+		zap.Any("tags", config.Tags),
+		zap.Duration("shutdownTimeout", config.ShutdownTimeout),
+		zap.String("pendingFile", config.PendingFile),
+		zap.String("spoolDir", config.SpoolDir),
+		zap.Int64("spoolMaxBytes", config.SpoolLimits.MaxBytes),
+		zap.Duration("spoolMaxAge", config.SpoolLimits.MaxAge),
+		zap.Strings("pollers", config.Pollers),
+		zap.String("logLevel", config.LogLevel),
+		zap.String("cryptoKey", config.CryptoKey),
+		zap.String("tlsCA", config.TLSCA),
+		zap.String("tlsCert", config.TLSCert),
+		zap.String("config", agent.configPath),
 	)
 
 	return agent, nil
 }
+
+// splitList splits a comma-separated list of names.
+func splitList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseTags parses static labels given as name=value pairs separated by commas.
+func parseTags(value string) (map[string]string, error) {
+	tags := storage.Labels{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, tagValue, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("tag %q must be name=value", pair)
+		}
+		tags[strings.TrimSpace(name)] = strings.TrimSpace(tagValue)
+	}
+	if err := tags.Validate(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
@@ -3,20 +3,40 @@ package agent
 import (
 	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	"metrics/internal/grpcserver"
+	"metrics/internal/handlers"
+	"metrics/internal/middleware"
 	"metrics/internal/pollers"
+	pb "metrics/internal/proto"
+	"metrics/internal/spool"
+	"metrics/internal/storage"
+	"metrics/internal/tlsconfig"
+	"metrics/internal/tlsconfig/tlstest"
+	"metrics/internal/utils"
 )
 
 type MockPoller struct {
@@ -43,7 +63,21 @@ func (m *MockPoller) ResetMetrics(ctx context.Context) error {
 	return args.Error(0)
 }
 
-func TestAgent_testPing(t *testing.T) {
+func (m *MockPoller) TakeMetrics(ctx context.Context) ([]pollers.Metric, error) {
+	args := m.Called()
+	metrics, ok := args.Get(0).([]pollers.Metric)
+	if !ok {
+		return nil, errors.New("invalid type assertion for metrics")
+	}
+	return metrics, args.Error(1)
+}
+
+func (m *MockPoller) RestoreMetrics(ctx context.Context, metrics []pollers.Metric) error {
+	args := m.Called(ctx, metrics)
+	return args.Error(0)
+}
+
+func TestHTTPTransport_Ping(t *testing.T) {
 	t.Run("successful ping", func(t *testing.T) {
 		logger := zaptest.NewLogger(t)
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -55,8 +89,8 @@ func TestAgent_testPing(t *testing.T) {
 		}))
 		defer server.Close()
 
-		agent := NewAgent(Config{ServerURL: server.URL}, logger, []pollers.Poller{})
-		err := agent.testPing()
+		transport := NewHTTPTransport(server.URL, "", logger)
+		err := transport.Ping(context.Background())
 		assert.NoError(t, err)
 	})
 
@@ -71,13 +105,13 @@ func TestAgent_testPing(t *testing.T) {
 		}))
 		defer server.Close()
 
-		agent := NewAgent(Config{ServerURL: server.URL}, logger, []pollers.Poller{})
-		err := agent.testPing()
+		transport := NewHTTPTransport(server.URL, "", logger)
+		err := transport.Ping(context.Background())
 		assert.Error(t, err)
 	})
 }
 
-func TestAgent_pushMetrics(t *testing.T) {
+func TestHTTPTransport_Push(t *testing.T) {
 	t.Run("successful push", func(t *testing.T) {
 		logger := zaptest.NewLogger(t)
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -92,9 +126,9 @@ func TestAgent_pushMetrics(t *testing.T) {
 		metrics := []pollers.Metric{
 			{ID: "test_metric", Value: float64Ptr(123)},
 		}
-		agent := NewAgent(Config{ServerURL: server.URL, Key: "test_key"}, logger, []pollers.Poller{})
+		transport := NewHTTPTransport(server.URL, "test_key", logger)
 
-		err := agent.pushMetrics(metrics)
+		err := transport.Push(context.Background(), "", metrics)
 		assert.NoError(t, err)
 	})
 
@@ -112,9 +146,9 @@ func TestAgent_pushMetrics(t *testing.T) {
 		metrics := []pollers.Metric{
 			{ID: "test_metric", Value: float64Ptr(123)},
 		}
-		agent := NewAgent(Config{ServerURL: server.URL, Key: "test_key"}, logger, []pollers.Poller{})
+		transport := NewHTTPTransport(server.URL, "test_key", logger)
 
-		err := agent.pushMetrics(metrics)
+		err := transport.Push(context.Background(), "", metrics)
 		assert.Error(t, err)
 	})
 
@@ -125,6 +159,7 @@ func TestAgent_pushMetrics(t *testing.T) {
 				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
 				assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
 				assert.NotEmpty(t, r.Header.Get("HashSHA256"))
+				assert.Equal(t, "batch-1", r.Header.Get("X-Batch-ID"))
 				w.WriteHeader(http.StatusOK)
 			} else {
 				w.WriteHeader(http.StatusNotFound)
@@ -135,20 +170,195 @@ func TestAgent_pushMetrics(t *testing.T) {
 		metrics := []pollers.Metric{
 			{ID: "test_metric", Value: float64Ptr(123)},
 		}
-		agent := NewAgent(Config{ServerURL: server.URL, Key: "test_key"}, logger, []pollers.Poller{})
+		transport := NewHTTPTransport(server.URL, "test_key", logger)
 
-		err := agent.pushMetrics(metrics)
+		err := transport.Push(context.Background(), "batch-1", metrics)
 		assert.NoError(t, err)
 	})
 }
 
+func TestHTTPTransport_Encrypted(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "public.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0o600))
+
+	gin.SetMode(gin.TestMode)
+	var received []pollers.Metric
+	router := gin.New()
+	router.Use(middleware.WithDecryption(middleware.NewDecryptionKey(privateKey)))
+	router.Use(middleware.WithHashValidation(utils.NewKey("test_key")))
+	router.Use(middleware.WithDecompress())
+	router.POST("/updates/", func(c *gin.Context) {
+		assert.NoError(t, c.ShouldBindJSON(&received))
+		c.Status(http.StatusOK)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	config := Config{ServerURL: server.URL, Key: "test_key", CryptoKey: keyPath}
+	transport, err := NewTransport(config, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	defer transport.Close()
+
+	metrics := []pollers.Metric{{ID: "test_metric", MType: pollers.TypeGauge, Value: float64Ptr(123)}}
+	require.NoError(t, transport.Push(context.Background(), "batch-1", metrics))
+	assert.Equal(t, metrics, received)
+
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	_, err = NewTransport(Config{ServerURL: server.URL, CryptoKey: missing}, zap.NewNop())
+	assert.ErrorContains(t, err, "cant load crypto key")
+}
+
+func TestTransport_MutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	serverCert, serverKey := ca.Issue(t, "server")
+	agentCert, agentKey := ca.Issue(t, "agent")
+	serverTLS, err := tlsconfig.NewServerConfig(serverCert, serverKey, ca.CertFile)
+	require.NoError(t, err)
+
+	logger := zap.NewNop()
+	memStorage := storage.NewMemStorage()
+	handler := handlers.NewMetricsHandler(memStorage, logger)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.WithDecompress())
+	router.POST("/updates/", handler.SetMetricsHandler)
+	httpServer := httptest.NewUnstartedServer(router)
+	httpServer.TLS = serverTLS
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(serverTLS)))
+	pb.RegisterMetricsServer(grpcServer, grpcserver.NewService(memStorage, handler, logger))
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	defer grpcServer.Stop()
+
+	delta := int64(1)
+	metrics := []pollers.Metric{{ID: "PollCount", MType: pollers.TypeCounter, Delta: &delta}}
+	config := Config{
+		ServerURL:   httpServer.URL,
+		GRPCAddress: listener.Addr().String(),
+		Transports:  []string{TransportHTTP, TransportGRPC},
+		TLSCA:       ca.CertFile,
+		TLSCert:     agentCert,
+		TLSKey:      agentKey,
+	}
+	transport, err := NewTransport(config, logger)
+	require.NoError(t, err)
+	defer transport.Close()
+	require.NoError(t, transport.Push(context.Background(), "", metrics))
+
+	value, _, err := memStorage.GetCounter(context.Background(), "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counter(2), value, "the batch must be pushed over https and grpc")
+
+	anonymous, err := NewTransport(Config{ServerURL: httpServer.URL, TLSCA: ca.CertFile}, logger)
+	require.NoError(t, err)
+	defer anonymous.Close()
+	assert.Error(t, anonymous.Push(context.Background(), "", metrics), "agents without a certificate must be rejected")
+
+	_, err = NewTransport(Config{ServerURL: httpServer.URL, TLSCA: filepath.Join(t.TempDir(), "ca.crt")}, logger)
+	assert.ErrorContains(t, err, "cant load tls config")
+}
+
+func TestTransport_RealIP(t *testing.T) {
+	logger := zap.NewNop()
+	memStorage := storage.NewMemStorage()
+	handler := handlers.NewMetricsHandler(memStorage, logger)
+	subnets, err := middleware.ParseSubnets("127.0.0.1/32")
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	var realIP string
+	router := gin.New()
+	router.Use(middleware.WithDecompress())
+	router.POST("/updates/", func(c *gin.Context) {
+		realIP = c.GetHeader(middleware.RealIPHeader)
+	}, middleware.WithTrustedSubnets(middleware.NewTrustedSubnets(subnets)), handler.SetMetricsHandler)
+	httpServer := httptest.NewServer(router)
+	defer httpServer.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(middleware.WithGRPCTrustedSubnets(middleware.NewTrustedSubnets(subnets))),
+	)
+	pb.RegisterMetricsServer(grpcServer, grpcserver.NewService(memStorage, handler, logger))
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	defer grpcServer.Stop()
+
+	config := Config{
+		ServerURL:   httpServer.URL,
+		GRPCAddress: listener.Addr().String(),
+		Transports:  []string{TransportHTTP, TransportGRPC},
+	}
+	transport, err := NewTransport(config, logger)
+	require.NoError(t, err)
+	defer transport.Close()
+
+	delta := int64(1)
+	metrics := []pollers.Metric{{ID: "PollCount", MType: pollers.TypeCounter, Delta: &delta}}
+	require.NoError(t, transport.Push(context.Background(), "", metrics))
+	assert.Equal(t, "127.0.0.1", realIP)
+
+	value, _, err := memStorage.GetCounter(context.Background(), "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counter(2), value, "the batch must be accepted over http and grpc")
+}
+
+func TestAgent_addSourceLabels(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	agent := NewAgent(Config{
+		Hostname:   "host1",
+		InstanceID: "agent1",
+		Tags:       map[string]string{"dc": "eu", "host": "ignored"},
+	}, logger, []pollers.Poller{})
+
+	metrics := []pollers.Metric{
+		{ID: "Alloc", MType: pollers.TypeGauge, Value: float64Ptr(1)},
+		{ID: "Custom", MType: pollers.TypeGauge, Value: float64Ptr(2), Labels: storage.Labels{"pool": "a"}},
+	}
+	agent.addSourceLabels(metrics)
+
+	assert.Equal(t, storage.Labels{"dc": "eu", "host": "host1", "instance": "agent1"}, metrics[0].Labels)
+	assert.Equal(t, storage.Labels{"dc": "eu", "host": "host1", "instance": "agent1", "pool": "a"}, metrics[1].Labels)
+
+	noSource := NewAgent(Config{}, logger, []pollers.Poller{})
+	metrics = []pollers.Metric{{ID: "Alloc", MType: pollers.TypeGauge, Value: float64Ptr(1)}}
+	noSource.addSourceLabels(metrics)
+	assert.Nil(t, metrics[0].Labels)
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags(" dc=eu, role = db ,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"dc": "eu", "role": "db"}, tags)
+
+	_, err = parseTags("dc")
+	assert.Error(t, err)
+
+	_, err = parseTags("bad-name=1")
+	assert.Error(t, err)
+}
+
 func TestAgent(t *testing.T) {
 	t.Run("base", func(t *testing.T) {
 		logger := zaptest.NewLogger(t)
 		mockPoller := new(MockPoller)
 		mockPoller.On("Poll").Return(nil)
-		mockPoller.On("GetMetrics", mock.Anything).Return([]pollers.Metric{{ID: "test_metric", Value: float64Ptr(123)}}, nil)
-		mockPoller.On("ResetMetrics", mock.Anything).Return(nil)
+		mockPoller.On("TakeMetrics", mock.Anything).Return([]pollers.Metric{{ID: "test_metric", Value: float64Ptr(123)}}, nil)
+		mockPoller.On("RestoreMetrics", mock.Anything, mock.Anything).Return(nil)
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			switch r.URL.Path {
@@ -182,8 +392,8 @@ func TestAgent(t *testing.T) {
 		wg.Wait()
 
 		mockPoller.AssertCalled(t, "Poll")
-		mockPoller.AssertCalled(t, "GetMetrics", mock.Anything)
-		mockPoller.AssertCalled(t, "ResetMetrics", mock.Anything)
+		mockPoller.AssertCalled(t, "TakeMetrics", mock.Anything)
+		mockPoller.AssertNotCalled(t, "RestoreMetrics", mock.Anything, mock.Anything)
 	})
 
 	t.Run("two updates", func(t *testing.T) {
@@ -195,10 +405,11 @@ func TestAgent(t *testing.T) {
 		mockPoller := new(MockPoller)
 		mockPoller.On("Poll").Return(nil)
 
-		mockPoller.On("GetMetrics", mock.Anything).Return([]pollers.Metric{{ID: "diff", Value: float64Ptr(1)}}, nil).Once()
-		mockPoller.On("GetMetrics", mock.Anything).Return([]pollers.Metric{{ID: "diff", Value: float64Ptr(2)}}, nil).Once()
+		mockPoller.On("TakeMetrics", mock.Anything).Return([]pollers.Metric{{ID: "diff", Value: float64Ptr(1)}}, nil).Once()
+		mockPoller.On("TakeMetrics", mock.Anything).Return([]pollers.Metric{{ID: "diff", Value: float64Ptr(2)}}, nil).Once()
+		mockPoller.On("TakeMetrics", mock.Anything).Return([]pollers.Metric{{ID: "diff", Value: float64Ptr(3)}}, nil).Once()
 
-		mockPoller.On("ResetMetrics", mock.Anything).Return(nil)
+		mockPoller.On("RestoreMetrics", mock.Anything, mock.Anything).Return(nil)
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			switch r.URL.Path {
@@ -249,16 +460,463 @@ func TestAgent(t *testing.T) {
 
 		wg.Wait()
 
+		// The third update is the final push on shutdown.
 		mockPoller.AssertNumberOfCalls(t, "Poll", 2)
-		mockPoller.AssertNumberOfCalls(t, "GetMetrics", 2)
-		mockPoller.AssertNumberOfCalls(t, "ResetMetrics", 2)
+		mockPoller.AssertNumberOfCalls(t, "TakeMetrics", 3)
+		mockPoller.AssertNumberOfCalls(t, "RestoreMetrics", 0)
 
-		assert.Equal(t, 2, len(receivedMetrics))
+		assert.Equal(t, 3, len(receivedMetrics))
 		assert.Equal(t, float64(1), *receivedMetrics[0][0].Value)
 		assert.Equal(t, float64(2), *receivedMetrics[1][0].Value)
+		assert.Equal(t, float64(3), *receivedMetrics[2][0].Value)
 	})
 }
 
 func float64Ptr(v float64) *float64 {
 	return &v
 }
+
+func TestAgent_StartStopsOnContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	var blocked sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := blocked.Load(r.URL.Path); ok {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	poller := new(MockPoller)
+	poller.On("Poll").Return(nil)
+	poller.On("TakeMetrics").Return([]pollers.Metric{{ID: "Alloc", MType: pollers.TypeGauge}}, nil)
+	poller.On("RestoreMetrics", mock.Anything, mock.Anything).Return(nil)
+
+	t.Run("without running pushes", func(t *testing.T) {
+		config := Config{
+			ServerURL:       server.URL,
+			PollInterval:    time.Hour,
+			PushInterval:    time.Hour,
+			RateLimit:       2,
+			ShutdownTimeout: time.Second,
+		}
+		agent := NewAgent(config, zaptest.NewLogger(t), []pollers.Poller{poller})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.NoError(t, agent.Start(ctx))
+	})
+
+	t.Run("push outlives the shutdown timeout", func(t *testing.T) {
+		blocked.Store("/updates/", true)
+		config := Config{
+			ServerURL:       server.URL,
+			PollInterval:    time.Hour,
+			PushInterval:    10 * time.Millisecond,
+			RateLimit:       1,
+			ShutdownTimeout: 50 * time.Millisecond,
+		}
+		// The abandoned push logs after the test ends, so it cannot use the test logger.
+		agent := NewAgent(config, zap.NewNop(), []pollers.Poller{poller})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := agent.Start(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "did not stop")
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+// decodePush decodes a gzipped batch pushed by the agent.
+func decodePush(t *testing.T, r *http.Request) []pollers.Metric {
+	reader, err := gzip.NewReader(r.Body)
+	require.NoError(t, err)
+	var metrics []pollers.Metric
+	require.NoError(t, json.NewDecoder(reader).Decode(&metrics))
+	return metrics
+}
+
+func TestAgent_FinalFlush(t *testing.T) {
+	var mu sync.Mutex
+	var pushed [][]pollers.Metric
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/updates/" {
+			mu.Lock()
+			pushed = append(pushed, decodePush(t, r))
+			mu.Unlock()
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	memStorage := storage.NewMemStorage()
+	poller := pollers.NewDefaultPoller(memStorage)
+	require.NoError(t, poller.Poll())
+
+	config := Config{
+		ServerURL:       server.URL,
+		PendingFile:     filepath.Join(t.TempDir(), "pending.json"),
+		PollInterval:    time.Hour,
+		PushInterval:    time.Hour,
+		RateLimit:       1,
+		ShutdownTimeout: time.Second,
+	}
+	agent := NewAgent(config, zaptest.NewLogger(t), []pollers.Poller{poller})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, agent.Start(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, pushed, 1)
+	var pollCount *int64
+	for _, metric := range pushed[0] {
+		if metric.ID == "PollCount" {
+			pollCount = metric.Delta
+		}
+	}
+	require.NotNil(t, pollCount)
+	assert.Equal(t, int64(1), *pollCount)
+	assert.NoFileExists(t, config.PendingFile)
+}
+
+func TestAgent_PendingMetrics(t *testing.T) {
+	var mu sync.Mutex
+	var pushed []pollers.Metric
+	available := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/updates/" {
+			if !available {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			pushed = append(pushed, decodePush(t, r)...)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	delta := int64(3)
+	poller := new(MockPoller)
+	poller.On("TakeMetrics").Return([]pollers.Metric{{ID: "PollCount", MType: pollers.TypeCounter, Delta: &delta}}, nil)
+
+	config := Config{
+		ServerURL:       server.URL,
+		PendingFile:     filepath.Join(t.TempDir(), "pending.json"),
+		PollInterval:    time.Hour,
+		PushInterval:    time.Hour,
+		RateLimit:       1,
+		ShutdownTimeout: time.Second,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, NewAgent(config, zaptest.NewLogger(t), []pollers.Poller{poller}).Start(ctx))
+	require.FileExists(t, config.PendingFile)
+
+	mu.Lock()
+	available = true
+	mu.Unlock()
+
+	restarted := NewAgent(config, zaptest.NewLogger(t), []pollers.Poller{})
+	restartCtx, restartCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer restartCancel()
+	require.NoError(t, restarted.Start(restartCtx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, pushed, 1)
+	assert.Equal(t, "PollCount", pushed[0].ID)
+	assert.Equal(t, delta, *pushed[0].Delta)
+	assert.NoFileExists(t, config.PendingFile)
+}
+
+func TestAgent_Spool(t *testing.T) {
+	var mu sync.Mutex
+	var pushed []pollers.Metric
+	var failedIDs, deliveredIDs []string
+	available := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/updates/" {
+			if !available {
+				failedIDs = append(failedIDs, r.Header.Get("X-Batch-ID"))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			deliveredIDs = append(deliveredIDs, r.Header.Get("X-Batch-ID"))
+			pushed = append(pushed, decodePush(t, r)...)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	delta := int64(1)
+	poller := new(MockPoller)
+	poller.On("Poll").Return(nil)
+	poller.On("TakeMetrics").Return([]pollers.Metric{{ID: "PollCount", MType: pollers.TypeCounter, Delta: &delta}}, nil)
+	poller.On("RestoreMetrics", mock.Anything, mock.Anything).Return(nil)
+
+	config := Config{
+		ServerURL:       server.URL,
+		SpoolDir:        t.TempDir(),
+		PollInterval:    time.Hour,
+		PushInterval:    10 * time.Millisecond,
+		RateLimit:       1,
+		ShutdownTimeout: time.Second,
+	}
+	agent := NewAgent(config, zap.NewNop(), []pollers.Poller{poller})
+
+	go func() {
+		time.Sleep(60 * time.Millisecond)
+		mu.Lock()
+		available = true
+		mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	require.NoError(t, agent.Start(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	var delivered int64
+	spoolGauges := 0
+	for _, metric := range pushed {
+		switch metric.ID {
+		case "PollCount":
+			delivered += *metric.Delta
+		case "SpoolSegments":
+			spoolGauges++
+		}
+	}
+	// Every collected batch is delivered exactly once, either directly or from the spool.
+	poller.AssertNumberOfCalls(t, "TakeMetrics", int(delivered))
+	assert.Positive(t, spoolGauges)
+	assert.Equal(t, 0, agent.spool.Stats().Segments)
+
+	// Spooled batches are delivered with the ID of their failed push.
+	require.NotEmpty(t, failedIDs)
+	for _, id := range failedIDs {
+		assert.NotEmpty(t, id)
+		assert.Contains(t, deliveredIDs, id)
+	}
+}
+
+func TestAgent_ShutdownDuringReplay(t *testing.T) {
+	transport := &recordingTransport{}
+	config := Config{SpoolDir: t.TempDir(), ShutdownTimeout: time.Second}
+	agent := NewAgentWithTransport(config, zap.NewNop(), nil, transport)
+	require.NoError(t, agent.openSpool())
+
+	delta := int64(1)
+	metrics := []pollers.Metric{{ID: "PollCount", MType: pollers.TypeCounter, Delta: &delta}}
+	require.NoError(t, agent.spoolMetrics("spooled", metrics))
+	agent.pending = []pendingBatch{{ID: "final", Metrics: metrics}}
+
+	// A replay still pushing the spool when shutdown starts keeps it, the final batches queue up behind.
+	agent.draining.Lock()
+	require.NoError(t, agent.shutdown(&sync.WaitGroup{}))
+	assert.Empty(t, transport.batches, "spooled batches must not be pushed twice at once")
+	agent.draining.Unlock()
+
+	agent.drainSpool(context.Background())
+	require.Len(t, transport.batches, 3)
+	assert.Equal(t, "spooled", transport.batches[0].ID)
+	assert.Equal(t, "final", transport.batches[1].ID)
+	assert.Equal(t, 0, agent.spool.Stats().Segments)
+}
+
+func TestAgent_LegacyPendingFile(t *testing.T) {
+	var mu sync.Mutex
+	var pushed []pollers.Metric
+	var batchIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/updates/" {
+			batchIDs = append(batchIDs, r.Header.Get("X-Batch-ID"))
+			pushed = append(pushed, decodePush(t, r)...)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := Config{
+		ServerURL:       server.URL,
+		PendingFile:     filepath.Join(t.TempDir(), "pending.json"),
+		PollInterval:    time.Hour,
+		PushInterval:    time.Hour,
+		RateLimit:       1,
+		ShutdownTimeout: time.Second,
+	}
+	require.NoError(t, os.WriteFile(config.PendingFile, []byte(`[{"id":"PollCount","type":"counter","delta":3}]`), 0o600))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, NewAgent(config, zaptest.NewLogger(t), []pollers.Poller{}).Start(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, pushed, 1)
+	assert.Equal(t, int64(3), *pushed[0].Delta)
+	assert.Equal(t, []string{""}, batchIDs, "metrics saved by older agents have no batch ID")
+	assert.NoFileExists(t, config.PendingFile)
+}
+
+func TestDecodeSegment(t *testing.T) {
+	body, err := encodeMetrics([]pollers.Metric{{ID: "Alloc", MType: pollers.TypeGauge, Value: float64Ptr(1)}})
+	require.NoError(t, err)
+
+	batchID, decoded := decodeSegment(encodeSegment("batch-1", body))
+	assert.Equal(t, "batch-1", batchID)
+	assert.Equal(t, body, decoded)
+
+	batchID, decoded = decodeSegment(body)
+	assert.Empty(t, batchID, "segments spooled by older agents have no batch ID")
+	assert.Equal(t, body, decoded)
+}
+
+func TestAgent_GRPC(t *testing.T) {
+	logger := zap.NewNop()
+	memStorage := storage.NewMemStorage()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(middleware.WithGRPCHashValidation(utils.NewKey("test_key"))))
+	handler := handlers.NewMetricsHandler(memStorage, logger)
+	pb.RegisterMetricsServer(server, grpcserver.NewService(memStorage, handler, logger))
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	delta := int64(2)
+	poller := new(MockPoller)
+	poller.On("TakeMetrics").Return([]pollers.Metric{{ID: "PollCount", MType: pollers.TypeCounter, Delta: &delta}}, nil)
+
+	config := Config{
+		GRPCAddress:     listener.Addr().String(),
+		Key:             "test_key",
+		PollInterval:    time.Hour,
+		PushInterval:    time.Hour,
+		RateLimit:       1,
+		ShutdownTimeout: time.Second,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, NewAgent(config, zaptest.NewLogger(t), []pollers.Poller{poller}).Start(ctx))
+
+	value, ok, err := memStorage.GetCounter(context.Background(), "PollCount")
+	require.NoError(t, err)
+	assert.True(t, ok, "final metrics must be pushed over grpc")
+	assert.Equal(t, storage.Counter(delta), value)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Config{PollInterval: time.Second, PushInterval: time.Second, RateLimit: 1, Transports: []string{"http"}}
+	assert.NoError(t, valid.Validate())
+
+	invalid := Config{
+		RateLimit:       0,
+		ShutdownTimeout: -time.Second,
+		SpoolLimits:     spool.Limits{MaxBytes: -1, MaxAge: -time.Second},
+		Transports:      []string{"grpc", "file", "carrier-pigeon"},
+		TLSCert:         "agent.crt",
+	}
+	err := invalid.Validate()
+	if assert.Error(t, err) {
+		for _, want := range []string{"poll interval", "push interval", "rate limit", "shutdown timeout",
+			"spool max bytes", "spool max age", "grpc address", "needs a path", `unknown transport "carrier-pigeon"`,
+			"certificate and key"} {
+			assert.Contains(t, err.Error(), want)
+		}
+	}
+}
+
+func TestAgent_applyConfig(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	runtimePoller, gopsutilPoller := new(MockPoller), new(MockPoller)
+	available := map[string]pollers.Poller{PollerRuntime: runtimePoller, PollerGopsutil: gopsutilPoller}
+	config := Config{PollInterval: time.Hour, PushInterval: time.Hour, RateLimit: 1, Key: "old"}
+	transport := NewHTTPTransport("http://localhost", config.Key, zap.NewNop())
+
+	agent := NewAgentWithTransport(config, zap.NewNop(), selectPollers(available, nil), transport)
+	agent.available = available
+	agent.level = &level
+	assert.Equal(t, []pollers.Poller{gopsutilPoller, runtimePoller}, agent.pollers)
+
+	pollTicker := time.NewTicker(config.PollInterval)
+	defer pollTicker.Stop()
+	reportTicker := time.NewTicker(config.PushInterval)
+	defer reportTicker.Stop()
+	var wg sync.WaitGroup
+	jobs := agent.startWorkers(config.RateLimit, &wg)
+
+	next := config
+	next.PollInterval = time.Minute
+	next.PushInterval = 2 * time.Minute
+	next.RateLimit = 3
+	next.Key = "new"
+	next.Pollers = []string{PollerRuntime}
+	next.LogLevel = "debug"
+	newJobs := agent.applyConfig(next, pollTicker, reportTicker, jobs, &wg)
+
+	// The old worker pool is stopped and replaced by a pool of the new size.
+	_, open := <-jobs
+	assert.False(t, open)
+	assert.Equal(t, 3, cap(newJobs))
+
+	assert.Equal(t, "new", transport.key.Get())
+	assert.Equal(t, []pollers.Poller{runtimePoller}, agent.pollers)
+	assert.Equal(t, zap.DebugLevel, level.Level())
+	assert.Equal(t, time.Minute, agent.config.PollInterval)
+	assert.Equal(t, 2*time.Minute, agent.config.PushInterval)
+
+	close(newJobs)
+	wg.Wait()
+}
+
+func TestAgent_applyConfigKeepsDisabledPollerMetrics(t *testing.T) {
+	delta := int64(1)
+	runtimePoller, gopsutilPoller := new(MockPoller), new(MockPoller)
+	runtimePoller.On("TakeMetrics").Return([]pollers.Metric{}, nil)
+	gopsutilPoller.On("TakeMetrics").Return([]pollers.Metric{{ID: "CPU", MType: pollers.TypeCounter, Delta: &delta}}, nil)
+	available := map[string]pollers.Poller{PollerRuntime: runtimePoller, PollerGopsutil: gopsutilPoller}
+	config := Config{PollInterval: time.Hour, PushInterval: time.Hour, RateLimit: 1}
+
+	agent := NewAgentWithTransport(config, zap.NewNop(), selectPollers(available, nil), &recordingTransport{})
+	agent.available = available
+
+	pollTicker := time.NewTicker(config.PollInterval)
+	defer pollTicker.Stop()
+	reportTicker := time.NewTicker(config.PushInterval)
+	defer reportTicker.Stop()
+	var wg sync.WaitGroup
+	jobs := agent.startWorkers(config.RateLimit, &wg)
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	next := config
+	next.Pollers = []string{PollerRuntime}
+	jobs = agent.applyConfig(next, pollTicker, reportTicker, jobs, &wg)
+	assert.Equal(t, []pollers.Poller{runtimePoller}, agent.pollers)
+	assert.Equal(t, []pollers.Poller{gopsutilPoller}, agent.retired)
+
+	// Metrics the disabled poller collected before the reload go into the next batch.
+	b := agent.collect(context.Background())
+	require.Len(t, b.metrics, 1)
+	assert.Equal(t, "CPU", b.metrics[0].ID)
+
+	next.Pollers = nil
+	jobs = agent.applyConfig(next, pollTicker, reportTicker, jobs, &wg)
+	assert.Empty(t, agent.retired, "enabled pollers are not retired")
+}
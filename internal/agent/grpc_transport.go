@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"metrics/internal/pollers"
+	pb "metrics/internal/proto"
+	"metrics/internal/utils"
+)
+
+// GRPCTransport pushes batches to the server with the UpdateMetrics gRPC call.
+type GRPCTransport struct {
+	conn   *grpc.ClientConn
+	client pb.MetricsClient
+	logger *zap.Logger
+	key    *utils.Key
+	// serverHost is the host of the server address, the outbound IP sent in x-real-ip is the one routing to it.
+	serverHost string
+}
+
+// NewGRPCTransport creates a new instance of GRPCTransport.
+// The connection is established lazily, on the first push. It uses TLS when tlsConfig is not nil.
+func NewGRPCTransport(address, key string, tlsConfig *tls.Config, logger *zap.Logger) (*GRPCTransport, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("cant create grpc client: %w", err)
+	}
+	transport := &GRPCTransport{conn: conn, client: pb.NewMetricsClient(conn), logger: logger, key: utils.NewKey(key)}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		transport.serverHost = host
+	}
+	return transport, nil
+}
+
+// SetKey replaces the key batches are signed with.
+func (t *GRPCTransport) SetKey(key string) {
+	t.key.Set(key)
+}
+
+// Push sends a batch to the server.
+// Retries reuse the batch ID, so the server applies the batch once even if a response was lost.
+func (t *GRPCTransport) Push(ctx context.Context, batchID string, metrics []pollers.Metric) error {
+	req := &pb.UpdateMetricsRequest{BatchId: batchID, Metrics: make([]*pb.Metric, 0, len(metrics))}
+	for _, metric := range metrics {
+		req.Metrics = append(req.Metrics, toProto(metric))
+	}
+
+	hash, err := utils.GetMessageHash(t.key.Get(), req)
+	if err != nil {
+		return fmt.Errorf("cant hash metrics: %w", err)
+	}
+	if hash != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "hashsha256", hash)
+	}
+	if ip, err := outboundIP(t.serverHost); err == nil {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-real-ip", ip)
+	} else {
+		t.logger.Debug("cant find outbound ip", zap.Error(err))
+	}
+
+	err = utils.WithGRPCRetry(ctx, func() error {
+		_, err := t.client.UpdateMetrics(ctx, req)
+		return err
+	})
+	if err != nil {
+		t.logger.Error("Failed to send metrics", zap.Error(err))
+		return fmt.Errorf("cant send metrics: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection to the server.
+func (t *GRPCTransport) Close() error {
+	if err := t.conn.Close(); err != nil {
+		return fmt.Errorf("cant close grpc connection: %w", err)
+	}
+	return nil
+}
+
+// toProto converts a metric to its protobuf form.
+func toProto(metric pollers.Metric) *pb.Metric {
+	result := &pb.Metric{
+		Id:     metric.ID,
+		Type:   pb.MetricTypeFromName(string(metric.MType)),
+		Delta:  metric.Delta,
+		Value:  metric.Value,
+		Labels: metric.Labels,
+	}
+	if h := metric.Histogram; h != nil {
+		result.Histogram = &pb.Histogram{Bounds: h.Bounds, Counts: h.Counts, Sum: h.Sum, Count: h.Count}
+	}
+	return result
+}
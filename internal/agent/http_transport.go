@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+
+	"metrics/internal/encryption"
+	"metrics/internal/pollers"
+	"metrics/internal/utils"
+)
+
+// HTTPTransport pushes batches as gzipped JSON to the /updates/ endpoint of the server.
+type HTTPTransport struct {
+	client    *resty.Client
+	logger    *zap.Logger
+	key       *utils.Key
+	publicKey *rsa.PublicKey
+	serverURL string
+	// serverHost is the host of serverURL, the outbound IP sent in X-Real-IP is the one routing to it.
+	serverHost string
+}
+
+// NewHTTPTransport creates a new instance of HTTPTransport.
+// Batches are signed with the key when it is not empty.
+func NewHTTPTransport(serverURL, key string, logger *zap.Logger) *HTTPTransport {
+	transport := &HTTPTransport{client: resty.New(), logger: logger, serverURL: serverURL, key: utils.NewKey(key)}
+	if parsed, err := url.Parse(serverURL); err == nil {
+		transport.serverHost = parsed.Hostname()
+	}
+	return transport
+}
+
+// Ping checks that the server responds on /ping.
+func (t *HTTPTransport) Ping(ctx context.Context) error {
+	resp, err := utils.WithRestyRetry(ctx, func() (*resty.Response, error) {
+		return t.client.R().SetContext(ctx).Get(t.serverURL + "/ping")
+	})
+
+	if err != nil {
+		return fmt.Errorf("cant ping server: %w", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("bad status code: %d", resp.StatusCode())
+	}
+	return nil
+}
+
+// SetPublicKey makes the transport encrypt batches with the public key of the server.
+// Batches are hashed before they are encrypted, so the server decrypts them before validating the hash.
+func (t *HTTPTransport) SetPublicKey(publicKey *rsa.PublicKey) {
+	t.publicKey = publicKey
+}
+
+// SetTLSConfig sets the TLS configuration of HTTPS pushes, e.g. the CA of the server and the client certificate.
+func (t *HTTPTransport) SetTLSConfig(tlsConfig *tls.Config) {
+	t.client.SetTLSClientConfig(tlsConfig)
+}
+
+// SetKey replaces the key batches are signed with.
+func (t *HTTPTransport) SetKey(key string) {
+	t.key.Set(key)
+}
+
+// Push sends a batch to the server.
+// Retries reuse the batch ID, so the server applies the batch once even if a response was lost.
+// An empty ID is not sent, and the server then applies every delivery.
+func (t *HTTPTransport) Push(ctx context.Context, batchID string, metrics []pollers.Metric) error {
+	body, err := encodeMetrics(metrics)
+	if err != nil {
+		return err
+	}
+	hash := utils.GetHash(t.key.Get(), body)
+	if t.publicKey != nil {
+		body, err = encryption.Encrypt(t.publicKey, body)
+		if err != nil {
+			return fmt.Errorf("cant encrypt metrics: %w", err)
+		}
+	}
+
+	resp, err := utils.WithRestyRetry(ctx, func() (*resty.Response, error) {
+		request := t.client.R().
+			SetContext(ctx).
+			SetHeader("Content-Type", "application/json").
+			SetHeader("Content-Encoding", "gzip").
+			SetHeader("HashSHA256", hash).
+			SetBody(body)
+		if batchID != "" {
+			request.SetHeader("X-Batch-ID", batchID)
+		}
+		if t.publicKey != nil {
+			request.SetHeader(encryption.Header, encryption.Scheme)
+		}
+		if ip, err := outboundIP(t.serverHost); err == nil {
+			request.SetHeader("X-Real-IP", ip)
+		} else {
+			t.logger.Debug("cant find outbound ip", zap.Error(err))
+		}
+
+		t.logger.Debug("Sending metrics",
+			zap.String("url", t.serverURL+"/updates/"),
+			zap.Any("headers", request.Header),
+			zap.ByteString("body", body),
+		)
+
+		return request.Post(t.serverURL + "/updates/")
+	})
+
+	if err != nil {
+		t.logger.Error("Failed to send metrics", zap.Error(err))
+		return fmt.Errorf("cant send metrics: %w", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		t.logger.Error("Unexpected response from server",
+			zap.Int("status_code", resp.StatusCode()),
+			zap.String("body", resp.String()),
+		)
+		return fmt.Errorf("bad status code: %d", resp.StatusCode())
+	}
+	return nil
+}
+
+// Close does nothing, the HTTP client keeps no resources that need releasing.
+func (t *HTTPTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+
+	"metrics/internal/pollers"
+)
+
+// pendingBatch is a batch saved to the pending file.
+// It keeps its ID, so the server drops it if it was applied before the push failed.
+type pendingBatch struct {
+	ID      string           `json:"id"`
+	Metrics []pollers.Metric `json:"metrics"`
+}
+
+// pendingFile is the content of the pending file.
+type pendingFile struct {
+	Batches []pendingBatch `json:"batches"`
+}
+
+// pushPending loads batches left by the previous run and pushes them.
+// Batches that cannot be pushed stay pending until the final push on shutdown.
+func (a *Agent) pushPending(ctx context.Context) {
+	pending, err := a.loadPending()
+	if err != nil {
+		a.logger.Error("cant load pending metrics", zap.String("file", a.config.PendingFile), zap.Error(err))
+		return
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	a.pending = a.pushBatches(ctx, pending)
+	if len(a.pending) > 0 {
+		a.logger.Warn("cant push pending metrics, keep them until shutdown", zap.Int("batches", len(a.pending)))
+		return
+	}
+	a.logger.Info("pending metrics pushed successfully", zap.Int("batches", len(pending)))
+	if err := a.removePending(); err != nil {
+		a.logger.Error("cant remove pending metrics", zap.Error(err))
+	}
+}
+
+// pushBatches pushes batches in order, stopping at the first one the server does not accept.
+// It returns the batches that were not pushed.
+func (a *Agent) pushBatches(ctx context.Context, batches []pendingBatch) []pendingBatch {
+	for i, b := range batches {
+		if err := a.pushMetrics(ctx, b.ID, b.Metrics); err != nil {
+			a.logger.Error("cant push metrics", zap.Error(err))
+			return batches[i:]
+		}
+	}
+	return nil
+}
+
+// loadPending reads the pending file, which holds either batches or, when written by older agents,
+// a plain array of metrics.
+func (a *Agent) loadPending() ([]pendingBatch, error) {
+	if a.config.PendingFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(a.config.PendingFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant read file: %w", err)
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var metrics []pollers.Metric
+		if err := json.Unmarshal(data, &metrics); err != nil {
+			return nil, fmt.Errorf("cant decode file: %w", err)
+		}
+		return []pendingBatch{{Metrics: metrics}}, nil
+	}
+
+	var file pendingFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("cant decode file: %w", err)
+	}
+	return file.Batches, nil
+}
+
+// savePending writes batches to a temporary file and renames it over the pending file.
+func (a *Agent) savePending(batches []pendingBatch) error {
+	if a.config.PendingFile == "" {
+		a.logger.Warn("drop unsent metrics, no pending file", zap.Int("batches", len(batches)))
+		return nil
+	}
+
+	data, err := json.Marshal(pendingFile{Batches: batches})
+	if err != nil {
+		return fmt.Errorf("cant encode metrics: %w", err)
+	}
+	tmp := a.config.PendingFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("cant write file: %w", err)
+	}
+	if err := os.Rename(tmp, a.config.PendingFile); err != nil {
+		return fmt.Errorf("cant rename file: %w", err)
+	}
+	a.logger.Info("saved unsent metrics", zap.String("file", a.config.PendingFile), zap.Int("batches", len(batches)))
+	return nil
+}
+
+func (a *Agent) removePending() error {
+	if a.config.PendingFile == "" {
+		return nil
+	}
+	if err := os.Remove(a.config.PendingFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cant remove pending file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"metrics/internal/pollers"
+	"metrics/internal/spool"
+)
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func (a *Agent) openSpool() error {
+	if a.config.SpoolDir == "" || a.spool != nil {
+		return nil
+	}
+	s, err := spool.Open(a.config.SpoolDir, a.config.SpoolLimits)
+	if err != nil {
+		return err
+	}
+	a.spool = s
+	if stats := s.Stats(); stats.Segments > 0 {
+		a.logger.Info("spooled batches restored", zap.Int("segments", stats.Segments), zap.Int64("bytes", stats.Bytes))
+	}
+	return nil
+}
+
+// spoolMetrics saves a batch that could not be pushed to the spool.
+func (a *Agent) spoolMetrics(batchID string, metrics []pollers.Metric) error {
+	body, err := encodeMetrics(metrics)
+	if err != nil {
+		a.logger.Error("cant spool metrics", zap.Error(err))
+		return err
+	}
+	if err := a.spool.Push(encodeSegment(batchID, body)); err != nil {
+		a.logger.Error("cant spool metrics", zap.Error(err))
+		return err
+	}
+	stats := a.spool.Stats()
+	a.logger.Warn("metrics spooled", zap.Int("segments", stats.Segments), zap.Int64("bytes", stats.Bytes))
+	return nil
+}
+
+// replaySpool pushes spooled batches every interval until ctx is done.
+// Like worker pushes, a running push is not cancelled with ctx, otherwise a batch the server already received
+// would stay in the spool and be sent again on shutdown.
+func (a *Agent) replaySpool(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.drainSpool(context.WithoutCancel(ctx))
+		}
+	}
+}
+
+// drainSpool pushes spooled batches oldest first, stopping at the first one the server does not accept.
+// It returns at once while another drain is running, e.g. a replay that outlived the shutdown timeout,
+// leaving the spool to it.
+func (a *Agent) drainSpool(ctx context.Context) {
+	if !a.draining.TryLock() {
+		return
+	}
+	defer a.draining.Unlock()
+
+	for {
+		seq, segment, ok, err := a.spool.Peek()
+		if err != nil {
+			a.logger.Error("cant read spool", zap.Error(err))
+			return
+		}
+		if !ok {
+			return
+		}
+		batchID, body := decodeSegment(segment)
+		metrics, err := decodeMetrics(body)
+		if err != nil {
+			// A segment that cannot be decoded will never be pushed, so it is dropped instead of blocking the spool.
+			a.logger.Error("cant decode spooled metrics, drop them", zap.Uint64("seq", seq), zap.Error(err))
+			if err := a.spool.Ack(seq); err != nil {
+				a.logger.Error("cant remove spooled metrics", zap.Error(err))
+				return
+			}
+			continue
+		}
+		if err := a.pushMetrics(ctx, batchID, metrics); err != nil {
+			a.logger.Debug("cant push spooled metrics", zap.Error(err))
+			return
+		}
+		if err := a.spool.Ack(seq); err != nil {
+			a.logger.Error("cant remove spooled metrics", zap.Error(err))
+			return
+		}
+		a.logger.Info("spooled metrics pushed successfully", zap.Uint64("seq", seq))
+	}
+}
+
+// encodeSegment prefixes an encoded batch with its ID line.
+func encodeSegment(batchID string, body []byte) []byte {
+	segment := make([]byte, 0, len(batchID)+1+len(body))
+	segment = append(segment, batchID...)
+	segment = append(segment, '\n')
+	return append(segment, body...)
+}
+
+// decodeSegment splits a spool segment into the batch ID and the encoded batch.
+// Segments spooled by older agents hold just the gzipped batch and have no ID.
+func decodeSegment(segment []byte) (string, []byte) {
+	if bytes.HasPrefix(segment, gzipMagic) {
+		return "", segment
+	}
+	batchID, body, ok := bytes.Cut(segment, []byte{'\n'})
+	if !ok {
+		return "", segment
+	}
+	return string(batchID), body
+}
+
+// decodeMetrics decodes a batch encoded by encodeMetrics.
+func decodeMetrics(body []byte) ([]pollers.Metric, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("cant gunzip metrics: %w", err)
+	}
+	var metrics []pollers.Metric
+	if err := json.NewDecoder(reader).Decode(&metrics); err != nil {
+		return nil, fmt.Errorf("cant decode metrics: %w", err)
+	}
+	return metrics, nil
+}
+
+// spoolStats reports the depth of the spool as gauges.
+func (a *Agent) spoolStats() []pollers.Metric {
+	if a.spool == nil {
+		return nil
+	}
+	stats := a.spool.Stats()
+	var oldestAge float64
+	if !stats.Oldest.IsZero() {
+		oldestAge = time.Since(stats.Oldest).Seconds()
+	}
+
+	gauges := []struct {
+		id    string
+		value float64
+	}{
+		{"SpoolSegments", float64(stats.Segments)},
+		{"SpoolBytes", float64(stats.Bytes)},
+		{"SpoolOldestAgeSeconds", oldestAge},
+		{"SpoolDropped", float64(stats.Dropped)},
+	}
+	metrics := make([]pollers.Metric, 0, len(gauges))
+	for _, gauge := range gauges {
+		value := gauge.value
+		metrics = append(metrics, pollers.Metric{ID: gauge.id, MType: pollers.TypeGauge, Value: &value})
+	}
+	return metrics
+}
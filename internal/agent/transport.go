@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"metrics/internal/encryption"
+	"metrics/internal/pollers"
+	"metrics/internal/tlsconfig"
+)
+
+// Transport delivers batches of metrics to a destination.
+type Transport interface {
+	// Push delivers a batch. A batch that failed may be pushed again with the same ID,
+	// so destinations applying metrics must apply each batch ID once.
+	Push(ctx context.Context, batchID string, metrics []pollers.Metric) error
+	// Close releases the resources of the transport.
+	Close() error
+}
+
+// Pinger is implemented by transports that can check the destination is reachable before the first push.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// KeySetter is implemented by transports that sign batches, so the key can be replaced while the agent runs.
+type KeySetter interface {
+	SetKey(key string)
+}
+
+// Transport names accepted in Config.Transports.
+const (
+	TransportHTTP   = "http"
+	TransportGRPC   = "grpc"
+	TransportStdout = "stdout"
+	// TransportFile is followed by a colon and the path of the file, e.g. "file:/tmp/metrics.jsonl".
+	TransportFile = "file"
+)
+
+// NewTransport creates the transport selected by the config.
+// Several transports are combined into a fan-out transport.
+// Without transports in the config, metrics are pushed over gRPC if a gRPC address is set and over HTTP otherwise.
+func NewTransport(config Config, logger *zap.Logger) (Transport, error) {
+	var tlsConfig *tls.Config
+	if config.TLSEnabled() {
+		var err error
+		tlsConfig, err = tlsconfig.NewClientConfig(config.TLSCA, config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("cant load tls config: %w", err)
+		}
+	}
+
+	names := config.Transports
+	if len(names) == 0 {
+		names = []string{TransportHTTP}
+		if config.GRPCAddress != "" {
+			names = []string{TransportGRPC}
+		}
+	}
+
+	transports := make([]Transport, 0, len(names))
+	for _, name := range names {
+		transport, err := newNamedTransport(name, config, tlsConfig, logger)
+		if err != nil {
+			for _, created := range transports {
+				_ = created.Close()
+			}
+			return nil, err
+		}
+		transports = append(transports, transport)
+	}
+	if len(transports) == 1 {
+		return transports[0], nil
+	}
+	return NewFanOutTransport(transports...), nil
+}
+
+func newNamedTransport(name string, config Config, tlsConfig *tls.Config, logger *zap.Logger) (Transport, error) {
+	if err := checkTransport(name, config); err != nil {
+		return nil, err
+	}
+	kind, path, _ := strings.Cut(name, ":")
+	switch kind {
+	case TransportGRPC:
+		return NewGRPCTransport(config.GRPCAddress, config.Key, tlsConfig, logger)
+	case TransportStdout:
+		return NewWriterTransport(os.Stdout), nil
+	case TransportFile:
+		return NewFileTransport(path)
+	default:
+		transport := NewHTTPTransport(config.ServerURL, config.Key, logger)
+		if tlsConfig != nil {
+			transport.SetTLSConfig(tlsConfig)
+		}
+		if config.CryptoKey != "" {
+			publicKey, err := encryption.LoadPublicKey(config.CryptoKey)
+			if err != nil {
+				return nil, fmt.Errorf("cant load crypto key: %w", err)
+			}
+			transport.SetPublicKey(publicKey)
+		}
+		return transport, nil
+	}
+}
+
+// checkTransport checks that a transport name is known and that the config has what the transport needs.
+func checkTransport(name string, config Config) error {
+	kind, path, _ := strings.Cut(name, ":")
+	switch kind {
+	case TransportHTTP, TransportStdout:
+		return nil
+	case TransportGRPC:
+		if config.GRPCAddress == "" {
+			return errors.New("grpc transport needs a grpc address")
+		}
+		return nil
+	case TransportFile:
+		if path == "" {
+			return errors.New("file transport needs a path, e.g. file:/tmp/metrics.jsonl")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown transport %q", name)
+	}
+}
+
+// outboundIP returns the local IP address of the route to host, the agent reports it to the server as its real IP.
+// Dialing UDP only selects the route and sends no packets, so the port does not matter.
+func outboundIP(host string) (string, error) {
+	if host == "" {
+		return "", errors.New("unknown server host")
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(host, "80"))
+	if err != nil {
+		return "", fmt.Errorf("cant dial server: %w", err)
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return "", fmt.Errorf("unexpected local address %s", conn.LocalAddr())
+	}
+	return addr.IP.String(), nil
+}
+
+// WriterTransport writes batches as JSON lines, for debugging.
+// Each line holds the batch ID and the metrics of one batch.
+type WriterTransport struct {
+	writer io.Writer
+	closer io.Closer
+	mu     sync.Mutex
+}
+
+// NewWriterTransport creates a WriterTransport writing to w, which is not closed by the transport.
+func NewWriterTransport(w io.Writer) *WriterTransport {
+	return &WriterTransport{writer: w}
+}
+
+// NewFileTransport creates a WriterTransport appending to the file at path.
+func NewFileTransport(path string) (*WriterTransport, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("cant open file: %w", err)
+	}
+	return &WriterTransport{writer: file, closer: file}, nil
+}
+
+// Push writes a batch as a single line.
+func (t *WriterTransport) Push(ctx context.Context, batchID string, metrics []pollers.Metric) error {
+	data, err := json.Marshal(pendingBatch{ID: batchID, Metrics: metrics})
+	if err != nil {
+		return fmt.Errorf("cant encode metrics: %w", err)
+	}
+	data = append(data, '\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.writer.Write(data); err != nil {
+		return fmt.Errorf("cant write metrics: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file of a file transport.
+func (t *WriterTransport) Close() error {
+	if t.closer == nil {
+		return nil
+	}
+	if err := t.closer.Close(); err != nil {
+		return fmt.Errorf("cant close file: %w", err)
+	}
+	return nil
+}
+
+// FanOutTransport pushes every batch to several transports.
+// A push fails if any transport fails, and the batch is then pushed again to all of them,
+// which relies on destinations dropping batch IDs they have already applied.
+type FanOutTransport struct {
+	transports []Transport
+}
+
+// NewFanOutTransport creates a new instance of FanOutTransport.
+func NewFanOutTransport(transports ...Transport) *FanOutTransport {
+	return &FanOutTransport{transports: transports}
+}
+
+// Ping pings every transport that supports it.
+func (t *FanOutTransport) Ping(ctx context.Context) error {
+	var errs []error
+	for _, transport := range t.transports {
+		if pinger, ok := transport.(Pinger); ok {
+			if err := pinger.Ping(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetKey replaces the key of every transport that signs batches.
+func (t *FanOutTransport) SetKey(key string) {
+	for _, transport := range t.transports {
+		if setter, ok := transport.(KeySetter); ok {
+			setter.SetKey(key)
+		}
+	}
+}
+
+// Push pushes a batch to every transport, even if some of them fail.
+func (t *FanOutTransport) Push(ctx context.Context, batchID string, metrics []pollers.Metric) error {
+	var errs []error
+	for _, transport := range t.transports {
+		if err := transport.Push(ctx, batchID, metrics); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every transport.
+func (t *FanOutTransport) Close() error {
+	var errs []error
+	for _, transport := range t.transports {
+		if err := transport.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
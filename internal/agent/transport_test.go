@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"metrics/internal/pollers"
+)
+
+// recordingTransport records pushed batches, failing while err is set.
+type recordingTransport struct {
+	err     error
+	batches []pendingBatch
+	mu      sync.Mutex
+	closed  bool
+}
+
+func (t *recordingTransport) Push(ctx context.Context, batchID string, metrics []pollers.Metric) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	t.batches = append(t.batches, pendingBatch{ID: batchID, Metrics: metrics})
+	return nil
+}
+
+func (t *recordingTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	return nil
+}
+
+func TestNewTransport(t *testing.T) {
+	logger := zap.NewNop()
+
+	transport, err := NewTransport(Config{ServerURL: "http://localhost:8080"}, logger)
+	require.NoError(t, err)
+	assert.IsType(t, &HTTPTransport{}, transport)
+
+	transport, err = NewTransport(Config{GRPCAddress: "localhost:3200"}, logger)
+	require.NoError(t, err)
+	assert.IsType(t, &GRPCTransport{}, transport)
+	assert.NoError(t, transport.Close())
+
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	transport, err = NewTransport(Config{Transports: []string{"stdout", "file:" + path}}, logger)
+	require.NoError(t, err)
+	assert.IsType(t, &FanOutTransport{}, transport)
+	assert.NoError(t, transport.Close())
+	assert.FileExists(t, path)
+
+	_, err = NewTransport(Config{Transports: []string{"grpc"}}, logger)
+	assert.Error(t, err, "grpc transport needs an address")
+	_, err = NewTransport(Config{Transports: []string{"file"}}, logger)
+	assert.Error(t, err, "file transport needs a path")
+	_, err = NewTransport(Config{Transports: []string{"carrier-pigeon"}}, logger)
+	assert.Error(t, err)
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{"http", "file:/tmp/m.jsonl"}, splitList(" http, file:/tmp/m.jsonl ,"))
+	assert.Empty(t, splitList(""))
+}
+
+func TestWriterTransport(t *testing.T) {
+	var buf bytes.Buffer
+	transport := NewWriterTransport(&buf)
+
+	value := 1.5
+	require.NoError(t, transport.Push(context.Background(), "batch-1",
+		[]pollers.Metric{{ID: "Alloc", MType: pollers.TypeGauge, Value: &value}}))
+	require.NoError(t, transport.Push(context.Background(), "batch-2", nil))
+	require.NoError(t, transport.Close())
+
+	scanner := bufio.NewScanner(&buf)
+	var batches []pendingBatch
+	for scanner.Scan() {
+		var b pendingBatch
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &b))
+		batches = append(batches, b)
+	}
+	require.Len(t, batches, 2)
+	assert.Equal(t, "batch-1", batches[0].ID)
+	assert.Equal(t, "Alloc", batches[0].Metrics[0].ID)
+	assert.Equal(t, "batch-2", batches[1].ID)
+}
+
+func TestFileTransport_Appends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	for _, id := range []string{"batch-1", "batch-2"} {
+		transport, err := NewFileTransport(path)
+		require.NoError(t, err)
+		require.NoError(t, transport.Push(context.Background(), id, nil))
+		require.NoError(t, transport.Close())
+	}
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(data, []byte{'\n'}))
+}
+
+func TestFanOutTransport(t *testing.T) {
+	healthy := &recordingTransport{}
+	failing := &recordingTransport{err: errors.New("unavailable")}
+	transport := NewFanOutTransport(healthy, failing)
+
+	err := transport.Push(context.Background(), "batch-1", nil)
+	assert.ErrorIs(t, err, failing.err)
+	assert.Len(t, healthy.batches, 1, "healthy transports get the batch even if others fail")
+
+	require.NoError(t, transport.Close())
+	assert.True(t, healthy.closed)
+	assert.True(t, failing.closed)
+}
+
+func TestAgent_WithTransport(t *testing.T) {
+	delta := int64(1)
+	poller := new(MockPoller)
+	poller.On("Poll").Return(nil)
+	poller.On("TakeMetrics").Return([]pollers.Metric{{ID: "PollCount", MType: pollers.TypeCounter, Delta: &delta}}, nil)
+	poller.On("RestoreMetrics", mock.Anything, mock.Anything).Return(nil)
+
+	transport := &recordingTransport{}
+	config := Config{
+		PollInterval:    10 * time.Millisecond,
+		PushInterval:    20 * time.Millisecond,
+		RateLimit:       1,
+		ShutdownTimeout: time.Second,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 70*time.Millisecond)
+	defer cancel()
+	require.NoError(t, NewAgentWithTransport(config, zaptest.NewLogger(t), []pollers.Poller{poller}, transport).Start(ctx))
+
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	assert.True(t, transport.closed, "agent closes its transport on stop")
+	require.NotEmpty(t, transport.batches)
+	ids := make(map[string]bool)
+	for _, b := range transport.batches {
+		assert.NotEmpty(t, b.ID)
+		assert.False(t, ids[b.ID], "every batch has its own ID")
+		ids[b.ID] = true
+	}
+	poller.AssertNumberOfCalls(t, "TakeMetrics", len(transport.batches))
+}
+
+func TestHTTPTransport_PushStopsRetryingWhenContextIsDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	transport := NewHTTPTransport(server.URL, "", zaptest.NewLogger(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := transport.Push(ctx, "batch-1", []pollers.Metric{{ID: "Alloc", MType: pollers.TypeGauge}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "the push must not outlive its context")
+}
@@ -0,0 +1,225 @@
+// Package config loads the configuration of the server and the agent.
+//
+// Every option is a command-line flag bound to an environment variable and to a key of the config file.
+// The file key is the name of the environment variable in lower case, e.g. ADDRESS is set with "address".
+// Values are taken in order of precedence: flags, environment variables, the config file, defaults.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ConfigFlag is the flag naming the config file.
+	ConfigFlag = "c"
+	// ConfigEnv is the environment variable naming the config file, the flag takes precedence.
+	ConfigEnv = "CONFIG"
+	// PrintFlag is the flag requesting to print the effective configuration.
+	PrintFlag = "print-config"
+
+	redacted = "<redacted>"
+)
+
+// ErrPrinted is returned when the configuration was printed on request, the program should exit without starting.
+var ErrPrinted = errors.New("config printed")
+
+// Option binds a flag to its environment variable.
+type Option struct {
+	Flag string
+	Env  string
+	// Secret options are redacted when the configuration is printed.
+	Secret bool
+}
+
+// key returns the config file key of the option.
+func (o Option) key() string {
+	return strings.ToLower(o.Env)
+}
+
+// Loader fills a flag set from command-line arguments, environment variables and a config file.
+type Loader struct {
+	fs      *flag.FlagSet
+	path    *string
+	print   *bool
+	file    string
+	options []Option
+}
+
+// NewLoader creates a new instance of Loader for the options of the flag set.
+// It adds the flags naming the config file and requesting to print the configuration to the flag set.
+func NewLoader(fs *flag.FlagSet, options ...Option) *Loader {
+	return &Loader{
+		fs:      fs,
+		path:    fs.String(ConfigFlag, "", "config file, JSON or YAML"),
+		print:   fs.Bool(PrintFlag, false, "print the configuration and exit"),
+		options: options,
+	}
+}
+
+// Load parses the arguments, then sets the flags that were not given from the environment and the config file.
+func (l *Loader) Load(args []string) error {
+	if err := l.fs.Parse(args); err != nil {
+		return fmt.Errorf("cant parse flags: %w", err)
+	}
+	explicit := make(map[string]bool)
+	l.fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	path := *l.path
+	if value, ok := os.LookupEnv(ConfigEnv); ok && value != "" && !explicit[ConfigFlag] {
+		path = value
+	}
+	if path != "" {
+		if err := l.loadFile(path, explicit); err != nil {
+			return err
+		}
+	}
+	l.file = path
+
+	for _, option := range l.options {
+		if explicit[option.Flag] {
+			continue
+		}
+		if value, ok := os.LookupEnv(option.Env); ok && value != "" {
+			if err := l.fs.Set(option.Flag, value); err != nil {
+				return fmt.Errorf("bad value of %s: %w", option.Env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Path returns the path of the loaded config file, empty without one.
+func (l *Loader) Path() string {
+	return l.file
+}
+
+// loadFile sets the flags that were not given from the config file.
+func (l *Loader) loadFile(path string, explicit map[string]bool) error {
+	values, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	options := make(map[string]Option, len(l.options))
+	for _, option := range l.options {
+		options[option.key()] = option
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		option, ok := options[key]
+		if !ok {
+			return fmt.Errorf("unknown option %q in %s", key, path)
+		}
+		if explicit[option.Flag] {
+			continue
+		}
+		value, err := scalar(values[key])
+		if err != nil {
+			return fmt.Errorf("bad value of %q in %s: %w", key, path, err)
+		}
+		if err := l.fs.Set(option.Flag, value); err != nil {
+			return fmt.Errorf("bad value of %q in %s: %w", key, path, err)
+		}
+	}
+	return nil
+}
+
+// readFile reads a config file, its format is chosen by the extension.
+func readFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cant read config: %w", err)
+	}
+
+	values := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&values); err != nil {
+			return nil, fmt.Errorf("cant parse config %s: %w", path, err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("cant parse config %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q, expected .json, .yaml or .yml", filepath.Ext(path))
+	}
+	return values, nil
+}
+
+// scalar formats a config file value the way it would be given on the command line.
+func scalar(value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(value), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("expected a scalar, got %T", value)
+	}
+}
+
+// PrintIfRequested prints the configuration and returns ErrPrinted if printing it was requested.
+func (l *Loader) PrintIfRequested(w io.Writer) error {
+	if !*l.print {
+		return nil
+	}
+	if err := l.Print(w); err != nil {
+		return err
+	}
+	return ErrPrinted
+}
+
+// Print writes the effective configuration as a JSON config file, secrets are redacted.
+func (l *Loader) Print(w io.Writer) error {
+	values := make(map[string]any, len(l.options))
+	for _, option := range l.options {
+		f := l.fs.Lookup(option.Flag)
+		if f == nil {
+			return fmt.Errorf("unknown flag %q", option.Flag)
+		}
+		var value any = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		if duration, ok := value.(time.Duration); ok {
+			value = duration.String()
+		}
+		if option.Secret && f.Value.String() != "" {
+			value = redacted
+		}
+		values[option.key()] = value
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(values); err != nil {
+		return fmt.Errorf("cant print config: %w", err)
+	}
+	return nil
+}
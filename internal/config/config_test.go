@@ -0,0 +1,205 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	address  *string
+	key      *string
+	interval *int
+	timeout  *time.Duration
+	restore  *bool
+	loader   *Loader
+}
+
+func newTestConfig() *testConfig {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c := &testConfig{
+		address:  fs.String("a", "localhost:8080", "address"),
+		key:      fs.String("k", "", "key"),
+		interval: fs.Int("i", 300, "interval"),
+		timeout:  fs.Duration("shutdown-timeout", 10*time.Second, "timeout"),
+		restore:  fs.Bool("r", true, "restore"),
+	}
+	c.loader = NewLoader(fs,
+		Option{Flag: "a", Env: "ADDRESS"},
+		Option{Flag: "k", Env: "KEY", Secret: true},
+		Option{Flag: "i", Env: "STORE_INTERVAL"},
+		Option{Flag: "shutdown-timeout", Env: "SHUTDOWN_TIMEOUT"},
+		Option{Flag: "r", Env: "RESTORE"},
+	)
+	return c
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoader_Defaults(t *testing.T) {
+	c := newTestConfig()
+	require.NoError(t, c.loader.Load(nil))
+
+	assert.Equal(t, "localhost:8080", *c.address)
+	assert.Equal(t, 300, *c.interval)
+	assert.Equal(t, 10*time.Second, *c.timeout)
+	assert.True(t, *c.restore)
+}
+
+func TestLoader_Precedence(t *testing.T) {
+	path := writeFile(t, "config.json", `{
+		"address": "file:1",
+		"store_interval": 100,
+		"shutdown_timeout": "1m",
+		"restore": false
+	}`)
+	t.Setenv("ADDRESS", "env:1")
+	t.Setenv("STORE_INTERVAL", "200")
+
+	c := newTestConfig()
+	require.NoError(t, c.loader.Load([]string{"-c", path, "-a", "flag:1"}))
+
+	assert.Equal(t, "flag:1", *c.address, "flags override env")
+	assert.Equal(t, 200, *c.interval, "env overrides the file")
+	assert.Equal(t, time.Minute, *c.timeout, "the file overrides defaults")
+	assert.False(t, *c.restore)
+}
+
+func TestLoader_YAML(t *testing.T) {
+	path := writeFile(t, "config.yaml", "address: yaml:1\nstore_interval: 50\nshutdown_timeout: 5s\nrestore: false\n")
+	t.Setenv("CONFIG", path)
+
+	c := newTestConfig()
+	require.NoError(t, c.loader.Load(nil))
+
+	assert.Equal(t, "yaml:1", *c.address)
+	assert.Equal(t, 50, *c.interval)
+	assert.Equal(t, 5*time.Second, *c.timeout)
+	assert.False(t, *c.restore)
+}
+
+func TestLoader_ConfigFlagOverridesEnv(t *testing.T) {
+	t.Setenv("CONFIG", filepath.Join(t.TempDir(), "missing.json"))
+	path := writeFile(t, "config.json", `{"address": "file:1"}`)
+
+	c := newTestConfig()
+	require.NoError(t, c.loader.Load([]string{"-c", path}))
+	assert.Equal(t, "file:1", *c.address)
+}
+
+func TestLoader_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "unknown flag",
+			args:    []string{"-unknown"},
+			wantErr: "cant parse flags",
+		},
+		{
+			name:    "unknown file key",
+			file:    "config.json",
+			content: `{"adress": "localhost:1"}`,
+			wantErr: `unknown option "adress"`,
+		},
+		{
+			name:    "bad file value",
+			file:    "config.yaml",
+			content: "store_interval: often\n",
+			wantErr: `bad value of "store_interval"`,
+		},
+		{
+			name:    "nested file value",
+			file:    "config.yaml",
+			content: "address:\n  host: localhost\n",
+			wantErr: "expected a scalar",
+		},
+		{
+			name:    "bad env value",
+			env:     map[string]string{"SHUTDOWN_TIMEOUT": "10"},
+			wantErr: "bad value of SHUTDOWN_TIMEOUT",
+		},
+		{
+			name:    "unsupported format",
+			file:    "config.toml",
+			content: `address = "localhost:1"`,
+			wantErr: "unsupported config format",
+		},
+		{
+			name:    "broken file",
+			file:    "config.json",
+			content: `{"address": `,
+			wantErr: "cant parse config",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append(args, "-c", writeFile(t, tt.file, tt.content))
+			}
+
+			c := newTestConfig()
+			c.loader.fs.SetOutput(&bytes.Buffer{})
+			err := c.loader.Load(args)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoader_Print(t *testing.T) {
+	c := newTestConfig()
+	require.NoError(t, c.loader.Load([]string{"-k", "secret", "-i", "5"}))
+
+	var out bytes.Buffer
+	require.NoError(t, c.loader.PrintIfRequested(&out))
+	assert.Empty(t, out.String())
+
+	require.NoError(t, c.loader.Print(&out))
+	var printed map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &printed))
+	assert.Equal(t, map[string]any{
+		"address":          "localhost:8080",
+		"key":              redacted,
+		"store_interval":   float64(5),
+		"shutdown_timeout": "10s",
+		"restore":          true,
+	}, printed)
+}
+
+func TestLoader_PrintIfRequested(t *testing.T) {
+	c := newTestConfig()
+	require.NoError(t, c.loader.Load([]string{"--print-config"}))
+
+	var out bytes.Buffer
+	require.ErrorIs(t, c.loader.PrintIfRequested(&out), ErrPrinted)
+
+	// The printed configuration can be loaded back as a config file.
+	path := writeFile(t, "printed.json", out.String())
+	reloaded := newTestConfig()
+	require.NoError(t, reloaded.loader.Load([]string{"-c", path}))
+	assert.Equal(t, *c.address, *reloaded.address)
+	assert.Equal(t, *c.timeout, *reloaded.timeout)
+}
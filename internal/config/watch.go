@@ -0,0 +1,68 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultWatchInterval is how often Watch checks the config file for changes.
+const DefaultWatchInterval = time.Second
+
+// Watch calls reload when the process receives SIGHUP or, when path is not empty, when the file at path changes.
+// The file is checked every interval by its modification time and size.
+// Watch returns when ctx is done.
+func Watch(ctx context.Context, path string, interval time.Duration, reload func()) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var check <-chan time.Time
+	last, _ := stat(path)
+	if path != "" {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			last, _ = stat(path)
+			reload()
+		case <-check:
+			// A file that cannot be read is being replaced, it is checked again on the next tick.
+			current, err := stat(path)
+			if err != nil || current.equal(last) {
+				continue
+			}
+			last = current
+			reload()
+		}
+	}
+}
+
+// fileState identifies a version of a file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func (s fileState) equal(other fileState) bool {
+	return s.modTime.Equal(other.modTime) && s.size == other.size
+}
+
+func stat(path string) (fileState, error) {
+	if path == "" {
+		return fileState{}, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}, nil
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"address": "localhost:1"}`), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := make(chan struct{}, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Watch(ctx, path, 10*time.Millisecond, func() { reloads <- struct{}{} })
+	}()
+
+	// Writes are retried until one is seen, the watcher may not have read the initial state yet.
+	waitReload := func(change func()) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			change()
+			select {
+			case <-reloads:
+				return
+			case <-deadline:
+				t.Fatal("config was not reloaded")
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+
+	// Every write grows the file, so it is seen as changed even if the modification time did not move.
+	content := []byte(`{"address": "localhost:2"}`)
+	waitReload(func() {
+		content = append(content, ' ')
+		require.NoError(t, os.WriteFile(path, content, 0o600))
+	})
+
+	// The watcher handles SIGHUP once it runs, which the file reload above proves.
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	waitReload(func() {
+		require.NoError(t, process.Signal(syscall.SIGHUP))
+	})
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watch did not stop")
+	}
+}
@@ -0,0 +1,176 @@
+// Package encryption implements hybrid encryption of agent payloads with the RSA key pair of the server.
+//
+// A payload is encrypted with a random AES-256-GCM key, and the AES key is encrypted with RSA-OAEP (SHA-256).
+// The encrypted payload is laid out as:
+//
+//	| encrypted key length (2 bytes, big endian) | encrypted key | nonce (12 bytes) | ciphertext and tag |
+//
+// Keys are PEM files, e.g. generated with:
+//
+//	openssl genrsa -out private.pem 4096
+//	openssl rsa -in private.pem -pubout -out public.pem
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// Header marks an encrypted request body, its value is the scheme.
+	Header = "X-Encryption"
+	// Scheme names the encryption implemented by this package.
+	Scheme = "rsa-oaep-aes256-gcm"
+
+	aesKeySize    = 32
+	keyLengthSize = 2
+)
+
+// ErrMalformed is returned when an encrypted payload is truncated or its layout is broken.
+var ErrMalformed = errors.New("malformed encrypted payload")
+
+// LoadPublicKey reads an RSA public key from a PEM file, in PKIX or PKCS #1 form.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cant parse public key: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key in %s is %T, expected RSA", path, key)
+		}
+		return rsaKey, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cant parse public key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q in %s, expected a public key", block.Type, path)
+	}
+}
+
+// LoadPrivateKey reads an RSA private key from a PEM file, in PKCS #8 or PKCS #1 form.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cant parse private key: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key in %s is %T, expected RSA", path, key)
+		}
+		return rsaKey, nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cant parse private key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q in %s, expected a private key", block.Type, path)
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cant read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return block, nil
+}
+
+// Encrypt encrypts a payload for the owner of the private key matching publicKey.
+func Encrypt(publicKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("cant generate key: %w", err)
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cant encrypt key: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("cant generate nonce: %w", err)
+	}
+
+	out := make([]byte, 0, keyLengthSize+len(encryptedKey)+len(nonce)+len(plaintext)+gcm.Overhead())
+	out = binary.BigEndian.AppendUint16(out, uint16(len(encryptedKey)))
+	out = append(out, encryptedKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt decrypts a payload encrypted by Encrypt with the matching public key.
+func Decrypt(privateKey *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < keyLengthSize {
+		return nil, ErrMalformed
+	}
+	keyLength := int(binary.BigEndian.Uint16(data))
+	data = data[keyLengthSize:]
+	if len(data) < keyLength {
+		return nil, ErrMalformed
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, data[:keyLength], nil)
+	if err != nil {
+		return nil, fmt.Errorf("cant decrypt key: %w", err)
+	}
+	data = data[keyLength:]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("cant decrypt payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cant create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cant create cipher: %w", err)
+	}
+	return gcm, nil
+}
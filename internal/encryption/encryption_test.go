@@ -0,0 +1,98 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, blockType string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0o600))
+	return path
+}
+
+func TestLoadKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	for blockType, data := range map[string][]byte{
+		"PRIVATE KEY":     pkcs8,
+		"RSA PRIVATE KEY": x509.MarshalPKCS1PrivateKey(key),
+	} {
+		loaded, err := LoadPrivateKey(writePEM(t, blockType, data))
+		require.NoError(t, err, blockType)
+		assert.True(t, key.Equal(loaded), blockType)
+	}
+	for blockType, data := range map[string][]byte{
+		"PUBLIC KEY":     pkix,
+		"RSA PUBLIC KEY": x509.MarshalPKCS1PublicKey(&key.PublicKey),
+	} {
+		loaded, err := LoadPublicKey(writePEM(t, blockType, data))
+		require.NoError(t, err, blockType)
+		assert.True(t, key.PublicKey.Equal(loaded), blockType)
+	}
+
+	_, err = LoadPublicKey(writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)))
+	assert.ErrorContains(t, err, "expected a public key")
+	_, err = LoadPrivateKey(filepath.Join(t.TempDir(), "missing.pem"))
+	assert.ErrorContains(t, err, "cant read key")
+
+	notPEM := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(notPEM, []byte("not a key"), 0o600))
+	_, err = LoadPrivateKey(notPEM)
+	assert.ErrorContains(t, err, "no PEM data")
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	plaintext := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+
+	encrypted, err := Encrypt(&key.PublicKey, plaintext)
+	require.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "PollCount")
+
+	decrypted, err := Decrypt(key, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// Every payload gets its own key and nonce.
+	again, err := Encrypt(&key.PublicKey, plaintext)
+	require.NoError(t, err)
+	assert.NotEqual(t, encrypted, again)
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := append([]byte(nil), encrypted...)
+		tampered[len(tampered)-1] ^= 1
+		_, err := Decrypt(key, tampered)
+		assert.ErrorContains(t, err, "cant decrypt payload")
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		_, err = Decrypt(other, encrypted)
+		assert.ErrorContains(t, err, "cant decrypt key")
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, data := range [][]byte{nil, {0x01}, encrypted[:100], encrypted[:2+256+5]} {
+			_, err := Decrypt(key, data)
+			assert.ErrorIs(t, err, ErrMalformed)
+		}
+	})
+}
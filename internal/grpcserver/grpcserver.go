@@ -0,0 +1,208 @@
+// Package grpcserver implements the Metrics gRPC service on top of the metrics storage.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"metrics/internal/handlers"
+	pb "metrics/internal/proto"
+	"metrics/internal/storage"
+)
+
+// Service implements the Metrics gRPC service.
+// Updates are applied by the HTTP handler, so both APIs validate and deduplicate batches the same way.
+type Service struct {
+	pb.UnimplementedMetricsServer
+	storage storage.MetricsStorage
+	handler *handlers.MetricsHandler
+	logger  *zap.Logger
+}
+
+// NewService creates a new instance of Service.
+func NewService(metricsStorage storage.MetricsStorage, handler *handlers.MetricsHandler, logger *zap.Logger) *Service {
+	return &Service{storage: metricsStorage, handler: handler, logger: logger}
+}
+
+// UpdateMetrics applies a batch of metrics.
+func (s *Service) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	if err := s.apply(ctx, req); err != nil {
+		return nil, err
+	}
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+// UpdateMetricsStream applies every batch sent on the stream, stopping at the first batch that cannot be applied.
+func (s *Service) UpdateMetricsStream(stream pb.Metrics_UpdateMetricsStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.UpdateMetricsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.apply(stream.Context(), req); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Service) apply(ctx context.Context, req *pb.UpdateMetricsRequest) error {
+	metrics := make([]handlers.Metric, 0, len(req.GetMetrics()))
+	for _, metric := range req.GetMetrics() {
+		metrics = append(metrics, FromProto(metric))
+	}
+
+	err := s.handler.ApplyMetrics(ctx, req.GetBatchId(), metrics)
+	var validationErr *handlers.ValidationError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &validationErr), errors.Is(err, storage.ErrBucketsMismatch):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, storage.ErrBatchInFlight):
+		return status.Error(codes.Aborted, err.Error())
+	default:
+		s.logger.Error("cant apply metrics batch", zap.Error(err))
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// GetMetric returns the current value of a metric.
+func (s *Service) GetMetric(ctx context.Context, req *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	labels := storage.Labels(req.GetLabels())
+	if err := storage.ValidateName(req.GetId()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := labels.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	key := storage.SeriesKey(req.GetId(), labels)
+	metric := &pb.Metric{Id: req.GetId(), Type: req.GetType(), Labels: req.GetLabels()}
+
+	var ok bool
+	var err error
+	switch req.GetType() {
+	case pb.MetricType_METRIC_TYPE_GAUGE:
+		var value storage.Gauge
+		value, ok, err = s.storage.GetGauge(ctx, key)
+		metric.Value = float64Ptr(float64(value))
+	case pb.MetricType_METRIC_TYPE_COUNTER:
+		var value storage.Counter
+		value, ok, err = s.storage.GetCounter(ctx, key)
+		metric.Delta = int64Ptr(int64(value))
+	case pb.MetricType_METRIC_TYPE_HISTOGRAM:
+		var value *storage.Histogram
+		value, ok, err = s.storage.GetHistogram(ctx, key)
+		metric.Histogram = histogramToProto(value)
+	case pb.MetricType_METRIC_TYPE_SET:
+		var value *storage.HyperLogLog
+		value, ok, err = s.storage.GetSet(ctx, key)
+		if ok {
+			metric.Delta = int64Ptr(int64(value.Estimate()))
+		}
+	default:
+		return nil, status.Error(codes.InvalidArgument, "no such metric type")
+	}
+	if err != nil {
+		s.logger.Error("cant get metric", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no such metric")
+	}
+	return &pb.GetMetricResponse{Metric: metric}, nil
+}
+
+// ListMetrics returns the current values of all metrics.
+func (s *Service) ListMetrics(ctx context.Context, req *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
+	gauges, err := s.storage.GetGauges(ctx)
+	if err != nil {
+		s.logger.Error("cant get gauges", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	counters, err := s.storage.GetCounters(ctx)
+	if err != nil {
+		s.logger.Error("cant get counters", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	histograms, err := s.storage.GetHistograms(ctx)
+	if err != nil {
+		s.logger.Error("cant get histograms", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	sets, err := s.storage.GetSets(ctx)
+	if err != nil {
+		s.logger.Error("cant get sets", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	metrics := make([]*pb.Metric, 0, len(gauges)+len(counters)+len(histograms)+len(sets))
+	series := func(key string, mtype pb.MetricType) *pb.Metric {
+		name, labels := storage.ParseSeriesKey(key)
+		return &pb.Metric{Id: name, Type: mtype, Labels: labels}
+	}
+	for key, value := range gauges {
+		metric := series(key, pb.MetricType_METRIC_TYPE_GAUGE)
+		metric.Value = float64Ptr(float64(value))
+		metrics = append(metrics, metric)
+	}
+	for key, value := range counters {
+		metric := series(key, pb.MetricType_METRIC_TYPE_COUNTER)
+		metric.Delta = int64Ptr(int64(value))
+		metrics = append(metrics, metric)
+	}
+	for key, value := range histograms {
+		metric := series(key, pb.MetricType_METRIC_TYPE_HISTOGRAM)
+		metric.Histogram = histogramToProto(value)
+		metrics = append(metrics, metric)
+	}
+	for key, value := range sets {
+		metric := series(key, pb.MetricType_METRIC_TYPE_SET)
+		metric.Delta = int64Ptr(int64(value.Estimate()))
+		metrics = append(metrics, metric)
+	}
+	return &pb.ListMetricsResponse{Metrics: metrics}, nil
+}
+
+// FromProto converts a protobuf metric to the metric accepted by the HTTP API.
+func FromProto(metric *pb.Metric) handlers.Metric {
+	result := handlers.Metric{
+		ID:      metric.GetId(),
+		MType:   metric.GetType().TypeName(),
+		Delta:   metric.Delta,
+		Value:   metric.Value,
+		Members: metric.GetMembers(),
+	}
+	if len(metric.GetLabels()) > 0 {
+		result.Labels = storage.Labels(metric.GetLabels())
+	}
+	if h := metric.GetHistogram(); h != nil {
+		result.Histogram = &storage.Histogram{Bounds: h.GetBounds(), Counts: h.GetCounts(), Sum: h.GetSum(), Count: h.GetCount()}
+	}
+	if set := metric.GetSet(); set != nil {
+		result.Set = &storage.HyperLogLog{Registers: set.GetRegisters()}
+	}
+	return result
+}
+
+func histogramToProto(h *storage.Histogram) *pb.Histogram {
+	if h == nil {
+		return nil
+	}
+	return &pb.Histogram{Bounds: h.Bounds, Counts: h.Counts, Sum: h.Sum, Count: h.Count}
+}
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
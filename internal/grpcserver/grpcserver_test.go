@@ -0,0 +1,145 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"metrics/internal/handlers"
+	pb "metrics/internal/proto"
+	"metrics/internal/storage"
+)
+
+func newTestClient(t *testing.T, metricsStorage storage.MetricsStorage) pb.MetricsClient {
+	t.Helper()
+	logger := zap.NewNop()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterMetricsServer(server, NewService(metricsStorage, handlers.NewMetricsHandler(metricsStorage, logger), logger))
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+func int64Value(v int64) *int64 {
+	return &v
+}
+
+func float64Value(v float64) *float64 {
+	return &v
+}
+
+func TestService_UpdateMetrics(t *testing.T) {
+	ctx := context.Background()
+	memStorage := storage.NewMemStorage()
+	client := newTestClient(t, memStorage)
+
+	req := &pb.UpdateMetricsRequest{
+		BatchId: "batch-1",
+		Metrics: []*pb.Metric{
+			{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: int64Value(2)},
+			{Id: "Alloc", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: float64Value(1.5), Labels: map[string]string{"host": "a"}},
+			{Id: "Users", Type: pb.MetricType_METRIC_TYPE_SET, Members: []string{"alice", "bob"}},
+			{Id: "Latency", Type: pb.MetricType_METRIC_TYPE_HISTOGRAM, Histogram: &pb.Histogram{
+				Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1,
+			}},
+		},
+	}
+	_, err := client.UpdateMetrics(ctx, req)
+	require.NoError(t, err)
+	_, err = client.UpdateMetrics(ctx, req)
+	require.NoError(t, err)
+
+	counter, _, err := memStorage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counter(2), counter, "duplicate batch must be applied once")
+
+	gauge, ok, err := memStorage.GetGauge(ctx, storage.SeriesKey("Alloc", storage.Labels{"host": "a"}))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, storage.Gauge(1.5), gauge)
+
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{
+		Metrics: []*pb.Metric{{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestService_UpdateMetricsStream(t *testing.T) {
+	ctx := context.Background()
+	memStorage := storage.NewMemStorage()
+	client := newTestClient(t, memStorage)
+
+	stream, err := client.UpdateMetricsStream(ctx)
+	require.NoError(t, err)
+	for range 3 {
+		require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{
+			Metrics: []*pb.Metric{{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: int64Value(1)}},
+		}))
+	}
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	counter, _, err := memStorage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counter(3), counter)
+}
+
+func TestService_GetMetric(t *testing.T) {
+	ctx := context.Background()
+	memStorage := storage.NewMemStorage()
+	require.NoError(t, memStorage.SetGauge(ctx, storage.SeriesKey("Alloc", storage.Labels{"host": "a"}), 42))
+	client := newTestClient(t, memStorage)
+
+	resp, err := client.GetMetric(ctx, &pb.GetMetricRequest{
+		Id: "Alloc", Type: pb.MetricType_METRIC_TYPE_GAUGE, Labels: map[string]string{"host": "a"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 42.0, resp.GetMetric().GetValue())
+
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc", Type: pb.MetricType_METRIC_TYPE_GAUGE})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestService_ListMetrics(t *testing.T) {
+	ctx := context.Background()
+	memStorage := storage.NewMemStorage()
+	require.NoError(t, memStorage.SetGauge(ctx, "Alloc", 1))
+	require.NoError(t, memStorage.SetCounter(ctx, storage.SeriesKey("PollCount", storage.Labels{"host": "a"}), 5))
+	client := newTestClient(t, memStorage)
+
+	resp, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.GetMetrics(), 2)
+
+	byID := make(map[string]*pb.Metric)
+	for _, metric := range resp.GetMetrics() {
+		byID[metric.GetId()] = metric
+	}
+	assert.Equal(t, 1.0, byID["Alloc"].GetValue())
+	assert.Equal(t, int64(5), byID["PollCount"].GetDelta())
+	assert.Equal(t, map[string]string{"host": "a"}, byID["PollCount"].GetLabels())
+}
@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"metrics/internal/storage"
 
@@ -13,22 +19,80 @@ import (
 )
 
 // Metric represents a single metric with its type and value.
+// Set metrics are updated with members and/or a sketch and read back as an approximate distinct count in Delta.
 type Metric struct {
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
+	Delta     *int64               `json:"delta,omitempty"`
+	Value     *float64             `json:"value,omitempty"`
+	Histogram *storage.Histogram   `json:"histogram,omitempty"`
+	Set       *storage.HyperLogLog `json:"set,omitempty"`
+	Labels    storage.Labels       `json:"labels,omitempty"`
+	ID        string               `json:"id"`
+	MType     string               `json:"type"`
+	Members   []string             `json:"members,omitempty"`
 }
 
+// Key returns the storage series key of the metric.
+func (m *Metric) Key() string {
+	return storage.SeriesKey(m.ID, m.Labels)
+}
+
+// validateSeries checks the metric ID and labels that make up the series key.
+func (m *Metric) validateSeries() error {
+	if err := storage.ValidateName(m.ID); err != nil {
+		return err
+	}
+	return m.Labels.Validate()
+}
+
+// setSketch returns a sketch of the set metric members merged with the sent sketch.
+func (m *Metric) setSketch() (*storage.HyperLogLog, error) {
+	if m.Set == nil && len(m.Members) == 0 {
+		return nil, errors.New("set must have members")
+	}
+	sketch := storage.NewHyperLogLog()
+	if m.Set != nil {
+		if err := m.Set.Validate(); err != nil {
+			return nil, err
+		}
+		if err := sketch.Merge(m.Set); err != nil {
+			return nil, err
+		}
+	}
+	for _, member := range m.Members {
+		sketch.Add(member)
+	}
+	return sketch, nil
+}
+
+// batchIDHeader carries the idempotency key of a metrics batch.
+const batchIDHeader = "X-Batch-ID"
+
+// maxBatchIDLength limits the length of batch IDs remembered by the storage.
+const maxBatchIDLength = 128
+
 // MetricsHandler handles HTTP requests for metrics operations.
 type MetricsHandler struct {
-	storage storage.MetricsStorage
-	logger  *zap.Logger
+	storage    storage.MetricsStorage
+	logger     *zap.Logger
+	cumulative *cumulativeTracker
+	// batchWindow is how long batch IDs are remembered to drop duplicate deliveries, it can change on reload.
+	batchWindow atomic.Int64
 }
 
 // NewMetricsHandler creates a new instance of MetricsHandler.
 func NewMetricsHandler(metricsStorage storage.MetricsStorage, logger *zap.Logger) *MetricsHandler {
-	return &MetricsHandler{storage: metricsStorage, logger: logger}
+	h := &MetricsHandler{
+		storage:    metricsStorage,
+		logger:     logger,
+		cumulative: newCumulativeTracker(),
+	}
+	h.SetBatchWindow(storage.DefaultBatchWindow)
+	return h
+}
+
+// SetBatchWindow sets how long batch IDs are remembered, it is safe to call while requests are handled.
+func (h *MetricsHandler) SetBatchWindow(window time.Duration) {
+	h.batchWindow.Store(int64(window))
 }
 
 // SetGaugeMetricHandler handles setting a gauge metric.
@@ -50,6 +114,10 @@ func (h *MetricsHandler) SetGaugeMetricHandler(c *gin.Context) {
 		c.String(http.StatusNotFound, "No metric name")
 		return
 	}
+	if err := storage.ValidateName(metricName); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 	value, err := strconv.ParseFloat(metricValue, 64)
 	if err != nil {
 		c.String(http.StatusBadRequest, "Gauge must be float32")
@@ -84,6 +152,10 @@ func (h *MetricsHandler) SetCounterMetricHandler(c *gin.Context) {
 		c.String(http.StatusNotFound, "No metric name")
 		return
 	}
+	if err := storage.ValidateName(metricName); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 	value, err := strconv.ParseInt(metricValue, 10, 32)
 	if err != nil {
 		c.String(http.StatusBadRequest, "Counter must be int32")
@@ -182,10 +254,14 @@ func (h *MetricsHandler) GetMetricsHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "Bad json")
 		return
 	}
+	if err := metric.validateSeries(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	switch metric.MType {
 	case "gauge":
-		value, ok, err := h.storage.GetGauge(ctx, metric.ID)
+		value, ok, err := h.storage.GetGauge(ctx, metric.Key())
 		if err != nil {
 			c.String(http.StatusInternalServerError, err.Error())
 			h.logger.Error("cant get gauge", zap.Error(err))
@@ -198,7 +274,7 @@ func (h *MetricsHandler) GetMetricsHandler(c *gin.Context) {
 		metric.Value = new(float64)
 		*metric.Value = float64(value)
 	case "counter":
-		value, ok, err := h.storage.GetCounter(ctx, metric.ID)
+		value, ok, err := h.storage.GetCounter(ctx, metric.Key())
 		if err != nil {
 			c.String(http.StatusInternalServerError, err.Error())
 			h.logger.Error("cant get counter", zap.Error(err))
@@ -210,6 +286,31 @@ func (h *MetricsHandler) GetMetricsHandler(c *gin.Context) {
 		}
 		metric.Delta = new(int64)
 		*metric.Delta = int64(value)
+	case "histogram":
+		value, ok, err := h.storage.GetHistogram(ctx, metric.Key())
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			h.logger.Error("cant get histogram", zap.Error(err))
+			return
+		}
+		if !ok {
+			c.String(http.StatusNotFound, "No such metric")
+			return
+		}
+		metric.Histogram = value
+	case "set":
+		value, ok, err := h.storage.GetSet(ctx, metric.Key())
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			h.logger.Error("cant get set", zap.Error(err))
+			return
+		}
+		if !ok {
+			c.String(http.StatusNotFound, "No such metric")
+			return
+		}
+		metric.Delta = new(int64)
+		*metric.Delta = int64(value.Estimate())
 	default:
 		c.String(http.StatusBadRequest, "No such metric")
 		return
@@ -218,6 +319,132 @@ func (h *MetricsHandler) GetMetricsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, metric)
 }
 
+// maxQueryPoints limits the number of buckets a single range query may produce.
+const maxQueryPoints = 11000
+
+// RangeQueryResult represents a downsampled series returned by the range query endpoint.
+type RangeQueryResult struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Points any       `json:"points"`
+	ID     string    `json:"id"`
+	MType  string    `json:"type"`
+	Step   float64   `json:"step"`
+}
+
+// parseQueryTime parses a unix timestamp in seconds or an RFC3339 time.
+func parseQueryTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		sec, frac := math.Modf(seconds)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cant parse time %q: %w", value, err)
+	}
+	return parsed, nil
+}
+
+// parseQueryStep parses a duration like "15s" or a number of seconds.
+func parseQueryStep(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("cant parse step %q: %w", value, err)
+	}
+	return parsed, nil
+}
+
+// QueryRangeHandler handles retrieving a downsampled metric series.
+// @Summary Query Metric Range.
+// @Description Returns time-bucketed samples of a metric: avg/min/max/last for gauges, increase/rate for counters.
+// @Tags Metrics.
+// @Produce json.
+// @Param name query string true "Metric Name, optionally with labels, e.g. Alloc{host=\"a\"}".
+// @Param type query string true "Metric Type".
+// @Param from query string false "Range start, unix seconds or RFC3339 (default: one hour before to)".
+// @Param to query string false "Range end, unix seconds or RFC3339 (default: now)".
+// @Param step query string false "Bucket width, duration or seconds (default: range / 60)".
+// @Success 200 {object} RangeQueryResult.
+// @Failure 400 {string} string "Bad Request".
+// @Router /api/v1/query_range [get].
+func (h *MetricsHandler) QueryRangeHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	name := c.Query("name")
+	if name == "" {
+		c.String(http.StatusBadRequest, "No metric name")
+		return
+	}
+
+	to, err := parseQueryTime(c.Query("to"), time.Now())
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseQueryTime(c.Query("from"), to.Add(-time.Hour))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if !from.Before(to) {
+		c.String(http.StatusBadRequest, "from must be before to")
+		return
+	}
+	step, err := parseQueryStep(c.Query("step"), to.Sub(from)/60)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if step <= 0 {
+		c.String(http.StatusBadRequest, "step must be positive")
+		return
+	}
+	if to.Sub(from)/step > maxQueryPoints {
+		c.String(http.StatusBadRequest, "too many points, increase step")
+		return
+	}
+
+	result := RangeQueryResult{
+		ID:    name,
+		MType: c.Query("type"),
+		From:  from,
+		To:    to,
+		Step:  step.Seconds(),
+	}
+
+	switch result.MType {
+	case "gauge":
+		history, err := h.storage.GetGaugeHistory(ctx, name, from, to)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			h.logger.Error("cant get gauge history", zap.Error(err))
+			return
+		}
+		result.Points = storage.DownsampleGauges(history, from, to, step)
+	case "counter":
+		history, err := h.storage.GetCounterHistory(ctx, name, from, to)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			h.logger.Error("cant get counter history", zap.Error(err))
+			return
+		}
+		result.Points = storage.DownsampleCounters(history, from, to, step)
+	default:
+		c.String(http.StatusBadRequest, "No such metric")
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
 // SetMetricHandler handles setting a single metric.
 // @Summary Set Metric.
 // @Description Sets a single metric.
@@ -240,6 +467,10 @@ func (h *MetricsHandler) SetMetricHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "Bad json")
 		return
 	}
+	if err := metric.validateSeries(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	switch metric.MType {
 	case "gauge":
@@ -247,7 +478,7 @@ func (h *MetricsHandler) SetMetricHandler(c *gin.Context) {
 			c.String(http.StatusBadRequest, "Gauge must be float32")
 			return
 		}
-		if err := h.storage.SetGauge(ctx, metric.ID, storage.Gauge(*metric.Value)); err != nil {
+		if err := h.storage.SetGauge(ctx, metric.Key(), storage.Gauge(*metric.Value)); err != nil {
 			c.String(http.StatusInternalServerError, err.Error())
 			h.logger.Error("cant set gauge", zap.Error(err))
 			return
@@ -257,11 +488,40 @@ func (h *MetricsHandler) SetMetricHandler(c *gin.Context) {
 			c.String(http.StatusBadRequest, "Counter must be int32")
 			return
 		}
-		if err := h.storage.SetCounter(ctx, metric.ID, storage.Counter(*metric.Delta)); err != nil {
+		if err := h.storage.SetCounter(ctx, metric.Key(), storage.Counter(*metric.Delta)); err != nil {
 			c.String(http.StatusInternalServerError, err.Error())
 			h.logger.Error("cant set counter", zap.Error(err))
 			return
 		}
+	case "histogram":
+		if metric.Histogram == nil {
+			c.String(http.StatusBadRequest, "Histogram must have buckets")
+			return
+		}
+		if err := metric.Histogram.Validate(); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.storage.SetHistogram(ctx, metric.Key(), metric.Histogram); err != nil {
+			if errors.Is(err, storage.ErrBucketsMismatch) {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			c.String(http.StatusInternalServerError, err.Error())
+			h.logger.Error("cant set histogram", zap.Error(err))
+			return
+		}
+	case "set":
+		sketch, err := metric.setSketch()
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.storage.SetSet(ctx, metric.Key(), sketch); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			h.logger.Error("cant set set", zap.Error(err))
+			return
+		}
 	default:
 		c.String(http.StatusBadRequest, "No such metric")
 		return
@@ -271,14 +531,19 @@ func (h *MetricsHandler) SetMetricHandler(c *gin.Context) {
 }
 
 // SetMetricsHandler handles setting multiple metrics in a batch.
+// A batch sent with an X-Batch-ID header is applied once, deliveries of the same ID within the batch window
+// are acknowledged without being applied again, and a delivery arriving while the batch is still being applied
+// gets 409 Conflict, to be retried later.
 // @Summary Set Metrics Batch.
 // @Description Sets multiple metrics in a batch.
 // @Tags Metrics.
 // @Accept json.
 // @Produce json.
+// @Param X-Batch-ID header string false "Batch ID".
 // @Param metrics body []Metric true "Metrics Batch".
 // @Success 200 {array} Metric.
 // @Failure 400 {string} string "Bad Request".
+// @Failure 409 {string} string "Batch is being applied".
 // @Router /updates [post].
 func (h *MetricsHandler) SetMetricsHandler(c *gin.Context) {
 	ctx := c.Request.Context()
@@ -294,46 +559,114 @@ func (h *MetricsHandler) SetMetricsHandler(c *gin.Context) {
 		return
 	}
 
+	if err := h.ApplyMetrics(ctx, c.GetHeader(batchIDHeader), metrics); err != nil {
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) || errors.Is(err, storage.ErrBucketsMismatch) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if errors.Is(err, storage.ErrBatchInFlight) {
+			c.String(http.StatusConflict, err.Error())
+			return
+		}
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant apply metrics batch.", zap.Error(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, metrics)
+}
+
+// ValidationError reports a metrics batch that cannot be applied because of its content.
+type ValidationError struct {
+	msg string
+}
+
+func (e *ValidationError) Error() string {
+	return e.msg
+}
+
+func validationErrorf(format string, args ...any) error {
+	return &ValidationError{msg: fmt.Sprintf(format, args...)}
+}
+
+// ApplyMetrics validates a metrics batch and applies it to the storage.
+// A batch with a non-empty batch ID is applied once, deliveries of the same ID within the batch window
+// are accepted without being applied again.
+// It returns a *ValidationError for invalid metrics, storage.ErrBucketsMismatch for histograms
+// that do not match the stored buckets, and storage.ErrBatchInFlight while another delivery of the batch ID
+// is being applied.
+func (h *MetricsHandler) ApplyMetrics(ctx context.Context, batchID string, metrics []Metric) error {
 	gaugeMetrics := make(map[string]storage.Gauge)
 	counterMetrics := make(map[string]storage.Counter)
+	histogramMetrics := make(map[string]*storage.Histogram)
+	setMetrics := make(map[string]*storage.HyperLogLog)
 
 	for _, metric := range metrics {
+		if err := metric.validateSeries(); err != nil {
+			return validationErrorf("Metric %s: %v.", metric.ID, err)
+		}
+
 		switch metric.MType {
 		case "gauge":
 			if metric.Value == nil {
-				c.String(http.StatusBadRequest, fmt.Sprintf("Gauge %s must be float32.", metric.ID))
-				return
+				return validationErrorf("Gauge %s must be float32.", metric.ID)
 			}
-			gaugeMetrics[metric.ID] = storage.Gauge(*metric.Value)
+			gaugeMetrics[metric.Key()] = storage.Gauge(*metric.Value)
 		case "counter":
 			if metric.Delta == nil {
-				c.String(http.StatusBadRequest, fmt.Sprintf("Counter %s must be int32.", metric.ID))
-				return
+				return validationErrorf("Counter %s must be int32.", metric.ID)
+			}
+			counterMetrics[metric.Key()] += storage.Counter(*metric.Delta)
+		case "histogram":
+			if metric.Histogram == nil {
+				return validationErrorf("Histogram %s must have buckets.", metric.ID)
+			}
+			if err := metric.Histogram.Validate(); err != nil {
+				return validationErrorf("Histogram %s: %v.", metric.ID, err)
+			}
+			current, ok := histogramMetrics[metric.Key()]
+			if !ok {
+				histogramMetrics[metric.Key()] = metric.Histogram.Clone()
+				continue
+			}
+			if err := current.Merge(metric.Histogram); err != nil {
+				return validationErrorf("Histogram %s: %v.", metric.ID, err)
+			}
+		case "set":
+			sketch, err := metric.setSketch()
+			if err != nil {
+				return validationErrorf("Set %s: %v.", metric.ID, err)
+			}
+			current, ok := setMetrics[metric.Key()]
+			if !ok {
+				setMetrics[metric.Key()] = sketch
+				continue
+			}
+			if err := current.Merge(sketch); err != nil {
+				return validationErrorf("Set %s: %v.", metric.ID, err)
 			}
-			counterMetrics[metric.ID] += storage.Counter(*metric.Delta)
 		default:
-			c.String(http.StatusBadRequest, fmt.Sprintf("No metric %s type.", metric.ID))
-			return
+			return validationErrorf("No metric %s type.", metric.ID)
 		}
 	}
 
-	if len(gaugeMetrics) > 0 {
-		if err := h.storage.SetGauges(ctx, gaugeMetrics); err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			h.logger.Error("cant set gauges.", zap.Error(err))
-			return
-		}
+	if len(batchID) > maxBatchIDLength {
+		return validationErrorf("Batch ID must be at most %d bytes.", maxBatchIDLength)
 	}
-
-	if len(counterMetrics) > 0 {
-		if err := h.storage.SetCounters(ctx, counterMetrics); err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			h.logger.Error("cant set counters.", zap.Error(err))
-			return
-		}
+	applied, err := h.storage.ApplyBatch(ctx, batchID, time.Duration(h.batchWindow.Load()), &storage.Batch{
+		Gauges:     gaugeMetrics,
+		Counters:   counterMetrics,
+		Histograms: histogramMetrics,
+		Sets:       setMetrics,
+	})
+	if err != nil {
+		return fmt.Errorf("cant apply batch: %w", err)
 	}
-
-	c.JSON(http.StatusOK, metrics)
+	if !applied {
+		h.logger.Info("Skipped duplicate metrics batch.", zap.String("batch_id", batchID))
+	}
+	return nil
 }
 
 // GetMetricsReportHandler handles generating an HTML report of all metrics.
@@ -401,6 +734,201 @@ func (h *MetricsHandler) GetMetricsReportHandler(c *gin.Context) {
 	}
 }
 
+// DeleteMetricHandler handles deleting a single metric.
+// @Summary Delete Metric.
+// @Description Deletes a metric and its history by type and name, labeled series are addressed by their series key.
+// @Tags Metrics.
+// @Param metricType path string true "Metric Type".
+// @Param metricName path string true "Metric Name, e.g. Alloc{host=\"a\"}".
+// @Success 200 {string} string "OK".
+// @Failure 400 {string} string "Bad Request".
+// @Failure 404 {string} string "Not Found".
+// @Router /value/{metricType}/{metricName} [delete].
+func (h *MetricsHandler) DeleteMetricHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	metricName := c.Param("metricName")
+	if metricName == "" {
+		c.String(http.StatusNotFound, "No metric name")
+		return
+	}
+
+	var deleted bool
+	var err error
+	switch c.Param("metricType") {
+	case "gauge":
+		deleted, err = h.storage.DeleteGauge(ctx, metricName)
+	case "counter":
+		deleted, err = h.storage.DeleteCounter(ctx, metricName)
+	case "histogram":
+		deleted, err = h.storage.DeleteHistogram(ctx, metricName)
+	case "set":
+		deleted, err = h.storage.DeleteSet(ctx, metricName)
+	default:
+		c.String(http.StatusBadRequest, "No such metric")
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant delete metric", zap.Error(err))
+		return
+	}
+	if !deleted {
+		c.String(http.StatusNotFound, "No such metric")
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// DeleteMetricsResult reports the number of series removed by a batch delete.
+type DeleteMetricsResult struct {
+	Deleted int `json:"deleted"`
+}
+
+// DeleteMetricsHandler handles deleting all metrics selected by a filter.
+// @Summary Delete Metrics Batch.
+// @Description Deletes metrics matching a name glob and/or labels, e.g. all series of a decommissioned host.
+// @Tags Metrics.
+// @Accept json.
+// @Produce json.
+// @Param filter body storage.MetricFilter true "Metrics Filter".
+// @Success 200 {object} DeleteMetricsResult.
+// @Failure 400 {string} string "Bad Request".
+// @Router /values [delete].
+func (h *MetricsHandler) DeleteMetricsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var filter storage.MetricFilter
+	if err := c.ShouldBindJSON(&filter); err != nil {
+		c.String(http.StatusBadRequest, "Bad json")
+		return
+	}
+	if err := filter.Labels.Validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	switch filter.Type {
+	case "", "gauge", "counter", "histogram", "set":
+	default:
+		c.String(http.StatusBadRequest, "No such metric")
+		return
+	}
+	if filter.IsEmpty() {
+		c.String(http.StatusBadRequest, "Filter must select by name pattern or labels")
+		return
+	}
+
+	deleted, err := h.storage.DeleteMetrics(ctx, filter)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant delete metrics.", zap.Error(err))
+		return
+	}
+	h.logger.Info("Deleted metrics.",
+		zap.String("pattern", filter.Pattern),
+		zap.String("labels", filter.Labels.String()),
+		zap.Int("deleted", deleted),
+	)
+
+	c.JSON(http.StatusOK, DeleteMetricsResult{Deleted: deleted})
+}
+
+// Source summarizes the series reported by one agent, identified by its host and instance labels.
+type Source struct {
+	Host       string `json:"host"`
+	Instance   string `json:"instance,omitempty"`
+	Gauges     int    `json:"gauges"`
+	Counters   int    `json:"counters"`
+	Histograms int    `json:"histograms"`
+	Sets       int    `json:"sets"`
+}
+
+// GetSourcesHandler handles listing the sources that reported metrics.
+// @Summary Get Sources.
+// @Description Lists agents that reported labeled metrics with the number of series per type.
+// @Tags Metrics.
+// @Produce json.
+// @Success 200 {array} Source.
+// @Router /api/v1/sources [get].
+func (h *MetricsHandler) GetSourcesHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	gauges, err := h.storage.GetGauges(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant get gauges.", zap.Error(err))
+		return
+	}
+
+	counters, err := h.storage.GetCounters(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant get counters.", zap.Error(err))
+		return
+	}
+
+	histograms, err := h.storage.GetHistograms(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant get histograms.", zap.Error(err))
+		return
+	}
+
+	sets, err := h.storage.GetSets(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant get sets.", zap.Error(err))
+		return
+	}
+
+	sources := make(map[[2]string]*Source)
+	source := func(key string) *Source {
+		_, labels := storage.ParseSeriesKey(key)
+		host, instance := labels[storage.LabelHost], labels[storage.LabelInstance]
+		if host == "" && instance == "" {
+			return nil
+		}
+		id := [2]string{host, instance}
+		if _, ok := sources[id]; !ok {
+			sources[id] = &Source{Host: host, Instance: instance}
+		}
+		return sources[id]
+	}
+
+	for key := range gauges {
+		if src := source(key); src != nil {
+			src.Gauges++
+		}
+	}
+	for key := range counters {
+		if src := source(key); src != nil {
+			src.Counters++
+		}
+	}
+	for key := range histograms {
+		if src := source(key); src != nil {
+			src.Histograms++
+		}
+	}
+	for key := range sets {
+		if src := source(key); src != nil {
+			src.Sets++
+		}
+	}
+
+	result := make([]Source, 0, len(sources))
+	for _, src := range sources {
+		result = append(result, *src)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Host != result[j].Host {
+			return result[i].Host < result[j].Host
+		}
+		return result[i].Instance < result[j].Instance
+	})
+
+	c.JSON(http.StatusOK, result)
+}
+
 // PingHandler handles health checks.
 // @Summary Ping.
 // @Description Health check endpoint.
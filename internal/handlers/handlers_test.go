@@ -4,13 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"metrics/internal/remotewrite"
 	"metrics/internal/storage"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
@@ -46,6 +55,13 @@ func TestSetGaugeMetricHandler(t *testing.T) {
 			expectedCode: http.StatusNotFound,
 			expectError:  true,
 		},
+		{
+			name:         "series key as metric name",
+			metricName:   url.PathEscape(`testMetric{host="victim"}`),
+			metricValue:  "123.45",
+			expectedCode: http.StatusBadRequest,
+			expectError:  true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -285,6 +301,61 @@ func TestSetMetricHandlers(t *testing.T) {
 				assert.Equal(t, storage.Counter(10), counter)
 			},
 		},
+		{
+			name: "labeled metrics batch",
+			url:  "/updates/",
+			body: func() []byte {
+				b, _ := json.Marshal([]Metric{
+					{ID: "Alloc", MType: "gauge", Labels: storage.Labels{"host": "a"}, Value: func() *float64 { v := 1.0; return &v }()},
+					{ID: "Alloc", MType: "gauge", Labels: storage.Labels{"host": "b"}, Value: func() *float64 { v := 2.0; return &v }()},
+				})
+				return b
+			}(),
+			contentType:  "application/json",
+			expectedCode: http.StatusOK,
+			verify: func(t *testing.T) {
+				t.Helper()
+				value, ok, _ := mockStorage.GetGauge(context.Background(), `Alloc{host="a"}`)
+				assert.True(t, ok)
+				assert.Equal(t, storage.Gauge(1), value)
+
+				value, ok, _ = mockStorage.GetGauge(context.Background(), `Alloc{host="b"}`)
+				assert.True(t, ok)
+				assert.Equal(t, storage.Gauge(2), value)
+			},
+		},
+		{
+			name: "invalid label name",
+			url:  "/update/",
+			body: func() []byte {
+				b, _ := json.Marshal(Metric{
+					ID: "Alloc", MType: "gauge", Labels: storage.Labels{"bad-name": "a"},
+					Value: func() *float64 { v := 1.0; return &v }(),
+				})
+				return b
+			}(),
+			contentType:  "application/json",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "invalid label name",
+		},
+		{
+			name: "series key as metric id",
+			url:  "/updates/",
+			body: func() []byte {
+				b, _ := json.Marshal([]Metric{{
+					ID: `Alloc{host="victim"}`, MType: "gauge", Value: func() *float64 { v := 1.0; return &v }(),
+				}})
+				return b
+			}(),
+			contentType:  "application/json",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "invalid metric name",
+			verify: func(t *testing.T) {
+				t.Helper()
+				value, _, _ := mockStorage.GetGauge(context.Background(), `Alloc{host="victim"}`)
+				assert.NotEqual(t, storage.Gauge(1), value, "the series of another source must not be written")
+			},
+		},
 		{
 			name:         "invalid JSON",
 			url:          "/update/",
@@ -474,6 +545,510 @@ func TestGetMetricsReportHandler(t *testing.T) {
 	assert.Equal(t, expectedHTML, actualHTML, "HTML output mismatch")
 }
 
+func TestQueryRangeHandler(t *testing.T) {
+	mockStorage := storage.NewMemStorageWithHistory(storage.DefaultHistorySize)
+	logger := zap.NewNop()
+	handler := NewMetricsHandler(mockStorage, logger)
+
+	from := time.Now().Add(-time.Second)
+	for _, value := range []storage.Gauge{1, 2, 3} {
+		if err := mockStorage.SetGauge(context.TODO(), "gauge1", value); err != nil {
+			t.Fatalf("Failed to set gauge: %v", err)
+		}
+	}
+	if err := mockStorage.SetCounter(context.TODO(), "counter1", 10); err != nil {
+		t.Fatalf("Failed to set counter: %v", err)
+	}
+	to := time.Now().Add(time.Second)
+
+	router := gin.Default()
+	router.GET("/api/v1/query_range", handler.QueryRangeHandler)
+
+	query := func(params url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+params.Encode(), http.NoBody)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	unix := func(ts time.Time) string {
+		return strconv.FormatInt(ts.Unix(), 10)
+	}
+
+	t.Run("gauge", func(t *testing.T) {
+		w := query(url.Values{
+			"name": {"gauge1"}, "type": {"gauge"},
+			"from": {from.Format(time.RFC3339Nano)}, "to": {to.Format(time.RFC3339Nano)}, "step": {"1h"},
+		})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Points []storage.GaugeBucket `json:"points"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Len(t, response.Points, 1)
+		assert.Equal(t, 2.0, response.Points[0].Avg)
+		assert.Equal(t, storage.Gauge(1), response.Points[0].Min)
+		assert.Equal(t, storage.Gauge(3), response.Points[0].Max)
+		assert.Equal(t, storage.Gauge(3), response.Points[0].Last)
+	})
+
+	t.Run("counter", func(t *testing.T) {
+		w := query(url.Values{
+			"name": {"counter1"}, "type": {"counter"},
+			"from": {unix(from)}, "to": {unix(to.Add(time.Second))}, "step": {"3600"},
+		})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Points []storage.CounterBucket `json:"points"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Len(t, response.Points, 1)
+		assert.Equal(t, storage.Counter(10), response.Points[0].Increase)
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, query(url.Values{"type": {"gauge"}}).Code)
+		assert.Equal(t, http.StatusBadRequest, query(url.Values{"name": {"gauge1"}, "type": {"unknown"}}).Code)
+		assert.Equal(t, http.StatusBadRequest, query(url.Values{"name": {"gauge1"}, "type": {"gauge"}, "step": {"bad"}}).Code)
+		assert.Equal(t, http.StatusBadRequest, query(url.Values{"name": {"gauge1"}, "type": {"gauge"}, "step": {"1ns"}}).Code)
+		assert.Equal(t, http.StatusBadRequest, query(url.Values{
+			"name": {"gauge1"}, "type": {"gauge"}, "from": {unix(to)}, "to": {unix(from)},
+		}).Code)
+	})
+}
+
+func TestGetPrometheusMetricsHandler(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	logger := zap.NewNop()
+	handler := NewMetricsHandler(mockStorage, logger)
+
+	if err := mockStorage.SetGauges(context.TODO(), map[string]storage.Gauge{
+		"gauge1":      123.45,
+		"cpu.usage-1": 0.5,
+		"1st":         1,
+		storage.SeriesKey("Alloc", storage.Labels{"host": "b"}):              2,
+		storage.SeriesKey("Alloc", storage.Labels{"host": "a", "dc": `x"y`}): 1,
+	}); err != nil {
+		t.Fatalf("Failed to set gauges: %v", err)
+	}
+	if err := mockStorage.SetCounters(context.TODO(), map[string]storage.Counter{
+		"counter1": 10,
+		"gauge1":   1,
+	}); err != nil {
+		t.Fatalf("Failed to set counters: %v", err)
+	}
+
+	router := gin.Default()
+	router.GET("/metrics", handler.GetPrometheusMetricsHandler)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	expected := `# TYPE Alloc gauge
+Alloc{dc="x\"y",host="a"} 1
+Alloc{host="b"} 2
+# TYPE _1st gauge
+_1st 1
+# TYPE counter1 counter
+counter1 10
+# TYPE cpu_usage_1 gauge
+cpu_usage_1 0.5
+# TYPE gauge1 gauge
+gauge1 123.45
+`
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, expected, w.Body.String())
+}
+
+func TestRemoteWriteHandler(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	logger := zap.NewNop()
+	handler := NewMetricsHandler(mockStorage, logger)
+
+	router := gin.Default()
+	router.POST("/api/v1/write", handler.RemoteWriteHandler)
+
+	write := func(req *remotewrite.WriteRequest) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(remotewrite.Encode(req)))
+		r.Header.Set("Content-Type", "application/x-protobuf")
+		r.Header.Set("Content-Encoding", "snappy")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	series := func(name string, value float64, labels ...remotewrite.Label) remotewrite.TimeSeries {
+		return remotewrite.TimeSeries{
+			Labels:  append([]remotewrite.Label{{Name: remotewrite.NameLabel, Value: name}}, labels...),
+			Samples: []remotewrite.Sample{{Value: value, Timestamp: time.Now().UnixMilli()}},
+		}
+	}
+
+	assert.Equal(t, http.StatusNoContent, write(&remotewrite.WriteRequest{
+		Timeseries: []remotewrite.TimeSeries{
+			series("temperature", 21.5),
+			series("requests_total", 10, remotewrite.Label{Name: "instance", Value: "a"}),
+			series("requests_total", 5, remotewrite.Label{Name: "instance", Value: "b"}),
+			series("errors", 3),
+		},
+		Metadata: []remotewrite.Metadata{{FamilyName: "errors", Type: remotewrite.TypeCounter}},
+	}))
+
+	gauge, ok, _ := mockStorage.GetGauge(context.Background(), "temperature")
+	assert.True(t, ok)
+	assert.Equal(t, storage.Gauge(21.5), gauge)
+
+	instanceA := storage.SeriesKey("requests_total", storage.Labels{"instance": "a"})
+	instanceB := storage.SeriesKey("requests_total", storage.Labels{"instance": "b"})
+
+	counter, _, _ := mockStorage.GetCounter(context.Background(), instanceA)
+	assert.Equal(t, storage.Counter(10), counter)
+
+	counter, _, _ = mockStorage.GetCounter(context.Background(), instanceB)
+	assert.Equal(t, storage.Counter(5), counter)
+
+	counter, _, _ = mockStorage.GetCounter(context.Background(), "errors")
+	assert.Equal(t, storage.Counter(3), counter)
+
+	assert.Equal(t, http.StatusNoContent, write(&remotewrite.WriteRequest{
+		Timeseries: []remotewrite.TimeSeries{
+			series("requests_total", 14, remotewrite.Label{Name: "instance", Value: "a"}),
+			series("requests_total", 2, remotewrite.Label{Name: "instance", Value: "b"}),
+		},
+	}))
+
+	counter, _, _ = mockStorage.GetCounter(context.Background(), instanceA)
+	assert.Equal(t, storage.Counter(10+4), counter, "increase should be applied")
+
+	counter, _, _ = mockStorage.GetCounter(context.Background(), instanceB)
+	assert.Equal(t, storage.Counter(5+2), counter, "reset should be applied")
+
+	assert.Equal(t, http.StatusNoContent, write(&remotewrite.WriteRequest{
+		Timeseries: []remotewrite.TimeSeries{
+			series(`temperature{instance="a"}`, 99),
+			series("temperature", 99, remotewrite.Label{Name: "__replica__", Value: "a"}),
+		},
+	}))
+	gauge, _, _ = mockStorage.GetGauge(context.Background(), "temperature")
+	assert.Equal(t, storage.Gauge(21.5), gauge, "invalid series must be skipped")
+	_, ok, _ = mockStorage.GetGauge(context.Background(), `temperature{instance="a"}`)
+	assert.False(t, ok, "invalid series must be skipped")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader([]byte("garbage")))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRemoteWriteHandler_TooLarge(t *testing.T) {
+	handler := NewMetricsHandler(storage.NewMemStorage(), zap.NewNop())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/v1/write", handler.RemoteWriteHandler)
+
+	post := func(body []byte) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(make([]byte, maxRemoteWriteBodySize+1)))
+	// A small body must not decompress into an unbounded allocation.
+	bomb := snappy.Encode(nil, make([]byte, remotewrite.MaxDecodedSize+1))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(bomb))
+}
+
+func TestCumulativeTracker(t *testing.T) {
+	tracker := newCumulativeTracker()
+	now := time.Now()
+	stored := func(string) (bool, error) { return false, nil }
+	var total storage.Counter
+	set := func(counters map[string]storage.Counter) error {
+		total += counters["requests_total"]
+		return nil
+	}
+	failing := func(map[string]storage.Counter) error { return errors.New("storage is down") }
+	samples := func(value float64) map[string]float64 { return map[string]float64{"requests_total": value} }
+
+	assert.NoError(t, tracker.apply(samples(10), now, stored, set))
+	assert.Equal(t, storage.Counter(10), total)
+
+	assert.Error(t, tracker.apply(samples(15), now, stored, failing))
+	assert.NoError(t, tracker.apply(samples(15), now, stored, set))
+	assert.Equal(t, storage.Counter(15), total, "a failed write must not advance the baseline")
+
+	assert.NoError(t, tracker.apply(samples(3), now, stored, set))
+	assert.Equal(t, storage.Counter(18), total, "reset should be applied")
+
+	assert.NoError(t, tracker.apply(map[string]float64{"other_total": 1}, now.Add(cumulativeIdleTimeout), stored, set))
+	assert.NotContains(t, tracker.last, "requests_total", "idle series must be forgotten")
+	assert.Contains(t, tracker.last, "other_total")
+}
+
+func TestDeleteMetricHandler(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	logger := zap.NewNop()
+	handler := NewMetricsHandler(mockStorage, logger)
+
+	key := storage.SeriesKey("Alloc", storage.Labels{"host": "a"})
+	if err := mockStorage.SetGauge(context.TODO(), key, 1); err != nil {
+		t.Fatalf("Failed to set gauge: %v", err)
+	}
+	if err := mockStorage.SetCounter(context.TODO(), "PollCount", 1); err != nil {
+		t.Fatalf("Failed to set counter: %v", err)
+	}
+
+	router := gin.Default()
+	router.DELETE("/value/:metricType/:metricName", handler.DeleteMetricHandler)
+
+	testCases := []struct {
+		name         string
+		url          string
+		expectedCode int
+	}{
+		{name: "labeled gauge", url: "/value/gauge/" + url.PathEscape(key), expectedCode: http.StatusOK},
+		{name: "deleted gauge", url: "/value/gauge/" + url.PathEscape(key), expectedCode: http.StatusNotFound},
+		{name: "counter", url: "/value/counter/PollCount", expectedCode: http.StatusOK},
+		{name: "missing histogram", url: "/value/histogram/latency", expectedCode: http.StatusNotFound},
+		{name: "unknown type", url: "/value/unknown/PollCount", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, tc.url, http.NoBody)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code)
+		})
+	}
+
+	gauges, _ := mockStorage.GetGauges(context.TODO())
+	counters, _ := mockStorage.GetCounters(context.TODO())
+	assert.Empty(t, gauges)
+	assert.Empty(t, counters)
+}
+
+func TestDeleteMetricsHandler(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	logger := zap.NewNop()
+	handler := NewMetricsHandler(mockStorage, logger)
+
+	if err := mockStorage.SetGauges(context.TODO(), map[string]storage.Gauge{
+		storage.SeriesKey("Alloc", storage.Labels{"host": "old"}): 1,
+		storage.SeriesKey("Alloc", storage.Labels{"host": "new"}): 1,
+	}); err != nil {
+		t.Fatalf("Failed to set gauges: %v", err)
+	}
+	if err := mockStorage.SetCounters(context.TODO(), map[string]storage.Counter{
+		storage.SeriesKey("PollCount", storage.Labels{"host": "old"}): 1,
+	}); err != nil {
+		t.Fatalf("Failed to set counters: %v", err)
+	}
+
+	router := gin.Default()
+	router.DELETE("/values", handler.DeleteMetricsHandler)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/values", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, send(`{"pattern": "*"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send(`{"pattern": "A*", "type": "unknown"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send(`{"labels": {"__name__": "x"}}`).Code)
+
+	w := send(`{"labels": {"host": "old"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"deleted": 2}`, w.Body.String())
+
+	gauges, _ := mockStorage.GetGauges(context.TODO())
+	assert.Equal(t, map[string]storage.Gauge{storage.SeriesKey("Alloc", storage.Labels{"host": "new"}): 1}, gauges)
+}
+
+func TestGetSourcesHandler(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	logger := zap.NewNop()
+	handler := NewMetricsHandler(mockStorage, logger)
+
+	if err := mockStorage.SetGauges(context.TODO(), map[string]storage.Gauge{
+		storage.SeriesKey("Alloc", storage.Labels{"host": "b", "instance": "1"}): 1,
+		storage.SeriesKey("Alloc", storage.Labels{"host": "a", "instance": "1"}): 1,
+		storage.SeriesKey("Sys", storage.Labels{"host": "a", "instance": "1"}):   1,
+		"Unlabeled": 1,
+	}); err != nil {
+		t.Fatalf("Failed to set gauges: %v", err)
+	}
+	if err := mockStorage.SetCounters(context.TODO(), map[string]storage.Counter{
+		storage.SeriesKey("PollCount", storage.Labels{"host": "a", "instance": "1"}): 1,
+	}); err != nil {
+		t.Fatalf("Failed to set counters: %v", err)
+	}
+
+	router := gin.Default()
+	router.GET("/api/v1/sources", handler.GetSourcesHandler)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/sources", http.NoBody)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var sources []Source
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&sources))
+	assert.Equal(t, []Source{
+		{Host: "a", Instance: "1", Gauges: 2, Counters: 1},
+		{Host: "b", Instance: "1", Gauges: 1},
+	}, sources)
+}
+
+func TestHistogramHandlers(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	logger := zap.NewNop()
+	handler := NewMetricsHandler(mockStorage, logger)
+
+	router := gin.Default()
+	router.POST("/update/", handler.SetMetricHandler)
+	router.POST("/updates/", handler.SetMetricsHandler)
+	router.POST("/value/", handler.GetMetricsHandler)
+
+	histogram := func(values ...float64) *storage.Histogram {
+		h := storage.NewHistogram([]float64{0.1, 1})
+		for _, v := range values {
+			h.Observe(v)
+		}
+		return h
+	}
+	post := func(url string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/updates/", []Metric{
+		{ID: "latency", MType: "histogram", Histogram: histogram(0.05)},
+		{ID: "latency", MType: "histogram", Histogram: histogram(0.5, 2)},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = post("/update/", Metric{ID: "latency", MType: "histogram", Histogram: histogram(0.5)})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = post("/update/", Metric{ID: "latency", MType: "histogram", Histogram: storage.NewHistogram([]float64{5})})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post("/update/", Metric{ID: "latency", MType: "histogram"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	invalid := histogram(0.5)
+	invalid.Count = 5
+	w = post("/updates/", []Metric{{ID: "latency", MType: "histogram", Histogram: invalid}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post("/value/", Metric{ID: "latency", MType: "histogram"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var metric Metric
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&metric))
+	assert.Equal(t, &storage.Histogram{
+		Bounds: []float64{0.1, 1},
+		Counts: []uint64{1, 2, 1},
+		Sum:    3.05,
+		Count:  4,
+	}, metric.Histogram)
+}
+
+func TestSetHandlers(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	logger := zap.NewNop()
+	handler := NewMetricsHandler(mockStorage, logger)
+
+	router := gin.Default()
+	router.POST("/update/", handler.SetMetricHandler)
+	router.POST("/updates/", handler.SetMetricsHandler)
+	router.POST("/value/", handler.GetMetricsHandler)
+
+	post := func(url string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	agentSketch := storage.NewHyperLogLog()
+	agentSketch.Add("carol")
+	agentSketch.Add("alice")
+
+	w := post("/updates/", []Metric{
+		{ID: "users", MType: "set", Members: []string{"alice", "bob"}},
+		{ID: "users", MType: "set", Members: []string{"bob"}, Set: agentSketch},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = post("/update/", Metric{ID: "users", MType: "set", Members: []string{"dave"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = post("/update/", Metric{ID: "users", MType: "set"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post("/updates/", []Metric{{ID: "users", MType: "set", Set: &storage.HyperLogLog{Registers: []byte{1}}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post("/value/", Metric{ID: "users", MType: "set"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var metric Metric
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&metric))
+	if assert.NotNil(t, metric.Delta) {
+		assert.Equal(t, int64(4), *metric.Delta)
+	}
+}
+
+func TestGetPrometheusMetricsHandler_Histogram(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	logger := zap.NewNop()
+	handler := NewMetricsHandler(mockStorage, logger)
+
+	latency := storage.NewHistogram([]float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(2)
+	key := storage.SeriesKey("latency", storage.Labels{"host": "a"})
+	if err := mockStorage.SetHistogram(context.TODO(), key, latency); err != nil {
+		t.Fatalf("Failed to set histogram: %v", err)
+	}
+
+	router := gin.Default()
+	router.GET("/metrics", handler.GetPrometheusMetricsHandler)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	expected := `# TYPE latency histogram
+latency_bucket{host="a",le="0.1"} 1
+latency_bucket{host="a",le="1"} 2
+latency_bucket{host="a",le="+Inf"} 3
+latency_sum{host="a"} 2.55
+latency_count{host="a"} 3
+`
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, expected, w.Body.String())
+}
+
 func TestPingHandler(t *testing.T) {
 	mockStorage := storage.NewMemStorage()
 	logger := zap.NewNop()
@@ -488,3 +1063,176 @@ func TestPingHandler(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, w.Code)
 }
+
+func updatesBody(metrics int) []byte {
+	batch := make([]Metric, 0, 2*metrics)
+	delta := int64(1)
+	value := 1.5
+	for i := 0; i < metrics; i++ {
+		batch = append(batch,
+			Metric{ID: "counter" + strconv.Itoa(i), MType: "counter", Delta: &delta},
+			Metric{ID: "gauge" + strconv.Itoa(i), MType: "gauge", Value: &value},
+		)
+	}
+	body, _ := json.Marshal(batch)
+	return body
+}
+
+func TestSetMetricsHandler_Concurrent(t *testing.T) {
+	mockStorage := storage.NewMemStorageWithHistory(storage.DefaultHistorySize)
+	handler := NewMetricsHandler(mockStorage, zap.NewNop())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/updates/", handler.SetMetricsHandler)
+	router.POST("/value/", handler.GetMetricsHandler)
+	router.GET("/metrics", handler.GetPrometheusMetricsHandler)
+
+	const workers = 8
+	const requests = 50
+	body := updatesBody(10)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				assert.Equal(t, http.StatusOK, w.Code)
+
+				req = httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				assert.Equal(t, http.StatusOK, w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	counters, err := mockStorage.GetCounters(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, counters, 10)
+	for _, value := range counters {
+		assert.Equal(t, storage.Counter(workers*requests), value)
+	}
+}
+
+func BenchmarkSetMetricsHandler_Parallel(b *testing.B) {
+	mockStorage := storage.NewMemStorageWithHistory(storage.DefaultHistorySize)
+	handler := NewMetricsHandler(mockStorage, zap.NewNop())
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.POST("/updates/", handler.SetMetricsHandler)
+
+	body := updatesBody(30)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				b.Fatalf("unexpected status %d", w.Code)
+			}
+		}
+	})
+}
+
+func TestSetMetricsHandler_BatchID(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(mockStorage, zap.NewNop())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/updates/", handler.SetMetricsHandler)
+
+	post := func(batchID string, body []byte) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if batchID != "" {
+			req.Header.Set(batchIDHeader, batchID)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	counter := func() storage.Counter {
+		value, _, err := mockStorage.GetCounter(context.Background(), "counter0")
+		assert.NoError(t, err)
+		return value
+	}
+
+	body := updatesBody(1)
+
+	assert.Equal(t, http.StatusOK, post("batch-1", body))
+	assert.Equal(t, http.StatusOK, post("batch-1", body))
+	assert.Equal(t, storage.Counter(1), counter(), "duplicate batch must be applied once")
+
+	assert.Equal(t, http.StatusOK, post("batch-2", body))
+	assert.Equal(t, storage.Counter(2), counter())
+
+	assert.Equal(t, http.StatusOK, post("", body))
+	assert.Equal(t, http.StatusOK, post("", body))
+	assert.Equal(t, storage.Counter(4), counter(), "batches without ID are always applied")
+
+	assert.Equal(t, http.StatusBadRequest, post(strings.Repeat("x", maxBatchIDLength+1), body))
+	assert.Equal(t, storage.Counter(4), counter())
+}
+
+func TestSetMetricsHandler_BatchIDReleasedOnFailure(t *testing.T) {
+	mockStorage := storage.NewMemStorage()
+	handler := NewMetricsHandler(mockStorage, zap.NewNop())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/updates/", handler.SetMetricsHandler)
+
+	post := func(batchID, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(batchIDHeader, batchID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	histogram := `[{"id":"latency","type":"histogram","histogram":{"bounds":[%d],"counts":[1,0],"sum":0.5,"count":1}}]`
+	assert.Equal(t, http.StatusOK, post("batch-1", fmt.Sprintf(histogram, 1)))
+	// Mismatched buckets fail in storage, after the batch ID was claimed.
+	assert.Equal(t, http.StatusBadRequest, post("batch-2", fmt.Sprintf(histogram, 2)))
+
+	applied, err := mockStorage.ApplyBatch(context.Background(), "batch-2", time.Hour, &storage.Batch{})
+	assert.NoError(t, err)
+	assert.True(t, applied, "failed batch must be released")
+}
+
+// inFlightStorage reports every batch as being applied by another delivery.
+type inFlightStorage struct {
+	*storage.MemStorage
+}
+
+func (s inFlightStorage) ApplyBatch(context.Context, string, time.Duration, *storage.Batch) (bool, error) {
+	return false, storage.ErrBatchInFlight
+}
+
+func TestSetMetricsHandler_BatchInFlight(t *testing.T) {
+	handler := NewMetricsHandler(inFlightStorage{storage.NewMemStorage()}, zap.NewNop())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/updates/", handler.SetMetricsHandler)
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(`[{"id":"a","type":"counter","delta":1}]`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(batchIDHeader, "batch-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
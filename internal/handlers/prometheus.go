@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"metrics/internal/storage"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// sanitizePrometheusName replaces characters not allowed in Prometheus metric names with underscores.
+func sanitizePrometheusName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type prometheusSample struct {
+	labels storage.Labels
+	suffix string
+	value  string
+}
+
+type prometheusFamily struct {
+	original string
+	mtype    string
+	samples  []prometheusSample
+}
+
+// prometheusWriter collects series into metric families and renders them
+// in the Prometheus text exposition format.
+type prometheusWriter struct {
+	families map[string]*prometheusFamily
+	logger   *zap.Logger
+}
+
+// family returns the family the series identified by key belongs to along with the series labels.
+// Series whose sanitized name collides with a family of another type are skipped.
+func (w *prometheusWriter) family(key, mtype string) (*prometheusFamily, storage.Labels, bool) {
+	id, labels := storage.ParseSeriesKey(key)
+	name := sanitizePrometheusName(id)
+
+	family, ok := w.families[name]
+	if !ok {
+		family = &prometheusFamily{original: id, mtype: mtype}
+		w.families[name] = family
+	}
+	if family.mtype != mtype {
+		w.logger.Warn("skip metric with conflicting prometheus name",
+			zap.String("name", key),
+			zap.String("conflicts_with", family.original),
+		)
+		return nil, nil, false
+	}
+	return family, labels, true
+}
+
+// add appends a sample of the series identified by key to its family.
+func (w *prometheusWriter) add(key, mtype, value string) {
+	family, labels, ok := w.family(key, mtype)
+	if !ok {
+		return
+	}
+	family.samples = append(family.samples, prometheusSample{labels: labels, value: value})
+}
+
+// addHistogram appends cumulative bucket, sum and count samples of the histogram identified by key.
+func (w *prometheusWriter) addHistogram(key string, histogram *storage.Histogram) {
+	family, labels, ok := w.family(key, "histogram")
+	if !ok {
+		return
+	}
+	var cumulative uint64
+	for i, count := range histogram.Counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(histogram.Bounds) {
+			le = strconv.FormatFloat(histogram.Bounds[i], 'g', -1, 64)
+		}
+		bucketLabels := make(storage.Labels, len(labels)+1)
+		for name, value := range labels {
+			bucketLabels[name] = value
+		}
+		bucketLabels["le"] = le
+		family.samples = append(family.samples, prometheusSample{
+			labels: bucketLabels,
+			suffix: "_bucket",
+			value:  strconv.FormatUint(cumulative, 10),
+		})
+	}
+	family.samples = append(family.samples,
+		prometheusSample{labels: labels, suffix: "_sum", value: strconv.FormatFloat(histogram.Sum, 'g', -1, 64)},
+		prometheusSample{labels: labels, suffix: "_count", value: strconv.FormatUint(histogram.Count, 10)},
+	)
+}
+
+func (w *prometheusWriter) render() []byte {
+	var buf bytes.Buffer
+	for _, name := range sortedKeys(w.families) {
+		family := w.families[name]
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, family.mtype)
+		for _, sample := range family.samples {
+			buf.WriteString(name)
+			buf.WriteString(sample.suffix)
+			writePrometheusLabels(&buf, sample.labels)
+			buf.WriteByte(' ')
+			buf.WriteString(sample.value)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+func writePrometheusLabels(buf *bytes.Buffer, labels storage.Labels) {
+	if len(labels) == 0 {
+		return
+	}
+	buf.WriteByte('{')
+	for i, name := range labels.SortedNames() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(sanitizePrometheusName(name))
+		buf.WriteString(`="`)
+		buf.WriteString(prometheusValueReplacer.Replace(labels[name]))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+}
+
+var prometheusValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// GetPrometheusMetricsHandler handles exposing all metrics in the Prometheus text format.
+// @Summary Get Prometheus Metrics.
+// @Description Returns all metrics in the Prometheus text exposition format.
+// @Tags Metrics.
+// @Produce plain.
+// @Success 200 {string} string "Prometheus metrics".
+// @Router /metrics [get].
+func (h *MetricsHandler) GetPrometheusMetricsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	gauges, err := h.storage.GetGauges(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant get gauges.", zap.Error(err))
+		return
+	}
+
+	counters, err := h.storage.GetCounters(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant get counters.", zap.Error(err))
+		return
+	}
+
+	histograms, err := h.storage.GetHistograms(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant get histograms.", zap.Error(err))
+		return
+	}
+
+	sets, err := h.storage.GetSets(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		h.logger.Error("cant get sets.", zap.Error(err))
+		return
+	}
+
+	w := &prometheusWriter{families: make(map[string]*prometheusFamily), logger: h.logger}
+
+	for _, key := range sortedKeys(gauges) {
+		w.add(key, "gauge", strconv.FormatFloat(float64(gauges[key]), 'g', -1, 64))
+	}
+
+	for _, key := range sortedKeys(counters) {
+		w.add(key, "counter", strconv.FormatInt(int64(counters[key]), 10))
+	}
+
+	for _, key := range sortedKeys(histograms) {
+		w.addHistogram(key, histograms[key])
+	}
+
+	// Sets are exposed as gauges holding the approximate number of distinct members.
+	for _, key := range sortedKeys(sets) {
+		w.add(key, "gauge", strconv.FormatUint(sets[key].Estimate(), 10))
+	}
+
+	c.Data(http.StatusOK, prometheusContentType, w.render())
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"metrics/internal/remotewrite"
+	"metrics/internal/storage"
+)
+
+const (
+	// maxRemoteWriteBodySize is the largest compressed remote-write request accepted.
+	maxRemoteWriteBodySize = 10 << 20
+	// cumulativeIdleTimeout is how long a counter series may go without samples before its baseline is dropped.
+	cumulativeIdleTimeout = time.Hour
+)
+
+// cumulativeSample is the last cumulative value of a series and when it was received.
+type cumulativeSample struct {
+	seen  time.Time
+	value float64
+}
+
+// cumulativeTracker converts cumulative counter samples into increments.
+type cumulativeTracker struct {
+	last  map[string]cumulativeSample
+	swept time.Time
+	mu    sync.Mutex
+}
+
+func newCumulativeTracker() *cumulativeTracker {
+	return &cumulativeTracker{last: make(map[string]cumulativeSample)}
+}
+
+// apply converts the latest cumulative samples of counter series into increments and stores them with set.
+// A decreasing value is treated as a counter reset. The first sample of a series
+// is applied in full unless stored reports the counter already exists, in which case
+// it only becomes the baseline to avoid counting the same total twice after a restart.
+// The samples become the baselines of their series only once set succeeds, so a failed write is counted on retry,
+// and the tracker stays locked until then, so concurrent requests never count the same increment twice.
+// Series without samples for cumulativeIdleTimeout are forgotten.
+func (t *cumulativeTracker) apply(
+	samples map[string]float64,
+	now time.Time,
+	stored func(series string) (bool, error),
+	set func(map[string]storage.Counter) error,
+) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counters := make(map[string]storage.Counter, len(samples))
+	for series, value := range samples {
+		last, ok := t.last[series]
+		switch {
+		case !ok:
+			exists, err := stored(series)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				counters[series] = storage.Counter(math.Floor(value))
+			}
+		case value < last.value:
+			counters[series] = storage.Counter(math.Floor(value))
+		default:
+			counters[series] = storage.Counter(math.Floor(value) - math.Floor(last.value))
+		}
+	}
+
+	if len(counters) > 0 {
+		if err := set(counters); err != nil {
+			return err
+		}
+	}
+	for series, value := range samples {
+		t.last[series] = cumulativeSample{seen: now, value: value}
+	}
+	t.evict(now)
+	return nil
+}
+
+// evict drops the baselines of idle series, scanning them at most once per cumulativeIdleTimeout.
+func (t *cumulativeTracker) evict(now time.Time) {
+	if now.Sub(t.swept) < cumulativeIdleTimeout {
+		return
+	}
+	t.swept = now
+	for series, last := range t.last {
+		if now.Sub(last.seen) >= cumulativeIdleTimeout {
+			delete(t.last, series)
+		}
+	}
+}
+
+// remoteSeriesKey returns the storage key of a remote-write series.
+// It fails for series whose name or labels could be mistaken for another series key.
+func remoteSeriesKey(ts *remotewrite.TimeSeries) (string, error) {
+	labels := storage.Labels{}
+	for _, label := range ts.Labels {
+		if label.Name != remotewrite.NameLabel {
+			labels[label.Name] = label.Value
+		}
+	}
+	if err := storage.ValidateName(ts.Name()); err != nil {
+		return "", err
+	}
+	if err := labels.Validate(); err != nil {
+		return "", err
+	}
+	return storage.SeriesKey(ts.Name(), labels), nil
+}
+
+func isRemoteCounter(name string, types map[string]remotewrite.MetricType) bool {
+	if mtype, ok := types[name]; ok && mtype != remotewrite.TypeUnknown {
+		return mtype == remotewrite.TypeCounter
+	}
+	return strings.HasSuffix(name, "_total")
+}
+
+// RemoteWriteHandler handles Prometheus remote-write requests.
+// Only the latest sample of each series is stored, keyed by the metric name and its labels. Series announced as counters in the
+// request metadata, or named with a _total suffix, are stored as counters.
+// @Summary Prometheus Remote Write.
+// @Description Accepts snappy-compressed protobuf WriteRequest payloads.
+// @Tags Metrics.
+// @Accept application/x-protobuf.
+// @Success 204 {string} string "No Content".
+// @Failure 400 {string} string "Bad Request".
+// @Failure 413 {string} string "Request Entity Too Large".
+// @Router /api/v1/write [post].
+func (h *MetricsHandler) RemoteWriteHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxRemoteWriteBodySize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.String(http.StatusRequestEntityTooLarge, "Write request too large")
+			return
+		}
+		c.String(http.StatusInternalServerError, "cant read request body")
+		return
+	}
+
+	req, err := remotewrite.Decode(body)
+	if errors.Is(err, remotewrite.ErrTooLarge) {
+		c.String(http.StatusRequestEntityTooLarge, "Write request too large")
+		return
+	}
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad write request")
+		h.logger.Error("Failed to decode write request.", zap.Error(err))
+		return
+	}
+
+	types := make(map[string]remotewrite.MetricType, len(req.Metadata))
+	for _, md := range req.Metadata {
+		types[md.FamilyName] = md.Type
+	}
+
+	gauges := make(map[string]storage.Gauge)
+	counters := make(map[string]float64)
+
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		name := ts.Name()
+		if name == "" || len(ts.Samples) == 0 {
+			continue
+		}
+
+		latest := ts.Samples[0]
+		for _, sample := range ts.Samples[1:] {
+			if sample.Timestamp >= latest.Timestamp {
+				latest = sample
+			}
+		}
+
+		key, err := remoteSeriesKey(ts)
+		if err != nil {
+			h.logger.Warn("Skipped invalid remote-write series.", zap.String("name", name), zap.Error(err))
+			continue
+		}
+		if !isRemoteCounter(name, types) {
+			gauges[key] = storage.Gauge(latest.Value)
+			continue
+		}
+		if !math.IsNaN(latest.Value) && !math.IsInf(latest.Value, 0) {
+			counters[key] = latest.Value
+		}
+	}
+
+	if len(gauges) > 0 {
+		if err := h.storage.SetGauges(ctx, gauges); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			h.logger.Error("cant set gauges.", zap.Error(err))
+			return
+		}
+	}
+
+	if len(counters) > 0 {
+		if err := h.setRemoteCounters(ctx, counters); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			h.logger.Error("cant set counters.", zap.Error(err))
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// setRemoteCounters stores the increments of the latest cumulative samples of counter series.
+func (h *MetricsHandler) setRemoteCounters(ctx context.Context, samples map[string]float64) error {
+	stored := func(series string) (bool, error) {
+		_, ok, err := h.storage.GetCounter(ctx, series)
+		if err != nil {
+			return false, fmt.Errorf("cant check stored counter: %w", err)
+		}
+		return ok, nil
+	}
+	set := func(counters map[string]storage.Counter) error {
+		return h.storage.SetCounters(ctx, counters)
+	}
+	return h.cumulative.apply(samples, time.Now(), stored, set)
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"metrics/internal/encryption"
+)
+
+// DecryptionKey holds the private key decrypting request bodies, it can be replaced while it is in use.
+type DecryptionKey struct {
+	value atomic.Pointer[rsa.PrivateKey]
+}
+
+// NewDecryptionKey creates a new instance of DecryptionKey, a nil key disables decryption.
+func NewDecryptionKey(privateKey *rsa.PrivateKey) *DecryptionKey {
+	k := &DecryptionKey{}
+	k.Set(privateKey)
+	return k
+}
+
+// Get returns the current key, nil when decryption is disabled.
+func (k *DecryptionKey) Get() *rsa.PrivateKey {
+	return k.value.Load()
+}
+
+// Set replaces the key.
+func (k *DecryptionKey) Set(privateKey *rsa.PrivateKey) {
+	k.value.Store(privateKey)
+}
+
+// WithDecryption is a middleware that decrypts request bodies the agent encrypted with the server public key.
+// It must run before the hash validation and the decompression, the agent hashes and encrypts the gzipped body.
+// Requests without the encryption header pass unchanged, encrypted requests are rejected without a private key.
+func WithDecryption(decryptionKey *DecryptionKey) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme := c.GetHeader(encryption.Header)
+		if scheme == "" {
+			c.Next()
+			return
+		}
+		privateKey := decryptionKey.Get()
+		if privateKey == nil {
+			c.String(http.StatusBadRequest, "encryption is not configured")
+			c.Abort()
+			return
+		}
+		if scheme != encryption.Scheme {
+			c.String(http.StatusBadRequest, "unsupported encryption")
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "cant read request body")
+			c.Abort()
+			return
+		}
+		plaintext, err := encryption.Decrypt(privateKey, body)
+		if err != nil {
+			zap.L().Error("cant decrypt request body", zap.Error(err))
+			c.String(http.StatusBadRequest, "cant decrypt request body")
+			c.Abort()
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(plaintext))
+		c.Request.ContentLength = int64(len(plaintext))
+		c.Request.Header.Del(encryption.Header)
+		c.Next()
+	}
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics/internal/encryption"
+	"metrics/internal/utils"
+)
+
+func TestWithDecryption(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	hashKey := "secret"
+	payload := `[{"id":"PollCount","type":"counter","delta":1}]`
+
+	// The agent gzips the payload, hashes the gzipped body and encrypts it last.
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, err = gz.Write([]byte(payload))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	hash := utils.GetHash(hashKey, gzipped.Bytes())
+	encrypted, err := encryption.Encrypt(&privateKey.PublicKey, gzipped.Bytes())
+	require.NoError(t, err)
+
+	newRouter := func(key *rsa.PrivateKey) *gin.Engine {
+		router := gin.New()
+		router.Use(WithDecryption(NewDecryptionKey(key)))
+		router.Use(WithHashValidation(utils.NewKey(hashKey)))
+		router.Use(WithDecompress())
+		router.POST("/updates/", func(c *gin.Context) {
+			body, err := io.ReadAll(c.Request.Body)
+			require.NoError(t, err)
+			c.String(http.StatusOK, string(body))
+		})
+		return router
+	}
+	send := func(router *gin.Engine, body []byte, scheme string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("HashSHA256", hash)
+		if scheme != "" {
+			req.Header.Set(encryption.Header, scheme)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("encrypted", func(t *testing.T) {
+		rec := send(newRouter(privateKey), encrypted, encryption.Scheme)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, payload, rec.Body.String())
+	})
+
+	t.Run("plain", func(t *testing.T) {
+		rec := send(newRouter(privateKey), gzipped.Bytes(), "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, payload, rec.Body.String())
+	})
+
+	t.Run("without private key", func(t *testing.T) {
+		rec := send(newRouter(nil), encrypted, encryption.Scheme)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		rec := send(newRouter(privateKey), encrypted, "rot13")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		corrupted := append([]byte(nil), encrypted...)
+		corrupted[len(corrupted)-1] ^= 1
+		rec := send(newRouter(privateKey), corrupted, encryption.Scheme)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
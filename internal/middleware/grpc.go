@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"metrics/internal/utils"
+)
+
+// HashMetadataKey is the gRPC metadata key carrying the hash of a request message.
+const HashMetadataKey = "hashsha256"
+
+// WithGRPCLogging is an interceptor that logs details about each unary gRPC call.
+func WithGRPCLogging(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+
+		resp, err := handler(ctx, req)
+
+		logger.Info("Call processed",
+			zap.String("method", info.FullMethod),
+			zap.Duration("duration", time.Since(start)),
+			zap.String("code", status.Code(err).String()),
+		)
+		return resp, err
+	}
+}
+
+// WithGRPCStreamLogging is an interceptor that logs details about each streaming gRPC call.
+func WithGRPCStreamLogging(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+
+		err := handler(srv, stream)
+
+		logger.Info("Stream processed",
+			zap.String("method", info.FullMethod),
+			zap.Duration("duration", time.Since(start)),
+			zap.String("code", status.Code(err).String()),
+		)
+		return err
+	}
+}
+
+// WithGRPCHashValidation is an interceptor that validates the hash of a unary request message using a shared key.
+// The hash is computed over the deterministic protobuf encoding of the message.
+func WithGRPCHashValidation(sharedKey *utils.Key) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		key := sharedKey.Get()
+		received := metadata.ValueFromIncomingContext(ctx, HashMetadataKey)
+		if key == "" || len(received) == 0 || received[0] == "" {
+			return handler(ctx, req)
+		}
+
+		message, ok := req.(proto.Message)
+		if !ok {
+			return nil, status.Error(codes.Internal, "cant hash request")
+		}
+		expectedHash, err := utils.GetMessageHash(key, message)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "cant hash request")
+		}
+		if received[0] != expectedHash {
+			zap.L().Error("Hash mismatch",
+				zap.String("method", info.FullMethod),
+				zap.String("expected", expectedHash),
+				zap.String("received", received[0]),
+			)
+			return nil, status.Error(codes.InvalidArgument, "invalid hash")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// WithGRPCStreamHashValidation is the streaming counterpart of WithGRPCHashValidation.
+// Messages sent on a stream carry their hash in their hash field, see utils.GetSignedMessageHash.
+// A message with an invalid hash ends the stream, messages without a hash are accepted as unary calls are.
+func WithGRPCStreamHashValidation(sharedKey *utils.Key) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !info.IsClientStream {
+			return handler(srv, stream)
+		}
+		return handler(srv, &hashValidatingStream{ServerStream: stream, sharedKey: sharedKey, method: info.FullMethod})
+	}
+}
+
+// signedMessage is a message carrying its own hash.
+type signedMessage interface {
+	proto.Message
+	GetHash() string
+}
+
+// hashValidatingStream validates the hash of every message received on a stream.
+type hashValidatingStream struct {
+	grpc.ServerStream
+	sharedKey *utils.Key
+	method    string
+}
+
+func (s *hashValidatingStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	key := s.sharedKey.Get()
+	message, ok := m.(signedMessage)
+	if key == "" || !ok || message.GetHash() == "" {
+		return nil
+	}
+
+	expectedHash, err := utils.GetSignedMessageHash(key, message)
+	if err != nil {
+		return status.Error(codes.Internal, "cant hash request")
+	}
+	if message.GetHash() != expectedHash {
+		zap.L().Error("Hash mismatch",
+			zap.String("method", s.method),
+			zap.String("expected", expectedHash),
+			zap.String("received", message.GetHash()),
+		)
+		return status.Error(codes.InvalidArgument, "invalid hash")
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "metrics/internal/proto"
+	"metrics/internal/utils"
+)
+
+func TestWithGRPCHashValidation(t *testing.T) {
+	interceptor := WithGRPCHashValidation(utils.NewKey("test-key"))
+	info := &grpc.UnaryServerInfo{FullMethod: pb.Metrics_UpdateMetrics_FullMethodName}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return &pb.UpdateMetricsResponse{}, nil
+	}
+	req := &pb.UpdateMetricsRequest{BatchId: "batch-1", Metrics: []*pb.Metric{{Id: "PollCount"}}}
+
+	hash, err := utils.GetMessageHash("test-key", req)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		hash string
+		code codes.Code
+	}{
+		{name: "valid hash", hash: hash, code: codes.OK},
+		{name: "no hash", hash: "", code: codes.OK},
+		{name: "invalid hash", hash: "invalid", code: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.hash != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(HashMetadataKey, tt.hash))
+			}
+			_, err := interceptor(ctx, req, info, handler)
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+}
+
+// recvStream is a server stream receiving the given messages.
+type recvStream struct {
+	grpc.ServerStream
+	messages []*pb.UpdateMetricsRequest
+}
+
+func (s *recvStream) RecvMsg(m any) error {
+	if len(s.messages) == 0 {
+		return io.EOF
+	}
+	proto.Merge(m.(proto.Message), s.messages[0])
+	s.messages = s.messages[1:]
+	return nil
+}
+
+func TestWithGRPCStreamHashValidation(t *testing.T) {
+	key := utils.NewKey("test-key")
+	interceptor := WithGRPCStreamHashValidation(key)
+	update := &grpc.StreamServerInfo{FullMethod: pb.Metrics_UpdateMetricsStream_FullMethodName, IsClientStream: true}
+	handler := func(srv any, stream grpc.ServerStream) error {
+		for {
+			if err := stream.RecvMsg(&pb.UpdateMetricsRequest{}); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	sign := func(req *pb.UpdateMetricsRequest) *pb.UpdateMetricsRequest {
+		hash, err := utils.GetSignedMessageHash("test-key", req)
+		require.NoError(t, err)
+		req.Hash = hash
+		return req
+	}
+	signed := sign(&pb.UpdateMetricsRequest{BatchId: "batch-1", Metrics: []*pb.Metric{{Id: "PollCount"}}})
+	tampered := sign(&pb.UpdateMetricsRequest{BatchId: "batch-2", Metrics: []*pb.Metric{{Id: "PollCount"}}})
+	tampered.Metrics[0].Id = "Alloc"
+	unsigned := &pb.UpdateMetricsRequest{BatchId: "batch-3"}
+
+	tests := []struct {
+		name     string
+		messages []*pb.UpdateMetricsRequest
+		code     codes.Code
+	}{
+		{name: "signed", messages: []*pb.UpdateMetricsRequest{signed, signed}, code: codes.OK},
+		{name: "unsigned", messages: []*pb.UpdateMetricsRequest{unsigned}, code: codes.OK},
+		{name: "tampered", messages: []*pb.UpdateMetricsRequest{signed, tampered}, code: codes.InvalidArgument},
+		{name: "invalid hash", messages: []*pb.UpdateMetricsRequest{{BatchId: "batch-4", Hash: "invalid"}},
+			code: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := interceptor(nil, &recvStream{messages: tt.messages}, update, handler)
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+
+	key.Set("")
+	err := interceptor(nil, &recvStream{messages: []*pb.UpdateMetricsRequest{tampered}}, update, handler)
+	assert.NoError(t, err, "hashes are not checked without a key")
+}
@@ -12,8 +12,10 @@ import (
 )
 
 // WithHashValidation is a middleware that validates the hash of the request body using a shared key.
-func WithHashValidation(key string) gin.HandlerFunc {
+// The key is read on every request, so it can be replaced while the server runs.
+func WithHashValidation(sharedKey *utils.Key) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		key := sharedKey.Get()
 		if key == "" || c.GetHeader("HashSHA256") == "" {
 			c.Next()
 			return
@@ -46,7 +48,7 @@ func WithHashValidation(key string) gin.HandlerFunc {
 }
 
 // WithHashHeader is a middleware that adds a hash of the response body to the response headers.
-func WithHashHeader(key string) gin.HandlerFunc {
+func WithHashHeader(sharedKey *utils.Key) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		buf := new(bytes.Buffer)
 		mw := io.MultiWriter(c.Writer, buf)
@@ -55,7 +57,7 @@ func WithHashHeader(key string) gin.HandlerFunc {
 		c.Writer = rw
 		c.Next()
 
-		if key != "" && len(buf.Bytes()) > 0 {
+		if key := sharedKey.Get(); key != "" && len(buf.Bytes()) > 0 {
 			hash := utils.GetHash(key, buf.Bytes())
 			c.Header("HashSHA256", hash)
 		}
@@ -16,7 +16,7 @@ func TestWithHashValidation(t *testing.T) {
 	hash := utils.GetHash(key, []byte(body))
 
 	router := gin.Default()
-	router.Use(WithHashValidation(key))
+	router.Use(WithHashValidation(utils.NewKey(key)))
 	router.POST("/", func(c *gin.Context) {
 		c.Status(http.StatusOK)
 	})
@@ -39,7 +39,7 @@ func TestWithHashHeader(t *testing.T) {
 	responseBody := "test"
 
 	router := gin.Default()
-	router.Use(WithHashHeader(key))
+	router.Use(WithHashHeader(utils.NewKey(key)))
 	router.GET("/", func(c *gin.Context) {
 		c.String(http.StatusOK, responseBody)
 	})
@@ -60,3 +60,32 @@ func TestWithHashHeader(t *testing.T) {
 		t.Errorf("expected hash to be '%s', got '%s'", expectedHash, hash)
 	}
 }
+
+func TestWithHashValidation_KeyReplaced(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body := "test"
+	key := utils.NewKey("old")
+
+	router := gin.Default()
+	router.Use(WithHashValidation(key))
+	router.POST("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	send := func(hashKey string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("HashSHA256", utils.GetHash(hashKey, []byte(body)))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	key.Set("new")
+	if code := send("old"); code != http.StatusBadRequest {
+		t.Errorf("expected status code 400 for the old key, got %d", code)
+	}
+	if code := send("new"); code != http.StatusOK {
+		t.Errorf("expected status code 200 for the new key, got %d", code)
+	}
+}
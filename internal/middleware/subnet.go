@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "metrics/internal/proto"
+)
+
+const (
+	// RealIPHeader carries the IP address of the agent, the agent sets it to its outbound address.
+	RealIPHeader = "X-Real-IP"
+	// RealIPMetadataKey is the gRPC metadata key carrying the IP address of the agent.
+	RealIPMetadataKey = "x-real-ip"
+)
+
+// ingestMethods are the gRPC methods writing metrics, checked by the trusted subnet interceptors.
+var ingestMethods = map[string]bool{
+	pb.Metrics_UpdateMetrics_FullMethodName:       true,
+	pb.Metrics_UpdateMetricsStream_FullMethodName: true,
+}
+
+// Subnets is a list of trusted networks.
+type Subnets []*net.IPNet
+
+// ParseSubnets parses comma-separated CIDRs, e.g. "10.0.0.0/8,192.168.1.0/24". An empty value gives no subnets.
+func ParseSubnets(value string) (Subnets, error) {
+	var subnets Subnets
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("cant parse subnet: %w", err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// Contains reports whether the IP address is in one of the subnets.
+func (s Subnets) Contains(ip net.IP) bool {
+	for _, subnet := range s {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the subnets as comma-separated CIDRs.
+func (s Subnets) String() string {
+	cidrs := make([]string, 0, len(s))
+	for _, subnet := range s {
+		cidrs = append(cidrs, subnet.String())
+	}
+	return strings.Join(cidrs, ",")
+}
+
+// TrustedSubnets holds the trusted subnets, they can be replaced while they are in use.
+type TrustedSubnets struct {
+	value atomic.Pointer[Subnets]
+}
+
+// NewTrustedSubnets creates a new instance of TrustedSubnets.
+func NewTrustedSubnets(subnets Subnets) *TrustedSubnets {
+	t := &TrustedSubnets{}
+	t.Set(subnets)
+	return t
+}
+
+// Get returns the current subnets.
+func (t *TrustedSubnets) Get() Subnets {
+	return *t.value.Load()
+}
+
+// Set replaces the subnets.
+func (t *TrustedSubnets) Set(subnets Subnets) {
+	t.value.Store(&subnets)
+}
+
+// Allowed reports whether metrics from ip are accepted, empty subnets accept every address.
+func (t *TrustedSubnets) Allowed(ip net.IP) bool {
+	subnets := t.Get()
+	return len(subnets) == 0 || subnets.Contains(ip)
+}
+
+// allowed reports whether a request from remoteAddr, claiming to come from realIP, is trusted.
+// The peer address is always checked, realIP is set by the client and can be forged, so it only narrows the check:
+// when it is not empty it must be in the subnets too.
+func (s Subnets) allowed(realIP, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	if peerIP := net.ParseIP(host); peerIP == nil || !s.Contains(peerIP) {
+		return false
+	}
+	if realIP == "" {
+		return true
+	}
+	ip := net.ParseIP(strings.TrimSpace(realIP))
+	return ip != nil && s.Contains(ip)
+}
+
+// WithTrustedSubnets is a middleware that rejects requests from outside the subnets with 403 Forbidden.
+// Both the remote address and the X-Real-IP header set by the agent, when present, must be in the subnets.
+// Empty subnets trust every request.
+func WithTrustedSubnets(trusted *TrustedSubnets) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subnets := trusted.Get()
+		if len(subnets) == 0 {
+			c.Next()
+			return
+		}
+		realIP := c.GetHeader(RealIPHeader)
+		if !subnets.allowed(realIP, c.Request.RemoteAddr) {
+			zap.L().Warn("Request from untrusted subnet",
+				zap.String("realIP", realIP),
+				zap.String("remoteAddr", c.Request.RemoteAddr),
+			)
+			c.String(http.StatusForbidden, "untrusted subnet")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// WithGRPCTrustedSubnets is an interceptor that rejects unary calls writing metrics from outside the subnets.
+// Both the peer address and the x-real-ip metadata set by the agent, when present, must be in the subnets.
+// Empty subnets trust every call.
+func WithGRPCTrustedSubnets(trusted *TrustedSubnets) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := checkGRPCSource(ctx, trusted.Get(), info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// WithGRPCStreamTrustedSubnets is the streaming counterpart of WithGRPCTrustedSubnets.
+func WithGRPCStreamTrustedSubnets(trusted *TrustedSubnets) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkGRPCSource(stream.Context(), trusted.Get(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+func checkGRPCSource(ctx context.Context, subnets Subnets, method string) error {
+	if len(subnets) == 0 || !ingestMethods[method] {
+		return nil
+	}
+	var realIP, remoteAddr string
+	if values := metadata.ValueFromIncomingContext(ctx, RealIPMetadataKey); len(values) > 0 {
+		realIP = values[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+	if !subnets.allowed(realIP, remoteAddr) {
+		zap.L().Warn("Call from untrusted subnet",
+			zap.String("method", method),
+			zap.String("realIP", realIP),
+			zap.String("remoteAddr", remoteAddr),
+		)
+		return status.Error(codes.PermissionDenied, "untrusted subnet")
+	}
+	return nil
+}
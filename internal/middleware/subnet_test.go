@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "metrics/internal/proto"
+)
+
+func TestParseSubnets(t *testing.T) {
+	subnets, err := ParseSubnets(" 10.0.0.0/8, 192.168.1.7/24 ,")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/8,192.168.1.0/24", subnets.String())
+	assert.True(t, subnets.Contains(net.ParseIP("10.1.2.3")))
+	assert.True(t, subnets.Contains(net.ParseIP("192.168.1.200")))
+	assert.False(t, subnets.Contains(net.ParseIP("192.168.2.1")))
+
+	subnets, err = ParseSubnets("")
+	require.NoError(t, err)
+	assert.Empty(t, subnets)
+
+	_, err = ParseSubnets("10.0.0.0/8,10.0.0.1")
+	assert.ErrorContains(t, err, "cant parse subnet")
+}
+
+func TestWithTrustedSubnets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	subnets, err := ParseSubnets("192.168.1.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		subnets    Subnets
+		realIP     string
+		remoteAddr string
+		code       int
+	}{
+		{name: "trusted real ip", subnets: subnets, realIP: "192.168.1.10", remoteAddr: "192.168.1.20:1234",
+			code: http.StatusOK},
+		{name: "forged real ip", subnets: subnets, realIP: "192.168.1.10", remoteAddr: "10.0.0.1:1234",
+			code: http.StatusForbidden},
+		{name: "untrusted real ip", subnets: subnets, realIP: "10.0.0.1", remoteAddr: "192.168.1.10:1234",
+			code: http.StatusForbidden},
+		{name: "bad real ip", subnets: subnets, realIP: "agent", remoteAddr: "192.168.1.10:1234",
+			code: http.StatusForbidden},
+		{name: "trusted remote address", subnets: subnets, remoteAddr: "192.168.1.10:1234", code: http.StatusOK},
+		{name: "untrusted remote address", subnets: subnets, remoteAddr: "10.0.0.1:1234", code: http.StatusForbidden},
+		{name: "no subnets", realIP: "10.0.0.1", remoteAddr: "10.0.0.1:1234", code: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.POST("/updates/", WithTrustedSubnets(NewTrustedSubnets(tt.subnets)), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/updates/", http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				req.Header.Set(RealIPHeader, tt.realIP)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.code, rec.Code)
+		})
+	}
+}
+
+func TestWithGRPCTrustedSubnets(t *testing.T) {
+	subnets, err := ParseSubnets("192.168.1.0/24")
+	require.NoError(t, err)
+	interceptor := WithGRPCTrustedSubnets(NewTrustedSubnets(subnets))
+	handler := func(ctx context.Context, req any) (any, error) {
+		return &pb.UpdateMetricsResponse{}, nil
+	}
+	update := &grpc.UnaryServerInfo{FullMethod: pb.Metrics_UpdateMetrics_FullMethodName}
+	untrusted := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234},
+	})
+
+	_, err = interceptor(untrusted, &pb.UpdateMetricsRequest{}, update, handler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	forged := metadata.NewIncomingContext(untrusted, metadata.Pairs(RealIPMetadataKey, "192.168.1.10"))
+	_, err = interceptor(forged, &pb.UpdateMetricsRequest{}, update, handler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "x-real-ip must not override the peer address")
+
+	trusted := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 1234},
+	})
+	withRealIP := metadata.NewIncomingContext(trusted, metadata.Pairs(RealIPMetadataKey, "192.168.1.10"))
+	_, err = interceptor(withRealIP, &pb.UpdateMetricsRequest{}, update, handler)
+	assert.NoError(t, err)
+
+	// Reading metrics is not restricted.
+	get := &grpc.UnaryServerInfo{FullMethod: pb.Metrics_GetMetric_FullMethodName}
+	_, err = interceptor(untrusted, &pb.GetMetricRequest{}, get, handler)
+	assert.NoError(t, err)
+}
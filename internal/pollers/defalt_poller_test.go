@@ -3,6 +3,8 @@ package pollers
 import (
 	"context"
 	"metrics/internal/storage"
+	"runtime"
+	"sync"
 	"testing"
 )
 
@@ -113,3 +115,84 @@ func TestDefaultPoller_CollectsAllMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestDefaultPoller_GCPauses(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	poller := NewDefaultPollerWithBuckets(memStorage, []float64{0.001, 0.01})
+
+	runtime.GC()
+	if err := poller.Poll(); err != nil {
+		t.Fatalf("unexpected error during Poll: %v", err)
+	}
+
+	pauses, ok, err := memStorage.GetHistogram(context.Background(), "GCPauseSeconds")
+	if err != nil || !ok {
+		t.Fatalf("expected GCPauseSeconds histogram, got ok=%v err=%v", ok, err)
+	}
+	if pauses.Count == 0 {
+		t.Errorf("expected GC pauses to be observed")
+	}
+	if len(pauses.Counts) != 3 {
+		t.Errorf("expected 3 buckets, got %d", len(pauses.Counts))
+	}
+
+}
+
+func TestDefaultPoller_gcPausesSincePreviousPoll(t *testing.T) {
+	poller := NewDefaultPollerWithBuckets(storage.NewMemStorage(), []float64{0.001, 0.01})
+
+	var m runtime.MemStats
+	m.NumGC = 2
+	m.PauseNs[0] = 500_000
+	m.PauseNs[1] = 5_000_000
+	pauses := poller.gcPauses(&m)
+	if pauses.Count != 2 || pauses.Counts[0] != 1 || pauses.Counts[1] != 1 {
+		t.Errorf("expected one pause in each of first two buckets, got %+v", pauses)
+	}
+
+	m.NumGC = 3
+	m.PauseNs[2] = 50_000_000
+	pauses = poller.gcPauses(&m)
+	if pauses.Count != 1 || pauses.Counts[2] != 1 {
+		t.Errorf("expected only the new pause in the overflow bucket, got %+v", pauses)
+	}
+
+	m.NumGC = 1000
+	pauses = poller.gcPauses(&m)
+	if pauses.Count != uint64(len(m.PauseNs)) {
+		t.Errorf("expected pauses capped at %d, got %d", len(m.PauseNs), pauses.Count)
+	}
+
+	// Stats read before the previous poll finished report nothing instead of wrapping around.
+	m.NumGC = 999
+	pauses = poller.gcPauses(&m)
+	if pauses.Count != 0 {
+		t.Errorf("expected no pauses from stale stats, got %d", pauses.Count)
+	}
+}
+
+func TestDefaultPoller_gcPauses_Concurrent(t *testing.T) {
+	poller := NewDefaultPollerWithBuckets(storage.NewMemStorage(), []float64{0.001, 0.01})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var total uint64
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var m runtime.MemStats
+			m.NumGC = uint32(i + 1)
+			pauses := poller.gcPauses(&m)
+			mu.Lock()
+			total += pauses.Count
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// However the polls interleave, every pause is reported once.
+	if total != 10 {
+		t.Errorf("expected 10 pauses in total, got %d", total)
+	}
+}
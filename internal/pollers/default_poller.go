@@ -6,16 +6,49 @@ import (
 	"math/rand/v2"
 	"metrics/internal/storage"
 	"runtime"
+	"time"
 )
 
 // DefaultPoller collects runtime metrics using the Go runtime package.
+// GC pauses are reported as the GCPauseSeconds histogram.
 type DefaultPoller struct {
+	pauseBuckets []float64
 	basePoller
+	lastNumGC uint32
 }
 
-// NewDefaultPoller creates a new instance of DefaultPoller.
+// NewDefaultPoller creates a new instance of DefaultPoller with default GC pause buckets.
 func NewDefaultPoller(ms storage.MetricsStorage) *DefaultPoller {
-	return &DefaultPoller{basePoller: basePoller{storage: ms}}
+	return NewDefaultPollerWithBuckets(ms, storage.DefaultBuckets)
+}
+
+// NewDefaultPollerWithBuckets creates a new instance of DefaultPoller with the given GC pause buckets in seconds.
+func NewDefaultPollerWithBuckets(ms storage.MetricsStorage, pauseBuckets []float64) *DefaultPoller {
+	return &DefaultPoller{basePoller: basePoller{storage: ms}, pauseBuckets: pauseBuckets}
+}
+
+// gcPauses returns a histogram of GC pauses finished since the previous poll.
+// Only the last len(m.PauseNs) pauses are available from the runtime.
+// Polls run concurrently, so lastNumGC is guarded by the poller lock, and stats older than the last ones seen
+// report no pauses.
+func (p *DefaultPoller) gcPauses(m *runtime.MemStats) *storage.Histogram {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pauses := storage.NewHistogram(p.pauseBuckets)
+	if m.NumGC <= p.lastNumGC {
+		return pauses
+	}
+	count := m.NumGC - p.lastNumGC
+	if count > uint32(len(m.PauseNs)) {
+		count = uint32(len(m.PauseNs))
+	}
+	for i := range count {
+		pause := m.PauseNs[(m.NumGC-1-i)%uint32(len(m.PauseNs))]
+		pauses.Observe(float64(pause) / float64(time.Second))
+	}
+	p.lastNumGC = m.NumGC
+	return pauses
 }
 
 // Poll collects runtime metrics and stores them in the storage.
@@ -66,6 +99,12 @@ func (p *DefaultPoller) Poll() error {
 	if err := p.storeCounters(ctx, counters); err != nil {
 		return fmt.Errorf("can't set counters: %w", err)
 	}
+	histograms := map[string]*storage.Histogram{
+		"GCPauseSeconds": p.gcPauses(&m),
+	}
+	if err := p.storeHistograms(ctx, histograms); err != nil {
+		return fmt.Errorf("can't set histograms: %w", err)
+	}
 
 	return nil
 }
@@ -79,3 +118,13 @@ func (p *DefaultPoller) GetMetrics(ctx context.Context) ([]Metric, error) {
 func (p *DefaultPoller) ResetMetrics(ctx context.Context) error {
 	return p.resetMetrics(ctx)
 }
+
+// TakeMetrics retrieves all collected metrics and clears them from the storage.
+func (p *DefaultPoller) TakeMetrics(ctx context.Context) ([]Metric, error) {
+	return p.takeMetrics(ctx)
+}
+
+// RestoreMetrics returns taken metrics that could not be delivered to the storage.
+func (p *DefaultPoller) RestoreMetrics(ctx context.Context, metrics []Metric) error {
+	return p.restoreMetrics(ctx, metrics)
+}
@@ -53,3 +53,13 @@ func (p *GopsutilPoller) GetMetrics(ctx context.Context) ([]Metric, error) {
 func (p *GopsutilPoller) ResetMetrics(ctx context.Context) error {
 	return p.resetMetrics(ctx)
 }
+
+// TakeMetrics retrieves all collected metrics and clears them from the storage.
+func (p *GopsutilPoller) TakeMetrics(ctx context.Context) ([]Metric, error) {
+	return p.takeMetrics(ctx)
+}
+
+// RestoreMetrics returns taken metrics that could not be delivered to the storage.
+func (p *GopsutilPoller) RestoreMetrics(ctx context.Context, metrics []Metric) error {
+	return p.restoreMetrics(ctx, metrics)
+}
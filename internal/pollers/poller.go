@@ -7,7 +7,7 @@ import (
 	"sync"
 )
 
-// MType represents the type of a metric (gauge or counter).
+// MType represents the type of a metric (gauge, counter or histogram).
 type MType string
 
 const (
@@ -15,14 +15,18 @@ const (
 	TypeGauge MType = "gauge"
 	// TypeCounter represents a counter metric type.
 	TypeCounter MType = "counter"
+	// TypeHistogram represents a histogram metric type.
+	TypeHistogram MType = "histogram"
 )
 
 // Metric represents a single metric with its type and value.
 type Metric struct {
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
-	ID    string   `json:"id"`
-	MType MType    `json:"type"`
+	Delta     *int64             `json:"delta,omitempty"`
+	Value     *float64           `json:"value,omitempty"`
+	Histogram *storage.Histogram `json:"histogram,omitempty"`
+	Labels    storage.Labels     `json:"labels,omitempty"`
+	ID        string             `json:"id"`
+	MType     MType              `json:"type"`
 }
 
 // Poller defines the interface for metric pollers.
@@ -33,6 +37,11 @@ type Poller interface {
 	GetMetrics(ctx context.Context) ([]Metric, error)
 	// ResetMetrics clears all collected metrics from the storage.
 	ResetMetrics(ctx context.Context) error
+	// TakeMetrics retrieves all collected metrics and clears them from the storage in one step,
+	// so the caller owns exactly the deltas it reports.
+	TakeMetrics(ctx context.Context) ([]Metric, error)
+	// RestoreMetrics returns taken metrics that could not be delivered to the storage.
+	RestoreMetrics(ctx context.Context, metrics []Metric) error
 }
 
 type basePoller struct {
@@ -52,35 +61,64 @@ func (b *basePoller) storeCounters(ctx context.Context, counters map[string]stor
 	return b.storage.SetCounters(ctx, counters)
 }
 
+func (b *basePoller) storeHistograms(ctx context.Context, histograms map[string]*storage.Histogram) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.storage.SetHistograms(ctx, histograms)
+}
+
 func (b *basePoller) getMetrics(ctx context.Context) ([]Metric, error) {
 	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.snapshotLocked(ctx)
+}
+
+func (b *basePoller) snapshotLocked(ctx context.Context) ([]Metric, error) {
 	gauges, err := b.storage.GetGauges(ctx)
 	if err != nil {
-		b.mu.RUnlock()
 		return nil, fmt.Errorf("can't get gauges: %w", err)
 	}
 	counters, err := b.storage.GetCounters(ctx)
 	if err != nil {
-		b.mu.RUnlock()
 		return nil, fmt.Errorf("can't get counters: %w", err)
 	}
-	b.mu.RUnlock()
+	histograms, err := b.storage.GetHistograms(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get histograms: %w", err)
+	}
+	cloned := make(map[string]*storage.Histogram, len(histograms))
+	for key, value := range histograms {
+		cloned[key] = value.Clone()
+	}
 
-	metrics := make([]Metric, 0, len(gauges)+len(counters))
-	for name, value := range gauges {
+	metrics := make([]Metric, 0, len(gauges)+len(counters)+len(cloned))
+	for key, value := range gauges {
 		v := float64(value)
+		name, labels := storage.ParseSeriesKey(key)
 		metrics = append(metrics, Metric{
-			Value: &v,
-			ID:    name,
-			MType: TypeGauge,
+			Value:  &v,
+			Labels: labels,
+			ID:     name,
+			MType:  TypeGauge,
 		})
 	}
-	for name, value := range counters {
+	for key, value := range counters {
 		d := int64(value)
+		name, labels := storage.ParseSeriesKey(key)
 		metrics = append(metrics, Metric{
-			Delta: &d,
-			ID:    name,
-			MType: TypeCounter,
+			Delta:  &d,
+			Labels: labels,
+			ID:     name,
+			MType:  TypeCounter,
+		})
+	}
+	for key, value := range cloned {
+		name, labels := storage.ParseSeriesKey(key)
+		metrics = append(metrics, Metric{
+			Histogram: value,
+			Labels:    labels,
+			ID:        name,
+			MType:     TypeHistogram,
 		})
 	}
 
@@ -90,11 +128,80 @@ func (b *basePoller) getMetrics(ctx context.Context) ([]Metric, error) {
 func (b *basePoller) resetMetrics(ctx context.Context) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	return b.clearLocked(ctx)
+}
+
+func (b *basePoller) clearLocked(ctx context.Context) error {
 	if err := b.storage.ClearGauges(ctx); err != nil {
 		return fmt.Errorf("can't clear gauges: %w", err)
 	}
 	if err := b.storage.ClearCounters(ctx); err != nil {
 		return fmt.Errorf("can't clear counters: %w", err)
 	}
+	if err := b.storage.ClearHistograms(ctx); err != nil {
+		return fmt.Errorf("can't clear histograms: %w", err)
+	}
+	return nil
+}
+
+// takeMetrics retrieves and clears the collected metrics under one lock,
+// so no poll can slip in between and every delta is taken exactly once.
+func (b *basePoller) takeMetrics(ctx context.Context) ([]Metric, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	metrics, err := b.snapshotLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.clearLocked(ctx); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// restoreMetrics adds taken counter deltas and histogram observations back to those collected since.
+// A taken gauge is restored only if it was not polled again, so newer values win.
+func (b *basePoller) restoreMetrics(ctx context.Context, metrics []Metric) error {
+	gauges := make(map[string]storage.Gauge)
+	counters := make(map[string]storage.Counter)
+	histograms := make(map[string]*storage.Histogram)
+	for _, metric := range metrics {
+		key := storage.SeriesKey(metric.ID, metric.Labels)
+		switch {
+		case metric.MType == TypeGauge && metric.Value != nil:
+			gauges[key] = storage.Gauge(*metric.Value)
+		case metric.MType == TypeCounter && metric.Delta != nil:
+			counters[key] += storage.Counter(*metric.Delta)
+		case metric.MType == TypeHistogram && metric.Histogram != nil:
+			if current, ok := histograms[key]; ok {
+				if err := current.Merge(metric.Histogram); err != nil {
+					return fmt.Errorf("can't restore histogram %s: %w", key, err)
+				}
+				continue
+			}
+			histograms[key] = metric.Histogram.Clone()
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key := range gauges {
+		_, ok, err := b.storage.GetGauge(ctx, key)
+		if err != nil {
+			return fmt.Errorf("can't get gauge: %w", err)
+		}
+		if ok {
+			delete(gauges, key)
+		}
+	}
+	if err := b.storage.SetGauges(ctx, gauges); err != nil {
+		return fmt.Errorf("can't restore gauges: %w", err)
+	}
+	if err := b.storage.SetCounters(ctx, counters); err != nil {
+		return fmt.Errorf("can't restore counters: %w", err)
+	}
+	if err := b.storage.SetHistograms(ctx, histograms); err != nil {
+		return fmt.Errorf("can't restore histograms: %w", err)
+	}
 	return nil
 }
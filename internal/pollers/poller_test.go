@@ -637,3 +637,92 @@ func float64Ptr(v float64) *float64 {
 func int64Ptr(v int64) *int64 {
 	return &v
 }
+
+func TestBasePoller_TakeAndRestoreMetrics(t *testing.T) {
+	ctx := context.Background()
+	memStorage := storage.NewMemStorage()
+	poller := basePoller{
+		storage: memStorage,
+	}
+
+	histogram := storage.NewHistogram([]float64{1})
+	histogram.Observe(0.5)
+	_ = poller.storeGauges(ctx, map[string]storage.Gauge{"Alloc": 1, "Frees": 2})
+	_ = poller.storeCounters(ctx, map[string]storage.Counter{"PollCount": 3})
+	_ = poller.storeHistograms(ctx, map[string]*storage.Histogram{"GCPauseSeconds": histogram})
+
+	taken, err := poller.takeMetrics(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(taken) != 4 {
+		t.Fatalf("expected 4 metrics, got %d", len(taken))
+	}
+	if remaining, _ := poller.getMetrics(ctx); len(remaining) != 0 {
+		t.Fatalf("expected taken metrics to be cleared, got %v", remaining)
+	}
+
+	_ = poller.storeGauges(ctx, map[string]storage.Gauge{"Alloc": 10})
+	_ = poller.storeCounters(ctx, map[string]storage.Counter{"PollCount": 1})
+	_ = poller.storeHistograms(ctx, map[string]*storage.Histogram{"GCPauseSeconds": histogram})
+
+	if err := poller.restoreMetrics(ctx, taken); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if value, _, _ := memStorage.GetGauge(ctx, "Alloc"); value != 10 {
+		t.Errorf("expected newer Alloc 10 to be kept, got %v", value)
+	}
+	if value, _, _ := memStorage.GetGauge(ctx, "Frees"); value != 2 {
+		t.Errorf("expected Frees 2 to be restored, got %v", value)
+	}
+	if value, _, _ := memStorage.GetCounter(ctx, "PollCount"); value != 4 {
+		t.Errorf("expected PollCount 4, got %v", value)
+	}
+	if value, _, _ := memStorage.GetHistogram(ctx, "GCPauseSeconds"); value.Count != 2 {
+		t.Errorf("expected 2 pauses, got %d", value.Count)
+	}
+}
+
+func TestBasePoller_TakeMetrics_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	memStorage := storage.NewMemStorage()
+	poller := basePoller{
+		storage: memStorage,
+	}
+
+	const polls = 1000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range make([]struct{}, polls) {
+			_ = poller.storeCounters(ctx, map[string]storage.Counter{"PollCount": 1})
+		}
+	}()
+
+	// Every other batch fails and is restored, the rest are delivered.
+	var delivered int64
+	for i := 0; i < 200; i++ {
+		taken, err := poller.takeMetrics(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i%2 == 0 {
+			_ = poller.restoreMetrics(ctx, taken)
+			continue
+		}
+		for _, metric := range taken {
+			delivered += *metric.Delta
+		}
+	}
+	wg.Wait()
+
+	taken, _ := poller.takeMetrics(ctx)
+	for _, metric := range taken {
+		delivered += *metric.Delta
+	}
+	if delivered != polls {
+		t.Errorf("expected %d delivered increments, got %d", polls, delivered)
+	}
+}
@@ -0,0 +1,23 @@
+package proto
+
+var metricTypeNames = map[MetricType]string{
+	MetricType_METRIC_TYPE_GAUGE:     "gauge",
+	MetricType_METRIC_TYPE_COUNTER:   "counter",
+	MetricType_METRIC_TYPE_HISTOGRAM: "histogram",
+	MetricType_METRIC_TYPE_SET:       "set",
+}
+
+// TypeName returns the name of the metric type used by the HTTP API, or an empty string if it is unspecified.
+func (t MetricType) TypeName() string {
+	return metricTypeNames[t]
+}
+
+// MetricTypeFromName returns the metric type with the given HTTP API name, or METRIC_TYPE_UNSPECIFIED.
+func MetricTypeFromName(name string) MetricType {
+	for t, typeName := range metricTypeNames {
+		if typeName == name {
+			return t
+		}
+	}
+	return MetricType_METRIC_TYPE_UNSPECIFIED
+}
@@ -0,0 +1,255 @@
+package remotewrite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MetricType is the metric family type announced in remote-write metadata.
+type MetricType int32
+
+const (
+	// TypeUnknown is used when the sender did not announce a type.
+	TypeUnknown MetricType = 0
+	// TypeCounter is a monotonically increasing cumulative value.
+	TypeCounter MetricType = 1
+	// TypeGauge is an arbitrary value that can go up and down.
+	TypeGauge MetricType = 2
+)
+
+// NameLabel is the label holding the metric name.
+const NameLabel = "__name__"
+
+// Label is a single name/value pair identifying a series.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single value of a series at a point in time.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is a labeled series of samples.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// Name returns the value of the metric name label.
+func (ts *TimeSeries) Name() string {
+	for _, label := range ts.Labels {
+		if label.Name == NameLabel {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// Metadata describes a metric family.
+type Metadata struct {
+	FamilyName string
+	Type       MetricType
+}
+
+// WriteRequest is the payload of a Prometheus remote-write request.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+	Metadata   []Metadata
+}
+
+// MaxDecodedSize is the largest decompressed WriteRequest accepted by Decode.
+const MaxDecodedSize = 32 << 20
+
+var (
+	// ErrMalformed is returned when the payload is not a valid WriteRequest.
+	ErrMalformed = errors.New("malformed write request")
+	// ErrTooLarge is returned when the payload decompresses to more than MaxDecodedSize bytes.
+	ErrTooLarge = errors.New("write request too large")
+)
+
+// Decode decompresses a snappy block-encoded body and parses the WriteRequest protobuf message.
+// The decompressed size is checked against MaxDecodedSize before anything is allocated for it.
+func Decode(body []byte) (*WriteRequest, error) {
+	size, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("cant decompress write request: %w", err)
+	}
+	if size > MaxDecodedSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, size)
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("cant decompress write request: %w", err)
+	}
+	req := &WriteRequest{}
+	err = walk(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			ts, err := decodeTimeSeries(value)
+			if err != nil {
+				return err
+			}
+			req.Timeseries = append(req.Timeseries, ts)
+		case num == 3 && typ == protowire.BytesType:
+			md, err := decodeMetadata(value)
+			if err != nil {
+				return err
+			}
+			req.Metadata = append(req.Metadata, md)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeTimeSeries(data []byte) (TimeSeries, error) {
+	ts := TimeSeries{}
+	err := walk(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			label, err := decodeLabel(value)
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, label)
+		case num == 2 && typ == protowire.BytesType:
+			sample, err := decodeSample(value)
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, sample)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+func decodeLabel(data []byte) (Label, error) {
+	label := Label{}
+	err := walk(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			label.Name = string(value)
+		case num == 2 && typ == protowire.BytesType:
+			label.Value = string(value)
+		}
+		return nil
+	})
+	return label, err
+}
+
+func decodeSample(data []byte) (Sample, error) {
+	sample := Sample{}
+	err := walk(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			bits, _ := protowire.ConsumeFixed64(value)
+			sample.Value = math.Float64frombits(bits)
+		case num == 2 && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			sample.Timestamp = int64(v)
+		}
+		return nil
+	})
+	return sample, err
+}
+
+func decodeMetadata(data []byte) (Metadata, error) {
+	md := Metadata{}
+	err := walk(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			md.Type = MetricType(v)
+		case num == 2 && typ == protowire.BytesType:
+			md.FamilyName = string(value)
+		}
+		return nil
+	})
+	return md, err
+}
+
+// walk calls field for every field of a protobuf message.
+// For length-delimited fields value is the payload, otherwise it is the raw encoded value.
+func walk(data []byte, field func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w: %w", ErrMalformed, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		var value []byte
+		if typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(data)
+			if m < 0 {
+				return fmt.Errorf("%w: %w", ErrMalformed, protowire.ParseError(m))
+			}
+			value, n = v, m
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return fmt.Errorf("%w: %w", ErrMalformed, protowire.ParseError(n))
+			}
+			value = data[:n]
+		}
+		data = data[n:]
+
+		if err := field(num, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode serializes the WriteRequest protobuf message and compresses it with snappy.
+func Encode(req *WriteRequest) []byte {
+	var data []byte
+	for i := range req.Timeseries {
+		data = protowire.AppendTag(data, 1, protowire.BytesType)
+		data = protowire.AppendBytes(data, encodeTimeSeries(&req.Timeseries[i]))
+	}
+	for _, md := range req.Metadata {
+		var msg []byte
+		msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(md.Type))
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendString(msg, md.FamilyName)
+		data = protowire.AppendTag(data, 3, protowire.BytesType)
+		data = protowire.AppendBytes(data, msg)
+	}
+	return snappy.Encode(nil, data)
+}
+
+func encodeTimeSeries(ts *TimeSeries) []byte {
+	var data []byte
+	for _, label := range ts.Labels {
+		var msg []byte
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, label.Name)
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendString(msg, label.Value)
+		data = protowire.AppendTag(data, 1, protowire.BytesType)
+		data = protowire.AppendBytes(data, msg)
+	}
+	for _, sample := range ts.Samples {
+		var msg []byte
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(sample.Value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(sample.Timestamp))
+		data = protowire.AppendTag(data, 2, protowire.BytesType)
+		data = protowire.AppendBytes(data, msg)
+	}
+	return data
+}
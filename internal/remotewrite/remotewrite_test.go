@@ -0,0 +1,39 @@
+package remotewrite
+
+import (
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	req := &WriteRequest{
+		Timeseries: []TimeSeries{
+			{
+				Labels:  []Label{{Name: NameLabel, Value: "http_requests_total"}, {Name: "job", Value: "api"}},
+				Samples: []Sample{{Value: 10, Timestamp: 1000}, {Value: 12.5, Timestamp: 2000}},
+			},
+		},
+		Metadata: []Metadata{{FamilyName: "http_requests_total", Type: TypeCounter}},
+	}
+
+	decoded, err := Decode(Encode(req))
+	require.NoError(t, err)
+	assert.Equal(t, req, decoded)
+	assert.Equal(t, "http_requests_total", decoded.Timeseries[0].Name())
+}
+
+func TestDecode_Malformed(t *testing.T) {
+	_, err := Decode([]byte("not snappy"))
+	assert.Error(t, err)
+
+	_, err = Decode(snappy.Encode(nil, []byte{0x0a, 0xff}))
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestDecode_TooLarge(t *testing.T) {
+	_, err := Decode(snappy.Encode(nil, make([]byte, MaxDecodedSize+1)))
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
@@ -2,32 +2,107 @@ package server
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"slices"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	_ "metrics/docs"
 
+	"metrics/internal/config"
+	"metrics/internal/encryption"
+	"metrics/internal/grpcserver"
 	"metrics/internal/handlers"
 	"metrics/internal/middleware"
+	pb "metrics/internal/proto"
+	"metrics/internal/statsd"
 	"metrics/internal/storage"
+	"metrics/internal/tlsconfig"
+	"metrics/internal/utils"
 )
 
 // Config holds the server configuration parameters.
 type Config struct {
-	Address         string
-	Key             string
-	FileStoragePath string
-	DatabaseDSN     string
+	Address          string
+	Key              string
+	FileStoragePath  string
+	DatabaseDSN      string
+	StatsdUDPAddress string
+	StatsdTCPAddress string
+	GRPCAddress      string
+	// CryptoKey is the path of the PEM private key decrypting request bodies encrypted by agents, empty disables it.
+	CryptoKey string
+	// TLSCert and TLSKey are the paths of the PEM certificate and key served over HTTPS and gRPC,
+	// empty serves plain HTTP and gRPC.
+	TLSCert string
+	TLSKey  string
+	// TLSClientCA is the path of the PEM CA that must sign client certificates, empty accepts any client.
+	TLSClientCA string
+	// TrustedSubnet lists comma-separated CIDRs metrics can be written and deleted from over HTTP, gRPC and StatsD,
+	// empty accepts them from anywhere.
+	TrustedSubnet string
+	// LogLevel is the minimal level of logged messages, e.g. info.
+	LogLevel        string
+	Retention       storage.RetentionPolicy
 	StoreInterval   int
-	Restore         bool
-	StoreFile       bool
+	ShutdownTimeout time.Duration
+	// BatchWindow is how long batch IDs are remembered to drop duplicate deliveries, zero keeps the default.
+	BatchWindow time.Duration
+	Restore     bool
+	StoreFile   bool
+}
+
+// Validate checks that the configuration can be used to start the server.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Address == "" {
+		errs = append(errs, errors.New("address must not be empty"))
+	}
+	if c.StoreInterval < 0 {
+		errs = append(errs, fmt.Errorf("store interval must not be negative, got %d", c.StoreInterval))
+	}
+	if c.Retention.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("retention interval must be positive, got %s", c.Retention.Interval))
+	}
+	if c.Retention.HistoryMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("history max age must not be negative, got %s", c.Retention.HistoryMaxAge))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("shutdown timeout must not be negative, got %s", c.ShutdownTimeout))
+	}
+	if c.BatchWindow < 0 {
+		errs = append(errs, fmt.Errorf("batch window must not be negative, got %s", c.BatchWindow))
+	}
+	if err := tlsconfig.CheckPair(c.TLSCert, c.TLSKey); err != nil {
+		errs = append(errs, err)
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		errs = append(errs, errors.New("tls client ca needs a tls certificate"))
+	}
+	if _, err := middleware.ParseSubnets(c.TrustedSubnet); err != nil {
+		errs = append(errs, fmt.Errorf("bad trusted subnet: %w", err))
+	}
+	if c.LogLevel != "" {
+		if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+			errs = append(errs, fmt.Errorf("bad log level: %w", err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // Server represents the HTTP server for the metrics service.
@@ -35,7 +110,18 @@ type Server struct {
 	storage storage.MetricsStorage
 	handler *handlers.MetricsHandler
 	logger  *zap.Logger
-	config  Config
+	// key is shared by the hash middleware, so it can be replaced on reload.
+	key *utils.Key
+	// subnets and decryptionKey are shared by the middleware, so they can be replaced on reload.
+	subnets       *middleware.TrustedSubnets
+	decryptionKey *middleware.DecryptionKey
+	// level is the level of the logger, nil when the logger level cannot be changed.
+	level *zap.AtomicLevel
+	// reload loads the configuration again, nil disables reloading.
+	reload func() (*Config, error)
+	// configPath is the config file watched for changes, empty reloads on SIGHUP only.
+	configPath string
+	config     Config
 }
 
 // NewServer creates a new instance of the Server.
@@ -46,7 +132,18 @@ type Server struct {
 // @BasePath /.
 func NewServer(metricsStorage storage.MetricsStorage, logger *zap.Logger, config *Config) *Server {
 	handler := handlers.NewMetricsHandler(metricsStorage, logger)
-	return &Server{storage: metricsStorage, handler: handler, logger: logger, config: *config}
+	if config.BatchWindow > 0 {
+		handler.SetBatchWindow(config.BatchWindow)
+	}
+	return &Server{
+		storage:       metricsStorage,
+		handler:       handler,
+		logger:        logger,
+		key:           utils.NewKey(config.Key),
+		subnets:       middleware.NewTrustedSubnets(nil),
+		decryptionKey: middleware.NewDecryptionKey(nil),
+		config:        *config,
+	}
 }
 
 func registerPprofRoutes(router *gin.Engine) {
@@ -58,17 +155,212 @@ func registerPprofRoutes(router *gin.Engine) {
 	pprofGroup.GET("/trace", gin.WrapH(http.HandlerFunc(pprof.Trace)))
 }
 
+func (s *Server) startStatsd(ctx context.Context) (*statsd.Server, error) {
+	statsdServer := statsd.NewServer(s.storage, s.logger)
+	statsdServer.SetAllowedSources(s.subnets.Allowed)
+	if s.config.StatsdUDPAddress != "" {
+		if err := statsdServer.ListenUDP(ctx, s.config.StatsdUDPAddress); err != nil {
+			return nil, fmt.Errorf("cant start statsd: %w", err)
+		}
+	}
+	if s.config.StatsdTCPAddress != "" {
+		if err := statsdServer.ListenTCP(ctx, s.config.StatsdTCPAddress); err != nil {
+			return nil, fmt.Errorf("cant start statsd: %w", err)
+		}
+	}
+	return statsdServer, nil
+}
+
+// startGRPC starts the gRPC server if an address is configured, it returns nil otherwise.
+// The server uses TLS when tlsConfig is not nil.
+func (s *Server) startGRPC(tlsConfig *tls.Config) (*grpc.Server, error) {
+	if s.config.GRPCAddress == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", s.config.GRPCAddress)
+	if err != nil {
+		return nil, fmt.Errorf("cant start grpc: %w", err)
+	}
+
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			middleware.WithGRPCLogging(s.logger),
+			middleware.WithGRPCTrustedSubnets(s.subnets),
+			middleware.WithGRPCHashValidation(s.key),
+		),
+		grpc.ChainStreamInterceptor(
+			middleware.WithGRPCStreamLogging(s.logger),
+			middleware.WithGRPCStreamTrustedSubnets(s.subnets),
+			middleware.WithGRPCStreamHashValidation(s.key),
+		),
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(options...)
+	pb.RegisterMetricsServer(grpcServer, grpcserver.NewService(s.storage, s.handler, s.logger))
+
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			s.logger.Error("grpc server error", zap.Error(err))
+		}
+	}()
+	s.logger.Info("grpc server started", zap.String("addr", listener.Addr().String()), zap.Bool("tls", tlsConfig != nil))
+	return grpcServer, nil
+}
+
+// reloadConfig loads the configuration again and applies the settings that can change at runtime:
+// the key, the trusted subnets, the crypto key, the batch window and the log level.
+// Other settings are read once on start, their changes are logged and need a restart.
+func (s *Server) reloadConfig() {
+	next, err := s.reload()
+	if err != nil {
+		s.logger.Error("cant reload config, keep the current one", zap.Error(err))
+		return
+	}
+
+	s.key.Set(next.Key)
+	if subnets, err := middleware.ParseSubnets(next.TrustedSubnet); err != nil {
+		s.logger.Error("cant parse trusted subnet, keep the current one", zap.Error(err))
+	} else {
+		s.subnets.Set(subnets)
+	}
+	if privateKey, err := loadPrivateKey(next.CryptoKey); err != nil {
+		s.logger.Error("cant load crypto key, keep the current one", zap.Error(err))
+	} else {
+		s.decryptionKey.Set(privateKey)
+	}
+	batchWindow := next.BatchWindow
+	if batchWindow == 0 {
+		batchWindow = storage.DefaultBatchWindow
+	}
+	s.handler.SetBatchWindow(batchWindow)
+	if s.level != nil && next.LogLevel != "" {
+		level, err := zapcore.ParseLevel(next.LogLevel)
+		if err != nil {
+			s.logger.Error("cant parse log level", zap.Error(err))
+		} else {
+			s.level.SetLevel(level)
+		}
+	}
+	if changed := restartSettings(&s.config, next); len(changed) > 0 {
+		s.logger.Warn("config changes need a restart", zap.Strings("settings", changed))
+	}
+	s.logger.Info("config reloaded",
+		zap.String("logLevel", next.LogLevel),
+		zap.String("trustedSubnet", next.TrustedSubnet),
+		zap.String("cryptoKey", next.CryptoKey),
+		zap.Duration("batchWindow", batchWindow),
+	)
+}
+
+// restartSettings returns the names of the settings read once on start that differ between current and next.
+func restartSettings(current, next *Config) []string {
+	var changed []string
+	for _, setting := range []struct {
+		name    string
+		changed bool
+	}{
+		{"Address", current.Address != next.Address},
+		{"StoreInterval", current.StoreInterval != next.StoreInterval},
+		{"FileStoragePath", current.FileStoragePath != next.FileStoragePath},
+		{"Restore", current.Restore != next.Restore},
+		{"DatabaseDSN", current.DatabaseDSN != next.DatabaseDSN},
+		{"StatsdUDPAddress", current.StatsdUDPAddress != next.StatsdUDPAddress},
+		{"StatsdTCPAddress", current.StatsdTCPAddress != next.StatsdTCPAddress},
+		{"GRPCAddress", current.GRPCAddress != next.GRPCAddress},
+		{"Retention", !slices.Equal(current.Retention.Rules, next.Retention.Rules) ||
+			current.Retention.HistoryMaxAge != next.Retention.HistoryMaxAge ||
+			current.Retention.Interval != next.Retention.Interval},
+		{"ShutdownTimeout", current.ShutdownTimeout != next.ShutdownTimeout},
+		{"TLSCert", current.TLSCert != next.TLSCert},
+		{"TLSKey", current.TLSKey != next.TLSKey},
+		{"TLSClientCA", current.TLSClientCA != next.TLSClientCA},
+	} {
+		if setting.changed {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
+
+// loadPrivateKey loads the private key decrypting request bodies, it returns nil when path is empty.
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return encryption.LoadPrivateKey(path)
+}
+
+// waitContext runs wait and returns when it is done or ctx is done, whichever comes first.
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Start starts the HTTP server and listens for incoming requests.
 // @title Start Server
 // @description Starts the HTTP server with all routes and middleware.
 func (s *Server) Start(ctx context.Context) error {
+	privateKey, err := loadPrivateKey(s.config.CryptoKey)
+	if err != nil {
+		return fmt.Errorf("cant load crypto key: %w", err)
+	}
+	s.decryptionKey.Set(privateKey)
+
+	var tlsConfig *tls.Config
+	if s.config.TLSCert != "" {
+		var err error
+		tlsConfig, err = tlsconfig.NewServerConfig(s.config.TLSCert, s.config.TLSKey, s.config.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("cant load tls config: %w", err)
+		}
+	}
+
+	subnets, err := middleware.ParseSubnets(s.config.TrustedSubnet)
+	if err != nil {
+		return fmt.Errorf("cant parse trusted subnet: %w", err)
+	}
+	s.subnets.Set(subnets)
+
+	statsdServer, err := s.startStatsd(ctx)
+	if err != nil {
+		return err
+	}
+	grpcServer, err := s.startGRPC(tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	if s.reload != nil {
+		go config.Watch(ctx, s.configPath, config.DefaultWatchInterval, s.reloadConfig)
+	}
+
+	sweeperDone := make(chan struct{})
+	go func() {
+		defer close(sweeperDone)
+		if s.config.Retention.Enabled() {
+			storage.NewSweeper(s.storage, s.config.Retention, s.logger).Run(ctx)
+		}
+	}()
+
 	router := gin.Default()
 
 	router.Use(middleware.WithLogging(s.logger))
-	router.Use(middleware.WithHashValidation(s.config.Key))
+	router.Use(middleware.WithDecryption(s.decryptionKey))
+	router.Use(middleware.WithHashValidation(s.key))
 	router.Use(middleware.WithDecompress())
 	router.Use(middleware.WithCompress())
-	router.Use(middleware.WithHashHeader(s.config.Key))
+	router.Use(middleware.WithHashHeader(s.key))
 
 	// Pprof routes
 	registerPprofRoutes(router)
@@ -80,23 +372,46 @@ func (s *Server) Start(ctx context.Context) error {
 
 	router.GET("/ping", s.handler.PingHandler)
 
+	router.GET("/metrics", s.handler.GetPrometheusMetricsHandler)
+
 	router.POST("/value", s.handler.GetMetricsHandler)
 
-	router.POST("/update/gauge/:metricName/:metricValue", s.handler.SetGaugeMetricHandler)
+	// Routes writing or deleting metrics only accept requests from the trusted subnets.
+	trusted := middleware.WithTrustedSubnets(s.subnets)
+
+	router.DELETE("/value/:metricType/:metricName", trusted, s.handler.DeleteMetricHandler)
+
+	router.DELETE("/values", trusted, s.handler.DeleteMetricsHandler)
+
+	router.GET("/api/v1/query_range", s.handler.QueryRangeHandler)
+
+	router.GET("/api/v1/sources", s.handler.GetSourcesHandler)
+
+	router.POST("/update/gauge/:metricName/:metricValue", trusted, s.handler.SetGaugeMetricHandler)
+
+	router.POST("/update/counter/:metricName/:metricValue", trusted, s.handler.SetCounterMetricHandler)
 
-	router.POST("/update/counter/:metricName/:metricValue", s.handler.SetCounterMetricHandler)
+	router.POST("/updates", trusted, s.handler.SetMetricsHandler)
 
-	router.POST("/updates", s.handler.SetMetricsHandler)
+	router.POST("/update", trusted, s.handler.SetMetricHandler)
 
-	router.POST("/update", s.handler.SetMetricHandler)
+	router.POST("/api/v1/write", trusted, s.handler.RemoteWriteHandler)
 
 	server := &http.Server{
-		Addr:    s.config.Address,
-		Handler: router,
+		Addr:      s.config.Address,
+		Handler:   router,
+		TLSConfig: tlsConfig,
 	}
 
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			// The certificate is already in TLSConfig.
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
@@ -104,9 +419,46 @@ func (s *Server) Start(ctx context.Context) error {
 	<-ctx.Done()
 	log.Println("Shutting down server...")
 
-	if err := server.Shutdown(context.Background()); err != nil {
-		log.Fatalf("Server shutdown failed: %v", err)
+	return s.shutdown(server, grpcServer, statsdServer, sweeperDone)
+}
+
+// shutdown stops accepting metrics, waits for running writes and closes the storage, all within the shutdown timeout.
+// The storage is closed even if the earlier steps time out, so buffered data gets a chance to be flushed.
+// A zero timeout waits without limit.
+func (s *Server) shutdown(
+	server *http.Server,
+	grpcServer *grpc.Server,
+	statsdServer *statsd.Server,
+	sweeperDone <-chan struct{},
+) error {
+	ctx := context.Background()
+	if s.config.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.ShutdownTimeout)
+		defer cancel()
 	}
 
-	return nil
+	var errs []error
+	if err := server.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("cant shutdown http server: %w", err))
+	}
+	if grpcServer != nil {
+		if err := waitContext(ctx, grpcServer.GracefulStop); err != nil {
+			grpcServer.Stop()
+			errs = append(errs, fmt.Errorf("cant shutdown grpc server: %w", err))
+		}
+	}
+	if err := waitContext(ctx, statsdServer.Wait); err != nil {
+		errs = append(errs, fmt.Errorf("cant stop statsd: %w", err))
+	}
+	if err := waitContext(ctx, func() { <-sweeperDone }); err != nil {
+		errs = append(errs, fmt.Errorf("cant stop retention sweeper: %w", err))
+	}
+	if err := s.storage.Close(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("cant close storage: %w", err))
+	}
+	if len(errs) == 0 {
+		s.logger.Info("server stopped")
+	}
+	return errors.Join(errs...)
 }
@@ -4,86 +4,164 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
+	"time"
 
 	"go.uber.org/zap"
 
+	"metrics/internal/config"
 	"metrics/internal/storage"
 )
 
+// Defaults holds the values of the options set by neither a flag, an environment variable nor the config file.
+type Defaults struct {
+	Address          string
+	FileStoragePath  string
+	DatabaseDSN      string
+	Key              string
+	StatsdUDPAddress string
+	StatsdTCPAddress string
+	GRPCAddress      string
+	// Retention lists stale series TTL rules, e.g. "Heap*=1h,*=24h".
+	Retention         string
+	LogLevel          string
+	CryptoKey         string
+	TLSCert           string
+	TLSKey            string
+	TLSClientCA       string
+	TrustedSubnet     string
+	HistoryMaxAge     time.Duration
+	RetentionInterval time.Duration
+	ShutdownTimeout   time.Duration
+	BatchWindow       time.Duration
+	StoreInterval     int
+	Restore           bool
+}
+
 // GetConfiguredServer initializes and configures a new Server instance.
-// It reads configuration from flags and environment variables, sets up storage, and returns the configured server.
-func GetConfiguredServer(
-	addrDefault string,
-	intervalDefault int,
-	fileDefault string,
-	restoreDefault bool,
-	databaseDefault string,
-	keyDefault string,
-) (*Server, error) {
-	fs := flag.NewFlagSet("server", flag.ContinueOnError)
-
-	addr := fs.String("a", addrDefault, "address")
-	interval := fs.Int("i", intervalDefault, "store interval")
-	file := fs.String("f", fileDefault, "file storage path")
-	restore := fs.Bool("r", restoreDefault, "restore from file")
-	database := fs.String("d", databaseDefault, "database DSN")
-	key := fs.String("k", keyDefault, "encryption key")
-
-	if err := fs.Parse([]string{}); err != nil {
-		return nil, fmt.Errorf("failed to parse empty flags: %w", err)
-	}
+// It reads configuration from the arguments, environment variables and a config file, falling back to defaults,
+// sets up storage, and returns the configured server.
+// It returns config.ErrPrinted when printing the configuration was requested.
+func GetConfiguredServer(args []string, defaults Defaults) (*Server, error) {
+	// load is called again on every reload, the arguments and defaults stay the same.
+	load := func() (*Config, *config.Loader, error) {
+		fs := flag.NewFlagSet("server", flag.ContinueOnError)
+
+		addr := fs.String("a", defaults.Address, "address")
+		interval := fs.Int("i", defaults.StoreInterval, "store interval")
+		file := fs.String("f", defaults.FileStoragePath, "file storage path")
+		restore := fs.Bool("r", defaults.Restore, "restore from file")
+		database := fs.String("d", defaults.DatabaseDSN, "database DSN")
+		key := fs.String("k", defaults.Key, "encryption key")
+		statsdUDP := fs.String("statsd-udp", defaults.StatsdUDPAddress, "statsd udp address")
+		statsdTCP := fs.String("statsd-tcp", defaults.StatsdTCPAddress, "statsd tcp address")
+		grpcAddr := fs.String("grpc", defaults.GRPCAddress, "grpc address")
+		retention := fs.String("retention", defaults.Retention, "stale series ttl rules, e.g. Heap*=1h,*=24h")
+		historyMaxAge := fs.Duration("history-max-age", defaults.HistoryMaxAge, "max age of history samples")
+		retentionInterval := fs.Duration("retention-interval", defaults.RetentionInterval, "retention sweep interval")
+		shutdownTimeout := fs.Duration("shutdown-timeout", defaults.ShutdownTimeout, "graceful shutdown timeout")
+		batchWindow := fs.Duration("batch-window", defaults.BatchWindow, "how long batch ids are remembered")
+		logLevel := fs.String("log-level", defaults.LogLevel, "log level: debug, info, warn or error")
+		cryptoKey := fs.String("crypto-key", defaults.CryptoKey, "private key file decrypting agent payloads")
+		tlsCert := fs.String("tls-cert", defaults.TLSCert, "certificate file, serves https and grpc over tls when set")
+		tlsKey := fs.String("tls-key", defaults.TLSKey, "private key file of the tls certificate")
+		tlsClientCA := fs.String("tls-client-ca", defaults.TLSClientCA, "ca file verifying client certificates (mtls)")
+		trustedSubnet := fs.String("t", defaults.TrustedSubnet,
+			"comma-separated CIDRs metrics can be written and deleted from")
+
+		loader := config.NewLoader(fs,
+			config.Option{Flag: "a", Env: "ADDRESS"},
+			config.Option{Flag: "i", Env: "STORE_INTERVAL"},
+			config.Option{Flag: "f", Env: "FILE_STORAGE_PATH"},
+			config.Option{Flag: "r", Env: "RESTORE"},
+			config.Option{Flag: "d", Env: "DATABASE_DSN", Secret: true},
+			config.Option{Flag: "k", Env: "KEY", Secret: true},
+			config.Option{Flag: "statsd-udp", Env: "STATSD_UDP_ADDRESS"},
+			config.Option{Flag: "statsd-tcp", Env: "STATSD_TCP_ADDRESS"},
+			config.Option{Flag: "grpc", Env: "GRPC_ADDRESS"},
+			config.Option{Flag: "retention", Env: "RETENTION"},
+			config.Option{Flag: "history-max-age", Env: "HISTORY_MAX_AGE"},
+			config.Option{Flag: "retention-interval", Env: "RETENTION_INTERVAL"},
+			config.Option{Flag: "shutdown-timeout", Env: "SHUTDOWN_TIMEOUT"},
+			config.Option{Flag: "batch-window", Env: "BATCH_WINDOW"},
+			config.Option{Flag: "log-level", Env: "LOG_LEVEL"},
+			config.Option{Flag: "crypto-key", Env: "CRYPTO_KEY"},
+			config.Option{Flag: "tls-cert", Env: "TLS_CERT"},
+			config.Option{Flag: "tls-key", Env: "TLS_KEY"},
+			config.Option{Flag: "tls-client-ca", Env: "TLS_CLIENT_CA"},
+			config.Option{Flag: "t", Env: "TRUSTED_SUBNET"},
+		)
+		if err := loader.Load(args); err != nil {
+			return nil, nil, err
+		}
 
-	if value, ok := os.LookupEnv("ADDRESS"); ok && value != "" {
-		addr = &value
-	}
-	if value, ok := os.LookupEnv("STORE_INTERVAL"); ok && value != "" {
-		parsed, err := strconv.ParseInt(value, 10, 32)
-		if err == nil && parsed >= 0 {
-			valueint := int(parsed)
-			interval = &valueint
+		rules, err := storage.ParseRetentionRules(*retention)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cant parse retention: %w", err)
 		}
-	}
-	if value, ok := os.LookupEnv("FILE_STORAGE_PATH"); ok && value != "" {
-		file = &value
-	}
-	if value, ok := os.LookupEnv("RESTORE"); ok && value != "" {
-		parsed, err := strconv.ParseBool(value)
-		if err == nil {
-			restore = &parsed
+
+		config := &Config{
+			Retention: storage.RetentionPolicy{
+				Rules:         rules,
+				HistoryMaxAge: *historyMaxAge,
+				Interval:      *retentionInterval,
+			},
+			Address:          *addr,
+			StoreInterval:    *interval,
+			FileStoragePath:  *file,
+			Restore:          *restore,
+			DatabaseDSN:      *database,
+			Key:              *key,
+			StatsdUDPAddress: *statsdUDP,
+			StatsdTCPAddress: *statsdTCP,
+			GRPCAddress:      *grpcAddr,
+			ShutdownTimeout:  *shutdownTimeout,
+			BatchWindow:      *batchWindow,
+			LogLevel:         *logLevel,
+			CryptoKey:        *cryptoKey,
+			TLSCert:          *tlsCert,
+			TLSKey:           *tlsKey,
+			TLSClientCA:      *tlsClientCA,
+			TrustedSubnet:    *trustedSubnet,
 		}
+		if err := config.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("bad config: %w", err)
+		}
+		return config, loader, nil
 	}
-	if value, ok := os.LookupEnv("DATABASE_DSN"); ok && value != "" {
-		database = &value
+
+	config, loader, err := load()
+	if err != nil {
+		return nil, err
 	}
-	if value, ok := os.LookupEnv("KEY"); ok && value != "" {
-		key = &value
+
+	if err := loader.PrintIfRequested(os.Stdout); err != nil {
+		return nil, err
 	}
 
-	logger, err := zap.NewProduction()
+	level, err := zap.ParseAtomicLevel(config.LogLevel)
 	if err != nil {
-		return nil, fmt.Errorf("cant create logger: %w", err)
+		return nil, fmt.Errorf("cant parse log level: %w", err)
 	}
-
-	config := &Config{
-		Address:         *addr,
-		StoreInterval:   *interval,
-		FileStoragePath: *file,
-		Restore:         *restore,
-		DatabaseDSN:     *database,
-		Key:             *key,
+	zapConfig := zap.NewProductionConfig()
+	zapConfig.Level = level
+	logger, err := zapConfig.Build()
+	if err != nil {
+		return nil, fmt.Errorf("cant create logger: %w", err)
 	}
 
 	var serverStorage storage.MetricsStorage = nil
 
 	if config.DatabaseDSN != "" {
-		db, err := storage.NewDB(*database)
+		db, err := storage.NewDB(config.DatabaseDSN)
 		if err != nil {
 			return nil, fmt.Errorf("cant open database: %w", err)
 		}
 		serverStorage, err = storage.NewPosgresStorage(db, logger)
 		if err != nil {
 			logger.Warn("cant create postgres storage", zap.Error(err))
+			if closeErr := db.Close(); closeErr != nil {
+				logger.Warn("cant close database", zap.Error(closeErr))
+			}
 		} else {
 			logger.Info("use postgres storage", zap.Error(err))
 		}
@@ -99,11 +177,17 @@ func GetConfiguredServer(
 	}
 
 	if serverStorage == nil {
-		serverStorage = storage.NewMemStorage()
+		serverStorage = storage.NewMemStorageWithHistory(storage.DefaultHistorySize)
 		logger.Info("use mem storage", zap.Error(err))
 	}
 
 	server := NewServer(serverStorage, logger, config)
+	server.level = &level
+	server.configPath = loader.Path()
+	server.reload = func() (*Config, error) {
+		next, _, err := load()
+		return next, err
+	}
 
 	logger.Info("server started:",
 		zap.String("addr", config.Address),
@@ -111,6 +195,20 @@ func GetConfiguredServer(
 		zap.String("file", config.FileStoragePath),
 		zap.Bool("restore", config.Restore),
 		zap.String("database", config.DatabaseDSN),
+		zap.String("statsdUDP", config.StatsdUDPAddress),
+		zap.String("statsdTCP", config.StatsdTCPAddress),
+		zap.String("grpc", config.GRPCAddress),
+		zap.Any("retention", config.Retention.Rules),
+		zap.Duration("historyMaxAge", config.Retention.HistoryMaxAge),
+		zap.Duration("retentionInterval", config.Retention.Interval),
+		zap.Duration("shutdownTimeout", config.ShutdownTimeout),
+		zap.Duration("batchWindow", config.BatchWindow),
+		zap.String("logLevel", config.LogLevel),
+		zap.String("cryptoKey", config.CryptoKey),
+		zap.String("tlsCert", config.TLSCert),
+		zap.String("tlsClientCA", config.TLSClientCA),
+		zap.String("trustedSubnet", config.TrustedSubnet),
+		zap.String("config", server.configPath),
 	)
 
 	return server, nil
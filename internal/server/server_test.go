@@ -1,17 +1,33 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"metrics/internal/middleware"
 	"metrics/internal/storage"
+	"metrics/internal/tlsconfig"
+	"metrics/internal/tlsconfig/tlstest"
 
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestServerRoutes(t *testing.T) {
@@ -25,10 +41,10 @@ func TestServerRoutes(t *testing.T) {
 
 	router := gin.Default()
 	router.Use(middleware.WithLogging(server.logger))
-	router.Use(middleware.WithHashValidation(server.config.Key))
+	router.Use(middleware.WithHashValidation(server.key))
 	router.Use(middleware.WithDecompress())
 	router.Use(middleware.WithCompress())
-	router.Use(middleware.WithHashHeader(server.config.Key))
+	router.Use(middleware.WithHashHeader(server.key))
 
 	registerPprofRoutes(router)
 
@@ -55,3 +71,253 @@ func TestServerRoutes(t *testing.T) {
 	router.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusNotFound, resp.Code)
 }
+
+func TestServerStart_GracefulShutdown(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	file := filepath.Join(t.TempDir(), "store")
+	fileStorage, err := storage.NewFileStorage(file, int(time.Hour/time.Millisecond), false, logger)
+	assert.NoError(t, err)
+	assert.NoError(t, fileStorage.SetCounter(context.Background(), "PollCount", 5))
+
+	config := Config{
+		Address:          "127.0.0.1:0",
+		StatsdUDPAddress: "127.0.0.1:0",
+		GRPCAddress:      "127.0.0.1:0",
+		Retention:        storage.RetentionPolicy{HistoryMaxAge: time.Hour, Interval: time.Hour},
+		ShutdownTimeout:  time.Second,
+	}
+	server := NewServer(fileStorage, logger, &config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, server.Start(ctx))
+
+	assert.ErrorIs(t, fileStorage.SetCounter(context.Background(), "PollCount", 1), storage.ErrStorageClosed)
+
+	restored, err := storage.NewFileStorage(file, 0, true, logger)
+	assert.NoError(t, err)
+	value, ok, err := restored.GetCounter(context.Background(), "PollCount")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, storage.Counter(5), value)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Config{
+		Address:   "localhost:8080",
+		Retention: storage.RetentionPolicy{Interval: time.Minute},
+	}
+	assert.NoError(t, valid.Validate())
+
+	invalid := Config{
+		StoreInterval:   -1,
+		Retention:       storage.RetentionPolicy{HistoryMaxAge: -time.Second},
+		ShutdownTimeout: -time.Second,
+		BatchWindow:     -time.Second,
+		TLSKey:          "server.key",
+		TLSClientCA:     "ca.crt",
+		TrustedSubnet:   "192.168.1.1",
+	}
+	err := invalid.Validate()
+	if assert.Error(t, err) {
+		for _, want := range []string{"address", "store interval", "retention interval", "history max age",
+			"shutdown timeout", "batch window", "certificate and key", "client ca", "trusted subnet"} {
+			assert.Contains(t, err.Error(), want)
+		}
+	}
+}
+
+func writePrivateKey(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "private.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func TestServer_reloadConfig(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	core, logs := observer.New(zap.InfoLevel)
+	server := NewServer(storage.NewMemStorage(), zap.New(core), &Config{Key: "old", Address: "localhost:8080"})
+	server.level = &level
+	cryptoKey := writePrivateKey(t)
+
+	server.reload = func() (*Config, error) {
+		return &Config{
+			Key:           "new",
+			LogLevel:      "debug",
+			TrustedSubnet: "192.0.2.0/24",
+			CryptoKey:     cryptoKey,
+			Address:       "localhost:8080",
+		}, nil
+	}
+	server.reloadConfig()
+	assert.Equal(t, "new", server.key.Get())
+	assert.Equal(t, zap.DebugLevel, level.Level())
+	assert.Equal(t, "192.0.2.0/24", server.subnets.Get().String())
+	assert.NotNil(t, server.decryptionKey.Get())
+	assert.Empty(t, logs.FilterMessage("config changes need a restart").All())
+
+	// Settings read on start are reported, the others are still applied.
+	server.reload = func() (*Config, error) {
+		return &Config{Key: "new", Address: "localhost:9090", GRPCAddress: "localhost:3200"}, nil
+	}
+	server.reloadConfig()
+	assert.Empty(t, server.subnets.Get())
+	assert.Nil(t, server.decryptionKey.Get())
+	warnings := logs.FilterMessage("config changes need a restart").All()
+	require.Len(t, warnings, 1)
+	assert.Equal(t, []any{"Address", "GRPCAddress"}, warnings[0].ContextMap()["settings"])
+
+	// A configuration that cannot be loaded keeps the current one.
+	server.reload = func() (*Config, error) {
+		return nil, errors.New("bad config")
+	}
+	server.reloadConfig()
+	assert.Equal(t, "new", server.key.Get())
+
+	// A crypto key that cannot be loaded keeps the current one.
+	server.decryptionKey.Set(nil)
+	server.reload = func() (*Config, error) {
+		return &Config{CryptoKey: cryptoKey}, nil
+	}
+	server.reloadConfig()
+	server.reload = func() (*Config, error) {
+		return &Config{CryptoKey: filepath.Join(t.TempDir(), "missing.pem")}, nil
+	}
+	server.reloadConfig()
+	assert.NotNil(t, server.decryptionKey.Get())
+}
+
+func TestServerStart_BadCryptoKey(t *testing.T) {
+	config := Config{
+		Address:   "localhost:0",
+		CryptoKey: filepath.Join(t.TempDir(), "missing.pem"),
+		Retention: storage.RetentionPolicy{Interval: time.Minute},
+	}
+	server := NewServer(storage.NewMemStorage(), zaptest.NewLogger(t), &config)
+
+	err := server.Start(context.Background())
+	assert.ErrorContains(t, err, "cant load crypto key")
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestServerStart_MutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	serverCert, serverKey := ca.Issue(t, "server")
+	agentCert, agentKey := ca.Issue(t, "agent")
+
+	config := Config{
+		Address:     freeAddress(t),
+		TLSCert:     serverCert,
+		TLSKey:      serverKey,
+		TLSClientCA: ca.CertFile,
+		Retention:   storage.RetentionPolicy{Interval: time.Minute},
+	}
+	server := NewServer(storage.NewMemStorage(), zaptest.NewLogger(t), &config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}()
+
+	ping := func(tlsConfig *tls.Config) (int, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: time.Second}
+		resp, err := client.Get("https://" + config.Address + "/ping")
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	enrolled, err := tlsconfig.NewClientConfig(ca.CertFile, agentCert, agentKey)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		code, err := ping(enrolled)
+		return err == nil && code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	anonymous, err := tlsconfig.NewClientConfig(ca.CertFile, "", "")
+	require.NoError(t, err)
+	_, err = ping(anonymous)
+	assert.Error(t, err, "clients without a certificate must be rejected")
+}
+
+func TestServerStart_BadTLSCert(t *testing.T) {
+	config := Config{
+		Address:   "localhost:0",
+		TLSCert:   filepath.Join(t.TempDir(), "missing.crt"),
+		TLSKey:    filepath.Join(t.TempDir(), "missing.key"),
+		Retention: storage.RetentionPolicy{Interval: time.Minute},
+	}
+	server := NewServer(storage.NewMemStorage(), zaptest.NewLogger(t), &config)
+
+	err := server.Start(context.Background())
+	assert.ErrorContains(t, err, "cant load tls config")
+}
+
+func TestServerStart_TrustedSubnet(t *testing.T) {
+	config := Config{
+		Address:       freeAddress(t),
+		TrustedSubnet: "192.0.2.0/24",
+		Retention:     storage.RetentionPolicy{Interval: time.Minute},
+	}
+	server := NewServer(storage.NewMemStorage(), zaptest.NewLogger(t), &config)
+	server.reload = func() (*Config, error) {
+		return &Config{Address: config.Address, Retention: config.Retention}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}()
+
+	send := func(method, path string) int {
+		req, err := http.NewRequest(method, "http://"+config.Address+path, http.NoBody)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Eventually(t, func() bool {
+		return send(http.MethodGet, "/ping") == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond, "reads are not restricted")
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/update"},
+		{http.MethodPost, "/updates"},
+		{http.MethodPost, "/update/counter/PollCount/1"},
+		{http.MethodPost, "/api/v1/write"},
+		{http.MethodDelete, "/value/counter/PollCount"},
+		{http.MethodDelete, "/values"},
+	} {
+		assert.Equal(t, http.StatusForbidden, send(route.method, route.path), route.path)
+	}
+
+	// Reloading without a trusted subnet accepts writes on the running server.
+	server.reloadConfig()
+	assert.NotEqual(t, http.StatusForbidden, send(http.MethodDelete, "/values"))
+}
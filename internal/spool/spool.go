@@ -0,0 +1,224 @@
+// Package spool implements a bounded on-disk FIFO queue of batches.
+// Every batch is stored in its own segment file named after its sequence number,
+// so batches survive restarts and are read back in the order they were pushed.
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt = ".seg"
+	tmpExt     = ".tmp"
+)
+
+// ErrTooLarge is returned by Push for a batch larger than the byte limit of the spool.
+var ErrTooLarge = errors.New("batch exceeds spool size limit")
+
+// Limits bound a Spool, zero values disable a limit.
+// When a limit is exceeded the oldest segments are dropped.
+type Limits struct {
+	// MaxBytes is the total size of all segments.
+	MaxBytes int64
+	// MaxAge is the age after which a segment is dropped.
+	MaxAge time.Duration
+}
+
+// Stats describes the content of a Spool.
+type Stats struct {
+	// Oldest is the creation time of the oldest segment, zero if the spool is empty.
+	Oldest time.Time
+	// Bytes is the total size of all segments.
+	Bytes int64
+	// Segments is the number of batches waiting in the spool.
+	Segments int
+	// Dropped is the number of batches dropped because of the limits since the spool was opened.
+	Dropped uint64
+}
+
+type segment struct {
+	created time.Time
+	seq     uint64
+	size    int64
+}
+
+// Spool is a bounded on-disk FIFO queue of batches, safe for concurrent use.
+type Spool struct {
+	dir      string
+	segments []segment
+	limits   Limits
+	bytes    int64
+	nextSeq  uint64
+	dropped  uint64
+	mu       sync.Mutex
+}
+
+// Open opens the spool in dir, creating the directory if needed and loading the segments left by a previous run.
+func Open(dir string, limits Limits) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cant create spool dir: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cant read spool dir: %w", err)
+	}
+
+	s := &Spool{dir: dir, limits: limits}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, tmpExt) {
+			// A segment that was being written when the process stopped.
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("cant stat segment %s: %w", name, err)
+		}
+		s.segments = append(s.segments, segment{seq: seq, size: info.Size(), created: info.ModTime()})
+		s.bytes += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	if len(s.segments) > 0 {
+		s.nextSeq = s.segments[len(s.segments)-1].seq + 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enforceLimitsLocked(time.Now())
+	return s, nil
+}
+
+// Push appends a batch to the spool, dropping the oldest segments if the limits are exceeded.
+func (s *Spool) Push(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.limits.MaxBytes > 0 && int64(len(data)) > s.limits.MaxBytes {
+		s.dropped++
+		return ErrTooLarge
+	}
+
+	seq := s.nextSeq
+	path := s.path(seq)
+	if err := writeFile(path+tmpExt, data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tmpExt, path); err != nil {
+		return fmt.Errorf("cant rename segment: %w", err)
+	}
+
+	now := time.Now()
+	s.segments = append(s.segments, segment{seq: seq, size: int64(len(data)), created: now})
+	s.bytes += int64(len(data))
+	s.nextSeq++
+	s.enforceLimitsLocked(now)
+	return nil
+}
+
+// Peek returns the oldest batch with its sequence number, or false if the spool is empty.
+// The batch stays in the spool until it is acknowledged with Ack.
+func (s *Spool) Peek() (uint64, []byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.enforceLimitsLocked(time.Now())
+	if len(s.segments) == 0 {
+		return 0, nil, false, nil
+	}
+	oldest := s.segments[0]
+	data, err := os.ReadFile(s.path(oldest.seq))
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("cant read segment: %w", err)
+	}
+	return oldest.seq, data, true, nil
+}
+
+// Ack removes the batch with the given sequence number, doing nothing if it was already dropped.
+func (s *Spool) Ack(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, seg := range s.segments {
+		if seg.seq == seq {
+			return s.removeLocked(i)
+		}
+	}
+	return nil
+}
+
+// Stats returns the current depth of the spool.
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := Stats{Bytes: s.bytes, Segments: len(s.segments), Dropped: s.dropped}
+	if len(s.segments) > 0 {
+		stats.Oldest = s.segments[0].created
+	}
+	return stats
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// enforceLimitsLocked drops expired segments and then the oldest ones until the spool fits its byte limit.
+func (s *Spool) enforceLimitsLocked(now time.Time) {
+	for len(s.segments) > 0 {
+		expired := s.limits.MaxAge > 0 && now.Sub(s.segments[0].created) > s.limits.MaxAge
+		oversized := s.limits.MaxBytes > 0 && s.bytes > s.limits.MaxBytes
+		if !expired && !oversized {
+			return
+		}
+		if err := s.removeLocked(0); err != nil {
+			// Forget the segment anyway, so a broken file cannot block the queue.
+			s.bytes -= s.segments[0].size
+			s.segments = s.segments[1:]
+		}
+		s.dropped++
+	}
+}
+
+func (s *Spool) removeLocked(i int) error {
+	if err := os.Remove(s.path(s.segments[i].seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cant remove segment: %w", err)
+	}
+	s.bytes -= s.segments[i].size
+	s.segments = append(s.segments[:i], s.segments[i+1:]...)
+	return nil
+}
+
+func writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("cant create segment: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cant write segment: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cant sync segment: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cant close segment: %w", err)
+	}
+	return nil
+}
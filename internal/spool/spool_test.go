@@ -0,0 +1,135 @@
+package spool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpool_FIFO(t *testing.T) {
+	s, err := Open(t.TempDir(), Limits{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, ok, err := s.Peek(); ok || err != nil {
+		t.Fatalf("expected empty spool, got %v %v", ok, err)
+	}
+
+	for _, batch := range []string{"first", "second", "third"} {
+		if err := s.Push([]byte(batch)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if stats := s.Stats(); stats.Segments != 3 || stats.Bytes != 16 || stats.Oldest.IsZero() {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	for _, want := range []string{"first", "second", "third"} {
+		seq, data, ok, err := s.Peek()
+		if err != nil || !ok {
+			t.Fatalf("expected a batch, got %v %v", ok, err)
+		}
+		if string(data) != want {
+			t.Fatalf("expected %q, got %q", want, data)
+		}
+		if err := s.Ack(seq); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if stats := s.Stats(); stats.Segments != 0 || stats.Bytes != 0 {
+		t.Fatalf("expected empty spool, got %+v", stats)
+	}
+}
+
+func TestSpool_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, Limits{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = s.Push([]byte("first"))
+	_ = s.Push([]byte("second"))
+	seq, _, _, _ := s.Peek()
+	_ = s.Ack(seq)
+
+	// A segment torn by a crash while being written is discarded.
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000002.seg.tmp"), []byte("torn"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reopened, err := Open(dir, Limits{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = reopened.Push([]byte("third"))
+
+	var got []string
+	for {
+		seq, data, ok, err := reopened.Peek()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, string(data))
+		_ = reopened.Ack(seq)
+	}
+	if len(got) != 2 || got[0] != "second" || got[1] != "third" {
+		t.Fatalf("expected second and third, got %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000002.seg.tmp")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected torn segment to be removed, got %v", err)
+	}
+}
+
+func TestSpool_MaxBytes(t *testing.T) {
+	s, err := Open(t.TempDir(), Limits{MaxBytes: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_ = s.Push([]byte("aaaa"))
+	_ = s.Push([]byte("bbbb"))
+	_ = s.Push([]byte("cccc"))
+	if err := s.Push([]byte("too large batch")); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+
+	stats := s.Stats()
+	if stats.Segments != 2 || stats.Bytes != 8 || stats.Dropped != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if _, data, _, _ := s.Peek(); string(data) != "bbbb" {
+		t.Fatalf("expected oldest batch to be dropped, got %q", data)
+	}
+}
+
+func TestSpool_MaxAge(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, Limits{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = s.Push([]byte("old"))
+	_ = s.Push([]byte("new"))
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "00000000000000000000.seg"), old, old); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reopened, err := Open(dir, Limits{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, data, _, _ := reopened.Peek(); string(data) != "new" {
+		t.Fatalf("expected expired batch to be dropped, got %q", data)
+	}
+	if stats := reopened.Stats(); stats.Segments != 1 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
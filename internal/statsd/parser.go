@@ -0,0 +1,99 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"metrics/internal/storage"
+)
+
+// Metric types understood by the parser.
+const (
+	TypeCounter = "c"
+	TypeGauge   = "g"
+	TypeSet     = "s"
+)
+
+// ErrUnsupportedType is returned for metric types the server cannot store, such as timers.
+var ErrUnsupportedType = errors.New("unsupported statsd metric type")
+
+// Line is a single parsed StatsD metric.
+type Line struct {
+	Labels storage.Labels
+	Name   string
+	Type   string
+	// Member is the raw value of set lines, which is not parsed as a number.
+	Member     string
+	Value      float64
+	SampleRate float64
+	// Relative is set for gauges sent with an explicit sign, which adjust the current value.
+	Relative bool
+}
+
+// ParseLine parses a StatsD line of the form name:value|type[|@rate][|#tag:value,...].
+// DogStatsD tags become labels; tags without a value get an empty label value.
+func ParseLine(line string) (Line, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return Line{}, fmt.Errorf("no metric name in %q", line)
+	}
+	if err := storage.ValidateName(name); err != nil {
+		return Line{}, fmt.Errorf("bad metric name in %q: %w", line, err)
+	}
+
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return Line{}, fmt.Errorf("no metric type in %q", line)
+	}
+
+	parsed := Line{Name: name, Type: parts[1], SampleRate: 1}
+	rawValue := parts[0]
+	switch parsed.Type {
+	case TypeCounter, TypeGauge:
+		value, err := strconv.ParseFloat(rawValue, 64)
+		if err != nil {
+			return Line{}, fmt.Errorf("bad value in %q: %w", line, err)
+		}
+		parsed.Value = value
+		parsed.Relative = parsed.Type == TypeGauge && (rawValue[0] == '+' || rawValue[0] == '-')
+	case TypeSet:
+		if rawValue == "" {
+			return Line{}, fmt.Errorf("no set member in %q", line)
+		}
+		parsed.Member = rawValue
+	default:
+		return Line{}, fmt.Errorf("%w: %q", ErrUnsupportedType, parsed.Type)
+	}
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Line{}, fmt.Errorf("bad sample rate in %q", line)
+			}
+			parsed.SampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			parsed.Labels = parseTags(part[1:])
+			if err := parsed.Labels.Validate(); err != nil {
+				return Line{}, fmt.Errorf("bad tags in %q: %w", line, err)
+			}
+		}
+	}
+
+	return parsed, nil
+}
+
+func parseTags(s string) storage.Labels {
+	labels := storage.Labels{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(tag, ":")
+		labels[name] = value
+	}
+	return labels
+}
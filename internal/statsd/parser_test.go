@@ -0,0 +1,77 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"metrics/internal/storage"
+)
+
+func TestParseLine(t *testing.T) {
+	testCases := []struct {
+		name     string
+		line     string
+		expected Line
+		wantErr  bool
+	}{
+		{
+			name:     "counter",
+			line:     "requests:1|c",
+			expected: Line{Name: "requests", Type: TypeCounter, Value: 1, SampleRate: 1},
+		},
+		{
+			name:     "sampled counter",
+			line:     "requests:2|c|@0.1",
+			expected: Line{Name: "requests", Type: TypeCounter, Value: 2, SampleRate: 0.1},
+		},
+		{
+			name:     "gauge",
+			line:     "temperature:3.2|g",
+			expected: Line{Name: "temperature", Type: TypeGauge, Value: 3.2, SampleRate: 1},
+		},
+		{
+			name:     "gauge increment",
+			line:     "temperature:+3|g",
+			expected: Line{Name: "temperature", Type: TypeGauge, Value: 3, SampleRate: 1, Relative: true},
+		},
+		{
+			name:     "gauge decrement",
+			line:     "temperature:-2|g",
+			expected: Line{Name: "temperature", Type: TypeGauge, Value: -2, SampleRate: 1, Relative: true},
+		},
+		{
+			name: "tags",
+			line: "requests:1|c|@0.5|#host:a,canary",
+			expected: Line{
+				Name: "requests", Type: TypeCounter, Value: 1, SampleRate: 0.5,
+				Labels: storage.Labels{"host": "a", "canary": ""},
+			},
+		},
+		{
+			name:     "set",
+			line:     "users:alice|s",
+			expected: Line{Name: "users", Type: TypeSet, Member: "alice", SampleRate: 1},
+		},
+		{name: "empty set member", line: "users:|s", wantErr: true},
+		{name: "bad tags", line: "requests:1|c|#bad-tag:a", wantErr: true},
+		{name: "no name", line: ":1|c", wantErr: true},
+		{name: "series key name", line: `requests{host="victim"}:1|c`, wantErr: true},
+		{name: "no type", line: "requests:1", wantErr: true},
+		{name: "bad value", line: "requests:abc|c", wantErr: true},
+		{name: "bad rate", line: "requests:1|c|@2", wantErr: true},
+		{name: "timer", line: "latency:320|ms", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			line, err := ParseLine(tc.line)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, line)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"metrics/internal/storage"
+)
+
+const maxPacketSize = 65535
+
+// Server receives StatsD metrics over UDP or TCP and writes them to the storage.
+type Server struct {
+	storage storage.MetricsStorage
+	logger  *zap.Logger
+	// allowed filters the sources of metrics, nil accepts all of them.
+	allowed func(ip net.IP) bool
+	// wg tracks listeners and connections, so Wait can tell when no more metrics are written.
+	wg sync.WaitGroup
+}
+
+// NewServer creates a new instance of Server.
+func NewServer(metricsStorage storage.MetricsStorage, logger *zap.Logger) *Server {
+	return &Server{storage: metricsStorage, logger: logger}
+}
+
+// SetAllowedSources makes the server drop metrics from addresses allowed rejects, e.g. outside trusted subnets.
+// It must be called before the listeners are started.
+func (s *Server) SetAllowedSources(allowed func(ip net.IP) bool) {
+	s.allowed = allowed
+}
+
+// trusted reports whether metrics from addr are accepted.
+func (s *Server) trusted(addr net.Addr) bool {
+	if s.allowed == nil {
+		return true
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	if ip != nil && s.allowed(ip) {
+		return true
+	}
+	s.logger.Warn("statsd metrics from untrusted source dropped", zap.Stringer("addr", addr))
+	return false
+}
+
+// ListenUDP binds the UDP address and serves packets until ctx is cancelled.
+func (s *Server) ListenUDP(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("cant listen statsd udp: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := conn.Close(); err != nil {
+			s.logger.Error("cant close statsd udp listener", zap.Error(err))
+		}
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.logger.Error("cant read statsd packet", zap.Error(err))
+				}
+				return
+			}
+			if !s.trusted(addr) {
+				continue
+			}
+			s.Process(ctx, strings.Split(string(buf[:n]), "\n"))
+		}
+	}()
+
+	s.logger.Info("statsd udp listener started", zap.String("addr", conn.LocalAddr().String()))
+	return nil
+}
+
+// ListenTCP binds the TCP address and serves newline-separated metrics until ctx is cancelled.
+func (s *Server) ListenTCP(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cant listen statsd tcp: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := listener.Close(); err != nil {
+			s.logger.Error("cant close statsd tcp listener", zap.Error(err))
+		}
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.logger.Error("cant accept statsd connection", zap.Error(err))
+				}
+				return
+			}
+			if !s.trusted(conn.RemoteAddr()) {
+				if err := conn.Close(); err != nil {
+					s.logger.Error("cant close statsd connection", zap.Error(err))
+				}
+				continue
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serveConn(ctx, conn)
+			}()
+		}
+	}()
+
+	s.logger.Info("statsd tcp listener started", zap.String("addr", listener.Addr().String()))
+	return nil
+}
+
+// Wait blocks until all listeners and connections have stopped after their context was cancelled.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-connCtx.Done()
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error("cant close statsd connection", zap.Error(err))
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxPacketSize)
+	for scanner.Scan() {
+		s.Process(connCtx, []string{scanner.Text()})
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Error("cant read statsd connection", zap.Error(err))
+	}
+}
+
+// Process parses the lines and stores them as one batch.
+// Invalid lines are logged and skipped.
+func (s *Server) Process(ctx context.Context, lines []string) {
+	gauges := make(map[string]storage.Gauge)
+	// gaugeDeltas are relative changes of gauges not set in the batch, added atomically by the storage.
+	gaugeDeltas := make(map[string]storage.Gauge)
+	counters := make(map[string]storage.Counter)
+	sets := make(map[string]*storage.HyperLogLog)
+
+	for _, raw := range lines {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		line, err := ParseLine(raw)
+		if err != nil {
+			s.logger.Warn("cant parse statsd line", zap.String("line", raw), zap.Error(err))
+			continue
+		}
+
+		key := storage.SeriesKey(line.Name, line.Labels)
+		switch line.Type {
+		case TypeCounter:
+			counters[key] += storage.Counter(math.Round(line.Value / line.SampleRate))
+		case TypeGauge:
+			switch _, ok := gauges[key]; {
+			case !line.Relative:
+				gauges[key] = storage.Gauge(line.Value)
+				delete(gaugeDeltas, key)
+			case ok:
+				gauges[key] += storage.Gauge(line.Value)
+			default:
+				gaugeDeltas[key] += storage.Gauge(line.Value)
+			}
+		case TypeSet:
+			if _, ok := sets[key]; !ok {
+				sets[key] = storage.NewHyperLogLog()
+			}
+			sets[key].Add(line.Member)
+		}
+	}
+
+	if len(gauges) > 0 {
+		if err := s.storage.SetGauges(ctx, gauges); err != nil {
+			s.logger.Error("cant set gauges", zap.Error(err))
+		}
+	}
+	if len(gaugeDeltas) > 0 {
+		if err := s.storage.AddGauges(ctx, gaugeDeltas); err != nil {
+			s.logger.Error("cant add gauges", zap.Error(err))
+		}
+	}
+	if len(counters) > 0 {
+		if err := s.storage.SetCounters(ctx, counters); err != nil {
+			s.logger.Error("cant set counters", zap.Error(err))
+		}
+	}
+	if len(sets) > 0 {
+		if err := s.storage.SetSets(ctx, sets); err != nil {
+			s.logger.Error("cant set sets", zap.Error(err))
+		}
+	}
+}
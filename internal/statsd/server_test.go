@@ -0,0 +1,164 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"metrics/internal/storage"
+)
+
+func TestServer_Process(t *testing.T) {
+	ctx := context.Background()
+	memStorage := storage.NewMemStorage()
+	require.NoError(t, memStorage.SetGauge(ctx, "temperature", 10))
+
+	server := NewServer(memStorage, zaptest.NewLogger(t))
+	server.Process(ctx, []string{
+		"requests:1|c",
+		"requests:2|c|@0.5",
+		"temperature:+3|g",
+		"temperature:-1|g",
+		"humidity:40|g",
+		"humidity:+2|g",
+		"latency:320|ms",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+		"garbage",
+		"",
+	})
+
+	counter, _, _ := memStorage.GetCounter(ctx, "requests")
+	assert.Equal(t, storage.Counter(5), counter)
+
+	gauge, _, _ := memStorage.GetGauge(ctx, "temperature")
+	assert.Equal(t, storage.Gauge(12), gauge)
+
+	gauge, _, _ = memStorage.GetGauge(ctx, "humidity")
+	assert.Equal(t, storage.Gauge(42), gauge)
+
+	users, _, _ := memStorage.GetSet(ctx, "users")
+	assert.Equal(t, uint64(2), users.Estimate())
+
+	_, ok, _ := memStorage.GetGauge(ctx, "latency")
+	assert.False(t, ok)
+}
+
+func TestServer_ProcessConcurrentRelativeGauges(t *testing.T) {
+	ctx := context.Background()
+	memStorage := storage.NewMemStorage()
+	server := NewServer(memStorage, zaptest.NewLogger(t))
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Process(ctx, []string{"queue:+1|g"})
+		}()
+	}
+	wg.Wait()
+
+	gauge, _, _ := memStorage.GetGauge(ctx, "queue")
+	assert.Equal(t, storage.Gauge(50), gauge, "concurrent relative updates must not be lost")
+}
+
+func TestServer_Listen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	memStorage := storage.NewMemStorage()
+	server := NewServer(memStorage, zaptest.NewLogger(t))
+
+	udpAddr := freeAddr(t, "udp")
+	tcpAddr := freeAddr(t, "tcp")
+	require.NoError(t, server.ListenUDP(ctx, udpAddr))
+	require.NoError(t, server.ListenTCP(ctx, tcpAddr))
+
+	udpConn, err := net.Dial("udp", udpAddr)
+	require.NoError(t, err)
+	defer func() { _ = udpConn.Close() }()
+	_, err = fmt.Fprint(udpConn, "udp_requests:1|c\nudp_gauge:7|g")
+	require.NoError(t, err)
+
+	tcpConn, err := net.Dial("tcp", tcpAddr)
+	require.NoError(t, err)
+	_, err = fmt.Fprint(tcpConn, "tcp_requests:2|c\ntcp_requests:3|c\n")
+	require.NoError(t, err)
+	require.NoError(t, tcpConn.Close())
+
+	assert.Eventually(t, func() bool {
+		udpCounter, _, _ := memStorage.GetCounter(ctx, "udp_requests")
+		udpGauge, _, _ := memStorage.GetGauge(ctx, "udp_gauge")
+		tcpCounter, _, _ := memStorage.GetCounter(ctx, "tcp_requests")
+		return udpCounter == 1 && udpGauge == 7 && tcpCounter == 5
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServer_AllowedSources(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	memStorage := storage.NewMemStorage()
+	server := NewServer(memStorage, zaptest.NewLogger(t))
+	var trusted atomic.Bool
+	server.SetAllowedSources(func(ip net.IP) bool {
+		return trusted.Load() && ip.IsLoopback()
+	})
+
+	udpAddr := freeAddr(t, "udp")
+	tcpAddr := freeAddr(t, "tcp")
+	require.NoError(t, server.ListenUDP(ctx, udpAddr))
+	require.NoError(t, server.ListenTCP(ctx, tcpAddr))
+
+	send := func() {
+		udpConn, err := net.Dial("udp", udpAddr)
+		require.NoError(t, err)
+		defer func() { _ = udpConn.Close() }()
+		_, err = fmt.Fprint(udpConn, "udp_requests:1|c")
+		require.NoError(t, err)
+
+		tcpConn, err := net.Dial("tcp", tcpAddr)
+		require.NoError(t, err)
+		_, _ = fmt.Fprint(tcpConn, "tcp_requests:1|c\n")
+		_ = tcpConn.Close()
+	}
+
+	send()
+	time.Sleep(50 * time.Millisecond)
+	_, ok, _ := memStorage.GetCounter(ctx, "udp_requests")
+	assert.False(t, ok, "udp packets from untrusted sources must be dropped")
+	_, ok, _ = memStorage.GetCounter(ctx, "tcp_requests")
+	assert.False(t, ok, "tcp connections from untrusted sources must be closed")
+
+	trusted.Store(true)
+	send()
+	assert.Eventually(t, func() bool {
+		udpCounter, _, _ := memStorage.GetCounter(ctx, "udp_requests")
+		tcpCounter, _, _ := memStorage.GetCounter(ctx, "tcp_requests")
+		return udpCounter == 1 && tcpCounter == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func freeAddr(t *testing.T, network string) string {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket(network, "127.0.0.1:0")
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		return conn.LocalAddr().String()
+	}
+	listener, err := net.Listen(network, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	return listener.Addr().String()
+}
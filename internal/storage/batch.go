@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultBatchWindow is how long batch IDs are remembered by default.
+const DefaultBatchWindow = 24 * time.Hour
+
+// batchClaim is a batch ID claimed at a given time.
+type batchClaim struct {
+	at time.Time
+	id string
+}
+
+// ErrBatchInFlight is returned by ApplyBatch for a batch ID that another delivery is still applying.
+// The delivery must be retried later, the batch may yet fail and be released.
+var ErrBatchInFlight = errors.New("batch is being applied")
+
+// Batch holds the updates of a metrics batch, applied at once by ApplyBatch.
+type Batch struct {
+	Gauges     map[string]Gauge
+	Counters   map[string]Counter
+	Histograms map[string]*Histogram
+	Sets       map[string]*HyperLogLog
+}
+
+// batchRegistry remembers claimed batch IDs in claim order, so expired ones are dropped from the front.
+// IDs of batches being applied are also kept in inFlight until the batch is applied or released.
+type batchRegistry struct {
+	ids      map[string]time.Time
+	inFlight map[string]struct{}
+	claims   []batchClaim
+	mu       sync.Mutex
+}
+
+func newBatchRegistry() *batchRegistry {
+	return &batchRegistry{ids: make(map[string]time.Time), inFlight: make(map[string]struct{})}
+}
+
+// claim records an ID as in flight, reporting false if it was applied within the window
+// and ErrBatchInFlight if it is still in flight.
+func (r *batchRegistry) claim(id string, window time.Duration, now time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expired := now.Add(-window)
+	for len(r.claims) > 0 && !r.claims[0].at.After(expired) {
+		front := r.claims[0]
+		// A newer claim of the same ID stays, only its own entry expires it.
+		if at, ok := r.ids[front.id]; ok && at.Equal(front.at) {
+			delete(r.ids, front.id)
+		}
+		r.claims = r.claims[1:]
+	}
+
+	if _, ok := r.inFlight[id]; ok {
+		return false, ErrBatchInFlight
+	}
+	if _, ok := r.ids[id]; ok {
+		return false, nil
+	}
+	r.ids[id] = now
+	r.inFlight[id] = struct{}{}
+	r.claims = append(r.claims, batchClaim{id: id, at: now})
+	return true, nil
+}
+
+// done marks a claimed ID as applied.
+func (r *batchRegistry) done(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.inFlight, id)
+}
+
+// release forgets a claimed ID, so the batch is applied on retry.
+func (r *batchRegistry) release(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ids, id)
+	delete(r.inFlight, id)
+}
+
+// apply runs op for a batch ID claimed within the window, marking the ID applied only once op succeeds.
+// A batch without an ID is always applied.
+func (r *batchRegistry) apply(id string, window time.Duration, op func() error) (bool, error) {
+	if id == "" {
+		return true, op()
+	}
+	claimed, err := r.claim(id, window, time.Now())
+	if err != nil || !claimed {
+		return false, err
+	}
+	if err := op(); err != nil {
+		r.release(id)
+		return false, err
+	}
+	r.done(id)
+	return true, nil
+}
+
+// ApplyBatch applies a batch once within the window.
+// IDs live in memory only, so they are forgotten on restart.
+func (ms *MemStorage) ApplyBatch(ctx context.Context, id string, window time.Duration, batch *Batch) (bool, error) {
+	return ms.batches.apply(id, window, func() error { return ms.applyBatch(ctx, batch, time.Now()) })
+}
+
+// applyBatch validates sets and merges histograms first, as only they can fail, so a failed batch stores nothing.
+// Gauge and counter samples are recorded at now.
+func (ms *MemStorage) applyBatch(ctx context.Context, batch *Batch, now time.Time) error {
+	if err := checkSets(batch.Sets); err != nil {
+		return err
+	}
+	if len(batch.Histograms) > 0 {
+		if err := ms.SetHistograms(ctx, batch.Histograms); err != nil {
+			return err
+		}
+	}
+	if len(batch.Sets) > 0 {
+		if err := ms.SetSets(ctx, batch.Sets); err != nil {
+			return err
+		}
+	}
+	ms.setGauges(batch.Gauges, now)
+	ms.setCounters(batch.Counters, now)
+	return nil
+}
+
+// checkBatch reports an error if applyBatch would fail on the batch.
+func (ms *MemStorage) checkBatch(batch *Batch) error {
+	if err := ms.checkHistograms(batch.Histograms); err != nil {
+		return err
+	}
+	return checkSets(batch.Sets)
+}
@@ -11,11 +11,15 @@ import (
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 )
 
+// driverName is the database/sql driver registered by the pgx stdlib package.
+// Statement errors of this driver are *pgconn.PgError, checked by isTransient.
+const driverName = "pgx"
+
 func NewDB(database string) (*sql.DB, error) {
 	if err := runMigrations(database); err != nil {
 		return nil, fmt.Errorf("failed to run DB migrations: %w", err)
 	}
-	db, err := sql.Open("postgres", database)
+	db, err := sql.Open(driverName, database)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create db: %w", err)
 	}
@@ -0,0 +1,81 @@
+package storage
+
+import "time"
+
+// GaugeBucket aggregates gauge samples reported within one step.
+type GaugeBucket struct {
+	Timestamp time.Time `json:"timestamp"`
+	Avg       float64   `json:"avg"`
+	Min       Gauge     `json:"min"`
+	Max       Gauge     `json:"max"`
+	Last      Gauge     `json:"last"`
+	Count     int       `json:"count"`
+}
+
+// CounterBucket aggregates counter samples reported within one step.
+type CounterBucket struct {
+	Timestamp time.Time `json:"timestamp"`
+	Rate      float64   `json:"rate"`
+	Increase  Counter   `json:"increase"`
+}
+
+// bucketIndex returns the index of the step containing ts, or -1 if ts is outside [from, to].
+func bucketIndex(ts, from, to time.Time, step time.Duration) int {
+	if !inRange(ts, from, to) {
+		return -1
+	}
+	return int(ts.Sub(from) / step)
+}
+
+// DownsampleGauges groups samples into step-sized buckets starting at from.
+// Samples must be ordered oldest first; empty buckets are omitted.
+func DownsampleGauges(samples []GaugeSample, from, to time.Time, step time.Duration) []GaugeBucket {
+	buckets := []GaugeBucket{}
+	last := -1
+	var sum float64
+	for _, sample := range samples {
+		idx := bucketIndex(sample.Timestamp, from, to, step)
+		if idx < 0 {
+			continue
+		}
+		if idx != last {
+			buckets = append(buckets, GaugeBucket{
+				Timestamp: from.Add(time.Duration(idx) * step),
+				Min:       sample.Value,
+				Max:       sample.Value,
+			})
+			last = idx
+			sum = 0
+		}
+		bucket := &buckets[len(buckets)-1]
+		bucket.Min = min(bucket.Min, sample.Value)
+		bucket.Max = max(bucket.Max, sample.Value)
+		bucket.Last = sample.Value
+		bucket.Count++
+		sum += float64(sample.Value)
+		bucket.Avg = sum / float64(bucket.Count)
+	}
+	return buckets
+}
+
+// DownsampleCounters groups samples into step-sized buckets starting at from.
+// Increase is the sum of reported deltas and rate is the increase per second.
+// Samples must be ordered oldest first; empty buckets are omitted.
+func DownsampleCounters(samples []CounterSample, from, to time.Time, step time.Duration) []CounterBucket {
+	buckets := []CounterBucket{}
+	last := -1
+	for _, sample := range samples {
+		idx := bucketIndex(sample.Timestamp, from, to, step)
+		if idx < 0 {
+			continue
+		}
+		if idx != last {
+			buckets = append(buckets, CounterBucket{Timestamp: from.Add(time.Duration(idx) * step)})
+			last = idx
+		}
+		bucket := &buckets[len(buckets)-1]
+		bucket.Increase += sample.Delta
+		bucket.Rate = float64(bucket.Increase) / step.Seconds()
+	}
+	return buckets
+}
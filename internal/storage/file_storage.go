@@ -1,35 +1,74 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"metrics/internal/utils"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
 type FileMetric struct {
-	Value       *float64 `json:"value"`
-	Delta       *int64   `json:"delta"`
-	StringValue string   `json:"string_value"`
-	ID          string   `json:"id"`
-	MType       string   `json:"mtype"`
-	Hash        string   `json:"hash"`
+	Value       *float64     `json:"value"`
+	Delta       *int64       `json:"delta"`
+	Histogram   *Histogram   `json:"histogram,omitempty"`
+	Set         *HyperLogLog `json:"set,omitempty"`
+	Labels      Labels       `json:"labels,omitempty"`
+	StringValue string       `json:"string_value"`
+	ID          string       `json:"id"`
+	MType       string       `json:"mtype"`
+	Hash        string       `json:"hash"`
 }
 
+// FileStorage is a MemStorage persisted to a file.
+// Every update is appended to a write-ahead log next to the file before it is acknowledged,
+// and the log is periodically compacted into a snapshot that replaces the file atomically.
+// Log records and snapshots keep the times of gauge and counter samples, so history survives a restart.
 type FileStorage struct {
+	logger *zap.Logger
+	wal    *os.File
+	stop   chan struct{}
+	file   string
 	MemStorage
-	logger       *zap.Logger
-	file         string
 	pushInterval int
+	// seq is the sequence number of the last record appended to the write-ahead log.
+	seq uint64
+	// pending is the number of records appended since the last compaction.
+	pending int
+	// walSize is the length of the write-ahead log up to the end of its last record.
+	walSize int64
+	// mu serializes updates with their log records and compactions.
+	mu     sync.Mutex
+	closed bool
 }
 
+// ErrStorageClosed is returned by updates of a FileStorage after Close.
+var ErrStorageClosed = errors.New("storage is closed")
+
+// NewFileStorage creates a new instance of FileStorage.
+// If restore is set, it replays the snapshot and the write-ahead log left by the previous run.
+// The log is compacted every pushInterval milliseconds, or after walCompactRecords records if pushInterval is 0.
 func NewFileStorage(file string, pushInterval int, restore bool, logger *zap.Logger) (*FileStorage, error) {
+	wal, err := utils.WithFileRetry(func() (*os.File, error) {
+		return os.OpenFile(file+walSuffix, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cant open wal: %w", err)
+	}
+
 	storage := &FileStorage{
-		MemStorage:   *NewMemStorage(),
+		MemStorage:   *NewMemStorageWithHistory(DefaultHistorySize),
+		wal:          wal,
+		stop:         make(chan struct{}),
 		file:         file,
 		pushInterval: pushInterval,
 		logger:       logger,
@@ -37,16 +76,27 @@ func NewFileStorage(file string, pushInterval int, restore bool, logger *zap.Log
 
 	if restore {
 		if err := storage.loadFromFile(); err != nil {
-			return nil, fmt.Errorf("cant load file: %w", err)
+			return nil, errors.Join(fmt.Errorf("cant load file: %w", err), storage.closeWAL())
 		}
 	}
 
+	// Fold the replayed log into a fresh snapshot, dropping a torn tail left by a crash.
+	if err := storage.compact(); err != nil {
+		return nil, errors.Join(fmt.Errorf("cant compact file: %w", err), storage.closeWAL())
+	}
+
 	if pushInterval > 0 {
 		ticker := time.NewTicker(time.Duration(pushInterval) * time.Millisecond)
 		go func() {
-			for range ticker.C {
-				if err := storage.saveToFile(context.Background()); err != nil {
-					logger.Error("cant save file", zap.String("file", file), zap.Error(err))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-storage.stop:
+					return
+				case <-ticker.C:
+					if err := storage.compact(); err != nil {
+						logger.Error("cant compact file", zap.String("file", file), zap.Error(err))
+					}
 				}
 			}
 		}()
@@ -56,120 +106,514 @@ func NewFileStorage(file string, pushInterval int, restore bool, logger *zap.Log
 }
 
 func (fs *FileStorage) SetGauge(ctx context.Context, name string, value Gauge) error {
-	return fs.withRetry(ctx, func() error { return fs.MemStorage.SetGauge(ctx, name, value) })
+	return fs.SetGauges(ctx, map[string]Gauge{name: value})
 }
 
 func (fs *FileStorage) SetGauges(ctx context.Context, values map[string]Gauge) error {
-	return fs.withRetry(ctx, func() error { return fs.MemStorage.SetGauges(ctx, values) })
+	record := walRecord{Op: walOpUpdate, Time: time.Now(), Metrics: appendGauges(nil, values)}
+	return fs.apply(record, nil, func() error {
+		fs.MemStorage.setGauges(values, record.Time)
+		return nil
+	})
+}
+
+// AddGauges logs the resulting values rather than the deltas, so replaying the log sets the same gauges.
+func (fs *FileStorage) AddGauges(ctx context.Context, deltas map[string]Gauge) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return ErrStorageClosed
+	}
+
+	// Updates of the file storage hold fs.mu, so the gauges cannot change before the record is applied.
+	values := make(map[string]Gauge, len(deltas))
+	for name, delta := range deltas {
+		current, _, err := fs.MemStorage.GetGauge(ctx, name)
+		if err != nil {
+			return err
+		}
+		values[name] = current + delta
+	}
+	record := walRecord{Op: walOpUpdate, Time: time.Now(), Metrics: appendGauges(nil, values)}
+	return fs.applyLocked(record, nil, func() error {
+		fs.MemStorage.setGauges(values, record.Time)
+		return nil
+	})
 }
 
 func (fs *FileStorage) ClearGauges(ctx context.Context) error {
-	return fs.withRetry(ctx, func() error { return fs.MemStorage.ClearGauges(ctx) })
+	return fs.apply(walRecord{Op: walOpClear, MType: "gauge"}, nil, func() error {
+		return fs.MemStorage.ClearGauges(ctx)
+	})
 }
 
 func (fs *FileStorage) SetCounter(ctx context.Context, name string, value Counter) error {
-	return fs.withRetry(ctx, func() error { return fs.MemStorage.SetCounter(ctx, name, value) })
+	return fs.SetCounters(ctx, map[string]Counter{name: value})
 }
 
 func (fs *FileStorage) SetCounters(ctx context.Context, values map[string]Counter) error {
-	return fs.withRetry(ctx, func() error { return fs.MemStorage.SetCounters(ctx, values) })
+	record := walRecord{Op: walOpUpdate, Time: time.Now(), Metrics: appendCounters(nil, values)}
+	return fs.apply(record, nil, func() error {
+		fs.MemStorage.setCounters(values, record.Time)
+		return nil
+	})
 }
 
 func (fs *FileStorage) ClearCounters(ctx context.Context) error {
-	return fs.withRetry(ctx, func() error { return fs.MemStorage.ClearCounters(ctx) })
+	return fs.apply(walRecord{Op: walOpClear, MType: "counter"}, nil, func() error {
+		return fs.MemStorage.ClearCounters(ctx)
+	})
 }
 
-func (fs *FileStorage) withRetry(ctx context.Context, op func() error) error {
-	if err := op(); err != nil {
+func (fs *FileStorage) SetHistogram(ctx context.Context, name string, value *Histogram) error {
+	return fs.SetHistograms(ctx, map[string]*Histogram{name: value})
+}
+
+func (fs *FileStorage) SetHistograms(ctx context.Context, values map[string]*Histogram) error {
+	record := walRecord{Op: walOpUpdate, Metrics: appendHistograms(nil, values)}
+	check := func() error { return fs.MemStorage.checkHistograms(values) }
+	return fs.apply(record, check, func() error { return fs.MemStorage.SetHistograms(ctx, values) })
+}
+
+func (fs *FileStorage) ClearHistograms(ctx context.Context) error {
+	return fs.apply(walRecord{Op: walOpClear, MType: "histogram"}, nil, func() error {
+		return fs.MemStorage.ClearHistograms(ctx)
+	})
+}
+
+func (fs *FileStorage) SetSet(ctx context.Context, name string, value *HyperLogLog) error {
+	return fs.SetSets(ctx, map[string]*HyperLogLog{name: value})
+}
+
+func (fs *FileStorage) SetSets(ctx context.Context, values map[string]*HyperLogLog) error {
+	record := walRecord{Op: walOpUpdate, Metrics: appendSets(nil, values)}
+	check := func() error { return checkSets(values) }
+	return fs.apply(record, check, func() error { return fs.MemStorage.SetSets(ctx, values) })
+}
+
+// ApplyBatch applies a batch once within the window, logging all its updates in a single record.
+// IDs live in memory only, so they are forgotten on restart.
+func (fs *FileStorage) ApplyBatch(ctx context.Context, id string, window time.Duration, batch *Batch) (bool, error) {
+	metrics := appendHistograms(nil, batch.Histograms)
+	metrics = appendSets(metrics, batch.Sets)
+	metrics = appendGauges(metrics, batch.Gauges)
+	metrics = appendCounters(metrics, batch.Counters)
+	record := walRecord{Op: walOpUpdate, Time: time.Now(), Metrics: metrics}
+	check := func() error { return fs.MemStorage.checkBatch(batch) }
+	return fs.batches.apply(id, window, func() error {
+		return fs.apply(record, check, func() error { return fs.MemStorage.applyBatch(ctx, batch, record.Time) })
+	})
+}
+
+func (fs *FileStorage) ClearSets(ctx context.Context) error {
+	return fs.apply(walRecord{Op: walOpClear, MType: "set"}, nil, func() error {
+		return fs.MemStorage.ClearSets(ctx)
+	})
+}
+
+func (fs *FileStorage) DeleteGauge(ctx context.Context, name string) (bool, error) {
+	return fs.deleteSeries(ctx, "gauge", name)
+}
+
+func (fs *FileStorage) DeleteCounter(ctx context.Context, name string) (bool, error) {
+	return fs.deleteSeries(ctx, "counter", name)
+}
+
+func (fs *FileStorage) DeleteHistogram(ctx context.Context, name string) (bool, error) {
+	return fs.deleteSeries(ctx, "histogram", name)
+}
+
+func (fs *FileStorage) DeleteSet(ctx context.Context, name string) (bool, error) {
+	return fs.deleteSeries(ctx, "set", name)
+}
+
+func (fs *FileStorage) deleteSeries(ctx context.Context, mtype, name string) (bool, error) {
+	var ok bool
+	record := walRecord{Op: walOpDelete, Metrics: []FileMetric{newFileMetric(name, mtype)}}
+	err := fs.apply(record, nil, func() (err error) {
+		ok, err = fs.MemStorage.deleteMetric(ctx, mtype, name)
 		return err
+	})
+	return ok, err
+}
+
+func (fs *FileStorage) DeleteMetrics(ctx context.Context, filter MetricFilter) (int, error) {
+	var deleted int
+	err := fs.apply(walRecord{Op: walOpDeleteMatching, Filter: &filter}, nil, func() (err error) {
+		deleted, err = fs.MemStorage.DeleteMetrics(ctx, filter)
+		return err
+	})
+	return deleted, err
+}
+
+// DeleteStale depends on update times that are not replayed, so it compacts the log instead of appending to it.
+func (fs *FileStorage) DeleteStale(ctx context.Context, filter MetricFilter, before time.Time) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return 0, ErrStorageClosed
 	}
-	if fs.pushInterval == 0 {
-		if err := fs.saveToFile(ctx); err != nil {
-			fs.logger.Error("cant save file", zap.String("file", fs.file), zap.Error(err))
+
+	deleted, err := fs.MemStorage.DeleteStale(ctx, filter, before)
+	if err != nil || deleted == 0 {
+		return deleted, err
+	}
+	if err := fs.compactLocked(); err != nil {
+		fs.logger.Error("cant compact file", zap.String("file", fs.file), zap.Error(err))
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// apply appends the record of an update to the write-ahead log, syncs it and only then runs the update,
+// so memory never holds an update the log lacks. check, if set, runs first and rejects updates op would fail on,
+// as a logged update must apply on replay.
+// With no push interval the log is compacted once it holds walCompactRecords records.
+func (fs *FileStorage) apply(record walRecord, check, op func() error) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return ErrStorageClosed
+	}
+	return fs.applyLocked(record, check, op)
+}
+
+// applyLocked is apply for callers holding fs.mu.
+func (fs *FileStorage) applyLocked(record walRecord, check, op func() error) error {
+	if check != nil {
+		if err := check(); err != nil {
 			return err
 		}
 	}
+	if err := fs.appendRecord(record); err != nil {
+		fs.logger.Error("cant write wal", zap.String("file", fs.file), zap.Error(err))
+		return err
+	}
+	if err := op(); err != nil {
+		return err
+	}
+	// The update is durable in the log, so a failed compaction is retried later and does not fail the update.
+	if fs.pushInterval == 0 && fs.pending >= walCompactRecords {
+		if err := fs.compactLocked(); err != nil {
+			fs.logger.Error("cant compact file", zap.String("file", fs.file), zap.Error(err))
+		}
+	}
 	return nil
 }
 
-func (fs *FileStorage) loadFromFile() error {
-	f, err := utils.WithFileRetry(func() (*os.File, error) {
-		return os.OpenFile(fs.file, os.O_RDONLY|os.O_CREATE, os.ModeAppend)
-	})
+// appendRecord writes a record to the log and syncs it.
+// A record that fails to be written or synced is cut off, so a torn line never hides the records appended after it.
+func (fs *FileStorage) appendRecord(record walRecord) error {
+	record.Seq = fs.seq + 1
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	data, err := json.Marshal(record)
 	if err != nil {
-		return fmt.Errorf("cant open file: %w", err)
+		return fmt.Errorf("cant encode wal record: %w", err)
 	}
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil {
-			err = fmt.Errorf("cant close file: %w", closeErr)
-		}
-	}()
+	data = append(data, '\n')
+	if _, err := fs.wal.Write(data); err != nil {
+		fs.truncateWAL()
+		return fmt.Errorf("cant append wal record: %w", err)
+	}
+	if err := fs.wal.Sync(); err != nil {
+		fs.truncateWAL()
+		return fmt.Errorf("cant sync wal: %w", err)
+	}
+	fs.seq = record.Seq
+	fs.walSize += int64(len(data))
+	fs.pending++
+	return nil
+}
 
-	data := []FileMetric{}
-	if err := json.NewDecoder(f).Decode(&data); err != nil && err.Error() != "EOF" {
-		return fmt.Errorf("cant decode file: %w", err)
+// truncateWAL cuts the log back to the end of the last record appended.
+func (fs *FileStorage) truncateWAL() {
+	if err := fs.wal.Truncate(fs.walSize); err != nil {
+		fs.logger.Error("cant truncate wal", zap.String("file", fs.file), zap.Int64("size", fs.walSize), zap.Error(err))
+	}
+}
+
+// closeWAL closes the log of a storage that failed to start.
+func (fs *FileStorage) closeWAL() error {
+	if err := fs.wal.Close(); err != nil {
+		return fmt.Errorf("cant close wal: %w", err)
+	}
+	return nil
+}
+
+func (fs *FileStorage) loadFromFile() error {
+	data, err := os.ReadFile(fs.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cant read file: %w", err)
+	}
+
+	snapshot := fileSnapshot{}
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0:
+	case data[0] == '[':
+		// Files written before the write-ahead log hold a bare array of metrics.
+		if err := json.Unmarshal(data, &snapshot.Metrics); err != nil {
+			return fmt.Errorf("cant decode file: %w", err)
+		}
+	default:
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return fmt.Errorf("cant decode file: %w", err)
+		}
 	}
 
 	syncTimeout := time.Minute
 	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
 	defer cancel()
 
-	for _, metric := range data {
-		switch metric.MType {
-		case "gauge":
-			if err := fs.SetGauge(ctx, metric.ID, Gauge(*metric.Value)); err != nil {
+	now := time.Now()
+	for _, metric := range snapshot.Metrics {
+		if err := fs.loadMetric(ctx, metric, now); err != nil {
+			return err
+		}
+	}
+	// Loading the values recorded samples at the current time, the history saved with them replaces those.
+	fs.MemStorage.restoreHistories(snapshot.GaugeHistory, snapshot.CounterHistory)
+	fs.seq = snapshot.Seq
+
+	return fs.replayWAL(ctx)
+}
+
+// replayWAL applies the log records not covered by the snapshot.
+// A record that cannot be decoded ends the log, as it was torn by a crash while being written.
+// Records torn by failed appends are cut off, so only the last record can be torn.
+func (fs *FileStorage) replayWAL(ctx context.Context) error {
+	if _, err := fs.wal.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("cant seek wal: %w", err)
+	}
+
+	reader := bufio.NewReader(fs.wal)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				fs.logger.Warn("skip torn wal record", zap.String("file", fs.file))
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cant read wal: %w", err)
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			fs.logger.Warn("skip wal tail after bad record", zap.String("file", fs.file), zap.Error(err))
+			return nil
+		}
+		if record.Seq <= fs.seq {
+			continue
+		}
+		if err := fs.replayRecord(ctx, record); err != nil {
+			fs.logger.Warn("cant replay wal record", zap.Uint64("seq", record.Seq), zap.Error(err))
+		}
+		fs.seq = record.Seq
+	}
+}
+
+func (fs *FileStorage) replayRecord(ctx context.Context, record walRecord) error {
+	switch record.Op {
+	case walOpUpdate:
+		at := record.Time
+		if at.IsZero() {
+			// Records written before records were timestamped.
+			at = time.Now()
+		}
+		for _, metric := range record.Metrics {
+			if err := fs.loadMetric(ctx, metric, at); err != nil {
 				return err
 			}
-		case "counter":
-			if err := fs.SetCounter(ctx, metric.ID, Counter(*metric.Delta)); err != nil {
+		}
+	case walOpDelete:
+		for _, metric := range record.Metrics {
+			if _, err := fs.MemStorage.deleteMetric(ctx, metric.MType, SeriesKey(metric.ID, metric.Labels)); err != nil {
 				return err
 			}
 		}
+	case walOpDeleteMatching:
+		if record.Filter == nil {
+			return fmt.Errorf("wal record %d has no filter", record.Seq)
+		}
+		if _, err := fs.MemStorage.DeleteMetrics(ctx, *record.Filter); err != nil {
+			return err
+		}
+	case walOpClear:
+		return fs.MemStorage.clearMetrics(ctx, record.MType)
+	default:
+		return fmt.Errorf("unknown wal op %q", record.Op)
 	}
+	return nil
+}
 
+// loadMetric applies a snapshot metric or a logged update to the memory storage, recording samples at the given time.
+func (fs *FileStorage) loadMetric(ctx context.Context, metric FileMetric, at time.Time) error {
+	key := SeriesKey(metric.ID, metric.Labels)
+	switch metric.MType {
+	case "gauge":
+		if metric.Value == nil {
+			return fmt.Errorf("gauge %s has no value", key)
+		}
+		fs.MemStorage.setGauges(map[string]Gauge{key: Gauge(*metric.Value)}, at)
+		return nil
+	case "counter":
+		if metric.Delta == nil {
+			return fmt.Errorf("counter %s has no delta", key)
+		}
+		fs.MemStorage.setCounters(map[string]Counter{key: Counter(*metric.Delta)}, at)
+		return nil
+	case "histogram":
+		if metric.Histogram == nil {
+			return fmt.Errorf("histogram %s has no value", key)
+		}
+		return fs.MemStorage.SetHistogram(ctx, key, metric.Histogram)
+	case "set":
+		if metric.Set == nil {
+			return fmt.Errorf("set %s has no value", key)
+		}
+		return fs.MemStorage.SetSet(ctx, key, metric.Set)
+	}
 	return nil
 }
 
-func (fs *FileStorage) saveToFile(ctx context.Context) error {
+func (fs *FileStorage) compact() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return nil
+	}
+	return fs.compactLocked()
+}
+
+// Close stops the push ticker, writes a final snapshot and closes the write-ahead log.
+// It gives up waiting for running updates when ctx is done.
+func (fs *FileStorage) Close(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if fs.closed {
+			done <- nil
+			return
+		}
+		fs.closed = true
+		close(fs.stop)
+
+		err := fs.compactLocked()
+		if closeErr := fs.wal.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("cant close wal: %w", closeErr)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("cant close file storage: %w", ctx.Err())
+	}
+}
+
+// compactLocked writes a snapshot to a temporary file, renames it over the file and truncates the log.
+// A crash before the truncation is harmless, as replay skips records covered by the snapshot.
+func (fs *FileStorage) compactLocked() error {
+	snapshot := fileSnapshot{Metrics: fs.fileMetrics(context.Background()), Seq: fs.seq}
+	snapshot.GaugeHistory, snapshot.CounterHistory = fs.MemStorage.histories()
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("cant encode data: %w", err)
+	}
+
+	tmp := fs.file + ".tmp"
 	f, err := utils.WithFileRetry(func() (*os.File, error) {
-		return os.Create(fs.file)
+		return os.Create(tmp)
 	})
 	if err != nil {
 		return fmt.Errorf("cant create file: %w", err)
 	}
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil {
-			err = fmt.Errorf("cant close file: %w", closeErr)
-		}
-	}()
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cant write file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cant sync file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cant close file: %w", err)
+	}
+	if err := os.Rename(tmp, fs.file); err != nil {
+		return fmt.Errorf("cant rename file: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(fs.file)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
 
-	data := []FileMetric{}
+	if err := fs.wal.Truncate(0); err != nil {
+		return fmt.Errorf("cant truncate wal: %w", err)
+	}
+	fs.walSize = 0
+	fs.pending = 0
+	return nil
+}
 
-	gauges, _ := fs.GetGauges(ctx)
-	for id, value := range gauges {
+func newFileMetric(key, mtype string) FileMetric {
+	id, labels := ParseSeriesKey(key)
+	return FileMetric{ID: id, Labels: labels, MType: mtype}
+}
+
+func appendGauges(metrics []FileMetric, values map[string]Gauge) []FileMetric {
+	for key, value := range values {
+		metric := newFileMetric(key, "gauge")
 		floatValue := float64(value)
-		metric := FileMetric{
-			ID:    id,
-			MType: "gauge",
-			Value: &floatValue,
-		}
-		data = append(data, metric)
+		metric.Value = &floatValue
+		metrics = append(metrics, metric)
 	}
+	return metrics
+}
 
-	counters, _ := fs.GetCounters(ctx)
-	for id, delta := range counters {
-		intDelta := int64(delta)
-		metric := FileMetric{
-			ID:    id,
-			MType: "counter",
-			Delta: &intDelta,
-		}
-		data = append(data, metric)
+func appendCounters(metrics []FileMetric, values map[string]Counter) []FileMetric {
+	for key, value := range values {
+		metric := newFileMetric(key, "counter")
+		intDelta := int64(value)
+		metric.Delta = &intDelta
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+func appendHistograms(metrics []FileMetric, values map[string]*Histogram) []FileMetric {
+	for key, value := range values {
+		metric := newFileMetric(key, "histogram")
+		metric.Histogram = value
+		metrics = append(metrics, metric)
 	}
+	return metrics
+}
 
-	if err := json.NewEncoder(f).Encode(data); err != nil {
-		return fmt.Errorf("cant encode data: %w", err)
+func appendSets(metrics []FileMetric, values map[string]*HyperLogLog) []FileMetric {
+	for key, value := range values {
+		metric := newFileMetric(key, "set")
+		metric.Set = value
+		metrics = append(metrics, metric)
 	}
+	return metrics
+}
 
-	return nil
+func (fs *FileStorage) fileMetrics(ctx context.Context) []FileMetric {
+	data := []FileMetric{}
+
+	gauges, _ := fs.GetGauges(ctx)
+	data = appendGauges(data, gauges)
+	counters, _ := fs.GetCounters(ctx)
+	data = appendCounters(data, counters)
+	histograms, _ := fs.GetHistograms(ctx)
+	data = appendHistograms(data, histograms)
+	sets, _ := fs.GetSets(ctx)
+	return appendSets(data, sets)
 }
@@ -0,0 +1,86 @@
+package storage
+
+import "strings"
+
+// MetricFilter selects series for batch operations.
+// Empty fields match everything.
+type MetricFilter struct {
+	// Labels the series must have, with equal values.
+	Labels Labels `json:"labels,omitempty"`
+	// Pattern is a glob matched against the bare metric name, '*' matches any sequence and '?' any single rune.
+	Pattern string `json:"pattern,omitempty"`
+	// Type limits the filter to one metric type: gauge, counter, histogram or set.
+	Type string `json:"type,omitempty"`
+}
+
+// IsEmpty reports whether the filter selects all series of its type.
+func (f MetricFilter) IsEmpty() bool {
+	return len(f.Labels) == 0 && (f.Pattern == "" || strings.Trim(f.Pattern, "*") == "")
+}
+
+// MatchesType reports whether the filter selects series of the given type.
+func (f MetricFilter) MatchesType(mtype string) bool {
+	return f.Type == "" || f.Type == mtype
+}
+
+// Matches reports whether the series identified by key is selected by the filter.
+func (f MetricFilter) Matches(key string) bool {
+	name, labels := ParseSeriesKey(key)
+	if f.Pattern != "" && !matchGlob(f.Pattern, name) {
+		return false
+	}
+	for label, value := range f.Labels {
+		if actual, ok := labels[label]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// likePattern converts the filter pattern to an SQL LIKE pattern with backslash escapes.
+func (f MetricFilter) likePattern() string {
+	if f.Pattern == "" {
+		return "%"
+	}
+	var b strings.Builder
+	for _, r := range f.Pattern {
+		switch r {
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		case '%', '_', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func matchGlob(pattern, name string) bool {
+	p, n := []rune(pattern), []rune(name)
+	// Positions to resume from after the last '*', for backtracking.
+	star, match := -1, 0
+	i, j := 0, 0
+	for j < len(n) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == n[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, match = i, j
+			i++
+		case star >= 0:
+			match++
+			i, j = star+1, match
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrInvalidHistogram is returned for histograms with malformed buckets.
+var ErrInvalidHistogram = errors.New("invalid histogram")
+
+// ErrBucketsMismatch is returned when merging histograms with different bucket bounds.
+var ErrBucketsMismatch = errors.New("histogram buckets mismatch")
+
+// DefaultBuckets are the upper bounds used for duration histograms, in seconds.
+var DefaultBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+// Histogram represents a distribution of observations over fixed buckets.
+// Counts are not cumulative: Counts[i] holds observations not greater than Bounds[i]
+// and above the previous bound, the last element holds observations above all bounds.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+// NewHistogram creates an empty histogram with the given sorted upper bounds.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		Bounds: append([]float64(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Validate checks that bounds are finite and strictly increasing and that counts match them.
+func (h *Histogram) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: %d counts for %d bounds", ErrInvalidHistogram, len(h.Counts), len(h.Bounds))
+	}
+	for i, bound := range h.Bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("%w: bound %v is not finite", ErrInvalidHistogram, bound)
+		}
+		if i > 0 && bound <= h.Bounds[i-1] {
+			return fmt.Errorf("%w: bounds must be strictly increasing", ErrInvalidHistogram)
+		}
+	}
+	var count uint64
+	for _, c := range h.Counts {
+		count += c
+	}
+	if count != h.Count {
+		return fmt.Errorf("%w: count %d does not match buckets total %d", ErrInvalidHistogram, h.Count, count)
+	}
+	return nil
+}
+
+// Observe adds a single value to the histogram.
+func (h *Histogram) Observe(value float64) {
+	h.Counts[sort.SearchFloat64s(h.Bounds, value)]++
+	h.Sum += value
+	h.Count++
+}
+
+// Merge adds the observations of other to the histogram.
+func (h *Histogram) Merge(other *Histogram) error {
+	if !h.sameBuckets(other) {
+		return ErrBucketsMismatch
+	}
+	for i, c := range other.Counts {
+		h.Counts[i] += c
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+	return nil
+}
+
+// sameBuckets reports whether the histograms have the same bucket bounds.
+func (h *Histogram) sameBuckets(other *Histogram) bool {
+	if len(h.Bounds) != len(other.Bounds) || len(h.Counts) != len(other.Counts) {
+		return false
+	}
+	for i, bound := range h.Bounds {
+		if bound != other.Bounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a deep copy of the histogram.
+func (h *Histogram) Clone() *Histogram {
+	return &Histogram{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: append([]uint64(nil), h.Counts...),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
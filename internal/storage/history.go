@@ -0,0 +1,116 @@
+package storage
+
+import "time"
+
+// DefaultHistorySize is the number of samples kept per series by in-memory storages.
+const DefaultHistorySize = 1000
+
+// GaugeSample represents a single reported gauge value.
+type GaugeSample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     Gauge     `json:"value"`
+}
+
+// CounterSample represents a single reported counter increment and the resulting total.
+type CounterSample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Delta     Counter   `json:"delta"`
+	Value     Counter   `json:"value"`
+}
+
+// ring is a fixed-size buffer that overwrites the oldest item when full.
+type ring[T any] struct {
+	items []T
+	start int
+	size  int
+}
+
+func newRing[T any](capacity int) *ring[T] {
+	return &ring[T]{items: make([]T, capacity)}
+}
+
+func (r *ring[T]) push(item T) {
+	if len(r.items) == 0 {
+		return
+	}
+	if r.size < len(r.items) {
+		r.items[(r.start+r.size)%len(r.items)] = item
+		r.size++
+		return
+	}
+	r.items[r.start] = item
+	r.start = (r.start + 1) % len(r.items)
+}
+
+// dropWhile removes the oldest items while drop returns true, returning the number removed.
+func (r *ring[T]) dropWhile(drop func(T) bool) int {
+	dropped := 0
+	for r.size > 0 && drop(r.items[r.start]) {
+		var zero T
+		r.items[r.start] = zero
+		r.start = (r.start + 1) % len(r.items)
+		r.size--
+		dropped++
+	}
+	return dropped
+}
+
+// filter returns items in insertion order for which keep returns true.
+func (r *ring[T]) filter(keep func(T) bool) []T {
+	result := make([]T, 0, r.size)
+	for i := range r.size {
+		item := r.items[(r.start+i)%len(r.items)]
+		if keep(item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func inRange(ts, from, to time.Time) bool {
+	return !ts.Before(from) && !ts.After(to)
+}
+
+// histories returns the history samples of every gauge and counter series, oldest first.
+func (ms *MemStorage) histories() (map[string][]GaugeSample, map[string][]CounterSample) {
+	gauges := make(map[string][]GaugeSample)
+	counters := make(map[string][]CounterSample)
+	for _, shard := range ms.shards {
+		shard.mu.RLock()
+		for name, history := range shard.gaugeHistory {
+			gauges[name] = history.filter(func(GaugeSample) bool { return true })
+		}
+		for name, history := range shard.counterHistory {
+			counters[name] = history.filter(func(CounterSample) bool { return true })
+		}
+		shard.mu.RUnlock()
+	}
+	return gauges, counters
+}
+
+// restoreHistories replaces the history of the given series with the samples, keeping the newest historySize ones.
+func (ms *MemStorage) restoreHistories(gauges map[string][]GaugeSample, counters map[string][]CounterSample) {
+	if ms.historySize == 0 {
+		return
+	}
+	for name, samples := range gauges {
+		history := newRing[GaugeSample](ms.historySize)
+		for _, sample := range samples {
+			history.push(sample)
+		}
+		shard := ms.shard(name)
+		shard.mu.Lock()
+		shard.gaugeHistory[name] = history
+		shard.mu.Unlock()
+	}
+	for name, samples := range counters {
+		history := newRing[CounterSample](ms.historySize)
+		for _, sample := range samples {
+			history.push(sample)
+		}
+		shard := ms.shard(name)
+		shard.mu.Lock()
+		shard.counterHistory[name] = history
+		shard.mu.Unlock()
+	}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of hash bits used to select a register.
+// 2^12 registers give a standard error of about 1.6%.
+const hllPrecision = 12
+
+const hllRegisters = 1 << hllPrecision
+
+// ErrInvalidSet is returned for set sketches with a malformed register array.
+var ErrInvalidSet = errors.New("invalid set")
+
+// HyperLogLog is an approximate distinct-count sketch of the members of a set metric.
+// Sketches built from the same members are identical, so they can be merged across agents and batches.
+type HyperLogLog struct {
+	Registers []byte `json:"registers"`
+}
+
+// NewHyperLogLog creates an empty sketch.
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{Registers: make([]byte, hllRegisters)}
+}
+
+// Validate checks that the sketch has the expected number of registers with possible values.
+func (h *HyperLogLog) Validate() error {
+	if len(h.Registers) != hllRegisters {
+		return fmt.Errorf("%w: expected %d registers, got %d", ErrInvalidSet, hllRegisters, len(h.Registers))
+	}
+	for _, r := range h.Registers {
+		if r > 64-hllPrecision+1 {
+			return fmt.Errorf("%w: register value %d out of range", ErrInvalidSet, r)
+		}
+	}
+	return nil
+}
+
+// Add adds a member to the sketch.
+func (h *HyperLogLog) Add(member string) {
+	hash := hllHash(member)
+	index := hash >> (64 - hllPrecision)
+	rank := byte(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.Registers[index] {
+		h.Registers[index] = rank
+	}
+}
+
+// Merge adds the members of other to the sketch.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if len(h.Registers) != len(other.Registers) {
+		return ErrInvalidSet
+	}
+	for i, r := range other.Registers {
+		if r > h.Registers[i] {
+			h.Registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Estimate returns the approximate number of distinct members.
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(len(h.Registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// Clone returns a deep copy of the sketch.
+func (h *HyperLogLog) Clone() *HyperLogLog {
+	return &HyperLogLog{Registers: append([]byte(nil), h.Registers...)}
+}
+
+// hllHash hashes a member with FNV-1a followed by a 64-bit finalizer for better bit dispersion.
+func hllHash(member string) uint64 {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(member))
+	x := hasher.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
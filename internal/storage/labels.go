@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Source labels identifying the agent that reported a series.
+const (
+	LabelHost     = "host"
+	LabelInstance = "instance"
+)
+
+// Labels is a set of key/value pairs that together with the metric name identifies a series.
+type Labels map[string]string
+
+// ErrInvalidLabel is returned when a label name is not a valid identifier.
+var ErrInvalidLabel = errors.New("invalid label name")
+
+// ErrInvalidName is returned when a metric name contains characters reserved for the label set of a series key.
+var ErrInvalidName = errors.New("invalid metric name")
+
+// ValidateName checks that a metric name cannot be mistaken for a series key with labels,
+// otherwise a name like Alloc{host="a"} would write to the series of another source.
+func ValidateName(name string) error {
+	if strings.ContainsAny(name, `{}"`) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// Validate checks that all label names are identifiers and none is reserved.
+func (l Labels) Validate() error {
+	for name := range l {
+		if !isLabelName(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("%w: %q", ErrInvalidLabel, name)
+		}
+	}
+	return nil
+}
+
+func isLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SortedNames returns label names in lexical order.
+func (l Labels) SortedNames() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String formats labels as {name="value",...} with names sorted, or "" for an empty set.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range l.SortedNames() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueReplacer.Replace(l[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// SeriesKey returns the storage key of the series identified by name and labels.
+// A series without labels is keyed by its bare name, so unlabeled metrics keep their existing keys.
+func SeriesKey(name string, labels Labels) string {
+	return name + labels.String()
+}
+
+// ParseSeriesKey splits a storage key into the metric name and labels.
+// Keys that do not carry a well-formed label set are returned as a bare name.
+func ParseSeriesKey(key string) (string, Labels) {
+	start := strings.IndexByte(key, '{')
+	if start <= 0 || !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	labels, ok := parseLabels(key[start+1 : len(key)-1])
+	if !ok {
+		return key, nil
+	}
+	return key[:start], labels
+}
+
+func parseLabels(s string) (Labels, bool) {
+	labels := Labels{}
+	for len(s) > 0 {
+		eq := strings.Index(s, `="`)
+		if eq <= 0 {
+			return nil, false
+		}
+		name := s[:eq]
+		s = s[eq+2:]
+
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '\\' && i+1 < len(s):
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+				} else {
+					value.WriteByte(s[i])
+				}
+			case c == '"':
+				s = s[i+1:]
+				closed = true
+			default:
+				value.WriteByte(c)
+			}
+			if closed {
+				break
+			}
+		}
+		if !closed {
+			return nil, false
+		}
+		labels[name] = value.String()
+
+		if len(s) > 0 {
+			if s[0] != ',' {
+				return nil, false
+			}
+			s = s[1:]
+		}
+	}
+	return labels, true
+}
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_gauge_history_name_created_at;
+DROP INDEX IF EXISTS idx_counter_history_name_created_at;
+DROP TABLE IF EXISTS gauge_history;
+DROP TABLE IF EXISTS counter_history;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS gauge_history (
+	id BIGSERIAL PRIMARY KEY,
+	name VARCHAR(50) NOT NULL,
+	value DOUBLE PRECISION NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS counter_history (
+	id BIGSERIAL PRIMARY KEY,
+	name VARCHAR(50) NOT NULL,
+	delta BIGINT NOT NULL,
+	value BIGINT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_gauge_history_name_created_at ON gauge_history (name, created_at);
+CREATE INDEX IF NOT EXISTS idx_counter_history_name_created_at ON counter_history (name, created_at);
@@ -0,0 +1,15 @@
+DROP INDEX IF EXISTS idx_gauges_labels;
+DROP INDEX IF EXISTS idx_counters_labels;
+
+ALTER TABLE gauges DROP COLUMN IF EXISTS labels;
+ALTER TABLE counters DROP COLUMN IF EXISTS labels;
+
+DELETE FROM gauges WHERE length(name) > 50;
+DELETE FROM counters WHERE length(name) > 50;
+DELETE FROM gauge_history WHERE length(name) > 50;
+DELETE FROM counter_history WHERE length(name) > 50;
+
+ALTER TABLE gauges ALTER COLUMN name TYPE VARCHAR(50);
+ALTER TABLE counters ALTER COLUMN name TYPE VARCHAR(50);
+ALTER TABLE gauge_history ALTER COLUMN name TYPE VARCHAR(50);
+ALTER TABLE counter_history ALTER COLUMN name TYPE VARCHAR(50);
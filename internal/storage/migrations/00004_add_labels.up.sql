@@ -0,0 +1,10 @@
+ALTER TABLE gauges ALTER COLUMN name TYPE TEXT;
+ALTER TABLE counters ALTER COLUMN name TYPE TEXT;
+ALTER TABLE gauge_history ALTER COLUMN name TYPE TEXT;
+ALTER TABLE counter_history ALTER COLUMN name TYPE TEXT;
+
+ALTER TABLE gauges ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE counters ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS idx_gauges_labels ON gauges USING GIN (labels);
+CREATE INDEX IF NOT EXISTS idx_counters_labels ON counters USING GIN (labels);
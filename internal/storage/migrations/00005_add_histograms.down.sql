@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_histograms_labels;
+DROP TABLE IF EXISTS histograms;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS histograms (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	labels JSONB NOT NULL DEFAULT '{}',
+	bounds JSONB NOT NULL,
+	counts JSONB NOT NULL,
+	sum DOUBLE PRECISION NOT NULL,
+	count BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_histograms_labels ON histograms USING GIN (labels);
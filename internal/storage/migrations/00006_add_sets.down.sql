@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_sets_labels;
+DROP TABLE IF EXISTS sets;
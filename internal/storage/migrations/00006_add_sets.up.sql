@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS sets (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	labels JSONB NOT NULL DEFAULT '{}',
+	registers BYTEA NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sets_labels ON sets USING GIN (labels);
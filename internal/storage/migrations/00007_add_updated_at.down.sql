@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_gauges_updated_at;
+DROP INDEX IF EXISTS idx_counters_updated_at;
+DROP INDEX IF EXISTS idx_histograms_updated_at;
+DROP INDEX IF EXISTS idx_sets_updated_at;
+DROP INDEX IF EXISTS idx_gauge_history_created_at;
+DROP INDEX IF EXISTS idx_counter_history_created_at;
+
+ALTER TABLE gauges DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE counters DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE histograms DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE sets DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,11 @@
+ALTER TABLE gauges ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE counters ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE histograms ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE sets ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS idx_gauges_updated_at ON gauges (updated_at);
+CREATE INDEX IF NOT EXISTS idx_counters_updated_at ON counters (updated_at);
+CREATE INDEX IF NOT EXISTS idx_histograms_updated_at ON histograms (updated_at);
+CREATE INDEX IF NOT EXISTS idx_sets_updated_at ON sets (updated_at);
+CREATE INDEX IF NOT EXISTS idx_gauge_history_created_at ON gauge_history (created_at);
+CREATE INDEX IF NOT EXISTS idx_counter_history_created_at ON counter_history (created_at);
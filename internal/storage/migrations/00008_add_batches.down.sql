@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_batches_claimed_at;
+DROP TABLE IF EXISTS batches;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS batches (
+    id TEXT PRIMARY KEY,
+    claimed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_batches_claimed_at ON batches (claimed_at);
@@ -3,13 +3,15 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sort"
 	"strings"
 	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 
 	"go.uber.org/zap"
@@ -29,6 +31,14 @@ func NewPosgresStorage(db *sql.DB, logger *zap.Logger) (*PostgresStorage, error)
 	return storage, nil
 }
 
+// Close closes the database, waiting for running queries to finish.
+func (s *PostgresStorage) Close(ctx context.Context) error {
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("cant close db: %w", err)
+	}
+	return nil
+}
+
 func (s *PostgresStorage) Ping(ctx context.Context) error {
 	err := s.withRetry(func() error {
 		return s.db.PingContext(ctx)
@@ -41,25 +51,19 @@ func (s *PostgresStorage) Ping(ctx context.Context) error {
 
 func (s *PostgresStorage) GetGauges(ctx context.Context) (map[string]Gauge, error) {
 	var rows *sql.Rows
-	var err error
-	err = s.withRetry(func() error {
+	err := s.withRetry(func() error {
+		var err error
 		rows, err = s.db.QueryContext(ctx, "SELECT name, value FROM gauges")
-		if err != nil {
-			return fmt.Errorf("cant query gauges: %w", err)
-		}
-		if rows.Err() != nil {
-			return fmt.Errorf("rows error: %w", rows.Err())
-		}
-		defer func() {
-			if closeErr := rows.Close(); closeErr != nil {
-				s.logger.Error("Error closing rows for counters", zap.Error(closeErr))
-			}
-		}()
-		return nil
+		return err
 	})
 	if err != nil {
 		return nil, fmt.Errorf("cant query gauges: %w", err)
 	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			s.logger.Error("Error closing rows for gauges", zap.Error(closeErr))
+		}
+	}()
 
 	result := make(map[string]Gauge)
 	for rows.Next() {
@@ -97,8 +101,16 @@ func (s *PostgresStorage) SetGauge(ctx context.Context, name string, value Gauge
 	err := s.withRetry(func() error {
 		_, err := s.db.ExecContext(
 			ctx,
-			"INSERT INTO gauges (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = $2",
+			`
+			WITH upsert AS (
+				INSERT INTO gauges (name, labels, value) VALUES ($1, $2, $3)
+				ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, updated_at = now()
+				RETURNING name, value
+			)
+			INSERT INTO gauge_history (name, value) SELECT name, value FROM upsert
+			`,
 			name,
+			labelsJSON(name),
 			value,
 		)
 		return err
@@ -110,6 +122,28 @@ func (s *PostgresStorage) SetGauge(ctx context.Context, name string, value Gauge
 }
 
 func (s *PostgresStorage) SetGauges(ctx context.Context, values map[string]Gauge) error {
+	err := s.withRetry(func() error {
+		return upsertGauges(ctx, s.db, values, "EXCLUDED.value")
+	})
+	if err != nil {
+		return fmt.Errorf("cant set gauges: %w", err)
+	}
+	return nil
+}
+
+// AddGauges adds deltas to the stored values in a single statement, so concurrent additions are not lost.
+func (s *PostgresStorage) AddGauges(ctx context.Context, deltas map[string]Gauge) error {
+	err := s.withRetry(func() error {
+		return upsertGauges(ctx, s.db, deltas, "gauges.value + EXCLUDED.value")
+	})
+	if err != nil {
+		return fmt.Errorf("cant add gauges: %w", err)
+	}
+	return nil
+}
+
+// upsertGauges inserts gauges, or updates stored ones to the update expression, recording their history.
+func upsertGauges(ctx context.Context, q querier, values map[string]Gauge, update string) error {
 	keys := make([]string, 0, len(values))
 	for name := range values {
 		keys = append(keys, name)
@@ -117,66 +151,114 @@ func (s *PostgresStorage) SetGauges(ctx context.Context, values map[string]Gauge
 	sort.Strings(keys)
 
 	valueStrings := make([]string, 0, len(keys))
-	valueArgs := make([]interface{}, 0, len(keys)*2)
+	valueArgs := make([]interface{}, 0, len(keys)*3)
 
 	i := 1
 	for _, name := range keys {
 		value := values[name]
-		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d)", i, i+1))
-		valueArgs = append(valueArgs, name, value)
-		i += 2
+		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d, $%d)", i, i+1, i+2))
+		valueArgs = append(valueArgs, name, labelsJSON(name), value)
+		i += 3
 	}
 
 	stmt := fmt.Sprintf(`
-		INSERT INTO gauges (name, value) 
-		VALUES %s
-		ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value
-	`, strings.Join(valueStrings, ","))
+		WITH upsert AS (
+			INSERT INTO gauges (name, labels, value)
+			VALUES %s
+			ON CONFLICT (name) DO UPDATE SET value = %s, updated_at = now()
+			RETURNING name, value
+		)
+		INSERT INTO gauge_history (name, value) SELECT name, value FROM upsert
+	`, strings.Join(valueStrings, ","), update)
+
+	_, err := q.ExecContext(ctx, stmt, valueArgs...)
+	return err
+}
 
+func (s *PostgresStorage) ClearGauges(ctx context.Context) error {
 	err := s.withRetry(func() error {
-		_, err := s.db.ExecContext(ctx, stmt, valueArgs...)
+		_, err := s.db.ExecContext(ctx, "WITH history AS (DELETE FROM gauge_history) DELETE FROM gauges")
 		return err
 	})
-
 	if err != nil {
-		return fmt.Errorf("cant set gauges: %w", err)
+		return fmt.Errorf("cant clear all gauges: %w", err)
 	}
-
 	return nil
 }
 
-func (s *PostgresStorage) ClearGauges(ctx context.Context) error {
+func (s *PostgresStorage) DeleteGauge(ctx context.Context, name string) (bool, error) {
+	var deleted int64
 	err := s.withRetry(func() error {
-		_, err := s.db.ExecContext(ctx, "DELETE FROM gauges")
+		result, err := s.db.ExecContext(
+			ctx,
+			"WITH history AS (DELETE FROM gauge_history WHERE name = $1) DELETE FROM gauges WHERE name = $1",
+			name,
+		)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
 		return err
 	})
 	if err != nil {
-		return fmt.Errorf("cant clear all gauges: %w", err)
+		return false, fmt.Errorf("cant delete gauge: %w", err)
 	}
-	return nil
+	return deleted > 0, nil
 }
 
-func (s *PostgresStorage) GetCounters(ctx context.Context) (map[string]Counter, error) {
+func (s *PostgresStorage) GetGaugeHistory(ctx context.Context, name string, from, to time.Time) ([]GaugeSample, error) {
 	var rows *sql.Rows
-	var err error
-	err = s.withRetry(func() error {
-		rows, err = s.db.QueryContext(ctx, "SELECT name, value FROM counters")
-		if err != nil {
-			return fmt.Errorf("cant query counters: %w", err)
+	err := s.withRetry(func() error {
+		var err error
+		rows, err = s.db.QueryContext(
+			ctx,
+			"SELECT created_at, value FROM gauge_history WHERE name = $1 AND created_at BETWEEN $2 AND $3 ORDER BY created_at, id",
+			name,
+			from,
+			to,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cant query gauge history: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			s.logger.Error("Error closing rows for gauge history", zap.Error(closeErr))
 		}
-		defer func() {
-			if closeErr := rows.Close(); closeErr != nil {
-				s.logger.Error("Error closing rows for counters", zap.Error(closeErr))
-			}
-		}()
-		if rows.Err() != nil {
-			return fmt.Errorf("rows error: %w", rows.Err())
+	}()
+
+	result := []GaugeSample{}
+	for rows.Next() {
+		var sample GaugeSample
+		if err := rows.Scan(&sample.Timestamp, &sample.Value); err != nil {
+			return nil, fmt.Errorf("cant scan gauge history row: %w", err)
 		}
-		return nil
+		result = append(result, sample)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *PostgresStorage) GetCounters(ctx context.Context) (map[string]Counter, error) {
+	var rows *sql.Rows
+	err := s.withRetry(func() error {
+		var err error
+		rows, err = s.db.QueryContext(ctx, "SELECT name, value FROM counters")
+		return err
 	})
 	if err != nil {
 		return nil, fmt.Errorf("cant query counters: %w", err)
 	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			s.logger.Error("Error closing rows for counters", zap.Error(closeErr))
+		}
+	}()
 
 	result := make(map[string]Counter)
 	for rows.Next() {
@@ -214,8 +296,16 @@ func (s *PostgresStorage) SetCounter(ctx context.Context, name string, value Cou
 	err := s.withRetry(func() error {
 		_, err := s.db.ExecContext(
 			ctx,
-			"INSERT INTO counters (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = counters.value + $2",
+			`
+			WITH upsert AS (
+				INSERT INTO counters (name, labels, value) VALUES ($1, $2, $3)
+				ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value, updated_at = now()
+				RETURNING name, value
+			)
+			INSERT INTO counter_history (name, delta, value) SELECT name, $3, value FROM upsert
+			`,
 			name,
+			labelsJSON(name),
 			value,
 		)
 		return err
@@ -227,6 +317,16 @@ func (s *PostgresStorage) SetCounter(ctx context.Context, name string, value Cou
 }
 
 func (s *PostgresStorage) SetCounters(ctx context.Context, values map[string]Counter) error {
+	err := s.withRetry(func() error {
+		return upsertCounters(ctx, s.db, values)
+	})
+	if err != nil {
+		return fmt.Errorf("cant set counters: %w", err)
+	}
+	return nil
+}
+
+func upsertCounters(ctx context.Context, q querier, values map[string]Counter) error {
 	keys := make([]string, 0, len(values))
 	for name := range values {
 		keys = append(keys, name)
@@ -234,63 +334,683 @@ func (s *PostgresStorage) SetCounters(ctx context.Context, values map[string]Cou
 	sort.Strings(keys)
 
 	valueStrings := make([]string, 0, len(keys))
-	valueArgs := make([]interface{}, 0, len(keys)*2)
+	valueArgs := make([]interface{}, 0, len(keys)*3)
 
 	i := 1
 	for _, name := range keys {
 		value := values[name]
-		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d)", i, i+1))
-		valueArgs = append(valueArgs, name, value)
-		i += 2
+		valueStrings = append(valueStrings, fmt.Sprintf("($%d::text, $%d::jsonb, $%d::bigint)", i, i+1, i+2))
+		valueArgs = append(valueArgs, name, labelsJSON(name), value)
+		i += 3
 	}
 
 	stmt := fmt.Sprintf(`
-		INSERT INTO counters (name, value) 
-		VALUES %s
-		ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value
+		WITH input (name, labels, delta) AS (
+			VALUES %s
+		), upsert AS (
+			INSERT INTO counters (name, labels, value)
+			SELECT name, labels, delta FROM input
+			ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value, updated_at = now()
+			RETURNING name, value
+		)
+		INSERT INTO counter_history (name, delta, value)
+		SELECT input.name, input.delta, upsert.value FROM input JOIN upsert ON upsert.name = input.name
 	`, strings.Join(valueStrings, ","))
 
+	_, err := q.ExecContext(ctx, stmt, valueArgs...)
+	return err
+}
+
+func (s *PostgresStorage) ClearCounters(ctx context.Context) error {
+	err := s.withRetry(func() error {
+		_, err := s.db.ExecContext(ctx, "WITH history AS (DELETE FROM counter_history) DELETE FROM counters")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cant clear all counters: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteCounter(ctx context.Context, name string) (bool, error) {
+	var deleted int64
 	err := s.withRetry(func() error {
-		_, err := s.db.ExecContext(ctx, stmt, valueArgs...)
+		result, err := s.db.ExecContext(
+			ctx,
+			"WITH history AS (DELETE FROM counter_history WHERE name = $1) DELETE FROM counters WHERE name = $1",
+			name,
+		)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
 		return err
 	})
+	if err != nil {
+		return false, fmt.Errorf("cant delete counter: %w", err)
+	}
+	return deleted > 0, nil
+}
 
+func (s *PostgresStorage) GetCounterHistory(
+	ctx context.Context,
+	name string,
+	from, to time.Time,
+) ([]CounterSample, error) {
+	var rows *sql.Rows
+	err := s.withRetry(func() error {
+		var err error
+		rows, err = s.db.QueryContext(
+			ctx,
+			`SELECT created_at, delta, value FROM counter_history
+			WHERE name = $1 AND created_at BETWEEN $2 AND $3 ORDER BY created_at, id`,
+			name,
+			from,
+			to,
+		)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("cant set counters: %w", err)
+		return nil, fmt.Errorf("cant query counter history: %w", err)
 	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			s.logger.Error("Error closing rows for counter history", zap.Error(closeErr))
+		}
+	}()
+
+	result := []CounterSample{}
+	for rows.Next() {
+		var sample CounterSample
+		if err := rows.Scan(&sample.Timestamp, &sample.Delta, &sample.Value); err != nil {
+			return nil, fmt.Errorf("cant scan counter history row: %w", err)
+		}
+		result = append(result, sample)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return result, nil
+}
 
+func (s *PostgresStorage) GetHistograms(ctx context.Context) (map[string]*Histogram, error) {
+	var rows *sql.Rows
+	err := s.withRetry(func() error {
+		var err error
+		rows, err = s.db.QueryContext(ctx, "SELECT name, bounds, counts, sum, count FROM histograms")
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cant query histograms: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			s.logger.Error("Error closing rows for histograms", zap.Error(closeErr))
+		}
+	}()
+
+	result := make(map[string]*Histogram)
+	for rows.Next() {
+		var name string
+		value, err := scanHistogram(rows, &name)
+		if err != nil {
+			s.logger.Error("Error scanning histogram row", zap.Error(err))
+			continue
+		}
+		result[name] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *PostgresStorage) GetHistogram(ctx context.Context, name string) (*Histogram, bool, error) {
+	var value *Histogram
+	err := s.withRetry(func() error {
+		var err error
+		value, err = scanHistogram(s.db.QueryRowContext(
+			ctx,
+			"SELECT bounds, counts, sum, count FROM histograms WHERE name = $1",
+			name,
+		))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("cant get histogram: %w", err)
+	}
+	return value, true, nil
+}
+
+func (s *PostgresStorage) SetHistogram(ctx context.Context, name string, value *Histogram) error {
+	return s.SetHistograms(ctx, map[string]*Histogram{name: value})
+}
+
+// SetHistograms merges histograms in a single transaction, locking the stored rows.
+// Nothing is stored if any of the histograms does not match the buckets of the stored one.
+func (s *PostgresStorage) SetHistograms(ctx context.Context, values map[string]*Histogram) error {
+	keys := make([]string, 0, len(values))
+	for name, value := range values {
+		if err := value.Validate(); err != nil {
+			return fmt.Errorf("cant set histogram %s: %w", name, err)
+		}
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+
+	err := s.withRetry(func() error {
+		return s.inTx(ctx, func(tx *sql.Tx) error {
+			return mergeHistograms(ctx, tx, keys, values)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("cant set histograms: %w", err)
+	}
 	return nil
 }
 
-func (s *PostgresStorage) ClearCounters(ctx context.Context) error {
+// mergeHistograms merges histograms in the transaction, locking the stored rows.
+func mergeHistograms(ctx context.Context, tx *sql.Tx, keys []string, values map[string]*Histogram) error {
+	for _, name := range keys {
+		merged, err := scanHistogram(tx.QueryRowContext(
+			ctx,
+			"SELECT bounds, counts, sum, count FROM histograms WHERE name = $1 FOR UPDATE",
+			name,
+		))
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			merged = values[name].Clone()
+		case err != nil:
+			return fmt.Errorf("cant get histogram %s: %w", name, err)
+		default:
+			if err := merged.Merge(values[name]); err != nil {
+				return fmt.Errorf("cant merge histogram %s: %w", name, err)
+			}
+		}
+
+		bounds, err := json.Marshal(merged.Bounds)
+		if err != nil {
+			return fmt.Errorf("cant encode histogram bounds: %w", err)
+		}
+		counts, err := json.Marshal(merged.Counts)
+		if err != nil {
+			return fmt.Errorf("cant encode histogram counts: %w", err)
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			`
+			INSERT INTO histograms (name, labels, bounds, counts, sum, count) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (name) DO UPDATE SET
+				bounds = EXCLUDED.bounds, counts = EXCLUDED.counts, sum = EXCLUDED.sum, count = EXCLUDED.count,
+				updated_at = now()
+			`,
+			name,
+			labelsJSON(name),
+			string(bounds),
+			string(counts),
+			merged.Sum,
+			merged.Count,
+		); err != nil {
+			return fmt.Errorf("cant upsert histogram %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ClearHistograms(ctx context.Context) error {
 	err := s.withRetry(func() error {
-		_, err := s.db.ExecContext(ctx, "DELETE FROM counters")
+		_, err := s.db.ExecContext(ctx, "DELETE FROM histograms")
 		return err
 	})
 	if err != nil {
-		return fmt.Errorf("cant clear all counters: %w", err)
+		return fmt.Errorf("cant clear all histograms: %w", err)
 	}
 	return nil
 }
 
-func (s *PostgresStorage) withRetry(exec func() error) error {
-	var err error
-	for _, delay := range []int{0, 1, 3, 5} {
-		time.Sleep(time.Duration(delay) * time.Second)
-		err = exec()
+func (s *PostgresStorage) DeleteHistogram(ctx context.Context, name string) (bool, error) {
+	var deleted int64
+	err := s.withRetry(func() error {
+		result, err := s.db.ExecContext(ctx, "DELETE FROM histograms WHERE name = $1", name)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("cant delete histogram: %w", err)
+	}
+	return deleted > 0, nil
+}
 
+func (s *PostgresStorage) GetSets(ctx context.Context) (map[string]*HyperLogLog, error) {
+	var rows *sql.Rows
+	err := s.withRetry(func() error {
+		var err error
+		rows, err = s.db.QueryContext(ctx, "SELECT name, registers FROM sets")
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cant query sets: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			s.logger.Error("Error closing rows for sets", zap.Error(closeErr))
+		}
+	}()
+
+	result := make(map[string]*HyperLogLog)
+	for rows.Next() {
+		var name string
+		value := &HyperLogLog{}
+		if err := rows.Scan(&name, &value.Registers); err != nil {
+			s.logger.Error("Error scanning set row", zap.Error(err))
+			continue
+		}
+		result[name] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *PostgresStorage) GetSet(ctx context.Context, name string) (*HyperLogLog, bool, error) {
+	value := &HyperLogLog{}
+	err := s.withRetry(func() error {
+		return s.db.QueryRowContext(ctx, "SELECT registers FROM sets WHERE name = $1", name).Scan(&value.Registers)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("cant get set: %w", err)
+	}
+	return value, true, nil
+}
+
+func (s *PostgresStorage) SetSet(ctx context.Context, name string, value *HyperLogLog) error {
+	return s.SetSets(ctx, map[string]*HyperLogLog{name: value})
+}
+
+// SetSets merges set sketches in a single transaction, locking the stored rows.
+func (s *PostgresStorage) SetSets(ctx context.Context, values map[string]*HyperLogLog) error {
+	keys := make([]string, 0, len(values))
+	for name, value := range values {
+		if err := value.Validate(); err != nil {
+			return fmt.Errorf("cant set set %s: %w", name, err)
+		}
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+
+	err := s.withRetry(func() error {
+		return s.inTx(ctx, func(tx *sql.Tx) error {
+			return mergeSets(ctx, tx, keys, values)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("cant set sets: %w", err)
+	}
+	return nil
+}
+
+// mergeSets merges set sketches in the transaction, locking the stored rows.
+func mergeSets(ctx context.Context, tx *sql.Tx, keys []string, values map[string]*HyperLogLog) error {
+	for _, name := range keys {
+		merged := &HyperLogLog{}
+		err := tx.QueryRowContext(ctx, "SELECT registers FROM sets WHERE name = $1 FOR UPDATE", name).
+			Scan(&merged.Registers)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			merged = values[name].Clone()
+		case err != nil:
+			return fmt.Errorf("cant get set %s: %w", name, err)
+		default:
+			if err := merged.Merge(values[name]); err != nil {
+				return fmt.Errorf("cant merge set %s: %w", name, err)
+			}
+		}
+
+		if _, err := tx.ExecContext(
+			ctx,
+			`
+			INSERT INTO sets (name, labels, registers) VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET registers = EXCLUDED.registers, updated_at = now()
+			`,
+			name,
+			labelsJSON(name),
+			merged.Registers,
+		); err != nil {
+			return fmt.Errorf("cant upsert set %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ClearSets(ctx context.Context) error {
+	err := s.withRetry(func() error {
+		_, err := s.db.ExecContext(ctx, "DELETE FROM sets")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cant clear all sets: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteSet(ctx context.Context, name string) (bool, error) {
+	var deleted int64
+	err := s.withRetry(func() error {
+		result, err := s.db.ExecContext(ctx, "DELETE FROM sets WHERE name = $1", name)
 		if err != nil {
-			if strings.Contains(err.Error(), "deadlock detected") {
-				s.logger.Warn("Deadlock detected, retrying", zap.Error(err))
-				continue
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("cant delete set: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+// deleteStatements select the series of each type matching a name LIKE pattern ($1) and labels ($2)
+// and, if $3 is not null, last updated before $3, deleting the history of deleted gauges and counters as well.
+var deleteStatements = map[string]string{
+	"gauge": `
+		WITH deleted AS (
+			DELETE FROM gauges WHERE split_part(name, '{', 1) LIKE $1 ESCAPE '\' AND labels @> $2::jsonb
+				AND ($3::timestamptz IS NULL OR updated_at < $3)
+			RETURNING name
+		), history AS (
+			DELETE FROM gauge_history WHERE name IN (SELECT name FROM deleted)
+		)
+		SELECT count(*) FROM deleted`,
+	"counter": `
+		WITH deleted AS (
+			DELETE FROM counters WHERE split_part(name, '{', 1) LIKE $1 ESCAPE '\' AND labels @> $2::jsonb
+				AND ($3::timestamptz IS NULL OR updated_at < $3)
+			RETURNING name
+		), history AS (
+			DELETE FROM counter_history WHERE name IN (SELECT name FROM deleted)
+		)
+		SELECT count(*) FROM deleted`,
+	"histogram": `
+		WITH deleted AS (
+			DELETE FROM histograms WHERE split_part(name, '{', 1) LIKE $1 ESCAPE '\' AND labels @> $2::jsonb
+				AND ($3::timestamptz IS NULL OR updated_at < $3)
+			RETURNING name
+		)
+		SELECT count(*) FROM deleted`,
+	"set": `
+		WITH deleted AS (
+			DELETE FROM sets WHERE split_part(name, '{', 1) LIKE $1 ESCAPE '\' AND labels @> $2::jsonb
+				AND ($3::timestamptz IS NULL OR updated_at < $3)
+			RETURNING name
+		)
+		SELECT count(*) FROM deleted`,
+}
+
+// DeleteMetrics deletes the selected series of all types in a single transaction.
+func (s *PostgresStorage) DeleteMetrics(ctx context.Context, filter MetricFilter) (int, error) {
+	deleted, err := s.deleteMatching(ctx, filter, nil)
+	if err != nil {
+		return 0, fmt.Errorf("cant delete metrics: %w", err)
+	}
+	return deleted, nil
+}
+
+// DeleteStale deletes the selected series not updated since before in a single transaction.
+func (s *PostgresStorage) DeleteStale(ctx context.Context, filter MetricFilter, before time.Time) (int, error) {
+	deleted, err := s.deleteMatching(ctx, filter, &before)
+	if err != nil {
+		return 0, fmt.Errorf("cant delete stale metrics: %w", err)
+	}
+	return deleted, nil
+}
+
+func (s *PostgresStorage) deleteMatching(ctx context.Context, filter MetricFilter, before *time.Time) (int, error) {
+	labels := "{}"
+	if len(filter.Labels) > 0 {
+		data, err := json.Marshal(filter.Labels)
+		if err != nil {
+			return 0, fmt.Errorf("cant encode labels: %w", err)
+		}
+		labels = string(data)
+	}
+
+	var deleted int
+	err := s.withRetry(func() error {
+		deleted = 0
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("cant begin transaction: %w", err)
+		}
+		defer func() {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+				s.logger.Error("Error rolling back delete", zap.Error(rollbackErr))
 			}
-			if errors.Is(err, pgx.ErrConnBusy) || !errors.Is(err, pgx.ErrDeadConn) {
-				s.logger.Warn("Connection fail, retry", zap.Error(err))
+		}()
+
+		for _, mtype := range []string{"gauge", "counter", "histogram", "set"} {
+			if !filter.MatchesType(mtype) {
 				continue
 			}
+			var count int
+			if err := tx.QueryRowContext(ctx, deleteStatements[mtype], filter.likePattern(), labels, before).
+				Scan(&count); err != nil {
+				return fmt.Errorf("cant delete %s metrics: %w", mtype, err)
+			}
+			deleted += count
+		}
+
+		return tx.Commit()
+	})
+	return deleted, err
+}
+
+// DeleteHistoryBefore deletes gauge and counter history older than before.
+func (s *PostgresStorage) DeleteHistoryBefore(ctx context.Context, before time.Time) (int, error) {
+	var deleted int
+	err := s.withRetry(func() error {
+		return s.db.QueryRowContext(
+			ctx,
+			`
+			WITH gauges AS (
+				DELETE FROM gauge_history WHERE created_at < $1 RETURNING id
+			), counters AS (
+				DELETE FROM counter_history WHERE created_at < $1 RETURNING id
+			)
+			SELECT (SELECT count(*) FROM gauges) + (SELECT count(*) FROM counters)
+			`,
+			before,
+		).Scan(&deleted)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cant delete history: %w", err)
+	}
+	return deleted, nil
+}
+
+// ApplyBatch claims the batch ID and applies the updates in a single transaction, so the batch is either applied
+// and remembered, or neither. The claim inserts the ID, or takes over an expired claim of it, dropping other expired
+// claims on the way. A concurrent delivery of the same ID waits for the transaction holding the row,
+// then finds it claimed if the batch was applied.
+func (s *PostgresStorage) ApplyBatch(ctx context.Context, id string, window time.Duration, batch *Batch) (bool, error) {
+	histogramKeys := make([]string, 0, len(batch.Histograms))
+	for name, value := range batch.Histograms {
+		if err := value.Validate(); err != nil {
+			return false, fmt.Errorf("cant set histogram %s: %w", name, err)
+		}
+		histogramKeys = append(histogramKeys, name)
+	}
+	sort.Strings(histogramKeys)
+	setKeys := make([]string, 0, len(batch.Sets))
+	for name, value := range batch.Sets {
+		if err := value.Validate(); err != nil {
+			return false, fmt.Errorf("cant set set %s: %w", name, err)
+		}
+		setKeys = append(setKeys, name)
+	}
+	sort.Strings(setKeys)
+
+	var applied bool
+	err := s.withRetry(func() error {
+		applied = false
+		return s.inTx(ctx, func(tx *sql.Tx) error {
+			if id != "" {
+				err := tx.QueryRowContext(
+					ctx,
+					`
+					WITH expired AS (
+						DELETE FROM batches WHERE claimed_at < now() - make_interval(secs => $2) AND id <> $1
+					)
+					INSERT INTO batches (id) VALUES ($1)
+					ON CONFLICT (id) DO UPDATE SET claimed_at = now()
+					WHERE batches.claimed_at < now() - make_interval(secs => $2)
+					RETURNING true
+					`,
+					id,
+					window.Seconds(),
+				).Scan(&applied)
+				if errors.Is(err, sql.ErrNoRows) {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("cant claim batch: %w", err)
+				}
+			}
+			applied = true
+			return applyBatch(ctx, tx, batch, histogramKeys, setKeys)
+		})
+	})
+	if err != nil {
+		return false, fmt.Errorf("cant apply batch: %w", err)
+	}
+	return applied, nil
+}
+
+func applyBatch(ctx context.Context, tx *sql.Tx, batch *Batch, histogramKeys, setKeys []string) error {
+	if len(batch.Gauges) > 0 {
+		if err := upsertGauges(ctx, tx, batch.Gauges, "EXCLUDED.value"); err != nil {
+			return fmt.Errorf("cant set gauges: %w", err)
 		}
+	}
+	if len(batch.Counters) > 0 {
+		if err := upsertCounters(ctx, tx, batch.Counters); err != nil {
+			return fmt.Errorf("cant set counters: %w", err)
+		}
+	}
+	if err := mergeHistograms(ctx, tx, histogramKeys, batch.Histograms); err != nil {
+		return err
+	}
+	return mergeSets(ctx, tx, setKeys, batch.Sets)
+}
 
+// querier runs statements on the database or in a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds and rolling it back otherwise.
+func (s *PostgresStorage) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cant begin transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			s.logger.Error("Error rolling back transaction", zap.Error(rollbackErr))
+		}
+	}()
+
+	if err := fn(tx); err != nil {
 		return err
 	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cant commit transaction: %w", err)
+	}
+	return nil
+}
+
+// scanHistogram scans bounds, counts, sum and count columns, preceded by dest columns.
+func scanHistogram(row interface{ Scan(dest ...any) error }, dest ...any) (*Histogram, error) {
+	var bounds, counts []byte
+	value := &Histogram{}
+	if err := row.Scan(append(dest, &bounds, &counts, &value.Sum, &value.Count)...); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bounds, &value.Bounds); err != nil {
+		return nil, fmt.Errorf("cant decode histogram bounds: %w", err)
+	}
+	if err := json.Unmarshal(counts, &value.Counts); err != nil {
+		return nil, fmt.Errorf("cant decode histogram counts: %w", err)
+	}
+	return value, nil
+}
+
+// labelsJSON encodes the labels of a series key for the labels column.
+func labelsJSON(key string) string {
+	_, labels := ParseSeriesKey(key)
+	if len(labels) == 0 {
+		return "{}"
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// SQLSTATE codes of transient errors, see https://www.postgresql.org/docs/current/errcodes-appendix.html.
+const (
+	// pgConnectionExceptionClass is the class of connection errors, e.g. 08006 connection_failure.
+	pgConnectionExceptionClass = "08"
+	pgSerializationFailure     = "40001"
+	pgDeadlockDetected         = "40P01"
+)
+
+// withRetry runs exec again after a delay while it fails with a transient error.
+func (s *PostgresStorage) withRetry(exec func() error) error {
+	var err error
+	for _, delay := range []int{0, 1, 3, 5} {
+		time.Sleep(time.Duration(delay) * time.Second)
+		err = exec()
+		if !isTransient(err) {
+			return err
+		}
+		s.logger.Warn("Transient database error, retrying", zap.Error(err))
+	}
 	return err
 }
+
+// isTransient reports whether a failed statement may succeed when run again: the statement was not sent,
+// the connection could not be established or was lost, or the transaction was aborted by a serialization failure
+// or a deadlock.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var connectErr *pgconn.ConnectError
+	if pgconn.SafeToRetry(err) || errors.Is(err, driver.ErrBadConn) || errors.As(err, &connectErr) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, pgConnectionExceptionClass) ||
+		pgErr.Code == pgSerializationFailure ||
+		pgErr.Code == pgDeadlockDetected
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetentionRule expires series whose name matches Pattern after TTL without updates.
+type RetentionRule struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// RetentionPolicy configures the retention sweeper.
+// When rules overlap, the shortest TTL applies to a series.
+type RetentionPolicy struct {
+	Rules []RetentionRule
+	// HistoryMaxAge is the age after which history samples are deleted, zero keeps them.
+	HistoryMaxAge time.Duration
+	// Interval is the period between sweeps.
+	Interval time.Duration
+}
+
+// Enabled reports whether the policy prunes anything.
+func (p RetentionPolicy) Enabled() bool {
+	return len(p.Rules) > 0 || p.HistoryMaxAge > 0
+}
+
+// ParseRetentionRules parses comma-separated rules of the form pattern=ttl, e.g. "Heap*=1h,*=24h".
+func ParseRetentionRules(value string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, rawTTL, ok := strings.Cut(item, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("bad retention rule %q, expected pattern=ttl", item)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(rawTTL))
+		if err != nil {
+			return nil, fmt.Errorf("bad retention ttl in %q: %w", item, err)
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("retention ttl in %q must be positive", item)
+		}
+		rules = append(rules, RetentionRule{Pattern: pattern, TTL: ttl})
+	}
+	return rules, nil
+}
+
+// Sweeper periodically deletes stale series and old history from a storage according to a retention policy.
+type Sweeper struct {
+	storage MetricsStorage
+	logger  *zap.Logger
+	policy  RetentionPolicy
+}
+
+// NewSweeper creates a new instance of Sweeper.
+func NewSweeper(metricsStorage MetricsStorage, policy RetentionPolicy, logger *zap.Logger) *Sweeper {
+	return &Sweeper{storage: metricsStorage, policy: policy, logger: logger}
+}
+
+// Run sweeps every policy interval until the context is done.
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := s.Sweep(ctx, now); err != nil {
+				s.logger.Error("cant sweep metrics", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Sweep applies the policy once, treating now as the current time.
+func (s *Sweeper) Sweep(ctx context.Context, now time.Time) error {
+	for _, rule := range s.policy.Rules {
+		deleted, err := s.storage.DeleteStale(ctx, MetricFilter{Pattern: rule.Pattern}, now.Add(-rule.TTL))
+		if err != nil {
+			return fmt.Errorf("cant delete stale series for %q: %w", rule.Pattern, err)
+		}
+		if deleted > 0 {
+			s.logger.Info("pruned stale series",
+				zap.String("pattern", rule.Pattern),
+				zap.Duration("ttl", rule.TTL),
+				zap.Int("deleted", deleted),
+			)
+		}
+	}
+
+	if s.policy.HistoryMaxAge > 0 {
+		deleted, err := s.storage.DeleteHistoryBefore(ctx, now.Add(-s.policy.HistoryMaxAge))
+		if err != nil {
+			return fmt.Errorf("cant delete history: %w", err)
+		}
+		if deleted > 0 {
+			s.logger.Info("pruned history samples",
+				zap.Duration("max_age", s.policy.HistoryMaxAge),
+				zap.Int("deleted", deleted),
+			)
+		}
+	}
+
+	return nil
+}
@@ -2,6 +2,11 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
 )
 
 // Gauge represents a floating-point metric value.
@@ -11,6 +16,7 @@ type Gauge float64
 type Counter int
 
 // MetricsStorage defines the interface for metric storage operations.
+// Metrics are identified by series keys built with SeriesKey from the metric name and labels.
 type MetricsStorage interface {
 	// GetGauge retrieves a gauge metric by name.
 	GetGauge(ctx context.Context, name string) (Gauge, bool, error)
@@ -20,8 +26,14 @@ type MetricsStorage interface {
 	SetGauge(ctx context.Context, name string, value Gauge) error
 	// SetGauges sets multiple gauge metrics.
 	SetGauges(ctx context.Context, values map[string]Gauge) error
+	// AddGauges atomically adds deltas to multiple gauge metrics, missing gauges start from zero.
+	AddGauges(ctx context.Context, deltas map[string]Gauge) error
 	// ClearGauges clears all gauge metrics.
 	ClearGauges(ctx context.Context) error
+	// DeleteGauge deletes a gauge metric and its history by name, reporting whether it existed.
+	DeleteGauge(ctx context.Context, name string) (bool, error)
+	// GetGaugeHistory retrieves gauge samples reported between from and to inclusive, oldest first.
+	GetGaugeHistory(ctx context.Context, name string, from, to time.Time) ([]GaugeSample, error)
 
 	// GetCounter retrieves a counter metric by name.
 	GetCounter(ctx context.Context, name string) (Counter, bool, error)
@@ -33,30 +45,217 @@ type MetricsStorage interface {
 	SetCounters(ctx context.Context, values map[string]Counter) error
 	// ClearCounters clears all counter metrics.
 	ClearCounters(ctx context.Context) error
+	// DeleteCounter deletes a counter metric and its history by name, reporting whether it existed.
+	DeleteCounter(ctx context.Context, name string) (bool, error)
+	// GetCounterHistory retrieves counter samples reported between from and to inclusive, oldest first.
+	GetCounterHistory(ctx context.Context, name string, from, to time.Time) ([]CounterSample, error)
+
+	// GetHistogram retrieves a histogram metric by name.
+	GetHistogram(ctx context.Context, name string) (*Histogram, bool, error)
+	// GetHistograms retrieves all histogram metrics.
+	GetHistograms(ctx context.Context) (map[string]*Histogram, error)
+	// SetHistogram merges observations into a histogram metric by name.
+	SetHistogram(ctx context.Context, name string, value *Histogram) error
+	// SetHistograms merges observations into multiple histogram metrics.
+	SetHistograms(ctx context.Context, values map[string]*Histogram) error
+	// ClearHistograms clears all histogram metrics.
+	ClearHistograms(ctx context.Context) error
+	// DeleteHistogram deletes a histogram metric by name, reporting whether it existed.
+	DeleteHistogram(ctx context.Context, name string) (bool, error)
+
+	// GetSet retrieves a set metric sketch by name.
+	GetSet(ctx context.Context, name string) (*HyperLogLog, bool, error)
+	// GetSets retrieves all set metric sketches.
+	GetSets(ctx context.Context) (map[string]*HyperLogLog, error)
+	// SetSet merges members into a set metric by name.
+	SetSet(ctx context.Context, name string, value *HyperLogLog) error
+	// SetSets merges members into multiple set metrics.
+	SetSets(ctx context.Context, values map[string]*HyperLogLog) error
+	// ClearSets clears all set metrics.
+	ClearSets(ctx context.Context) error
+	// DeleteSet deletes a set metric by name, reporting whether it existed.
+	DeleteSet(ctx context.Context, name string) (bool, error)
+
+	// DeleteMetrics deletes all series of any type selected by the filter, returning the number deleted.
+	DeleteMetrics(ctx context.Context, filter MetricFilter) (int, error)
+	// DeleteStale deletes series selected by the filter that were last updated before the given time,
+	// returning the number deleted.
+	DeleteStale(ctx context.Context, filter MetricFilter, before time.Time) (int, error)
+	// DeleteHistoryBefore deletes history samples reported before the given time, returning the number deleted.
+	DeleteHistoryBefore(ctx context.Context, before time.Time) (int, error)
+
+	// ApplyBatch applies the updates of a batch. A batch with a non-empty ID is applied once within the window:
+	// it reports false without applying a batch whose ID was already applied, and returns ErrBatchInFlight
+	// while another delivery of the ID is being applied. The ID is remembered only once every update succeeded,
+	// so a batch that could not be applied is applied on retry.
+	ApplyBatch(ctx context.Context, id string, window time.Duration, batch *Batch) (bool, error)
+
+	// Close flushes pending data and releases the resources of the storage.
+	// The storage must not be used after Close.
+	Close(ctx context.Context) error
 }
 
-// MemStorage is an in-memory implementation of MetricsStorage.
+// memShardCount is the number of independently locked shards of MemStorage.
+const memShardCount = 32
+
+// MemStorage is an in-memory implementation of MetricsStorage, safe for concurrent use.
+// Series are spread over shards by key hash, each shard guarded by its own lock,
+// and methods returning all metrics of a type return snapshots.
+// History is kept in a ring buffer per series, holding at most historySize samples.
 type MemStorage struct {
-	gauges   map[string]Gauge
-	counters map[string]Counter
+	batches     *batchRegistry
+	shards      []*memShard
+	historySize int
+}
+
+// memShard holds a part of the series of MemStorage.
+// The last update time of each series is tracked in lastSeen, entries of deleted series are dropped on sweep.
+type memShard struct {
+	gauges         map[string]Gauge
+	counters       map[string]Counter
+	histograms     map[string]*Histogram
+	sets           map[string]*HyperLogLog
+	gaugeHistory   map[string]*ring[GaugeSample]
+	counterHistory map[string]*ring[CounterSample]
+	lastSeen       map[seriesID]time.Time
+	mu             sync.RWMutex
+}
+
+// seriesID identifies a series of a given metric type.
+type seriesID struct {
+	mtype string
+	key   string
 }
 
-// NewMemStorage creates a new instance of MemStorage.
+// NewMemStorage creates a new instance of MemStorage without history.
 func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		gauges:   make(map[string]Gauge),
-		counters: make(map[string]Counter),
+	return NewMemStorageWithHistory(0)
+}
+
+// NewMemStorageWithHistory creates a new instance of MemStorage keeping up to historySize samples per series.
+func NewMemStorageWithHistory(historySize int) *MemStorage {
+	ms := &MemStorage{
+		batches:     newBatchRegistry(),
+		shards:      make([]*memShard, memShardCount),
+		historySize: historySize,
+	}
+	for i := range ms.shards {
+		ms.shards[i] = &memShard{
+			gauges:         make(map[string]Gauge),
+			counters:       make(map[string]Counter),
+			histograms:     make(map[string]*Histogram),
+			sets:           make(map[string]*HyperLogLog),
+			gaugeHistory:   make(map[string]*ring[GaugeSample]),
+			counterHistory: make(map[string]*ring[CounterSample]),
+			lastSeen:       make(map[seriesID]time.Time),
+		}
+	}
+	return ms
+}
+
+func (ms *MemStorage) shardIndex(key string) int {
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(key))
+	return int(hasher.Sum32() % memShardCount)
+}
+
+func (ms *MemStorage) shard(key string) *memShard {
+	return ms.shards[ms.shardIndex(key)]
+}
+
+// groupByShard splits batch values by the index of the shard owning each key.
+func groupByShard[V any](ms *MemStorage, values map[string]V) map[int]map[string]V {
+	groups := make(map[int]map[string]V)
+	for key, value := range values {
+		index := ms.shardIndex(key)
+		if groups[index] == nil {
+			groups[index] = make(map[string]V)
+		}
+		groups[index][key] = value
+	}
+	return groups
+}
+
+func (s *memShard) setGauge(name string, value Gauge, now time.Time, historySize int) {
+	s.gauges[name] = value
+	s.lastSeen[seriesID{mtype: "gauge", key: name}] = now
+	if historySize == 0 {
+		return
+	}
+	history, ok := s.gaugeHistory[name]
+	if !ok {
+		history = newRing[GaugeSample](historySize)
+		s.gaugeHistory[name] = history
+	}
+	history.push(GaugeSample{Timestamp: now, Value: value})
+}
+
+func (s *memShard) setCounter(name string, value Counter, now time.Time, historySize int) {
+	s.counters[name] += value
+	s.lastSeen[seriesID{mtype: "counter", key: name}] = now
+	if historySize == 0 {
+		return
+	}
+	history, ok := s.counterHistory[name]
+	if !ok {
+		history = newRing[CounterSample](historySize)
+		s.counterHistory[name] = history
+	}
+	history.push(CounterSample{Timestamp: now, Delta: value, Value: s.counters[name]})
+}
+
+func (s *memShard) seriesExists(id seriesID) bool {
+	var ok bool
+	switch id.mtype {
+	case "gauge":
+		_, ok = s.gauges[id.key]
+	case "counter":
+		_, ok = s.counters[id.key]
+	case "histogram":
+		_, ok = s.histograms[id.key]
+	case "set":
+		_, ok = s.sets[id.key]
+	}
+	return ok
+}
+
+// deleteSeries deletes a series with its history, reporting whether it existed.
+func (s *memShard) deleteSeries(id seriesID) bool {
+	ok := s.seriesExists(id)
+	switch id.mtype {
+	case "gauge":
+		delete(s.gauges, id.key)
+		delete(s.gaugeHistory, id.key)
+	case "counter":
+		delete(s.counters, id.key)
+		delete(s.counterHistory, id.key)
+	case "histogram":
+		delete(s.histograms, id.key)
+	case "set":
+		delete(s.sets, id.key)
 	}
+	return ok
 }
 
-// GetGauges retrieves all gauge metrics from memory.
+// GetGauges retrieves a snapshot of all gauge metrics from memory.
 func (ms *MemStorage) GetGauges(ctx context.Context) (map[string]Gauge, error) {
-	return ms.gauges, nil
+	result := make(map[string]Gauge)
+	for _, shard := range ms.shards {
+		shard.mu.RLock()
+		for name, value := range shard.gauges {
+			result[name] = value
+		}
+		shard.mu.RUnlock()
+	}
+	return result, nil
 }
 
 // GetGauge retrieves a specific gauge metric by name from memory.
 func (ms *MemStorage) GetGauge(ctx context.Context, name string) (Gauge, bool, error) {
-	value, ok := ms.gauges[name]
+	shard := ms.shard(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	value, ok := shard.gauges[name]
 	if !ok {
 		return 0, false, nil
 	}
@@ -65,34 +264,92 @@ func (ms *MemStorage) GetGauge(ctx context.Context, name string) (Gauge, bool, e
 
 // SetGauge sets a gauge metric in memory.
 func (ms *MemStorage) SetGauge(ctx context.Context, name string, value Gauge) error {
-	ms.gauges[name] = value
+	shard := ms.shard(name)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.setGauge(name, value, time.Now(), ms.historySize)
 	return nil
 }
 
 // SetGauges sets multiple gauge metrics in memory.
 func (ms *MemStorage) SetGauges(ctx context.Context, values map[string]Gauge) error {
-	for name, value := range values {
-		ms.gauges[name] = value
+	ms.setGauges(values, time.Now())
+	return nil
+}
+
+// setGauges sets multiple gauge metrics, recording their samples at now.
+func (ms *MemStorage) setGauges(values map[string]Gauge, now time.Time) {
+	for index, group := range groupByShard(ms, values) {
+		shard := ms.shards[index]
+		shard.mu.Lock()
+		for name, value := range group {
+			shard.setGauge(name, value, now, ms.historySize)
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// AddGauges adds deltas to multiple gauge metrics in memory.
+func (ms *MemStorage) AddGauges(ctx context.Context, deltas map[string]Gauge) error {
+	now := time.Now()
+	for index, group := range groupByShard(ms, deltas) {
+		shard := ms.shards[index]
+		shard.mu.Lock()
+		for name, delta := range group {
+			shard.setGauge(name, shard.gauges[name]+delta, now, ms.historySize)
+		}
+		shard.mu.Unlock()
 	}
 	return nil
 }
 
 // ClearGauges clears all gauge metrics from memory.
 func (ms *MemStorage) ClearGauges(ctx context.Context) error {
-	for k := range ms.gauges {
-		delete(ms.gauges, k)
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		clear(shard.gauges)
+		clear(shard.gaugeHistory)
+		shard.mu.Unlock()
 	}
 	return nil
 }
 
-// GetCounters retrieves all counter metrics from memory.
+// DeleteGauge deletes a gauge metric and its history from memory.
+func (ms *MemStorage) DeleteGauge(ctx context.Context, name string) (bool, error) {
+	return ms.deleteMetric(ctx, "gauge", name)
+}
+
+// GetGaugeHistory retrieves gauge samples for a series from memory.
+func (ms *MemStorage) GetGaugeHistory(ctx context.Context, name string, from, to time.Time) ([]GaugeSample, error) {
+	shard := ms.shard(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	history, ok := shard.gaugeHistory[name]
+	if !ok {
+		return []GaugeSample{}, nil
+	}
+	return history.filter(func(s GaugeSample) bool { return inRange(s.Timestamp, from, to) }), nil
+}
+
+// GetCounters retrieves a snapshot of all counter metrics from memory.
 func (ms *MemStorage) GetCounters(ctx context.Context) (map[string]Counter, error) {
-	return ms.counters, nil
+	result := make(map[string]Counter)
+	for _, shard := range ms.shards {
+		shard.mu.RLock()
+		for name, value := range shard.counters {
+			result[name] = value
+		}
+		shard.mu.RUnlock()
+	}
+	return result, nil
 }
 
 // GetCounter retrieves a specific counter metric by name from memory.
 func (ms *MemStorage) GetCounter(ctx context.Context, name string) (Counter, bool, error) {
-	value, ok := ms.counters[name]
+	shard := ms.shard(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	value, ok := shard.counters[name]
 	if !ok {
 		return 0, false, nil
 	}
@@ -101,22 +358,346 @@ func (ms *MemStorage) GetCounter(ctx context.Context, name string) (Counter, boo
 
 // SetCounter increments a counter metric in memory.
 func (ms *MemStorage) SetCounter(ctx context.Context, name string, value Counter) error {
-	ms.counters[name] += value
+	shard := ms.shard(name)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.setCounter(name, value, time.Now(), ms.historySize)
 	return nil
 }
 
 // SetCounters increments multiple counter metrics in memory.
 func (ms *MemStorage) SetCounters(ctx context.Context, values map[string]Counter) error {
-	for name, value := range values {
-		ms.counters[name] += value
-	}
+	ms.setCounters(values, time.Now())
 	return nil
 }
 
+// setCounters increments multiple counter metrics, recording their samples at now.
+func (ms *MemStorage) setCounters(values map[string]Counter, now time.Time) {
+	for index, group := range groupByShard(ms, values) {
+		shard := ms.shards[index]
+		shard.mu.Lock()
+		for name, value := range group {
+			shard.setCounter(name, value, now, ms.historySize)
+		}
+		shard.mu.Unlock()
+	}
+}
+
 // ClearCounters clears all counter metrics from memory.
 func (ms *MemStorage) ClearCounters(ctx context.Context) error {
-	for k := range ms.counters {
-		delete(ms.counters, k)
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		clear(shard.counters)
+		clear(shard.counterHistory)
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// DeleteCounter deletes a counter metric and its history from memory.
+func (ms *MemStorage) DeleteCounter(ctx context.Context, name string) (bool, error) {
+	return ms.deleteMetric(ctx, "counter", name)
+}
+
+// GetCounterHistory retrieves counter samples for a series from memory.
+func (ms *MemStorage) GetCounterHistory(ctx context.Context, name string, from, to time.Time) ([]CounterSample, error) {
+	shard := ms.shard(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	history, ok := shard.counterHistory[name]
+	if !ok {
+		return []CounterSample{}, nil
+	}
+	return history.filter(func(s CounterSample) bool { return inRange(s.Timestamp, from, to) }), nil
+}
+
+// GetHistograms retrieves a snapshot of all histogram metrics from memory.
+func (ms *MemStorage) GetHistograms(ctx context.Context) (map[string]*Histogram, error) {
+	result := make(map[string]*Histogram)
+	for _, shard := range ms.shards {
+		shard.mu.RLock()
+		for name, value := range shard.histograms {
+			result[name] = value.Clone()
+		}
+		shard.mu.RUnlock()
+	}
+	return result, nil
+}
+
+// GetHistogram retrieves a specific histogram metric by name from memory.
+func (ms *MemStorage) GetHistogram(ctx context.Context, name string) (*Histogram, bool, error) {
+	shard := ms.shard(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	value, ok := shard.histograms[name]
+	if !ok {
+		return nil, false, nil
+	}
+	return value.Clone(), true, nil
+}
+
+// SetHistogram merges a histogram metric in memory.
+func (ms *MemStorage) SetHistogram(ctx context.Context, name string, value *Histogram) error {
+	return ms.SetHistograms(ctx, map[string]*Histogram{name: value})
+}
+
+// checkHistograms reports an error if any of the histograms is invalid or does not match the buckets
+// of the stored one, that is if SetHistograms would fail on them.
+func (ms *MemStorage) checkHistograms(values map[string]*Histogram) error {
+	for name, value := range values {
+		if err := value.Validate(); err != nil {
+			return fmt.Errorf("cant set histogram %s: %w", name, err)
+		}
+		shard := ms.shard(name)
+		shard.mu.RLock()
+		current, ok := shard.histograms[name]
+		shard.mu.RUnlock()
+		if ok && !current.sameBuckets(value) {
+			return fmt.Errorf("cant set histogram %s: %w", name, ErrBucketsMismatch)
+		}
+	}
+	return nil
+}
+
+// SetHistograms merges multiple histogram metrics in memory.
+// Nothing is stored if any of the histograms does not match the buckets of the stored one,
+// so all shards involved are locked, in index order, for the whole batch.
+func (ms *MemStorage) SetHistograms(ctx context.Context, values map[string]*Histogram) error {
+	for name, value := range values {
+		if err := value.Validate(); err != nil {
+			return fmt.Errorf("cant set histogram %s: %w", name, err)
+		}
+	}
+
+	groups := groupByShard(ms, values)
+	indexes := make([]int, 0, len(groups))
+	for index := range groups {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		ms.shards[index].mu.Lock()
+		defer ms.shards[index].mu.Unlock()
+	}
+
+	merged := make(map[string]*Histogram, len(values))
+	for name, value := range values {
+		current, ok := ms.shard(name).histograms[name]
+		if !ok {
+			merged[name] = value.Clone()
+			continue
+		}
+		current = current.Clone()
+		if err := current.Merge(value); err != nil {
+			return fmt.Errorf("cant set histogram %s: %w", name, err)
+		}
+		merged[name] = current
+	}
+	now := time.Now()
+	for name, value := range merged {
+		shard := ms.shard(name)
+		shard.histograms[name] = value
+		shard.lastSeen[seriesID{mtype: "histogram", key: name}] = now
+	}
+	return nil
+}
+
+// ClearHistograms clears all histogram metrics from memory.
+func (ms *MemStorage) ClearHistograms(ctx context.Context) error {
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		clear(shard.histograms)
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// DeleteHistogram deletes a histogram metric from memory.
+func (ms *MemStorage) DeleteHistogram(ctx context.Context, name string) (bool, error) {
+	return ms.deleteMetric(ctx, "histogram", name)
+}
+
+// GetSets retrieves a snapshot of all set metric sketches from memory.
+func (ms *MemStorage) GetSets(ctx context.Context) (map[string]*HyperLogLog, error) {
+	result := make(map[string]*HyperLogLog)
+	for _, shard := range ms.shards {
+		shard.mu.RLock()
+		for name, value := range shard.sets {
+			result[name] = value.Clone()
+		}
+		shard.mu.RUnlock()
+	}
+	return result, nil
+}
+
+// GetSet retrieves a specific set metric sketch by name from memory.
+func (ms *MemStorage) GetSet(ctx context.Context, name string) (*HyperLogLog, bool, error) {
+	shard := ms.shard(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	value, ok := shard.sets[name]
+	if !ok {
+		return nil, false, nil
+	}
+	return value.Clone(), true, nil
+}
+
+// SetSet merges a set metric sketch in memory.
+func (ms *MemStorage) SetSet(ctx context.Context, name string, value *HyperLogLog) error {
+	return ms.SetSets(ctx, map[string]*HyperLogLog{name: value})
+}
+
+// SetSets merges multiple set metric sketches in memory.
+func (ms *MemStorage) SetSets(ctx context.Context, values map[string]*HyperLogLog) error {
+	if err := checkSets(values); err != nil {
+		return err
 	}
+	now := time.Now()
+	for index, group := range groupByShard(ms, values) {
+		shard := ms.shards[index]
+		shard.mu.Lock()
+		for name, value := range group {
+			shard.lastSeen[seriesID{mtype: "set", key: name}] = now
+			current, ok := shard.sets[name]
+			if !ok {
+				shard.sets[name] = value.Clone()
+				continue
+			}
+			// Validated sketches always have the same number of registers.
+			_ = current.Merge(value)
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// checkSets reports an error if any of the sketches is invalid, that is if SetSets would fail on them.
+func checkSets(values map[string]*HyperLogLog) error {
+	for name, value := range values {
+		if err := value.Validate(); err != nil {
+			return fmt.Errorf("cant set set %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ClearSets clears all set metrics from memory.
+func (ms *MemStorage) ClearSets(ctx context.Context) error {
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		clear(shard.sets)
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// DeleteSet deletes a set metric from memory.
+func (ms *MemStorage) DeleteSet(ctx context.Context, name string) (bool, error) {
+	return ms.deleteMetric(ctx, "set", name)
+}
+
+// deleteMetric deletes a series of the given metric type from memory.
+func (ms *MemStorage) deleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	shard := ms.shard(name)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return shard.deleteSeries(seriesID{mtype: mtype, key: name}), nil
+}
+
+// clearMetrics clears all metrics of the given type from memory.
+func (ms *MemStorage) clearMetrics(ctx context.Context, mtype string) error {
+	switch mtype {
+	case "gauge":
+		return ms.ClearGauges(ctx)
+	case "counter":
+		return ms.ClearCounters(ctx)
+	case "histogram":
+		return ms.ClearHistograms(ctx)
+	case "set":
+		return ms.ClearSets(ctx)
+	}
+	return fmt.Errorf("unknown metric type %q", mtype)
+}
+
+// DeleteMetrics deletes all series selected by the filter from memory.
+func (ms *MemStorage) DeleteMetrics(ctx context.Context, filter MetricFilter) (int, error) {
+	deleted := 0
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		for _, id := range shard.seriesIDs() {
+			if filter.MatchesType(id.mtype) && filter.Matches(id.key) && shard.deleteSeries(id) {
+				deleted++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return deleted, nil
+}
+
+// seriesIDs lists the series of all types stored in the shard.
+func (s *memShard) seriesIDs() []seriesID {
+	ids := make([]seriesID, 0, len(s.gauges)+len(s.counters)+len(s.histograms)+len(s.sets))
+	for name := range s.gauges {
+		ids = append(ids, seriesID{mtype: "gauge", key: name})
+	}
+	for name := range s.counters {
+		ids = append(ids, seriesID{mtype: "counter", key: name})
+	}
+	for name := range s.histograms {
+		ids = append(ids, seriesID{mtype: "histogram", key: name})
+	}
+	for name := range s.sets {
+		ids = append(ids, seriesID{mtype: "set", key: name})
+	}
+	return ids
+}
+
+// DeleteStale deletes series selected by the filter that were not updated since before from memory.
+// It also forgets update times of series deleted by other means.
+func (ms *MemStorage) DeleteStale(ctx context.Context, filter MetricFilter, before time.Time) (int, error) {
+	deleted := 0
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		for id, seen := range shard.lastSeen {
+			if !shard.seriesExists(id) {
+				delete(shard.lastSeen, id)
+				continue
+			}
+			if !seen.Before(before) || !filter.MatchesType(id.mtype) || !filter.Matches(id.key) {
+				continue
+			}
+			shard.deleteSeries(id)
+			delete(shard.lastSeen, id)
+			deleted++
+		}
+		shard.mu.Unlock()
+	}
+	return deleted, nil
+}
+
+// DeleteHistoryBefore deletes history samples older than before from memory.
+func (ms *MemStorage) DeleteHistoryBefore(ctx context.Context, before time.Time) (int, error) {
+	deleted := 0
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		for name, history := range shard.gaugeHistory {
+			deleted += history.dropWhile(func(s GaugeSample) bool { return s.Timestamp.Before(before) })
+			if history.size == 0 {
+				delete(shard.gaugeHistory, name)
+			}
+		}
+		for name, history := range shard.counterHistory {
+			deleted += history.dropWhile(func(s CounterSample) bool { return s.Timestamp.Before(before) })
+			if history.size == 0 {
+				delete(shard.counterHistory, name)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return deleted, nil
+}
+
+// Close does nothing, as memory storage holds no resources.
+func (ms *MemStorage) Close(ctx context.Context) error {
 	return nil
 }
@@ -2,7 +2,22 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"go.uber.org/zap"
 )
 
 func TestMemStorage_SetAndGetGauges(t *testing.T) {
@@ -196,3 +211,1248 @@ func TestMemStorage_ClearCounters(t *testing.T) {
 		t.Errorf("expected no counters, got %v", counters)
 	}
 }
+
+func TestMemStorage_GaugeHistory(t *testing.T) {
+	memStorage := NewMemStorageWithHistory(3)
+	ctx := context.Background()
+
+	from := time.Now()
+	for _, value := range []Gauge{1, 2, 3, 4} {
+		if err := memStorage.SetGauge(ctx, "gauge1", value); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	to := time.Now()
+
+	history, err := memStorage.GetGaugeHistory(ctx, "gauge1", from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("expected 3 samples, got %d", len(history))
+	}
+	for i, expected := range []Gauge{2, 3, 4} {
+		if history[i].Value != expected {
+			t.Errorf("expected sample %d to be %f, got %f", i, expected, history[i].Value)
+		}
+	}
+
+	history, err = memStorage.GetGaugeHistory(ctx, "gauge1", to.Add(time.Second), to.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("expected no samples out of range, got %v", history)
+	}
+
+	gauge, ok, err := memStorage.GetGauge(ctx, "gauge1")
+	if err != nil || !ok || gauge != 4 {
+		t.Errorf("expected latest gauge to be 4, got %f", gauge)
+	}
+}
+
+func TestMemStorage_CounterHistory(t *testing.T) {
+	memStorage := NewMemStorageWithHistory(10)
+	ctx := context.Background()
+
+	from := time.Now()
+	if err := memStorage.SetCounter(ctx, "counter1", 5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := memStorage.SetCounters(ctx, map[string]Counter{"counter1": 3}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	to := time.Now()
+
+	history, err := memStorage.GetCounterHistory(ctx, "counter1", from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []struct{ delta, value Counter }{{5, 5}, {3, 8}}
+	if len(history) != len(expected) {
+		t.Fatalf("expected %d samples, got %d", len(expected), len(history))
+	}
+	for i, e := range expected {
+		if history[i].Delta != e.delta || history[i].Value != e.value {
+			t.Errorf("expected sample %d to be %d/%d, got %d/%d", i, e.delta, e.value, history[i].Delta, history[i].Value)
+		}
+	}
+
+	if err := memStorage.ClearCounters(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	history, err = memStorage.GetCounterHistory(ctx, "counter1", from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("expected history to be cleared, got %v", history)
+	}
+}
+
+func TestMemStorage_WithoutHistory(t *testing.T) {
+	memStorage := NewMemStorage()
+	ctx := context.Background()
+
+	if err := memStorage.SetGauge(ctx, "gauge1", 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	history, err := memStorage.GetGaugeHistory(ctx, "gauge1", time.Time{}, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("expected no history, got %v", history)
+	}
+}
+
+func TestDownsampleGauges(t *testing.T) {
+	from := time.Unix(0, 0)
+	to := from.Add(time.Minute)
+	samples := []GaugeSample{
+		{Timestamp: from.Add(1 * time.Second), Value: 1},
+		{Timestamp: from.Add(5 * time.Second), Value: 3},
+		{Timestamp: from.Add(35 * time.Second), Value: 10},
+		{Timestamp: from.Add(2 * time.Minute), Value: 100},
+	}
+
+	buckets := DownsampleGauges(samples, from, to, 30*time.Second)
+	if len(buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(buckets))
+	}
+
+	first := buckets[0]
+	if first.Avg != 2 || first.Min != 1 || first.Max != 3 || first.Last != 3 || first.Count != 2 {
+		t.Errorf("unexpected first bucket: %+v", first)
+	}
+	if !buckets[1].Timestamp.Equal(from.Add(30*time.Second)) || buckets[1].Last != 10 {
+		t.Errorf("unexpected second bucket: %+v", buckets[1])
+	}
+}
+
+func TestDownsampleCounters(t *testing.T) {
+	from := time.Unix(0, 0)
+	to := from.Add(time.Minute)
+	samples := []CounterSample{
+		{Timestamp: from.Add(1 * time.Second), Delta: 10, Value: 10},
+		{Timestamp: from.Add(2 * time.Second), Delta: 20, Value: 30},
+		{Timestamp: from.Add(40 * time.Second), Delta: 3, Value: 33},
+	}
+
+	buckets := DownsampleCounters(samples, from, to, 10*time.Second)
+	if len(buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(buckets))
+	}
+	if buckets[0].Increase != 30 || buckets[0].Rate != 3 {
+		t.Errorf("unexpected first bucket: %+v", buckets[0])
+	}
+	if !buckets[1].Timestamp.Equal(from.Add(40*time.Second)) || buckets[1].Increase != 3 {
+		t.Errorf("unexpected second bucket: %+v", buckets[1])
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	testCases := []struct {
+		name     string
+		metric   string
+		labels   Labels
+		expected string
+	}{
+		{name: "no labels", metric: "Alloc", expected: "Alloc"},
+		{name: "empty labels", metric: "Alloc", labels: Labels{}, expected: "Alloc"},
+		{name: "sorted labels", metric: "Alloc", labels: Labels{"z": "1", "a": "2"}, expected: `Alloc{a="2",z="1"}`},
+		{name: "escaped value", metric: "Alloc", labels: Labels{"a": "x\"y\\z\n"}, expected: `Alloc{a="x\"y\\z\n"}`},
+		{name: "separators in value", metric: "Alloc", labels: Labels{"a": `,b="c"}`}, expected: `Alloc{a=",b=\"c\"}"}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key := SeriesKey(tc.metric, tc.labels)
+			if key != tc.expected {
+				t.Fatalf("expected key %s, got %s", tc.expected, key)
+			}
+
+			name, labels := ParseSeriesKey(key)
+			if name != tc.metric {
+				t.Errorf("expected name %s, got %s", tc.metric, name)
+			}
+			if len(labels) != len(tc.labels) {
+				t.Fatalf("expected labels %v, got %v", tc.labels, labels)
+			}
+			for k, v := range tc.labels {
+				if labels[k] != v {
+					t.Errorf("expected label %s to be %q, got %q", k, v, labels[k])
+				}
+			}
+		})
+	}
+}
+
+func TestParseSeriesKey_Malformed(t *testing.T) {
+	for _, key := range []string{"{a=\"b\"}", "weird{name", `Alloc{a="b"`, `Alloc{a=b}`, `Alloc{a="b"c="d"}`} {
+		name, labels := ParseSeriesKey(key)
+		if name != key || labels != nil {
+			t.Errorf("expected %s to be a bare name, got %s %v", key, name, labels)
+		}
+	}
+}
+
+func TestLabels_Validate(t *testing.T) {
+	if err := (Labels{"host": "a", "_id2": "b"}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"", "1a", "bad-name", "__name__"} {
+		if err := (Labels{name: "a"}).Validate(); err == nil {
+			t.Errorf("expected error for label name %q", name)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"Alloc", "http.requests", "cpu-usage_1"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("unexpected error for name %q: %v", name, err)
+		}
+	}
+	for _, name := range []string{`Alloc{host="victim"}`, "Alloc{", "Alloc}", `Al"loc`} {
+		if err := ValidateName(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("expected ErrInvalidName for name %q, got %v", name, err)
+		}
+	}
+}
+
+func TestHistogram_ObserveAndMerge(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.Observe(v)
+	}
+	if want := []uint64{2, 1, 1}; !slices.Equal(h.Counts, want) {
+		t.Fatalf("expected counts %v, got %v", want, h.Counts)
+	}
+	if h.Sum != 14.5 || h.Count != 4 {
+		t.Fatalf("expected sum 14.5 and count 4, got %v and %d", h.Sum, h.Count)
+	}
+	if err := h.Validate(); err != nil {
+		t.Fatalf("unexpected validate error: %v", err)
+	}
+
+	other := NewHistogram([]float64{1, 5})
+	other.Observe(2)
+	if err := h.Merge(other); err != nil {
+		t.Fatalf("unexpected merge error: %v", err)
+	}
+	if want := []uint64{2, 2, 1}; !slices.Equal(h.Counts, want) {
+		t.Fatalf("expected counts %v, got %v", want, h.Counts)
+	}
+
+	if err := h.Merge(NewHistogram([]float64{1, 10})); !errors.Is(err, ErrBucketsMismatch) {
+		t.Fatalf("expected buckets mismatch, got %v", err)
+	}
+}
+
+func TestHistogram_Validate(t *testing.T) {
+	invalid := []*Histogram{
+		{Bounds: []float64{1, 2}, Counts: []uint64{0, 0}},
+		{Bounds: []float64{2, 1}, Counts: []uint64{0, 0, 0}},
+		{Bounds: []float64{math.Inf(1)}, Counts: []uint64{0, 0}},
+		{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 1},
+	}
+	for _, h := range invalid {
+		if err := h.Validate(); !errors.Is(err, ErrInvalidHistogram) {
+			t.Errorf("expected invalid histogram for %+v, got %v", h, err)
+		}
+	}
+}
+
+func TestMemStorage_SetHistograms(t *testing.T) {
+	memStorage := NewMemStorage()
+	ctx := context.Background()
+
+	first := NewHistogram([]float64{1})
+	first.Observe(0.5)
+	if err := memStorage.SetHistogram(ctx, "latency", first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first.Observe(0.5)
+
+	second := NewHistogram([]float64{1})
+	second.Observe(2)
+	if err := memStorage.SetHistograms(ctx, map[string]*Histogram{"latency": second}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, ok, err := memStorage.GetHistogram(ctx, "latency")
+	if err != nil || !ok {
+		t.Fatalf("expected histogram, got ok=%v err=%v", ok, err)
+	}
+	if want := []uint64{1, 1}; !slices.Equal(got.Counts, want) || got.Count != 2 || got.Sum != 2.5 {
+		t.Fatalf("expected merged histogram with counts %v, got %+v", want, got)
+	}
+
+	mismatch := NewHistogram([]float64{2})
+	err = memStorage.SetHistograms(ctx, map[string]*Histogram{"latency": mismatch, "other": second})
+	if !errors.Is(err, ErrBucketsMismatch) {
+		t.Fatalf("expected buckets mismatch, got %v", err)
+	}
+	if _, ok, _ := memStorage.GetHistogram(ctx, "other"); ok {
+		t.Fatalf("expected failed batch to store nothing")
+	}
+
+	if err := memStorage.ClearHistograms(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	histograms, _ := memStorage.GetHistograms(ctx)
+	if len(histograms) != 0 {
+		t.Fatalf("expected no histograms, got %v", histograms)
+	}
+}
+
+func TestHyperLogLog_Estimate(t *testing.T) {
+	sketch := NewHyperLogLog()
+	if got := sketch.Estimate(); got != 0 {
+		t.Fatalf("expected empty sketch estimate 0, got %d", got)
+	}
+
+	other := NewHyperLogLog()
+	for i := range 10000 {
+		sketch.Add(fmt.Sprintf("user-%d", i))
+		other.Add(fmt.Sprintf("user-%d", i+5000))
+	}
+	sketch.Add("user-1")
+
+	if got := sketch.Estimate(); math.Abs(float64(got)-10000)/10000 > 0.05 {
+		t.Fatalf("expected estimate near 10000, got %d", got)
+	}
+
+	if err := sketch.Merge(other); err != nil {
+		t.Fatalf("unexpected merge error: %v", err)
+	}
+	if got := sketch.Estimate(); math.Abs(float64(got)-15000)/15000 > 0.05 {
+		t.Fatalf("expected merged estimate near 15000, got %d", got)
+	}
+
+	if err := (&HyperLogLog{Registers: []byte{1}}).Validate(); !errors.Is(err, ErrInvalidSet) {
+		t.Fatalf("expected invalid set, got %v", err)
+	}
+}
+
+func TestMemStorage_SetSets(t *testing.T) {
+	memStorage := NewMemStorage()
+	ctx := context.Background()
+
+	first := NewHyperLogLog()
+	first.Add("alice")
+	first.Add("bob")
+	second := NewHyperLogLog()
+	second.Add("bob")
+	second.Add("carol")
+
+	if err := memStorage.SetSet(ctx, "users", first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := memStorage.SetSets(ctx, map[string]*HyperLogLog{"users": second}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	users, ok, err := memStorage.GetSet(ctx, "users")
+	if err != nil || !ok {
+		t.Fatalf("expected set, got ok=%v err=%v", ok, err)
+	}
+	if got := users.Estimate(); got != 3 {
+		t.Fatalf("expected 3 distinct users, got %d", got)
+	}
+
+	if err := memStorage.SetSet(ctx, "users", &HyperLogLog{}); !errors.Is(err, ErrInvalidSet) {
+		t.Fatalf("expected invalid set, got %v", err)
+	}
+
+	if err := memStorage.ClearSets(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sets, _ := memStorage.GetSets(ctx)
+	if len(sets) != 0 {
+		t.Fatalf("expected no sets, got %v", sets)
+	}
+}
+
+func TestMetricFilter_Matches(t *testing.T) {
+	testCases := []struct {
+		filter MetricFilter
+		key    string
+		want   bool
+	}{
+		{filter: MetricFilter{}, key: "Alloc", want: true},
+		{filter: MetricFilter{Pattern: "Heap*"}, key: "HeapAlloc", want: true},
+		{filter: MetricFilter{Pattern: "Heap*"}, key: "Alloc", want: false},
+		{filter: MetricFilter{Pattern: "*Alloc"}, key: SeriesKey("HeapAlloc", Labels{"host": "a"}), want: true},
+		{filter: MetricFilter{Pattern: "Heap?lloc"}, key: "HeapAlloc", want: true},
+		{filter: MetricFilter{Pattern: "a*b*c"}, key: "abxbc", want: true},
+		{filter: MetricFilter{Pattern: "a*b*c"}, key: "abxbcd", want: false},
+		{filter: MetricFilter{Labels: Labels{"host": "a"}}, key: SeriesKey("Alloc", Labels{"host": "a", "dc": "x"}), want: true},
+		{filter: MetricFilter{Labels: Labels{"host": "a"}}, key: SeriesKey("Alloc", Labels{"host": "b"}), want: false},
+		{filter: MetricFilter{Labels: Labels{"host": "a"}}, key: "Alloc", want: false},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.filter.Matches(tc.key); got != tc.want {
+			t.Errorf("filter %+v on %s: expected %v, got %v", tc.filter, tc.key, tc.want, got)
+		}
+	}
+
+	if got := (MetricFilter{Pattern: "cpu_*%?"}).likePattern(); got != `cpu\_%\%_` {
+		t.Errorf("unexpected like pattern %s", got)
+	}
+	if !(MetricFilter{Pattern: "**"}).IsEmpty() || (MetricFilter{Pattern: "a*"}).IsEmpty() {
+		t.Errorf("unexpected IsEmpty result")
+	}
+}
+
+func TestMemStorage_Delete(t *testing.T) {
+	memStorage := NewMemStorageWithHistory(10)
+	ctx := context.Background()
+
+	oldHost := Labels{"host": "old"}
+	if err := memStorage.SetGauges(ctx, map[string]Gauge{
+		"Alloc":                         1,
+		SeriesKey("Alloc", oldHost):     2,
+		SeriesKey("HeapAlloc", oldHost): 3,
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := memStorage.SetCounters(ctx, map[string]Counter{
+		"PollCount":                     1,
+		SeriesKey("PollCount", oldHost): 1,
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ok, err := memStorage.DeleteGauge(ctx, "Alloc")
+	if err != nil || !ok {
+		t.Fatalf("expected gauge to be deleted, got ok=%v err=%v", ok, err)
+	}
+	history, _ := memStorage.GetGaugeHistory(ctx, "Alloc", time.Time{}, time.Now())
+	if len(history) != 0 {
+		t.Fatalf("expected gauge history to be deleted, got %v", history)
+	}
+	if ok, _ := memStorage.DeleteGauge(ctx, "Alloc"); ok {
+		t.Fatalf("expected second delete to report missing gauge")
+	}
+
+	deleted, err := memStorage.DeleteMetrics(ctx, MetricFilter{Labels: oldHost, Pattern: "*Alloc"})
+	if err != nil || deleted != 2 {
+		t.Fatalf("expected 2 deleted series, got %d err=%v", deleted, err)
+	}
+	deleted, _ = memStorage.DeleteMetrics(ctx, MetricFilter{Labels: oldHost, Type: "gauge"})
+	if deleted != 0 {
+		t.Fatalf("expected no gauges left for old host, got %d", deleted)
+	}
+	deleted, _ = memStorage.DeleteMetrics(ctx, MetricFilter{Labels: oldHost})
+	if deleted != 1 {
+		t.Fatalf("expected old host counter to be deleted, got %d", deleted)
+	}
+
+	counters, _ := memStorage.GetCounters(ctx)
+	if len(counters) != 1 || counters["PollCount"] != 1 {
+		t.Fatalf("expected only unlabeled counter left, got %v", counters)
+	}
+}
+
+func TestParseRetentionRules(t *testing.T) {
+	rules, err := ParseRetentionRules(" Heap*=1h, *=24h ,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []RetentionRule{{Pattern: "Heap*", TTL: time.Hour}, {Pattern: "*", TTL: 24 * time.Hour}}
+	if !slices.Equal(rules, want) {
+		t.Fatalf("expected %v, got %v", want, rules)
+	}
+
+	for _, value := range []string{"Heap*", "=1h", "*=abc", "*=-1h"} {
+		if _, err := ParseRetentionRules(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestSweeper_Sweep(t *testing.T) {
+	memStorage := NewMemStorageWithHistory(10)
+	ctx := context.Background()
+
+	if err := memStorage.SetGauges(ctx, map[string]Gauge{"HeapAlloc": 1, "Alloc": 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := memStorage.SetCounter(ctx, "PollCount", 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	users := NewHyperLogLog()
+	users.Add("alice")
+	if err := memStorage.SetSet(ctx, "users", users); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := memStorage.DeleteGauge(ctx, "Alloc"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sweeper := NewSweeper(memStorage, RetentionPolicy{
+		Rules:         []RetentionRule{{Pattern: "Heap*", TTL: time.Minute}, {Pattern: "*", TTL: time.Hour}},
+		HistoryMaxAge: 10 * time.Second,
+	}, zap.NewNop())
+
+	if err := sweeper.Sweep(ctx, time.Now().Add(30*time.Second)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok, _ := memStorage.GetGauge(ctx, "HeapAlloc"); !ok {
+		t.Fatalf("expected HeapAlloc to be kept before its ttl")
+	}
+	history, _ := memStorage.GetCounterHistory(ctx, "PollCount", time.Time{}, time.Now().Add(time.Hour))
+	if len(history) != 0 {
+		t.Fatalf("expected old history to be pruned, got %v", history)
+	}
+	if _, ok, _ := memStorage.GetCounter(ctx, "PollCount"); !ok {
+		t.Fatalf("expected pruning history to keep the counter")
+	}
+
+	if err := sweeper.Sweep(ctx, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok, _ := memStorage.GetGauge(ctx, "HeapAlloc"); ok {
+		t.Fatalf("expected HeapAlloc to expire after its ttl")
+	}
+	if _, ok, _ := memStorage.GetCounter(ctx, "PollCount"); !ok {
+		t.Fatalf("expected PollCount to be kept before the catch-all ttl")
+	}
+
+	if err := sweeper.Sweep(ctx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	counters, _ := memStorage.GetCounters(ctx)
+	sets, _ := memStorage.GetSets(ctx)
+	if len(counters) != 0 || len(sets) != 0 || lastSeenCount(memStorage) != 0 {
+		t.Fatalf("expected all series to expire, got %v %v %d", counters, sets, lastSeenCount(memStorage))
+	}
+}
+
+func lastSeenCount(ms *MemStorage) int {
+	count := 0
+	for _, shard := range ms.shards {
+		shard.mu.RLock()
+		count += len(shard.lastSeen)
+		shard.mu.RUnlock()
+	}
+	return count
+}
+
+func TestMemStorage_ConcurrentUpdates(t *testing.T) {
+	memStorage := NewMemStorageWithHistory(10)
+	ctx := context.Background()
+
+	const workers = 16
+	const iterations = 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				name := fmt.Sprintf("metric%d", i%20)
+				_ = memStorage.SetCounters(ctx, map[string]Counter{name: 1, "total": 1})
+				_ = memStorage.SetGauges(ctx, map[string]Gauge{name: Gauge(w)})
+				histogram := NewHistogram([]float64{1})
+				histogram.Observe(float64(i))
+				_ = memStorage.SetHistogram(ctx, name, histogram)
+				set := NewHyperLogLog()
+				set.Add(fmt.Sprintf("user%d", w))
+				_ = memStorage.SetSet(ctx, name, set)
+
+				gauges, _ := memStorage.GetGauges(ctx)
+				gauges["local"] = 0
+				_, _ = memStorage.GetHistograms(ctx)
+				_, _ = memStorage.GetSets(ctx)
+				_, _ = memStorage.GetCounterHistory(ctx, name, time.Time{}, time.Time{})
+				if i%50 == 0 {
+					_, _ = memStorage.DeleteStale(ctx, MetricFilter{}, time.Now().Add(-time.Hour))
+					_, _ = memStorage.DeleteHistoryBefore(ctx, time.Now().Add(-time.Hour))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total, ok, _ := memStorage.GetCounter(ctx, "total")
+	if !ok || total != workers*iterations {
+		t.Fatalf("expected total %d, got %d", workers*iterations, total)
+	}
+	counters, _ := memStorage.GetCounters(ctx)
+	var sum Counter
+	for name, value := range counters {
+		if name != "total" {
+			sum += value
+		}
+	}
+	if sum != workers*iterations {
+		t.Fatalf("expected per-metric counters to sum to %d, got %d", workers*iterations, sum)
+	}
+	histograms, _ := memStorage.GetHistograms(ctx)
+	var count uint64
+	for _, histogram := range histograms {
+		count += histogram.Count
+	}
+	if count != workers*iterations {
+		t.Fatalf("expected %d histogram observations, got %d", workers*iterations, count)
+	}
+	if _, ok, _ := memStorage.GetGauge(ctx, "local"); ok {
+		t.Fatalf("expected gauges snapshot changes not to leak into storage")
+	}
+}
+
+func TestMemStorage_GettersReturnSnapshots(t *testing.T) {
+	memStorage := NewMemStorage()
+	ctx := context.Background()
+
+	_ = memStorage.SetGauge(ctx, "Alloc", 1)
+	_ = memStorage.SetCounter(ctx, "PollCount", 1)
+	_ = memStorage.SetHistogram(ctx, "latency", NewHistogram([]float64{1}))
+	_ = memStorage.SetSet(ctx, "users", NewHyperLogLog())
+
+	gauges, _ := memStorage.GetGauges(ctx)
+	counters, _ := memStorage.GetCounters(ctx)
+	histograms, _ := memStorage.GetHistograms(ctx)
+	sets, _ := memStorage.GetSets(ctx)
+
+	gauges["Alloc"] = 2
+	delete(counters, "PollCount")
+	histograms["latency"].Observe(0.5)
+	sets["users"].Add("alice")
+	_ = memStorage.SetGauge(ctx, "Alloc", 3)
+
+	if gauges["Alloc"] != 2 {
+		t.Fatalf("expected snapshot not to change on update, got %v", gauges["Alloc"])
+	}
+	if value, _, _ := memStorage.GetGauge(ctx, "Alloc"); value != 3 {
+		t.Fatalf("expected Alloc 3, got %v", value)
+	}
+	if _, ok, _ := memStorage.GetCounter(ctx, "PollCount"); !ok {
+		t.Fatalf("expected PollCount to be kept")
+	}
+	if histogram, _, _ := memStorage.GetHistogram(ctx, "latency"); histogram.Count != 0 {
+		t.Fatalf("expected stored histogram to be empty, got %d", histogram.Count)
+	}
+	if set, _, _ := memStorage.GetSet(ctx, "users"); set.Estimate() != 0 {
+		t.Fatalf("expected stored set to be empty, got %d", set.Estimate())
+	}
+}
+
+func TestMemStorage_SetHistogramsIsAtomicAcrossShards(t *testing.T) {
+	memStorage := NewMemStorage()
+	ctx := context.Background()
+
+	_ = memStorage.SetHistogram(ctx, "latency9", NewHistogram([]float64{1}))
+
+	batch := map[string]*Histogram{"latency9": NewHistogram([]float64{2})}
+	for i := 0; i < 8; i++ {
+		batch[fmt.Sprintf("latency%d", i)] = NewHistogram([]float64{1})
+	}
+	if err := memStorage.SetHistograms(ctx, batch); !errors.Is(err, ErrBucketsMismatch) {
+		t.Fatalf("expected ErrBucketsMismatch, got %v", err)
+	}
+	histograms, _ := memStorage.GetHistograms(ctx)
+	if len(histograms) != 1 {
+		t.Fatalf("expected failed batch not to be stored, got %d histograms", len(histograms))
+	}
+}
+
+func BenchmarkMemStorage_SetCountersParallel(b *testing.B) {
+	memStorage := NewMemStorageWithHistory(DefaultHistorySize)
+	ctx := context.Background()
+
+	values := make(map[string]Counter, 30)
+	for i := 0; i < 30; i++ {
+		values[fmt.Sprintf("metric%d", i)] = 1
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = memStorage.SetCounters(ctx, values)
+		}
+	})
+}
+
+func BenchmarkMemStorage_MixedParallel(b *testing.B) {
+	memStorage := NewMemStorageWithHistory(DefaultHistorySize)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			name := fmt.Sprintf("metric%d", i%100)
+			if i%10 == 0 {
+				_, _ = memStorage.GetGauges(ctx)
+			} else {
+				_ = memStorage.SetGauge(ctx, name, Gauge(i))
+			}
+			i++
+		}
+	})
+}
+
+func TestFileStorage_ReplaysWALAfterCrash(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store")
+	ctx := context.Background()
+
+	// A long push interval keeps everything in the log, as if the process died before the first snapshot.
+	fileStorage, err := NewFileStorage(file, int(time.Hour/time.Millisecond), false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = fileStorage.SetCounter(ctx, "PollCount", 2)
+	_ = fileStorage.SetCounters(ctx, map[string]Counter{"PollCount": 3, "Requests": 1})
+	_ = fileStorage.SetGauge(ctx, "Alloc", 1.5)
+	_ = fileStorage.SetGauge(ctx, `Alloc{host="a"}`, 2.5)
+	histogram := NewHistogram([]float64{1})
+	histogram.Observe(0.5)
+	_ = fileStorage.SetHistogram(ctx, "latency", histogram)
+	_ = fileStorage.SetHistogram(ctx, "latency", histogram)
+	set := NewHyperLogLog()
+	set.Add("alice")
+	_ = fileStorage.SetSet(ctx, "users", set)
+	_, _ = fileStorage.DeleteCounter(ctx, "Requests")
+	_, _ = fileStorage.DeleteMetrics(ctx, MetricFilter{Labels: Labels{"host": "a"}})
+
+	restored, err := NewFileStorage(file, int(time.Hour/time.Millisecond), true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := restored.GetCounter(ctx, "PollCount"); value != 5 {
+		t.Fatalf("expected PollCount 5, got %d", value)
+	}
+	if _, ok, _ := restored.GetCounter(ctx, "Requests"); ok {
+		t.Fatalf("expected Requests to stay deleted")
+	}
+	gauges, _ := restored.GetGauges(ctx)
+	if len(gauges) != 1 || gauges["Alloc"] != 1.5 {
+		t.Fatalf("expected only Alloc 1.5, got %v", gauges)
+	}
+	if h, _, _ := restored.GetHistogram(ctx, "latency"); h == nil || h.Count != 2 {
+		t.Fatalf("expected latency histogram with 2 observations, got %+v", h)
+	}
+	if s, _, _ := restored.GetSet(ctx, "users"); s == nil || s.Estimate() != 1 {
+		t.Fatalf("expected users set with 1 member, got %+v", s)
+	}
+}
+
+func TestFileStorage_SkipsTornWALRecord(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store")
+	ctx := context.Background()
+
+	fileStorage, err := NewFileStorage(file, int(time.Hour/time.Millisecond), false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = fileStorage.SetCounter(ctx, "PollCount", 1)
+
+	wal, err := os.OpenFile(file+walSuffix, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, _ = wal.WriteString(`{"op":"update","metrics":[{"id":"PollCount","mty`)
+	_ = wal.Close()
+
+	restored, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := restored.GetCounter(ctx, "PollCount"); value != 1 {
+		t.Fatalf("expected PollCount 1, got %d", value)
+	}
+
+	// The torn tail is dropped on start, so new records are not appended after it.
+	_ = restored.SetCounter(ctx, "PollCount", 1)
+	again, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := again.GetCounter(ctx, "PollCount"); value != 2 {
+		t.Fatalf("expected PollCount 2, got %d", value)
+	}
+}
+
+func TestAddGauges(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "store")
+	fileStorage, err := NewFileStorage(file, int(time.Hour/time.Millisecond), false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, metricsStorage := range map[string]MetricsStorage{"memory": NewMemStorage(), "file": fileStorage} {
+		t.Run(name, func(t *testing.T) {
+			_ = metricsStorage.SetGauge(ctx, "temperature", 10)
+			if err := metricsStorage.AddGauges(ctx, map[string]Gauge{"temperature": 2.5, "queue": -1}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if value, _, _ := metricsStorage.GetGauge(ctx, "temperature"); value != 12.5 {
+				t.Errorf("expected temperature 12.5, got %v", value)
+			}
+			if value, ok, _ := metricsStorage.GetGauge(ctx, "queue"); !ok || value != -1 {
+				t.Errorf("expected queue -1, got %v", value)
+			}
+		})
+	}
+
+	restored, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := restored.GetGauge(ctx, "temperature"); value != 12.5 {
+		t.Errorf("expected temperature 12.5 after replay, got %v", value)
+	}
+}
+
+func TestFileStorage_FailedAppend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store")
+	ctx := context.Background()
+
+	fileStorage, err := NewFileStorage(file, int(time.Hour/time.Millisecond), false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = fileStorage.SetCounter(ctx, "PollCount", 1)
+
+	wal := fileStorage.wal
+	readOnly, err := os.Open(file + walSuffix)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fileStorage.wal = readOnly
+	if err := fileStorage.SetCounter(ctx, "PollCount", 1); err == nil {
+		t.Fatalf("expected the update to fail when the log cannot be written")
+	}
+	if value, _, _ := fileStorage.GetCounter(ctx, "PollCount"); value != 1 {
+		t.Fatalf("expected an update missing from the log not to be applied, got PollCount %d", value)
+	}
+	fileStorage.wal = wal
+	_ = readOnly.Close()
+
+	// A record torn by a failed write is cut off, so the records appended after it are replayed.
+	_, _ = fileStorage.wal.WriteString(`{"op":"update","metrics":[{"id":"PollCount","mty`)
+	fileStorage.truncateWAL()
+	_ = fileStorage.SetCounter(ctx, "PollCount", 1)
+
+	restored, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := restored.GetCounter(ctx, "PollCount"); value != 2 {
+		t.Fatalf("expected PollCount 2, got %d", value)
+	}
+}
+
+func TestFileStorage_CompactionFailureKeepsUpdate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "store")
+	ctx := context.Background()
+
+	fileStorage, err := NewFileStorage(file, 0, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fileStorage.pending = walCompactRecords
+	fileStorage.file = filepath.Join(dir, "missing", "store")
+	if err := fileStorage.SetCounter(ctx, "PollCount", 1); err != nil {
+		t.Fatalf("expected a logged update to succeed when compaction fails, got %v", err)
+	}
+	fileStorage.file = file
+
+	restored, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := restored.GetCounter(ctx, "PollCount"); value != 1 {
+		t.Fatalf("expected PollCount 1, got %d", value)
+	}
+}
+
+func TestFileStorage_CompactionDoesNotDoubleCount(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store")
+	ctx := context.Background()
+
+	fileStorage, err := NewFileStorage(file, int(time.Hour/time.Millisecond), false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = fileStorage.SetCounter(ctx, "PollCount", 1)
+	_ = fileStorage.SetCounter(ctx, "PollCount", 1)
+	stale, err := os.ReadFile(file + walSuffix)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := fileStorage.compact(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = fileStorage.SetCounter(ctx, "PollCount", 1)
+
+	// Simulate a crash after the snapshot rename but before the log was truncated.
+	current, _ := os.ReadFile(file + walSuffix)
+	if err := os.WriteFile(file+walSuffix, append(stale, current...), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restored, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := restored.GetCounter(ctx, "PollCount"); value != 3 {
+		t.Fatalf("expected PollCount 3, got %d", value)
+	}
+	if _, err := os.Stat(file + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected no temporary snapshot left, got %v", err)
+	}
+}
+
+func TestFileStorage_RestoresLegacySnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store")
+	ctx := context.Background()
+
+	legacy := `[{"value":1.5,"delta":null,"string_value":"","id":"Alloc","mtype":"gauge","hash":""},` +
+		`{"value":null,"delta":7,"string_value":"","id":"PollCount","mtype":"counter","hash":""}]`
+	if err := os.WriteFile(file, []byte(legacy), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restored, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := restored.GetGauge(ctx, "Alloc"); value != 1.5 {
+		t.Fatalf("expected Alloc 1.5, got %v", value)
+	}
+	if value, _, _ := restored.GetCounter(ctx, "PollCount"); value != 7 {
+		t.Fatalf("expected PollCount 7, got %d", value)
+	}
+}
+
+func TestFileStorage_Close(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store")
+	ctx := context.Background()
+
+	fileStorage, err := NewFileStorage(file, int(time.Hour/time.Millisecond), false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = fileStorage.SetCounter(ctx, "PollCount", 3)
+
+	if err := fileStorage.Close(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := fileStorage.Close(ctx); err != nil {
+		t.Fatalf("expected second close to succeed, got %v", err)
+	}
+	if err := fileStorage.SetCounter(ctx, "PollCount", 1); !errors.Is(err, ErrStorageClosed) {
+		t.Fatalf("expected ErrStorageClosed, got %v", err)
+	}
+	if info, err := os.Stat(file + walSuffix); err != nil || info.Size() != 0 {
+		t.Fatalf("expected an empty wal after the final snapshot, got %v %v", info, err)
+	}
+
+	restored, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := restored.GetCounter(ctx, "PollCount"); value != 3 {
+		t.Fatalf("expected PollCount 3, got %d", value)
+	}
+}
+
+func TestFileStorage_RestoresHistory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store")
+	ctx := context.Background()
+	all := func(fs *FileStorage) ([]GaugeSample, []CounterSample) {
+		gauges, _ := fs.GetGaugeHistory(ctx, "Alloc", time.Time{}, time.Now().Add(time.Hour))
+		counters, _ := fs.GetCounterHistory(ctx, "PollCount", time.Time{}, time.Now().Add(time.Hour))
+		return gauges, counters
+	}
+	sameHistory := func(t *testing.T, fs *FileStorage, gauges []GaugeSample, counters []CounterSample) {
+		t.Helper()
+		restoredGauges, restoredCounters := all(fs)
+		if len(restoredGauges) != len(gauges) || len(restoredCounters) != len(counters) {
+			t.Fatalf("expected %d gauge and %d counter samples, got %v and %v",
+				len(gauges), len(counters), restoredGauges, restoredCounters)
+		}
+		for i, sample := range gauges {
+			if !restoredGauges[i].Timestamp.Equal(sample.Timestamp) || restoredGauges[i].Value != sample.Value {
+				t.Fatalf("expected gauge sample %v, got %v", sample, restoredGauges[i])
+			}
+		}
+		for i, sample := range counters {
+			restored := restoredCounters[i]
+			if !restored.Timestamp.Equal(sample.Timestamp) || restored.Delta != sample.Delta || restored.Value != sample.Value {
+				t.Fatalf("expected counter sample %v, got %v", sample, restored)
+			}
+		}
+	}
+
+	fileStorage, err := NewFileStorage(file, 0, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := range 3 {
+		_ = fileStorage.SetGauge(ctx, "Alloc", Gauge(i))
+		_ = fileStorage.SetCounter(ctx, "PollCount", 1)
+		_, _ = fileStorage.ApplyBatch(ctx, "", time.Minute, &Batch{Gauges: map[string]Gauge{"Alloc": Gauge(i + 10)}})
+		time.Sleep(time.Millisecond)
+	}
+	gauges, counters := all(fileStorage)
+
+	// The storage is not closed, as after a crash, so the samples are replayed from the log.
+	replayed, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sameHistory(t, replayed, gauges, counters)
+
+	// The restart compacted the log, so the samples are now loaded from the snapshot.
+	if err := replayed.Close(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	restored, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sameHistory(t, restored, gauges, counters)
+}
+
+func TestNewFileStorage_ClosesWALOnError(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("open files cannot be listed")
+	}
+	file := filepath.Join(t.TempDir(), "store")
+	if err := os.WriteFile(file, []byte("{bad"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := NewFileStorage(file, 0, true, zap.NewNop()); err == nil {
+		t.Fatal("expected an error for a bad snapshot")
+	}
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, fd := range fds {
+		if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); target == file+walSuffix {
+			t.Fatalf("expected the wal to be closed")
+		}
+	}
+}
+
+func TestBatchRegistry_Claim(t *testing.T) {
+	registry := newBatchRegistry()
+	now := time.Now()
+	window := time.Minute
+	claim := func(id string, at time.Time) bool {
+		t.Helper()
+		claimed, err := registry.claim(id, window, at)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		registry.done(id)
+		return claimed
+	}
+
+	if !claim("a", now) {
+		t.Fatalf("expected first claim to succeed")
+	}
+	if claim("a", now.Add(30*time.Second)) {
+		t.Fatalf("expected duplicate within window to be rejected")
+	}
+	if !claim("b", now.Add(30*time.Second)) {
+		t.Fatalf("expected other id to be claimed")
+	}
+	if !claim("a", now.Add(window)) {
+		t.Fatalf("expected expired id to be claimed again")
+	}
+	if claim("a", now.Add(window+time.Second)) {
+		t.Fatalf("expected renewed claim to be kept")
+	}
+	if len(registry.ids) != 2 {
+		t.Errorf("expected 2 remembered ids, got %d", len(registry.ids))
+	}
+
+	claim("c", now.Add(3*window))
+	if len(registry.ids) != 1 || len(registry.claims) != 1 {
+		t.Errorf("expected expired ids to be dropped, got %v", registry.ids)
+	}
+
+	registry.release("c")
+	if !claim("c", now.Add(3*window)) {
+		t.Errorf("expected released id to be claimed again")
+	}
+
+	if claimed, err := registry.claim("d", window, now.Add(3*window)); !claimed || err != nil {
+		t.Fatalf("expected d to be claimed, got %v, %v", claimed, err)
+	}
+	if _, err := registry.claim("d", window, now.Add(3*window)); !errors.Is(err, ErrBatchInFlight) {
+		t.Errorf("expected ErrBatchInFlight for a batch being applied, got %v", err)
+	}
+}
+
+func TestApplyBatch(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	fileStorage, err := NewFileStorage(file, 0, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, metricsStorage := range map[string]MetricsStorage{"memory": NewMemStorage(), "file": fileStorage} {
+		t.Run(name, func(t *testing.T) {
+			if err := metricsStorage.SetHistogram(ctx, "latency", NewHistogram([]float64{1})); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			mismatched := &Batch{
+				Counters:   map[string]Counter{"requests": 1},
+				Histograms: map[string]*Histogram{"latency": NewHistogram([]float64{2})},
+			}
+			if _, err := metricsStorage.ApplyBatch(ctx, "batch-1", time.Hour, mismatched); !errors.Is(err, ErrBucketsMismatch) {
+				t.Fatalf("expected ErrBucketsMismatch, got %v", err)
+			}
+			if _, ok, _ := metricsStorage.GetCounter(ctx, "requests"); ok {
+				t.Fatalf("expected failed batch to store nothing")
+			}
+
+			batch := &Batch{Counters: map[string]Counter{"requests": 1}, Gauges: map[string]Gauge{"alloc": 2}}
+			for range 2 {
+				applied, err := metricsStorage.ApplyBatch(ctx, "batch-1", time.Hour, batch)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if value, _, _ := metricsStorage.GetCounter(ctx, "requests"); value != 1 {
+					t.Fatalf("expected requests 1, got %d (applied %v)", value, applied)
+				}
+			}
+		})
+	}
+
+	if err := fileStorage.Close(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	restored, err := NewFileStorage(file, 0, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _, _ := restored.GetGauge(ctx, "alloc"); value != 2 {
+		t.Errorf("expected alloc 2 after restore, got %v", value)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		name string
+		want bool
+	}{
+		{name: "no error", err: nil, want: false},
+		{name: "bad connection", err: fmt.Errorf("cant set gauges: %w", driver.ErrBadConn), want: true},
+		{name: "connection failure", err: &pgconn.PgError{Code: "08006"}, want: true},
+		{name: "serialization failure", err: &pgconn.PgError{Code: "40001"}, want: true},
+		{name: "deadlock", err: &pgconn.PgError{Code: "40P01"}, want: true},
+		{name: "unique violation", err: &pgconn.PgError{Code: "23505"}, want: false},
+		{name: "buckets mismatch", err: fmt.Errorf("cant merge histogram: %w", ErrBucketsMismatch), want: false},
+		{name: "context canceled", err: context.Canceled, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// serveFailingPostgres accepts one connection on l and answers every statement with the SQLSTATE code.
+func serveFailingPostgres(t *testing.T, l net.Listener, code string) {
+	t.Helper()
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+	if _, err := backend.ReceiveStartupMessage(); err != nil {
+		t.Errorf("cant receive startup message: %v", err)
+		return
+	}
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	for {
+		if err := backend.Flush(); err != nil {
+			return
+		}
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		switch msg.(type) {
+		case *pgproto3.Query, *pgproto3.Sync:
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: code, Message: "statement failed"})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		case *pgproto3.Terminate:
+			return
+		}
+	}
+}
+
+func TestIsTransient_DriverErrors(t *testing.T) {
+	for _, tt := range []struct {
+		code string
+		want bool
+	}{
+		{code: "40P01", want: true},
+		{code: "40001", want: true},
+		{code: "23505", want: false},
+	} {
+		t.Run(tt.code, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("cant listen: %v", err)
+			}
+			defer l.Close()
+			go serveFailingPostgres(t, l, tt.code)
+
+			db, err := sql.Open(driverName, "postgres://metrics@"+l.Addr().String()+"/metrics?sslmode=disable")
+			if err != nil {
+				t.Fatalf("cant open db: %v", err)
+			}
+			defer db.Close()
+			_, err = db.ExecContext(context.Background(), "DELETE FROM sets")
+			if err == nil {
+				t.Fatal("expected statement error")
+			}
+			if got := isTransient(err); got != tt.want {
+				t.Errorf("isTransient(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("connection refused", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("cant listen: %v", err)
+		}
+		addr := l.Addr().String()
+		l.Close()
+
+		db, err := sql.Open(driverName, "postgres://metrics@"+addr+"/metrics?sslmode=disable&connect_timeout=1")
+		if err != nil {
+			t.Fatalf("cant open db: %v", err)
+		}
+		defer db.Close()
+		if err := db.PingContext(context.Background()); !isTransient(err) {
+			t.Errorf("isTransient(%v) = false, want true", err)
+		}
+	})
+}
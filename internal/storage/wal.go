@@ -0,0 +1,38 @@
+package storage
+
+import "time"
+
+// walSuffix is appended to the file path of FileStorage to name its write-ahead log.
+const walSuffix = ".wal"
+
+// walCompactRecords is the number of log records after which FileStorage without a push interval compacts the log.
+const walCompactRecords = 1000
+
+const (
+	walOpUpdate         = "update"
+	walOpDelete         = "delete"
+	walOpDeleteMatching = "delete_matching"
+	walOpClear          = "clear"
+)
+
+// walRecord is a line of the write-ahead log of FileStorage.
+// Update records hold gauge values, counter deltas and histograms or sets to merge,
+// and the time their gauge and counter samples were recorded at, so replay restores the same history.
+type walRecord struct {
+	Time    time.Time     `json:"time"`
+	Filter  *MetricFilter `json:"filter,omitempty"`
+	Op      string        `json:"op"`
+	MType   string        `json:"mtype,omitempty"`
+	Metrics []FileMetric  `json:"metrics,omitempty"`
+	Seq     uint64        `json:"seq"`
+}
+
+// fileSnapshot is the content of the FileStorage file.
+// Seq is the last log record included, so records up to it are skipped on replay.
+// The history of gauge and counter series is kept by series key, oldest sample first.
+type fileSnapshot struct {
+	GaugeHistory   map[string][]GaugeSample   `json:"gauge_history,omitempty"`
+	CounterHistory map[string][]CounterSample `json:"counter_history,omitempty"`
+	Metrics        []FileMetric               `json:"metrics"`
+	Seq            uint64                     `json:"seq"`
+}
@@ -0,0 +1,77 @@
+// Package tlsconfig builds TLS configurations of the server and the agent from PEM files.
+//
+// The server serves HTTPS and gRPC with its certificate, and with a client CA it accepts only clients
+// presenting a certificate signed by that CA (mutual TLS), so only enrolled agents can push metrics.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// NewServerConfig creates the TLS configuration of the server from its certificate and key.
+// When clientCAFile is not empty, clients must present a certificate signed by one of the CAs in it.
+func NewServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cant load certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// NewClientConfig creates the TLS configuration of the agent.
+// The server certificate is verified with the CAs in caFile, or with the system CAs when caFile is empty.
+// When certFile is not empty, the agent presents the certificate to servers requiring client certificates.
+func NewClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cant load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// CheckPair checks that a certificate and its key are either both set or both empty.
+func CheckPair(certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("tls certificate and key must be set together")
+	}
+	return nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cant read ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,99 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics/internal/tlsconfig/tlstest"
+)
+
+func newTLSServer(t *testing.T, config *tls.Config) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = config
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, url string, config *tls.Config) error {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	serverCert, serverKey := ca.Issue(t, "server")
+
+	serverConfig, err := NewServerConfig(serverCert, serverKey, "")
+	require.NoError(t, err)
+	server := newTLSServer(t, serverConfig)
+
+	clientConfig, err := NewClientConfig(ca.CertFile, "", "")
+	require.NoError(t, err)
+	assert.NoError(t, get(t, server.URL, clientConfig))
+
+	// The system CAs do not know the local CA.
+	systemConfig, err := NewClientConfig("", "", "")
+	require.NoError(t, err)
+	assert.Error(t, get(t, server.URL, systemConfig))
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	serverCert, serverKey := ca.Issue(t, "server")
+	agentCert, agentKey := ca.Issue(t, "agent")
+
+	serverConfig, err := NewServerConfig(serverCert, serverKey, ca.CertFile)
+	require.NoError(t, err)
+	server := newTLSServer(t, serverConfig)
+
+	enrolled, err := NewClientConfig(ca.CertFile, agentCert, agentKey)
+	require.NoError(t, err)
+	assert.NoError(t, get(t, server.URL, enrolled))
+
+	anonymous, err := NewClientConfig(ca.CertFile, "", "")
+	require.NoError(t, err)
+	assert.Error(t, get(t, server.URL, anonymous), "clients without a certificate must be rejected")
+
+	otherCA := tlstest.NewCA(t)
+	strangerCert, strangerKey := otherCA.Issue(t, "stranger")
+	stranger, err := NewClientConfig(ca.CertFile, strangerCert, strangerKey)
+	require.NoError(t, err)
+	assert.Error(t, get(t, server.URL, stranger), "clients signed by another ca must be rejected")
+}
+
+func TestLoadErrors(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	cert, key := ca.Issue(t, "server")
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	notPEM := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0o600))
+
+	_, err := NewServerConfig(missing, key, "")
+	assert.ErrorContains(t, err, "cant load certificate")
+	_, err = NewServerConfig(cert, key, missing)
+	assert.ErrorContains(t, err, "cant read ca")
+	_, err = NewClientConfig(notPEM, "", "")
+	assert.ErrorContains(t, err, "no certificates")
+	_, err = NewClientConfig(ca.CertFile, cert, missing)
+	assert.ErrorContains(t, err, "cant load client certificate")
+
+	assert.NoError(t, CheckPair("", ""))
+	assert.NoError(t, CheckPair(cert, key))
+	assert.Error(t, CheckPair(cert, ""))
+}
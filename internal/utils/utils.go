@@ -1,16 +1,21 @@
 package utils
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // GetHash generates a HMAC-SHA256 hash of the given data using the provided key.
@@ -23,12 +28,82 @@ func GetHash(key string, data []byte) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
+// GetMessageHash generates a HMAC-SHA256 hash of the deterministic protobuf encoding of a message.
+func GetMessageHash(key string, message proto.Message) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	return GetHash(key, data), nil
+}
+
+// hashField is the field of messages carrying their own hash, see GetSignedMessageHash.
+const hashField = "hash"
+
+// GetSignedMessageHash generates a HMAC-SHA256 hash of a message carrying its own hash in a hash field.
+// The hash is computed over the deterministic protobuf encoding of the message with an empty hash field.
+func GetSignedMessageHash(key string, message proto.Message) (string, error) {
+	field := message.ProtoReflect().Descriptor().Fields().ByName(hashField)
+	if field == nil {
+		return GetMessageHash(key, message)
+	}
+	unsigned := proto.Clone(message)
+	unsigned.ProtoReflect().Clear(field)
+	return GetMessageHash(key, unsigned)
+}
+
+// Key is a shared hashing key that can be replaced while it is in use.
+type Key struct {
+	value atomic.Pointer[string]
+}
+
+// NewKey creates a new instance of Key.
+func NewKey(key string) *Key {
+	k := &Key{}
+	k.Set(key)
+	return k
+}
+
+// Get returns the current key.
+func (k *Key) Get() string {
+	return *k.value.Load()
+}
+
+// Set replaces the key.
+func (k *Key) Set(key string) {
+	k.value.Store(&key)
+}
+
+// retryDelays are the pauses before the attempts of requests retried while the server is unavailable.
+var retryDelays = []time.Duration{0, time.Second, 3 * time.Second, 5 * time.Second}
+
+// sleepContext pauses for delay, it returns ctx.Err() early when ctx is done.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // WithRestyRetry retries a Resty request with exponential backoff.
-func WithRestyRetry(request func() (*resty.Response, error)) (*resty.Response, error) {
+// It stops waiting for the next attempt and returns ctx.Err() when ctx is done.
+func WithRestyRetry(ctx context.Context, request func() (*resty.Response, error)) (*resty.Response, error) {
 	var resp *resty.Response
 	var err error
-	for _, delay := range []int{0, 1, 3, 5} {
-		time.Sleep(time.Duration(delay) * time.Second)
+	for _, delay := range retryDelays {
+		if err := sleepContext(ctx, delay); err != nil {
+			return resp, err
+		}
 		resp, err = request()
 		if resp.StatusCode() != http.StatusServiceUnavailable {
 			return resp, err
@@ -37,6 +112,22 @@ func WithRestyRetry(request func() (*resty.Response, error)) (*resty.Response, e
 	return resp, err
 }
 
+// WithGRPCRetry retries a gRPC call with exponential backoff while the server is unavailable.
+// It stops waiting for the next attempt and returns ctx.Err() when ctx is done.
+func WithGRPCRetry(ctx context.Context, call func() error) error {
+	var err error
+	for _, delay := range retryDelays {
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+		err = call()
+		if status.Code(err) != codes.Unavailable {
+			return err
+		}
+	}
+	return err
+}
+
 // WithFileRetry retries opening a file with exponential backoff.
 func WithFileRetry(open func() (*os.File, error)) (*os.File, error) {
 	var f *os.File
@@ -1,14 +1,20 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"os"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "metrics/internal/proto"
 )
 
 func TestGetHash(t *testing.T) {
@@ -20,6 +26,24 @@ func TestGetHash(t *testing.T) {
 	assert.Equal(t, GetHash("", data), "", "Hash should be empty when key is empty")
 }
 
+func TestGetSignedMessageHash(t *testing.T) {
+	req := &pb.UpdateMetricsRequest{BatchId: "batch-1"}
+	hash, err := GetSignedMessageHash("testkey", req)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, hash)
+
+	req.Hash = hash
+	signedHash, err := GetSignedMessageHash("testkey", req)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, signedHash, "the hash field must not be hashed")
+	assert.Equal(t, hash, req.GetHash(), "the message must not be changed")
+
+	req.BatchId = "batch-2"
+	changedHash, err := GetSignedMessageHash("testkey", req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, changedHash)
+}
+
 func TestWithRestyRetry(t *testing.T) {
 	attempts := 0
 	mockRequest := func() (*resty.Response, error) {
@@ -30,12 +54,47 @@ func TestWithRestyRetry(t *testing.T) {
 		return &resty.Response{RawResponse: &http.Response{StatusCode: http.StatusOK}}, nil
 	}
 
-	resp, err := WithRestyRetry(mockRequest)
+	resp, err := WithRestyRetry(context.Background(), mockRequest)
 	assert.NoError(t, err, "Error should be nil")
 	assert.Equal(t, http.StatusOK, resp.StatusCode(), "Response status should be OK")
 	assert.Equal(t, 3, attempts, "Should retry 3 times before success")
 }
 
+func TestWithGRPCRetry(t *testing.T) {
+	attempts := 0
+	err := WithGRPCRetry(context.Background(), func() error {
+		attempts++
+		if attempts < 2 {
+			return status.Error(codes.Unavailable, "unavailable")
+		}
+		return status.Error(codes.InvalidArgument, "bad request")
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Should return the first error that is not retried")
+	assert.Equal(t, 2, attempts, "Should retry while the server is unavailable")
+}
+
+func TestWithRetry_ContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	start := time.Now()
+	_, err := WithRestyRetry(ctx, func() (*resty.Response, error) {
+		attempts++
+		cancel()
+		return &resty.Response{RawResponse: &http.Response{StatusCode: http.StatusServiceUnavailable}}, nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, attempts, "Should not retry after the context is done")
+
+	attempts = 0
+	err = WithGRPCRetry(ctx, func() error {
+		attempts++
+		return status.Error(codes.Unavailable, "unavailable")
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, attempts, "Should not retry after the context is done")
+	assert.Less(t, time.Since(start), time.Second, "Should not wait for the next attempt")
+}
+
 func TestWithFileRetry(t *testing.T) {
 	attempts := 0
 	mockOpen := func() (*os.File, error) {